@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kjk/betterguid"
+)
+
+// Time window used when the request doesn't specify one.
+const defaultAnalyticsWindow = 30 * 24 * time.Hour
+
+// ErrInvalidAnalyticsWindow is returned when the from, to or days query parameters can't be used
+var ErrInvalidAnalyticsWindow = errors.New("invalid analytics window")
+
+type TaskEventType int16
+
+const (
+	TaskEventCreated TaskEventType = iota
+	TaskEventDone
+	TaskEventNotDone
+	TaskEventWaitingRequest
+	TaskEventReminder
+	TaskEventGoodJob
+)
+
+type TaskEventModel struct {
+	Id        string        `json:"id" dynamodbav:"id"`
+	ChatId    string        `json:"chatId" dynamodbav:"chatId"`
+	TaskId    string        `json:"taskId" dynamodbav:"taskId"`
+	Type      TaskEventType `json:"type" dynamodbav:"type"`
+	SentBy    string        `json:"sentBy" dynamodbav:"sentBy"`
+	SentTo    string        `json:"sentTo" dynamodbav:"sentTo"`
+	DueDate   time.Time     `json:"dueDate" dynamodbav:"dueDate"`
+	Timestamp time.Time     `json:"timestamp" dynamodbav:"timestamp"`
+	// Reactions to the event, see AddReactionModel.
+	ReactionCounts map[string]int `json:"reactionCounts,omitempty" dynamodbav:"reactionCounts,omitempty"`
+}
+
+type MemberAnalyticsModel struct {
+	UserId                 string  `json:"userId"`
+	TasksAssigned          int     `json:"tasksAssigned"`
+	TasksDone              int     `json:"tasksDone"`
+	CompletionRate         float64 `json:"completionRate"`
+	AverageTimeToDoneHours float64 `json:"averageTimeToDoneHours"`
+	OverdueCount           int     `json:"overdueCount"`
+	Reminders              int     `json:"reminders"`
+	RemindersPerTask       float64 `json:"remindersPerTask"`
+	WaitingRequests        int     `json:"waitingRequests"`
+	GoodJobs               int     `json:"goodJobs"`
+}
+
+type GroupAnalyticsModel struct {
+	ChatId  string                 `json:"chatId"`
+	From    time.Time              `json:"from"`
+	To      time.Time              `json:"to"`
+	Members []MemberAnalyticsModel `json:"members"`
+}
+
+// recordTaskEvent saves a task event for analytics. Failures are logged and
+// never interrupt the delivery of the event itself.
+func recordTaskEvent(ctx context.Context, e TaskEventModel) {
+	if e.Id == "" {
+		e.Id = betterguid.New()
+	}
+
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+	// the timestamp sorts the events of the group in the index
+	e.Timestamp = e.Timestamp.UTC()
+
+	if err := dbService.addTaskEvent(ctx, e); err != nil {
+		log.Printf("%s : Couldn't record task event for task %v. Here's why: %v\n", ctx.Value(logPrefix), e.TaskId, err)
+	}
+}
+
+type taskAnalyticsState struct {
+	assignee  string
+	createdAt time.Time
+	dueDate   time.Time
+	isDone    bool
+	doneAt    time.Time
+}
+
+// computeGroupAnalytics aggregates the events of tasks created in [from, to)
+// into per member statistics. Events after to are ignored, so the result for a
+// past window doesn't change over time.
+func computeGroupAnalytics(chatId string, events []TaskEventModel, from time.Time, to time.Time) GroupAnalyticsModel {
+	sorted := make([]TaskEventModel, len(events))
+	copy(sorted, events)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+	})
+
+	tasks := make(map[string]*taskAnalyticsState)
+	members := make(map[string]*MemberAnalyticsModel)
+
+	member := func(userId string) *MemberAnalyticsModel {
+		m, ok := members[userId]
+		if !ok {
+			m = &MemberAnalyticsModel{UserId: userId}
+			members[userId] = m
+		}
+		return m
+	}
+
+	for _, e := range sorted {
+		if !e.Timestamp.Before(to) {
+			break
+		}
+
+		if e.Type == TaskEventCreated {
+			if e.Timestamp.Before(from) {
+				continue
+			}
+			tasks[e.TaskId] = &taskAnalyticsState{
+				assignee:  e.SentTo,
+				createdAt: e.Timestamp,
+				dueDate:   e.DueDate,
+			}
+			member(e.SentTo).TasksAssigned++
+			continue
+		}
+
+		t, ok := tasks[e.TaskId]
+		if !ok {
+			// the task was created outside of the window
+			continue
+		}
+
+		switch e.Type {
+		case TaskEventDone:
+			t.isDone = true
+			t.doneAt = e.Timestamp
+		case TaskEventNotDone:
+			t.isDone = false
+			t.doneAt = time.Time{}
+		case TaskEventReminder:
+			member(t.assignee).Reminders++
+		case TaskEventWaitingRequest:
+			member(t.assignee).WaitingRequests++
+		case TaskEventGoodJob:
+			member(t.assignee).GoodJobs++
+		}
+	}
+
+	timeToDone := make(map[string]time.Duration)
+	for _, t := range tasks {
+		m := member(t.assignee)
+
+		if t.isDone {
+			m.TasksDone++
+			timeToDone[t.assignee] += t.doneAt.Sub(t.createdAt)
+		}
+
+		if !t.dueDate.IsZero() && t.dueDate.Before(to) && (!t.isDone || t.doneAt.After(t.dueDate)) {
+			m.OverdueCount++
+		}
+	}
+
+	result := GroupAnalyticsModel{
+		ChatId:  chatId,
+		From:    from,
+		To:      to,
+		Members: make([]MemberAnalyticsModel, 0, len(members)),
+	}
+
+	for userId, m := range members {
+		if m.TasksAssigned > 0 {
+			m.CompletionRate = float64(m.TasksDone) / float64(m.TasksAssigned)
+			m.RemindersPerTask = float64(m.Reminders) / float64(m.TasksAssigned)
+		}
+
+		if m.TasksDone > 0 {
+			m.AverageTimeToDoneHours = (timeToDone[userId] / time.Duration(m.TasksDone)).Hours()
+		}
+
+		result.Members = append(result.Members, *m)
+	}
+
+	sort.Slice(result.Members, func(i, j int) bool {
+		return result.Members[i].UserId < result.Members[j].UserId
+	})
+
+	return result
+}
+
+func groupAnalyticsCSV(a GroupAnalyticsModel) ([]byte, error) {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+
+	header := []string{
+		"userId",
+		"tasksAssigned",
+		"tasksDone",
+		"completionRate",
+		"averageTimeToDoneHours",
+		"overdueCount",
+		"reminders",
+		"remindersPerTask",
+		"waitingRequests",
+		"goodJobs",
+	}
+	if err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', 2, 64)
+	}
+
+	for _, m := range a.Members {
+		record := []string{
+			m.UserId,
+			strconv.Itoa(m.TasksAssigned),
+			strconv.Itoa(m.TasksDone),
+			formatFloat(m.CompletionRate),
+			formatFloat(m.AverageTimeToDoneHours),
+			strconv.Itoa(m.OverdueCount),
+			strconv.Itoa(m.Reminders),
+			formatFloat(m.RemindersPerTask),
+			strconv.Itoa(m.WaitingRequests),
+			strconv.Itoa(m.GoodJobs),
+		}
+		if err := w.Write(record); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+	return b.Bytes(), w.Error()
+}
+
+// parseAnalyticsWindow reads the time window from the from/to query
+// parameters (RFC 3339) or from days, the number of days up to now.
+func parseAnalyticsWindow(c *gin.Context, now time.Time) (time.Time, time.Time, error) {
+	to := now.UTC()
+	from := to.Add(-defaultAnalyticsWindow)
+
+	if v := c.Query("days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days <= 0 {
+			return from, to, ErrInvalidAnalyticsWindow
+		}
+		from = to.AddDate(0, 0, -days)
+	}
+
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return from, to, ErrInvalidAnalyticsWindow
+		}
+		from = t.UTC()
+	}
+
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return from, to, ErrInvalidAnalyticsWindow
+		}
+		to = t.UTC()
+	}
+
+	if !from.Before(to) {
+		return from, to, ErrInvalidAnalyticsWindow
+	}
+
+	return from, to, nil
+}
+
+func getGroupAnalytics(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+	groupId := c.Param("groupId")
+
+	members, err := dbService.getChatGroupMembers(c, groupId)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if !isChatGroupMember(members, uid) {
+		respondWithError(c, http.StatusForbidden, "Not a member of the chat group")
+		return
+	}
+
+	from, to, err := parseAnalyticsWindow(c, time.Now())
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	events, err := dbService.getTaskEvents(c, groupId, from, to)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	analytics := computeGroupAnalytics(groupId, events, from, to)
+
+	if c.Query("format") == "csv" {
+		data, err := groupAnalyticsCSV(analytics)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.Header("Content-Disposition", "attachment; filename=\"analytics-"+groupId+".csv\"")
+		c.Data(http.StatusOK, "text/csv; charset=utf-8", data)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"data": analytics})
+}
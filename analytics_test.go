@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComputeGroupAnalytics(t *testing.T) {
+	start := time.Date(2022, 10, 10, 8, 0, 0, 0, time.UTC)
+	at := func(hours int) time.Time {
+		return start.Add(time.Duration(hours) * time.Hour)
+	}
+
+	events := []TaskEventModel{
+		// done within 2 hours, before the due date
+		{TaskId: "t1", Type: TaskEventCreated, SentBy: "manager", SentTo: "alice", DueDate: at(4), Timestamp: at(0)},
+		{TaskId: "t1", Type: TaskEventReminder, SentBy: "manager", SentTo: "alice", Timestamp: at(1)},
+		{TaskId: "t1", Type: TaskEventDone, SentBy: "alice", SentTo: "manager", Timestamp: at(2)},
+		{TaskId: "t1", Type: TaskEventGoodJob, SentBy: "manager", SentTo: "alice", Timestamp: at(3)},
+		// marked done, then reopened and never finished
+		{TaskId: "t2", Type: TaskEventCreated, SentBy: "manager", SentTo: "alice", DueDate: at(5), Timestamp: at(0)},
+		{TaskId: "t2", Type: TaskEventDone, SentBy: "alice", SentTo: "manager", Timestamp: at(1)},
+		{TaskId: "t2", Type: TaskEventNotDone, SentBy: "manager", SentTo: "alice", Timestamp: at(2)},
+		{TaskId: "t2", Type: TaskEventReminder, SentBy: "manager", SentTo: "alice", Timestamp: at(6)},
+		{TaskId: "t2", Type: TaskEventReminder, SentBy: "manager", SentTo: "alice", Timestamp: at(7)},
+		// done after the due date
+		{TaskId: "t3", Type: TaskEventCreated, SentBy: "manager", SentTo: "bob", DueDate: at(1), Timestamp: at(0)},
+		{TaskId: "t3", Type: TaskEventWaitingRequest, SentBy: "bob", SentTo: "manager", Timestamp: at(1)},
+		{TaskId: "t3", Type: TaskEventDone, SentBy: "bob", SentTo: "manager", Timestamp: at(4)},
+		// created before the window
+		{TaskId: "t0", Type: TaskEventCreated, SentBy: "manager", SentTo: "bob", Timestamp: at(-48)},
+		{TaskId: "t0", Type: TaskEventDone, SentBy: "bob", SentTo: "manager", Timestamp: at(1)},
+	}
+
+	a := computeGroupAnalytics("g1", events, at(-1), at(24))
+
+	if len(a.Members) != 2 {
+		t.Fatalf("len(members) = %v, want 2", len(a.Members))
+	}
+
+	alice := a.Members[0]
+	if alice.UserId != "alice" || alice.TasksAssigned != 2 || alice.TasksDone != 1 {
+		t.Errorf("alice = %+v", alice)
+	}
+	if alice.CompletionRate != 0.5 || alice.AverageTimeToDoneHours != 2 {
+		t.Errorf("alice rates = %v, %v", alice.CompletionRate, alice.AverageTimeToDoneHours)
+	}
+	if alice.OverdueCount != 1 || alice.Reminders != 3 || alice.RemindersPerTask != 1.5 || alice.GoodJobs != 1 {
+		t.Errorf("alice counts = %+v", alice)
+	}
+
+	bob := a.Members[1]
+	if bob.UserId != "bob" || bob.TasksAssigned != 1 || bob.TasksDone != 1 || bob.CompletionRate != 1 {
+		t.Errorf("bob = %+v", bob)
+	}
+	if bob.OverdueCount != 1 || bob.WaitingRequests != 1 || bob.AverageTimeToDoneHours != 4 {
+		t.Errorf("bob counts = %+v", bob)
+	}
+
+	data, err := groupAnalyticsCSV(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "alice,2,1,0.50,2.00,1,3,1.50,0,1") {
+		t.Errorf("csv = %q", data)
+	}
+}
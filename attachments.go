@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kjk/betterguid"
+)
+
+// Upper bound for the size of a single attachment.
+const maxAttachmentSize = 25 << 20
+
+// Upper bound for a single chunk of a resumable upload.
+const maxAttachmentChunkSize = 5 << 20
+
+// How long a signed download URL stays valid.
+const attachmentUrlTTL = time.Hour
+
+var allowedAttachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/heic":      true,
+	"video/mp4":       true,
+	"video/quicktime": true,
+	"application/pdf": true,
+}
+
+var blobStore BlobStore
+
+// Key for signing download URLs. Set from ATTACHMENT_URL_SECRET, or generated
+// on startup, in which case URLs don't survive a restart.
+var attachmentUrlSecret []byte
+
+var (
+	// ErrAttachmentTooLarge is returned when an attachment exceeds maxAttachmentSize
+	ErrAttachmentTooLarge = errors.New("attachment is too large")
+	// ErrAttachmentType is returned for content types that aren't allowed
+	ErrAttachmentType = errors.New("attachment type is not allowed")
+	// ErrAttachmentChecksum is returned when the content doesn't match the announced SHA-256
+	ErrAttachmentChecksum = errors.New("attachment checksum mismatch")
+)
+
+type AttachmentStatus int16
+
+const (
+	AttachmentUploading AttachmentStatus = iota
+	AttachmentComplete
+)
+
+type AttachmentModel struct {
+	Id          string           `json:"id" dynamodbav:"id"`
+	ChatId      string           `json:"chatId" dynamodbav:"chatId"`
+	SentBy      string           `json:"sentBy" dynamodbav:"sentBy"`
+	FileName    string           `json:"fileName" dynamodbav:"fileName"`
+	ContentType string           `json:"contentType" dynamodbav:"contentType"`
+	Size        int64            `json:"size" dynamodbav:"size"`
+	Sha256      string           `json:"sha256" dynamodbav:"sha256"`
+	Status      AttachmentStatus `json:"status" dynamodbav:"status"`
+	// Progress of a resumable upload. The next chunk starts at UploadedBytes.
+	UploadedBytes int64     `json:"uploadedBytes" dynamodbav:"uploadedBytes"`
+	Chunks        int       `json:"chunks" dynamodbav:"chunks"`
+	CreatedAt     time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	// Image metadata, set for JPEG and PNG images.
+	Width           int    `json:"width,omitempty" dynamodbav:"width,omitempty"`
+	Height          int    `json:"height,omitempty" dynamodbav:"height,omitempty"`
+	BlurHash        string `json:"blurHash,omitempty" dynamodbav:"blurHash,omitempty"`
+	HasThumbnail    bool   `json:"hasThumbnail,omitempty" dynamodbav:"hasThumbnail,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnailWidth,omitempty" dynamodbav:"thumbnailWidth,omitempty"`
+	ThumbnailHeight int    `json:"thumbnailHeight,omitempty" dynamodbav:"thumbnailHeight,omitempty"`
+	// Signed, expiring URLs of the content. Set when the attachment is sent to a client.
+	DownloadUrl  string `json:"downloadUrl,omitempty" dynamodbav:"-"`
+	ThumbnailUrl string `json:"thumbnailUrl,omitempty" dynamodbav:"-"`
+}
+
+func configAttachmentUrlSecret() {
+	if v := os.Getenv("ATTACHMENT_URL_SECRET"); v != "" {
+		attachmentUrlSecret = []byte(v)
+		return
+	}
+
+	attachmentUrlSecret = make([]byte, 32)
+	if _, err := rand.Read(attachmentUrlSecret); err != nil {
+		log.Fatalf("unable to generate attachment URL secret, %v", err)
+	}
+}
+
+func attachmentKey(id string) string {
+	return "attachments/" + id
+}
+
+func attachmentThumbnailKey(id string) string {
+	return "thumbnails/" + id
+}
+
+func attachmentChunkKey(id string, chunk int) string {
+	return fmt.Sprintf("uploads/%s/%06d", id, chunk)
+}
+
+// Variants of an attachment that can be downloaded with a signed URL.
+const (
+	attachmentContent   = "content"
+	attachmentThumbnail = "thumbnail"
+)
+
+func attachmentSignature(id string, variant string, expires int64) string {
+	mac := hmac.New(sha256.New, attachmentUrlSecret)
+	mac.Write([]byte(id + "\n" + variant + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func signAttachmentUrl(id string, variant string, now time.Time) string {
+	expires := now.Add(attachmentUrlTTL).Unix()
+	return fmt.Sprintf("/attachments/%s/%s?expires=%d&sig=%s", id, variant, expires, attachmentSignature(id, variant, expires))
+}
+
+func verifyAttachmentUrl(id string, variant string, expires string, sig string, now time.Time) bool {
+	e, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > e {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(attachmentSignature(id, variant, e)))
+}
+
+// signAttachmentUrls sets the download URLs of a complete attachment.
+func signAttachmentUrls(a *AttachmentModel, now time.Time) {
+	if a.Status != AttachmentComplete {
+		return
+	}
+
+	a.DownloadUrl = signAttachmentUrl(a.Id, attachmentContent, now)
+	if a.HasThumbnail {
+		a.ThumbnailUrl = signAttachmentUrl(a.Id, attachmentThumbnail, now)
+	}
+}
+
+// signServerPushAttachments sets fresh download URLs on the attachments of a
+// chat or task message. Stored messages only keep the attachment metadata,
+// and URLs signed when a message was sent may have expired before it is
+// delivered.
+func signServerPushAttachments(sp *ServerPush, now time.Time) {
+	switch sp.Type {
+	case ServerPushAddChatMessage:
+		var m AddChatMessageModel
+		if !serverPushData(sp.Data, &m) || len(m.Attachments) == 0 {
+			return
+		}
+		for i := range m.Attachments {
+			signAttachmentUrls(&m.Attachments[i], now)
+		}
+		sp.Data = m
+	case ServerPushAddTaskMessage:
+		var m AddTaskMessageModel
+		if !serverPushData(sp.Data, &m) || len(m.Attachments) == 0 {
+			return
+		}
+		for i := range m.Attachments {
+			signAttachmentUrls(&m.Attachments[i], now)
+		}
+		sp.Data = m
+	}
+}
+
+// serverPushData converts the data of a server push to v. Pushes read back
+// from the database carry their data as a map.
+func serverPushData(data interface{}, v interface{}) bool {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(b, v) == nil
+}
+
+func validateAttachment(contentType string, size int64) error {
+	if size <= 0 || size > maxAttachmentSize {
+		return ErrAttachmentTooLarge
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !allowedAttachmentTypes[mediaType] {
+		return ErrAttachmentType
+	}
+	return nil
+}
+
+// storeAttachment checks r against the size and checksum of a and stores it
+// as the content of a.
+func storeAttachment(ctx context.Context, a *AttachmentModel, r io.ReadSeeker) error {
+	h := sha256.New()
+	n, err := io.Copy(h, io.LimitReader(r, maxAttachmentSize+1))
+	if err != nil {
+		return err
+	}
+
+	if n != a.Size {
+		return fmt.Errorf("attachment: got %v bytes, expected %v", n, a.Size)
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if a.Sha256 != "" && !strings.EqualFold(a.Sha256, sum) {
+		return ErrAttachmentChecksum
+	}
+	a.Sha256 = sum
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if isProcessableImage(a.ContentType) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		img, err := processImage(data, a.ContentType)
+		if err != nil {
+			return err
+		}
+
+		if err := blobStore.Put(ctx, attachmentThumbnailKey(a.Id), bytes.NewReader(img.Thumbnail), int64(len(img.Thumbnail)), "image/jpeg"); err != nil {
+			return err
+		}
+
+		// the stored image differs from the upload when GPS data was removed
+		stored := sha256.Sum256(img.Data)
+		a.Sha256 = hex.EncodeToString(stored[:])
+		a.Size = int64(len(img.Data))
+		a.Width = img.Width
+		a.Height = img.Height
+		a.BlurHash = img.BlurHash
+		a.HasThumbnail = true
+		a.ThumbnailWidth = img.ThumbnailWidth
+		a.ThumbnailHeight = img.ThumbnailHeight
+		r = bytes.NewReader(img.Data)
+	}
+
+	if err := blobStore.Put(ctx, attachmentKey(a.Id), r, a.Size, a.ContentType); err != nil {
+		return err
+	}
+
+	a.Status = AttachmentComplete
+	a.UploadedBytes = a.Size
+	return nil
+}
+
+// resolveAttachments returns the complete attachments of the chat with the
+// given ids, ready to be sent to clients. Unknown ids are dropped.
+func resolveAttachments(ctx context.Context, chatId string, ids []string) ([]string, []AttachmentModel) {
+	var validIds []string
+	var attachments []AttachmentModel
+	for _, id := range ids {
+		a, err := dbService.getAttachmentById(ctx, id)
+		if err != nil || a.ChatId != chatId || a.Status != AttachmentComplete {
+			log.Printf("%s : Ignoring attachment %v\n", ctx.Value(logPrefix), id)
+			continue
+		}
+
+		signAttachmentUrls(&a, time.Now())
+		validIds = append(validIds, a.Id)
+		attachments = append(attachments, a)
+	}
+	return validIds, attachments
+}
+
+// loadAttachment fetches the attachment in the path and checks that the user
+// is a member of its chat.
+func loadAttachment(c *gin.Context) (AttachmentModel, bool) {
+	uid := c.MustGet(uidKey).(string)
+
+	a, err := dbService.getAttachmentById(c, c.Param("attachmentId"))
+	if err != nil {
+		respondWithError(c, http.StatusNotFound, "Attachment not found")
+		return a, false
+	}
+
+	members, err := dbService.getChatGroupMembers(c, a.ChatId)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return a, false
+	}
+
+	if !isChatGroupMember(members, uid) {
+		respondWithError(c, http.StatusForbidden, "Not a member of the chat")
+		return a, false
+	}
+
+	return a, true
+}
+
+// addAttachment uploads an attachment as multipart/form-data with the fields
+// chatId, file and optionally sha256, or, with a JSON body describing the
+// attachment, starts a resumable upload that continues with addAttachmentChunk.
+func addAttachment(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+
+	a := AttachmentModel{
+		Id:        betterguid.New(),
+		SentBy:    uid,
+		Status:    AttachmentUploading,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	isMultipart := strings.HasPrefix(c.ContentType(), "multipart/")
+	if isMultipart {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAttachmentSize+1<<20)
+		a.ChatId = c.PostForm("chatId")
+		a.Sha256 = c.PostForm("sha256")
+	} else {
+		if err := c.BindJSON(&a); err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+		// only the description is taken from the client
+		a.Id = betterguid.New()
+		a.SentBy = uid
+		a.Status = AttachmentUploading
+		a.UploadedBytes = 0
+		a.Chunks = 0
+		a.CreatedAt = time.Now().UTC()
+	}
+
+	members, err := dbService.getChatGroupMembers(c, a.ChatId)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if !isChatGroupMember(members, uid) {
+		respondWithError(c, http.StatusForbidden, "Not a member of the chat")
+		return
+	}
+
+	if isMultipart {
+		fh, err := c.FormFile("file")
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, "A file is required")
+			return
+		}
+
+		a.FileName = fh.Filename
+		a.ContentType = fh.Header.Get("Content-Type")
+		a.Size = fh.Size
+		if err := validateAttachment(a.ContentType, a.Size); err != nil {
+			respondWithError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		f, err := fh.Open()
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		defer f.Close()
+
+		if err := storeAttachment(c, &a, f); err != nil {
+			respondWithError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else if err := validateAttachment(a.ContentType, a.Size); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := dbService.addAttachment(c, a); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	signAttachmentUrls(&a, time.Now())
+
+	c.IndentedJSON(http.StatusOK, a)
+}
+
+// addAttachmentChunk appends the request body to a resumable upload. The
+// offset query parameter has to match the bytes uploaded so far, on a
+// mismatch the client resumes from the uploadedBytes in the response.
+func addAttachmentChunk(c *gin.Context) {
+	a, ok := loadAttachment(c)
+	if !ok {
+		return
+	}
+
+	if a.Status != AttachmentUploading {
+		respondWithError(c, http.StatusConflict, "Upload is already complete")
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.Query("offset"), 10, 64)
+	if err != nil || offset != a.UploadedBytes {
+		c.IndentedJSON(http.StatusConflict, a)
+		return
+	}
+
+	chunk, err := io.ReadAll(io.LimitReader(c.Request.Body, maxAttachmentChunkSize+1))
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if len(chunk) == 0 || len(chunk) > maxAttachmentChunkSize || offset+int64(len(chunk)) > a.Size {
+		respondWithError(c, http.StatusBadRequest, "Invalid chunk size")
+		return
+	}
+
+	if err := blobStore.Put(c, attachmentChunkKey(a.Id, a.Chunks), bytes.NewReader(chunk), int64(len(chunk)), "application/octet-stream"); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// fails when a concurrent request uploaded the same chunk
+	if err := dbService.updateAttachmentUpload(c, a.Id, offset, offset+int64(len(chunk)), a.Chunks+1); err != nil {
+		respondWithError(c, http.StatusConflict, "Upload changed, fetch the attachment and resume")
+		return
+	}
+
+	a.UploadedBytes += int64(len(chunk))
+	a.Chunks++
+
+	c.IndentedJSON(http.StatusOK, a)
+}
+
+// completeAttachment assembles the chunks of a resumable upload once all
+// bytes are uploaded.
+func completeAttachment(c *gin.Context) {
+	a, ok := loadAttachment(c)
+	if !ok {
+		return
+	}
+
+	if a.Status == AttachmentComplete {
+		signAttachmentUrls(&a, time.Now())
+		c.IndentedJSON(http.StatusOK, a)
+		return
+	}
+
+	if a.UploadedBytes != a.Size {
+		c.IndentedJSON(http.StatusConflict, a)
+		return
+	}
+
+	f, err := os.CreateTemp("", "attachment-*")
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	for i := 0; i < a.Chunks; i++ {
+		r, err := blobStore.Get(c, attachmentChunkKey(a.Id, i))
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		_, err = io.Copy(f, r)
+		r.Close()
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := storeAttachment(c, &a, f); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := dbService.addAttachment(c, a); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	for i := 0; i < a.Chunks; i++ {
+		blobStore.Delete(c, attachmentChunkKey(a.Id, i))
+	}
+
+	signAttachmentUrls(&a, time.Now())
+	c.IndentedJSON(http.StatusOK, a)
+}
+
+func getAttachment(c *gin.Context) {
+	a, ok := loadAttachment(c)
+	if !ok {
+		return
+	}
+
+	signAttachmentUrls(&a, time.Now())
+
+	c.IndentedJSON(http.StatusOK, a)
+}
+
+// getAttachmentContent serves the content of an attachment for a signed URL,
+// see signAttachmentUrl.
+func getAttachmentContent(c *gin.Context) {
+	serveAttachment(c, attachmentContent)
+}
+
+func getAttachmentThumbnail(c *gin.Context) {
+	serveAttachment(c, attachmentThumbnail)
+}
+
+func serveAttachment(c *gin.Context, variant string) {
+	id := c.Param("attachmentId")
+	if !verifyAttachmentUrl(id, variant, c.Query("expires"), c.Query("sig"), time.Now()) {
+		respondWithError(c, http.StatusForbidden, "Invalid or expired URL")
+		return
+	}
+
+	a, err := dbService.getAttachmentById(c, id)
+	if err != nil || a.Status != AttachmentComplete || (variant == attachmentThumbnail && !a.HasThumbnail) {
+		respondWithError(c, http.StatusNotFound, "Attachment not found")
+		return
+	}
+
+	key, contentType := attachmentKey(a.Id), a.ContentType
+	if variant == attachmentThumbnail {
+		key, contentType = attachmentThumbnailKey(a.Id), "image/jpeg"
+	}
+
+	r, err := blobStore.Get(c, key)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer r.Close()
+
+	size := int64(-1)
+	if variant == attachmentContent {
+		size = a.Size
+	}
+
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.Header("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": a.FileName}))
+	c.DataFromReader(http.StatusOK, size, contentType, r, nil)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+)
+
+func TestSignAttachmentUrl(t *testing.T) {
+	attachmentUrlSecret = []byte("secret")
+	now := time.Date(2022, 10, 17, 8, 0, 0, 0, time.UTC)
+
+	u, err := url.Parse(signAttachmentUrl("a1", attachmentContent, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(u.Path, "/attachments/a1/content") {
+		t.Errorf("path = %v", u.Path)
+	}
+
+	expires, sig := u.Query().Get("expires"), u.Query().Get("sig")
+	if !verifyAttachmentUrl("a1", attachmentContent, expires, sig, now.Add(time.Minute)) {
+		t.Errorf("valid URL was rejected")
+	}
+	if verifyAttachmentUrl("a2", attachmentContent, expires, sig, now.Add(time.Minute)) {
+		t.Errorf("URL was accepted for another attachment")
+	}
+	if verifyAttachmentUrl("a1", attachmentThumbnail, expires, sig, now.Add(time.Minute)) {
+		t.Errorf("content URL was accepted for the thumbnail")
+	}
+	if verifyAttachmentUrl("a1", attachmentContent, expires, sig, now.Add(attachmentUrlTTL+time.Minute)) {
+		t.Errorf("expired URL was accepted")
+	}
+}
+
+func TestValidateAttachment(t *testing.T) {
+	if err := validateAttachment("image/jpeg", 1024); err != nil {
+		t.Errorf("jpeg: %v", err)
+	}
+	if err := validateAttachment("application/x-msdownload", 1024); err != ErrAttachmentType {
+		t.Errorf("exe: %v", err)
+	}
+	if err := validateAttachment("image/png", maxAttachmentSize+1); err != ErrAttachmentTooLarge {
+		t.Errorf("too large: %v", err)
+	}
+}
+
+func TestSignServerPushAttachments(t *testing.T) {
+	attachmentUrlSecret = []byte("secret")
+	sentAt := time.Date(2022, 10, 17, 8, 0, 0, 0, time.UTC)
+
+	a := AttachmentModel{Id: "a1", ChatId: "g1", ContentType: "application/pdf", Size: 2048, Status: AttachmentComplete}
+	signAttachmentUrls(&a, sentAt)
+	sp := ServerPush{Id: "m1", UserId: "bob", Type: ServerPushAddChatMessage, Data: AddChatMessageModel{
+		Id:            "m1",
+		ChatId:        "g1",
+		AttachmentIds: []string{"a1"},
+		Attachments:   []AttachmentModel{a},
+	}}
+
+	// saved for offline delivery and read back a day later
+	item, err := attributevalue.MarshalMap(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored ServerPush
+	if err := attributevalue.UnmarshalMap(item, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(fmt.Sprint(stored.Data), "/attachments/") {
+		t.Errorf("stored message contains a download URL: %v", stored.Data)
+	}
+
+	now := sentAt.AddDate(0, 0, 1)
+	signServerPushAttachments(&stored, now)
+
+	m, ok := stored.Data.(AddChatMessageModel)
+	if !ok || len(m.Attachments) != 1 {
+		t.Fatalf("data = %#v", stored.Data)
+	}
+	got := m.Attachments[0]
+	u, err := url.Parse(got.DownloadUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifyAttachmentUrl("a1", attachmentContent, u.Query().Get("expires"), u.Query().Get("sig"), now.Add(time.Minute)) {
+		t.Errorf("download URL %v wasn't signed again", got.DownloadUrl)
+	}
+
+	got.DownloadUrl = a.DownloadUrl
+	if !reflect.DeepEqual(got, a) {
+		t.Errorf("attachment = %+v, want %+v", got, a)
+	}
+}
+
+func TestSignServerPushAttachmentsKeepsImageMetadata(t *testing.T) {
+	attachmentUrlSecret = []byte("secret")
+	a := AttachmentModel{Id: "a1", ContentType: "image/jpeg", Status: AttachmentComplete, Width: 480, Height: 640,
+		BlurHash: "LEHV6nWB2yk8pyo0adR*.7kCMdnj", HasThumbnail: true, ThumbnailWidth: 240, ThumbnailHeight: 320}
+	sp := ServerPush{Id: "m1", UserId: "bob", Type: ServerPushAddTaskMessage, Data: AddTaskMessageModel{Id: "m1", Attachments: []AttachmentModel{a}}}
+
+	item, err := attributevalue.MarshalMap(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored ServerPush
+	if err := attributevalue.UnmarshalMap(item, &stored); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	signServerPushAttachments(&stored, now)
+
+	m, ok := stored.Data.(AddTaskMessageModel)
+	if !ok || len(m.Attachments) != 1 {
+		t.Fatalf("data = %#v", stored.Data)
+	}
+	got := m.Attachments[0]
+	if got.ThumbnailUrl != signAttachmentUrl("a1", attachmentThumbnail, now) || got.DownloadUrl != signAttachmentUrl("a1", attachmentContent, now) {
+		t.Errorf("urls = %v, %v", got.DownloadUrl, got.ThumbnailUrl)
+	}
+
+	got.DownloadUrl, got.ThumbnailUrl = "", ""
+	if !reflect.DeepEqual(got, a) {
+		t.Errorf("attachment = %+v, want %+v", got, a)
+	}
+}
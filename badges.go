@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UnreadModel is a pushed message the user hasn't read yet. The badge of the
+// app icon is the number of these, keeping one item per message makes
+// counting a repeated push or receipt harmless.
+type UnreadModel struct {
+	UserId string `json:"userId" dynamodbav:"userId"`
+	// id of the message, time ordered
+	Id        string    `json:"id" dynamodbav:"id"`
+	ChatId    string    `json:"chatId" dynamodbav:"chatId"`
+	Timestamp time.Time `json:"timestamp" dynamodbav:"timestamp"`
+	// Set when the app received the message before it was counted, so a
+	// later push doesn't count it again. Acked items expire at ExpiresAt.
+	Acked     bool  `json:"-" dynamodbav:"acked,omitempty"`
+	ExpiresAt int64 `json:"-" dynamodbav:"expiresAt,omitempty"`
+}
+
+// How long an acked message is remembered, pushes come within minutes.
+const ackedUnreadTTL = 24 * time.Hour
+
+type UnreadCountsModel struct {
+	Total int `json:"total"`
+	// Unread messages by chat id
+	Chats map[string]int `json:"chats"`
+}
+
+func unreadCounts(items []UnreadModel) UnreadCountsModel {
+	counts := UnreadCountsModel{Chats: make(map[string]int)}
+	for _, u := range items {
+		counts.Chats[u.ChatId]++
+	}
+	counts.Total = len(items)
+	return counts
+}
+
+// readUpTo returns the items a read receipt for read clears: reading a
+// message means the older messages of its chat were seen as well.
+func readUpTo(items []UnreadModel, read UnreadModel) []UnreadModel {
+	var cleared []UnreadModel
+	for _, u := range items {
+		if u.ChatId == read.ChatId && u.Id <= read.Id {
+			cleared = append(cleared, u)
+		}
+	}
+	return cleared
+}
+
+// countUnread records a push of message mid in chatId to userId and returns
+// the badge the push should carry. An empty chatId only reads the badge.
+// Messages the app already received through the socket aren't counted.
+func countUnread(ctx context.Context, userId string, chatId string, mid string) int {
+	if chatId != "" && mid != "" {
+		u := UnreadModel{UserId: userId, Id: mid, ChatId: chatId, Timestamp: time.Now().UTC()}
+		if err := dbService.addUnread(ctx, u); err != nil {
+			log.Printf("%s : Couldn't count message %v as unread for %v. Here's why: %v\n", ctx.Value(logPrefix), mid, userId, err)
+		}
+	}
+
+	items, err := dbService.getUnread(ctx, userId)
+	if err != nil {
+		log.Printf("%s : Couldn't load unread messages of %v. Here's why: %v\n", ctx.Value(logPrefix), userId, err)
+		return 1
+	}
+	return len(items)
+}
+
+// markRead clears message mid and the older unread messages of its chat.
+func markRead(ctx context.Context, userId string, mid string) {
+	items, err := dbService.getUnread(ctx, userId)
+	if err != nil {
+		log.Printf("%s : Couldn't load unread messages of %v. Here's why: %v\n", ctx.Value(logPrefix), userId, err)
+		return
+	}
+
+	for _, u := range items {
+		if u.Id != mid {
+			continue
+		}
+		for _, r := range readUpTo(items, u) {
+			dbService.removeUnread(ctx, userId, r.Id)
+		}
+		return
+	}
+}
+
+// markAcked clears message mid once the app has received it. The push of mid
+// is often sent after the ack, so mid is remembered as acked instead of
+// being removed.
+func markAcked(ctx context.Context, userId string, mid string) {
+	now := time.Now().UTC()
+	u := UnreadModel{UserId: userId, Id: mid, Timestamp: now, Acked: true, ExpiresAt: now.Add(ackedUnreadTTL).Unix()}
+	if err := dbService.setUnreadAcked(ctx, u); err != nil {
+		log.Printf("%s : Couldn't mark message %v as received by %v. Here's why: %v\n", ctx.Value(logPrefix), mid, userId, err)
+	}
+}
+
+func getUnreadCounts(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+
+	items, err := dbService.getUnread(c, uid)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"data": unreadCounts(items)})
+}
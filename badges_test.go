@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnreadCounts(t *testing.T) {
+	items := []UnreadModel{
+		{Id: "a1", ChatId: "a"},
+		{Id: "b1", ChatId: "b"},
+		{Id: "a2", ChatId: "a"},
+	}
+
+	counts := unreadCounts(items)
+	if counts.Total != 3 || !reflect.DeepEqual(counts.Chats, map[string]int{"a": 2, "b": 1}) {
+		t.Errorf("counts = %+v", counts)
+	}
+
+	if counts := unreadCounts(nil); counts.Total != 0 || counts.Chats == nil {
+		t.Errorf("counts = %+v", counts)
+	}
+}
+
+func TestReadUpTo(t *testing.T) {
+	items := []UnreadModel{
+		{Id: "1", ChatId: "a"},
+		{Id: "2", ChatId: "b"},
+		{Id: "3", ChatId: "a"},
+		{Id: "4", ChatId: "a"},
+	}
+
+	cleared := readUpTo(items, items[2])
+	want := []UnreadModel{items[0], items[2]}
+	if !reflect.DeepEqual(cleared, want) {
+		t.Errorf("cleared = %v, want %v", cleared, want)
+	}
+}
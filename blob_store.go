@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ErrBlobNotFound is returned when a blob doesn't exist in the store
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps the content of attachments. Keys are slash separated paths
+// like "attachments/<id>".
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// configureBlobStore picks the blob store from the environment. BLOB_STORE=s3
+// stores blobs in the S3_BUCKET bucket, anything else in the directory
+// BLOB_STORE_DIR, "blobs" by default.
+func configureBlobStore(ctx context.Context) BlobStore {
+	if os.Getenv("BLOB_STORE") == "s3" {
+		bucket := os.Getenv("S3_BUCKET")
+		if bucket == "" {
+			log.Fatal("S3_BUCKET is required for the s3 blob store")
+		}
+
+		cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("ap-south-1"))
+		if err != nil {
+			log.Fatalf("unable to load SDK config, %v", err)
+		}
+
+		return &S3BlobStore{client: s3.NewFromConfig(cfg), bucket: bucket}
+	}
+
+	dir := os.Getenv("BLOB_STORE_DIR")
+	if dir == "" {
+		dir = "blobs"
+	}
+
+	store, err := NewLocalBlobStore(dir)
+	if err != nil {
+		log.Fatalf("unable to create blob store, %v", err)
+	}
+	return store
+}
+
+type LocalBlobStore struct {
+	dir string
+}
+
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{dir: dir}, nil
+}
+
+// path maps a key to a file below the store directory and rejects keys that
+// would escape it.
+func (s *LocalBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "..") {
+		return "", fmt.Errorf("blob: invalid key %q", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(clean)), nil
+}
+
+func (s *LocalBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so readers never see a partial blob
+	f, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), p)
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+type S3BlobStore struct {
+	client *s3.Client
+	bucket string
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          r,
+		ContentLength: size,
+		ContentType:   aws.String(contentType),
+	})
+	if err != nil {
+		log.Printf("Couldn't upload %v to bucket %v. Here's why: %v\n", key, s.bucket, err)
+	}
+	return err
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	var nsk *types.NoSuchKey
+	if errors.As(err, &nsk) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		log.Printf("Couldn't download %v from bucket %v. Here's why: %v\n", key, s.bucket, err)
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		log.Printf("Couldn't delete %v from bucket %v. Here's why: %v\n", key, s.bucket, err)
+	}
+	return err
+}
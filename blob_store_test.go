@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLocalBlobStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Put(ctx, "attachments/a1", strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := store.Get(ctx, "attachments/a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "hello" {
+		t.Errorf("content = %q", data)
+	}
+
+	if err := store.Delete(ctx, "attachments/a1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "attachments/a1"); err != ErrBlobNotFound {
+		t.Errorf("Get after Delete: %v", err)
+	}
+
+	if err := store.Put(ctx, "../escape", strings.NewReader("x"), 1, "text/plain"); err == nil {
+		t.Errorf("key outside of the store was accepted")
+	}
+}
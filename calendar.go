@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const calendarProductId = "-//Klak//Tasks//EN"
+
+// icsDateTimeFormat is the UTC form of the RFC 5545 DATE-TIME value type.
+const icsDateTimeFormat = "20060102T150405Z"
+
+// icsDateFormat is the RFC 5545 DATE value type.
+const icsDateFormat = "20060102"
+
+// repeatWeekdays maps AddTaskModel.RepeatWeekday to the RRULE BYDAY value.
+// The app uses Calendar weekday numbers, starting with Sunday = 1.
+var repeatWeekdays = map[int8]string{
+	1: "SU",
+	2: "MO",
+	3: "TU",
+	4: "WE",
+	5: "TH",
+	6: "FR",
+	7: "SA",
+}
+
+type CalendarFeedModel struct {
+	Url string `json:"url"`
+}
+
+func newCalendarToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// escapeICSText escapes a TEXT property value as described in RFC 5545
+// section 3.3.11.
+func escapeICSText(s string) string {
+	r := strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+		"\r", `\n`,
+	)
+	return r.Replace(s)
+}
+
+// foldICSLine splits a content line into 75 octet chunks as required by
+// RFC 5545 section 3.1, without breaking multi-byte UTF-8 sequences.
+func foldICSLine(line string) string {
+	const limit = 75
+
+	var b strings.Builder
+	n := 0
+	for _, r := range line {
+		size := len(string(r))
+		if n+size > limit {
+			b.WriteString("\r\n ")
+			// the leading space counts towards the next line
+			n = 1
+		}
+		b.WriteRune(r)
+		n += size
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+func writeICSLine(b *strings.Builder, name string, value string) {
+	b.WriteString(foldICSLine(name + ":" + value))
+}
+
+func taskRecurrenceRule(task AddTaskModel) string {
+	if !task.IsRepeatWeekly {
+		return ""
+	}
+
+	if day, ok := repeatWeekdays[task.RepeatWeekday]; ok {
+		return "FREQ=WEEKLY;BYDAY=" + day
+	}
+
+	return "FREQ=WEEKLY"
+}
+
+// taskRecurrenceStart is the first day a recurring task without a due date
+// repeats on. RRULE needs a DTSTART, so the recurrence starts on the first
+// matching weekday after the latest recurring copy was created, or after now.
+func taskRecurrenceStart(task AddTaskModel, now time.Time) time.Time {
+	start := task.LatestRecurringTaskCreatedAt
+	if start.IsZero() {
+		start = now
+	}
+	start = start.UTC()
+
+	if _, ok := repeatWeekdays[task.RepeatWeekday]; ok {
+		weekday := time.Weekday(task.RepeatWeekday - 1)
+		start = start.AddDate(0, 0, (int(weekday)-int(start.Weekday())+7)%7)
+	}
+	return start
+}
+
+// isDateOnly reports whether a due date is a day rather than a point in
+// time. Due dates at midnight UTC are read as days.
+func isDateOnly(t time.Time) bool {
+	return t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0
+}
+
+// renderTasksCalendar renders the open tasks as an iCalendar object. Tasks
+// with a due date become VEVENTs so that they show up in calendar apps,
+// the rest become VTODOs.
+func renderTasksCalendar(tasks []AddTaskModel, now time.Time) string {
+	var b strings.Builder
+	stamp := now.UTC().Format(icsDateTimeFormat)
+
+	writeICSLine(&b, "BEGIN", "VCALENDAR")
+	writeICSLine(&b, "VERSION", "2.0")
+	writeICSLine(&b, "PRODID", calendarProductId)
+	writeICSLine(&b, "CALSCALE", "GREGORIAN")
+	writeICSLine(&b, "METHOD", "PUBLISH")
+	writeICSLine(&b, "X-WR-CALNAME", "Klak Tasks")
+
+	for _, task := range tasks {
+		if task.IsDone {
+			continue
+		}
+
+		summary := task.Title
+		if task.IsUrgent {
+			summary = "(Urgent) " + summary
+		}
+
+		component := "VTODO"
+		if !task.DueDate.IsZero() {
+			component = "VEVENT"
+		}
+
+		writeICSLine(&b, "BEGIN", component)
+		writeICSLine(&b, "UID", task.Id+"@klak")
+		writeICSLine(&b, "DTSTAMP", stamp)
+		writeICSLine(&b, "SUMMARY", escapeICSText(summary))
+		if task.Description != "" {
+			writeICSLine(&b, "DESCRIPTION", escapeICSText(task.Description))
+		}
+		if task.IsUrgent {
+			writeICSLine(&b, "PRIORITY", "1")
+		}
+
+		if component == "VEVENT" {
+			due := task.DueDate.UTC()
+			if isDateOnly(due) {
+				// an all-day event, DTEND is exclusive
+				writeICSLine(&b, "DTSTART;VALUE=DATE", due.Format(icsDateFormat))
+				writeICSLine(&b, "DTEND;VALUE=DATE", due.AddDate(0, 0, 1).Format(icsDateFormat))
+			} else {
+				// without DTEND the event takes no time, RFC 5545 doesn't
+				// allow a DTEND equal to DTSTART
+				writeICSLine(&b, "DTSTART", due.Format(icsDateTimeFormat))
+			}
+			if rule := taskRecurrenceRule(task); rule != "" {
+				writeICSLine(&b, "RRULE", rule)
+			}
+		} else {
+			if rule := taskRecurrenceRule(task); rule != "" {
+				writeICSLine(&b, "DTSTART;VALUE=DATE", taskRecurrenceStart(task, now).Format(icsDateFormat))
+				writeICSLine(&b, "RRULE", rule)
+			}
+			writeICSLine(&b, "STATUS", "NEEDS-ACTION")
+		}
+
+		writeICSLine(&b, "END", component)
+	}
+
+	writeICSLine(&b, "END", "VCALENDAR")
+
+	return b.String()
+}
+
+func addCalendarFeed(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+
+	token, err := newCalendarToken()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := dbService.updateCalendarToken(c, uid, token); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, CalendarFeedModel{
+		Url: fmt.Sprintf("/users/%s/tasks.ics?token=%s", uid, token),
+	})
+}
+
+func getUserTasksCalendar(c *gin.Context) {
+	userId := c.Param("userId")
+	token := c.Query("token")
+
+	user, err := dbService.getUserById(c, userId)
+	if err != nil {
+		respondWithError(c, http.StatusUnauthorized, "Invalid calendar token")
+		return
+	}
+
+	if user.CalendarToken == "" || subtle.ConstantTimeCompare([]byte(user.CalendarToken), []byte(token)) != 1 {
+		respondWithError(c, http.StatusUnauthorized, "Invalid calendar token")
+		return
+	}
+
+	tasks, err := dbService.getTasksByAssignee(c, userId)
+	if err != nil {
+		log.Printf("Couldn't load tasks for calendar of %v. Here's why: %v\n", userId, err)
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(renderTasksCalendar(tasks, time.Now())))
+}
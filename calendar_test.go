@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderTasksCalendar(t *testing.T) {
+	now := time.Date(2022, 10, 17, 8, 0, 0, 0, time.UTC)
+	tasks := []AddTaskModel{
+		{
+			Id:             "t1",
+			Title:          "Close the store, lock doors",
+			Description:    "Check the freezer\nthen the alarm",
+			DueDate:        time.Date(2022, 10, 18, 18, 30, 0, 0, time.UTC),
+			IsRepeatWeekly: true,
+			RepeatWeekday:  3,
+		},
+		{
+			Id:    "t2",
+			Title: "Order stock",
+		},
+		{
+			Id:             "t4",
+			Title:          "Clean the shelves",
+			IsRepeatWeekly: true,
+			RepeatWeekday:  6,
+		},
+		{
+			Id:      "t5",
+			Title:   "Pay the rent",
+			DueDate: time.Date(2022, 10, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Id:      "t3",
+			Title:   "Already done",
+			DueDate: time.Date(2022, 10, 18, 18, 30, 0, 0, time.UTC),
+			IsDone:  true,
+		},
+	}
+
+	ics := renderTasksCalendar(tasks, now)
+
+	expected := []string{
+		"BEGIN:VCALENDAR\r\n",
+		"BEGIN:VEVENT\r\nUID:t1@klak\r\nDTSTAMP:20221017T080000Z\r\n",
+		"SUMMARY:Close the store\\, lock doors\r\n",
+		"DESCRIPTION:Check the freezer\\nthen the alarm\r\n",
+		"DTSTART:20221018T183000Z\r\nRRULE:FREQ=WEEKLY;BYDAY=TU\r\n",
+		// all-day event, DTEND is the next day
+		"BEGIN:VEVENT\r\nUID:t5@klak\r\n",
+		"DTSTART;VALUE=DATE:20221031\r\nDTEND;VALUE=DATE:20221101\r\n",
+		"BEGIN:VTODO\r\nUID:t2@klak\r\n",
+		"STATUS:NEEDS-ACTION\r\n",
+		"BEGIN:VTODO\r\nUID:t4@klak\r\n",
+		// the first Friday after now
+		"DTSTART;VALUE=DATE:20221021\r\nRRULE:FREQ=WEEKLY;BYDAY=FR\r\nSTATUS:NEEDS-ACTION\r\n",
+		"END:VCALENDAR\r\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(ics, e) {
+			t.Errorf("calendar is missing %q:\n%s", e, ics)
+		}
+	}
+
+	// RFC 5545 doesn't allow a DTEND equal to DTSTART
+	if strings.Contains(ics, "DTEND:20221018T183000Z") {
+		t.Errorf("event with a due time ends when it starts:\n%s", ics)
+	}
+
+	if strings.Contains(ics, "t3@klak") {
+		t.Errorf("calendar contains a done task:\n%s", ics)
+	}
+}
+
+func TestFoldICSLine(t *testing.T) {
+	line := "DESCRIPTION:" + strings.Repeat("අ", 40)
+
+	folded := foldICSLine(line)
+	for _, l := range strings.Split(strings.TrimSuffix(folded, "\r\n"), "\r\n") {
+		if len(l) > 75 {
+			t.Errorf("line is longer than 75 octets: %q", l)
+		}
+	}
+
+	if unfolded := strings.ReplaceAll(folded, "\r\n ", ""); unfolded != line+"\r\n" {
+		t.Errorf("unfolded line = %q, want %q", unfolded, line)
+	}
+}
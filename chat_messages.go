@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kjk/betterguid"
+)
+
+const (
+	defaultRepliesLimit = 50
+	maxRepliesLimit     = 100
+)
+
+// How long after sending a chat message its author may still edit or delete
+// it. Can be changed with the MESSAGE_EDIT_WINDOW environment variable, e.g. 1h.
+var messageEditWindow = 15 * time.Minute
+
+var (
+	// ErrNotMessageAuthor is returned when someone other than the author tries to change a message
+	ErrNotMessageAuthor = errors.New("only the author may change a message")
+	// ErrMessageEditWindowClosed is returned when a message is too old to be changed
+	ErrMessageEditWindowClosed = errors.New("message can no longer be changed")
+	// ErrMessageDeleted is returned when a deleted message is edited
+	ErrMessageDeleted = errors.New("message was deleted")
+)
+
+func configMessageEditWindow() {
+	v := os.Getenv("MESSAGE_EDIT_WINDOW")
+	if v == "" {
+		return
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("Ignoring invalid MESSAGE_EDIT_WINDOW %q\n", v)
+		return
+	}
+	messageEditWindow = d
+}
+
+type EditChatMessageModel struct {
+	Id        string    `json:"id"`
+	ChatId    string    `json:"chatId"`
+	MessageId string    `json:"messageId"`
+	Message   string    `json:"message"`
+	SentBy    string    `json:"sentBy"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type DeleteChatMessageModel struct {
+	Id        string    `json:"id"`
+	ChatId    string    `json:"chatId"`
+	MessageId string    `json:"messageId"`
+	SentBy    string    `json:"sentBy"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// canChangeChatMessage checks whether userId may edit or delete m at now. The
+// window starts when the server received m, clients choose the timestamp.
+// Messages saved without a receive time can't be changed.
+func canChangeChatMessage(m AddChatMessageModel, userId string, now time.Time) error {
+	if m.SentBy != userId {
+		return ErrNotMessageAuthor
+	}
+
+	if m.IsDeleted {
+		return ErrMessageDeleted
+	}
+
+	if m.ReceivedAt.IsZero() || now.Sub(m.ReceivedAt) > messageEditWindow {
+		return ErrMessageEditWindowClosed
+	}
+
+	return nil
+}
+
+// chatMessageNotificationExcept returns the users that don't get the regular
+// notification of m: mentioned users and the author of the parent message are
+// notified separately. notifyParent is true when the author of parent gets a
+// reply notification.
+func chatMessageNotificationExcept(m AddChatMessageModel, parent AddChatMessageModel) (except []string, notifyParent bool) {
+	except = mentionedUserIds(m.Mentions)
+	if m.ReplyToMessageId != "" && parent.SentBy != m.SentBy {
+		except = append(except, parent.SentBy)
+		notifyParent = true
+	}
+	return except, notifyParent
+}
+
+// updateChatMessageOutbox replaces, or with a nil message removes, the copies
+// of a chat message that members haven't received yet, so they see the
+// current version when the messages are replayed.
+func updateChatMessageOutbox(ctx context.Context, chatId string, messageId string, sentBy string, m *AddChatMessageModel) {
+	members, err := dbService.getChatGroupMembers(ctx, chatId)
+	if err != nil {
+		log.Printf("Failed to fetch group members %v", err)
+		return
+	}
+
+	for _, member := range members {
+		if member.MemberUserId == sentBy {
+			continue
+		}
+
+		sp, err := dbService.getMessageById(ctx, messageId, member.MemberUserId)
+		if err != nil || sp.Type != ServerPushAddChatMessage {
+			// already delivered
+			continue
+		}
+
+		if m == nil {
+			dbService.removeMessageById(ctx, messageId, member.MemberUserId)
+		} else {
+			sp.Data = *m
+			dbService.addMessage(ctx, sp)
+		}
+	}
+}
+
+func sendChatMessageChangeReceipt(ctx context.Context, id string, sentBy string) {
+	mr := MessageReceiptModel{
+		Type:      Sent,
+		MessageId: id,
+		Timestamp: time.Now().UTC(),
+	}
+
+	pr := ServerPush{
+		Id:     betterguid.New(),
+		UserId: sentBy,
+		Type:   ServerPushMessageReceipt,
+		Data:   mr,
+	}
+
+	go hub.send(ctx, sentBy, pr, true)
+}
+
+// handleEditChatMessage edits a message of uid, the user of the connection.
+// The sentBy of the message is only the client's claim, uid replaces it.
+func handleEditChatMessage(ctx context.Context, uid string, m EditChatMessageModel) {
+	m.SentBy = uid
+	cm, err := dbService.getChatMessageById(ctx, m.ChatId, m.MessageId)
+	if err != nil {
+		log.Printf("%s : Couldn't fetch chat message %v. Here's why: %v\n", ctx.Value(logPrefix), m.MessageId, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	if err := canChangeChatMessage(cm, uid, now); err != nil {
+		log.Printf("%s : %v can't edit chat message %v. Here's why: %v\n", ctx.Value(logPrefix), m.SentBy, m.MessageId, err)
+		return
+	}
+
+	// send receipt
+	sendChatMessageChangeReceipt(ctx, m.Id, m.SentBy)
+
+	cm.Message = m.Message
+	cm.EditedAt = now
+
+	//save message history
+	if err := dbService.updateChatMessage(ctx, cm); err != nil {
+		return
+	}
+
+	indexChatMessage(ctx, cm)
+	updateChatMessageOutbox(ctx, m.ChatId, m.MessageId, m.SentBy, &cm)
+
+	//send edit
+	go hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushEditChatMessage, m, true, m.SentBy)
+}
+
+// handleDeleteChatMessage deletes a message of uid, see handleEditChatMessage.
+func handleDeleteChatMessage(ctx context.Context, uid string, m DeleteChatMessageModel) {
+	m.SentBy = uid
+	cm, err := dbService.getChatMessageById(ctx, m.ChatId, m.MessageId)
+	if err != nil {
+		log.Printf("%s : Couldn't fetch chat message %v. Here's why: %v\n", ctx.Value(logPrefix), m.MessageId, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	if err := canChangeChatMessage(cm, uid, now); err != nil {
+		log.Printf("%s : %v can't delete chat message %v. Here's why: %v\n", ctx.Value(logPrefix), m.SentBy, m.MessageId, err)
+		return
+	}
+
+	// send receipt
+	sendChatMessageChangeReceipt(ctx, m.Id, m.SentBy)
+
+	// keep a tombstone so clients can show that a message was deleted
+	cm.Message = ""
+	cm.IsDeleted = true
+	cm.EditedAt = now
+
+	//save message history
+	if err := dbService.updateChatMessage(ctx, cm); err != nil {
+		return
+	}
+
+	if cm.ReplyToMessageId != "" {
+		dbService.removeChatMessageReply(ctx, cm.ChatId, cm.ReplyToMessageId)
+	}
+
+	unindexChatMessage(ctx, cm.Id)
+	updateChatMessageOutbox(ctx, m.ChatId, m.MessageId, m.SentBy, nil)
+
+	//send deletion
+	go hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushDeleteChatMessage, m, true, m.SentBy)
+}
+
+func getChatMessageReplies(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+	chatId := c.Param("chatId")
+	messageId := c.Param("messageId")
+
+	members, err := dbService.getChatGroupMembers(c, chatId)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if !isChatGroupMember(members, uid) {
+		respondWithError(c, http.StatusForbidden, "Not a member of the chat")
+		return
+	}
+
+	limit := defaultRepliesLimit
+	if v := c.Query("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 {
+			respondWithError(c, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = l
+	}
+	if limit > maxRepliesLimit {
+		limit = maxRepliesLimit
+	}
+
+	// replies are sorted by id, the next page starts after the id in next
+	replies, next, err := dbService.getChatMessageReplies(c, chatId, messageId, c.Query("after"), int32(limit))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"data": replies, "next": next})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+func TestCanChangeChatMessage(t *testing.T) {
+	sentAt := time.Date(2022, 10, 17, 8, 0, 0, 0, time.UTC)
+	// the client clock is a day ahead
+	m := AddChatMessageModel{Id: "m1", ChatId: "g1", Message: "helo", SentBy: "alice", Timestamp: sentAt.AddDate(0, 0, 1), ReceivedAt: sentAt}
+
+	if err := canChangeChatMessage(m, "alice", sentAt.Add(time.Minute)); err != nil {
+		t.Errorf("author within the window: %v", err)
+	}
+	if err := canChangeChatMessage(m, "bob", sentAt.Add(time.Minute)); err != ErrNotMessageAuthor {
+		t.Errorf("other member: %v", err)
+	}
+	if err := canChangeChatMessage(m, "alice", sentAt.Add(messageEditWindow+time.Second)); err != ErrMessageEditWindowClosed {
+		t.Errorf("after the window: %v", err)
+	}
+
+	m.IsDeleted = true
+	if err := canChangeChatMessage(m, "alice", sentAt.Add(time.Minute)); err != ErrMessageDeleted {
+		t.Errorf("deleted message: %v", err)
+	}
+
+	old := AddChatMessageModel{Id: "m0", ChatId: "g1", Message: "hi", SentBy: "alice", Timestamp: sentAt}
+	if err := canChangeChatMessage(old, "alice", sentAt.Add(time.Minute)); err != ErrMessageEditWindowClosed {
+		t.Errorf("message without receive time: %v", err)
+	}
+}
+
+func TestChatMessageChangesIgnoreSpoofedSender(t *testing.T) {
+	db := useFakeDynamoDb(t)
+	db.add(DDB_TABLE_CHAT_MESSAGE, AddChatMessageModel{Id: "m1", ChatId: "g1", Message: "hi", SentBy: "alice", ReceivedAt: time.Now().UTC()})
+	ctx := context.Background()
+
+	// mallory sends the id of alice, the author
+	handleEditChatMessage(ctx, "mallory", EditChatMessageModel{Id: "e1", ChatId: "g1", MessageId: "m1", Message: "bye", SentBy: "alice"})
+	handleDeleteChatMessage(ctx, "mallory", DeleteChatMessageModel{Id: "d1", ChatId: "g1", MessageId: "m1", SentBy: "alice"})
+
+	if writes := db.writes(DDB_TABLE_CHAT_MESSAGE); len(writes) != 0 {
+		t.Errorf("spoofed requests changed the message: %+v", writes)
+	}
+}
+
+func TestDeleteChatMessageReply(t *testing.T) {
+	db := useFakeDynamoDb(t)
+	db.add(DDB_TABLE_CHAT_MESSAGE, AddChatMessageModel{Id: "m2", ChatId: "g1", Message: "me too", SentBy: "alice", ReplyToMessageId: "m1", ReceivedAt: time.Now().UTC()})
+	useTestHub(t)
+	index, err := bleve.NewMemOnly(searchIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := searchIndex
+	searchIndex = index
+	defer func() { searchIndex = old }()
+	defer index.Close()
+
+	handleDeleteChatMessage(context.Background(), "alice", DeleteChatMessageModel{Id: "d1", ChatId: "g1", MessageId: "m2"})
+	// the receipt and the push to the chat group
+	db.waitForCalls(t, "PutItem", DDB_TABLE_USER_MESSAGES, 1)
+	db.waitForCalls(t, "Query", DDB_TABLE_CHAT_GROUP_MEMBER, 2)
+
+	decremented := false
+	for _, c := range db.writes(DDB_TABLE_CHAT_MESSAGE) {
+		key := fmtJSON(c.Body["Key"])
+		if c.Op == "UpdateItem" && c.Body["UpdateExpression"] == "ADD replyCount :minusOne" && strings.Contains(key, `"m1"`) {
+			decremented = true
+		}
+	}
+	if !decremented {
+		t.Errorf("reply count of the parent wasn't decremented: %+v", db.writes(DDB_TABLE_CHAT_MESSAGE))
+	}
+}
+
+func TestChatMessageNotificationExcept(t *testing.T) {
+	parent := AddChatMessageModel{Id: "m1", ChatId: "g1", SentBy: "bob"}
+	reply := AddChatMessageModel{Id: "m2", ChatId: "g1", SentBy: "alice", ReplyToMessageId: "m1", Mentions: []Mention{{Uid: "carol"}}}
+
+	except, notifyParent := chatMessageNotificationExcept(reply, parent)
+	if !notifyParent || len(except) != 2 || except[0] != "carol" || except[1] != "bob" {
+		t.Errorf("reply: except = %v, notifyParent = %v", except, notifyParent)
+	}
+
+	// bob replying to himself gets no notification at all
+	reply.SentBy = "bob"
+	except, notifyParent = chatMessageNotificationExcept(reply, parent)
+	if notifyParent || len(except) != 1 {
+		t.Errorf("reply to self: except = %v, notifyParent = %v", except, notifyParent)
+	}
+
+	// the parent wasn't found
+	reply.ReplyToMessageId = ""
+	if _, notifyParent := chatMessageNotificationExcept(reply, AddChatMessageModel{}); notifyParent {
+		t.Errorf("message without parent notifies a parent")
+	}
+}
@@ -364,7 +364,78 @@ func (c *Client) readPump() {
 					log.Fatalln("Could not convert chat group member data to struct")
 				}
 				log.Printf("%s : Received chat group member from %s\n", ctx.Value(logPrefix), c.userUid)
-				handleAddChatGroupMember(ctx, update)
+				handleAddChatGroupMember(ctx, c.userUid, update)
+			}
+
+			if clientPush.Type == ClientPushRemoveGroupMember {
+				// convert json to struct
+				var update RemoveChatGroupMemberModel
+				if err := json.Unmarshal(data, &update); err != nil {
+					log.Fatalln("Could not convert chat group member data to struct")
+				}
+				log.Printf("%s : Received chat group member removal from %s\n", ctx.Value(logPrefix), c.userUid)
+				handleRemoveChatGroupMember(ctx, c.userUid, update)
+			}
+
+			if clientPush.Type == ClientPushLeaveChatGroup {
+				// convert json to struct
+				var update RemoveChatGroupMemberModel
+				if err := json.Unmarshal(data, &update); err != nil {
+					log.Fatalln("Could not convert chat group member data to struct")
+				}
+				log.Printf("%s : Received leave chat group from %s\n", ctx.Value(logPrefix), c.userUid)
+				update.MemberUserId = c.userUid
+				handleRemoveChatGroupMember(ctx, c.userUid, update)
+			}
+
+			if clientPush.Type == ClientPushSetChatGroupRole {
+				// convert json to struct
+				var update AddChatGroupMemberModel
+				if err := json.Unmarshal(data, &update); err != nil {
+					log.Fatalln("Could not convert chat group member data to struct")
+				}
+				log.Printf("%s : Received chat group role from %s\n", ctx.Value(logPrefix), c.userUid)
+				handleSetChatGroupRole(ctx, c.userUid, update)
+			}
+
+			if clientPush.Type == ClientPushUpdateChatGroup {
+				// convert json to struct
+				var update UpdateChatGroupModel
+				if err := json.Unmarshal(data, &update); err != nil {
+					log.Fatalln("Could not convert chat group data to struct")
+				}
+				log.Printf("%s : Received chat group update from %s\n", ctx.Value(logPrefix), c.userUid)
+				handleUpdateChatGroup(ctx, c.userUid, update)
+			}
+
+			if clientPush.Type == ClientPushDeleteChatGroup {
+				// convert json to struct
+				var update DeleteChatGroupModel
+				if err := json.Unmarshal(data, &update); err != nil {
+					log.Fatalln("Could not convert chat group data to struct")
+				}
+				log.Printf("%s : Received chat group deletion from %s\n", ctx.Value(logPrefix), c.userUid)
+				handleDeleteChatGroup(ctx, c.userUid, update)
+			}
+
+			if clientPush.Type == ClientPushEditChatMessage {
+				// convert json to struct
+				var update EditChatMessageModel
+				if err := json.Unmarshal(data, &update); err != nil {
+					log.Fatalln("Could not convert chat message data to struct")
+				}
+				log.Printf("%s : Received chat message edit from %s\n", ctx.Value(logPrefix), c.userUid)
+				handleEditChatMessage(ctx, c.userUid, update)
+			}
+
+			if clientPush.Type == ClientPushDeleteChatMessage {
+				// convert json to struct
+				var update DeleteChatMessageModel
+				if err := json.Unmarshal(data, &update); err != nil {
+					log.Fatalln("Could not convert chat message data to struct")
+				}
+				log.Printf("%s : Received chat message deletion from %s\n", ctx.Value(logPrefix), c.userUid)
+				handleDeleteChatMessage(ctx, c.userUid, update)
 			}
 
 			if clientPush.Type == ClientPushAddPresence {
@@ -386,6 +457,46 @@ func (c *Client) readPump() {
 				log.Printf("%s : Received good job message from %s\n", ctx.Value(logPrefix), c.userUid)
 				handleAddGoodJobMessage(ctx, update)
 			}
+
+			if clientPush.Type == ClientPushAddChecklistItem {
+				// convert json to struct
+				var update AddChecklistItemModel
+				if err := json.Unmarshal(data, &update); err != nil {
+					log.Fatalln("Could not convert checklist item data to struct")
+				}
+				log.Printf("%s : Received checklist item from %s\n", ctx.Value(logPrefix), c.userUid)
+				handleAddChecklistItem(ctx, update)
+			}
+
+			if clientPush.Type == ClientPushAddChecklistStatus {
+				// convert json to struct
+				var update AddChecklistStatusModel
+				if err := json.Unmarshal(data, &update); err != nil {
+					log.Fatalln("Could not convert checklist status data to struct")
+				}
+				log.Printf("%s : Received checklist status from %s\n", ctx.Value(logPrefix), c.userUid)
+				handleAddChecklistStatus(ctx, update)
+			}
+
+			if clientPush.Type == ClientPushAddReaction {
+				// convert json to struct
+				var update AddReactionModel
+				if err := json.Unmarshal(data, &update); err != nil {
+					log.Fatalln("Could not convert reaction data to struct")
+				}
+				log.Printf("%s : Received reaction from %s\n", ctx.Value(logPrefix), c.userUid)
+				handleAddReaction(ctx, update)
+			}
+
+			if clientPush.Type == ClientPushRemoveReaction {
+				// convert json to struct
+				var update AddReactionModel
+				if err := json.Unmarshal(data, &update); err != nil {
+					log.Fatalln("Could not convert reaction data to struct")
+				}
+				log.Printf("%s : Received reaction removal from %s\n", ctx.Value(logPrefix), c.userUid)
+				handleRemoveReaction(ctx, update)
+			}
 		}
 	}
 }
@@ -439,6 +550,7 @@ func (c *Client) writePump(offset int64) {
 				return
 			}
 
+			signServerPushAttachments(&msg, time.Now())
 			message, _ := json.Marshal(msg)
 
 			// message := m.Value
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"time"
 )
 
 type DatabaseService struct {
@@ -36,14 +37,42 @@ func (db DatabaseService) getDeviceTokens(ctx context.Context, userId string) ([
 	return db.dynamoDbRespository.getDeviceTokens(ctx, userId)
 }
 
+func (db DatabaseService) deleteDeviceToken(ctx context.Context, userId string, token string) error {
+	return db.dynamoDbRespository.deleteDeviceToken(ctx, userId, token)
+}
+
 func (db DatabaseService) addTask(ctx context.Context, task AddTaskModel) error {
 	return db.dynamoDbRespository.addTask(ctx, task)
 }
 
+func (db DatabaseService) addTasks(ctx context.Context, tasks []AddTaskModel) error {
+	return db.dynamoDbRespository.addTasks(ctx, tasks)
+}
+
 func (db DatabaseService) getTaskById(ctx context.Context, taskId string) (AddTaskModel, error) {
 	return db.dynamoDbRespository.getTaskById(ctx, taskId)
 }
 
+func (db DatabaseService) updateTaskChecklist(ctx context.Context, taskId string, items []TaskChecklistItemModel, version int) error {
+	return db.dynamoDbRespository.updateTaskChecklist(ctx, taskId, items, version)
+}
+
+func (db DatabaseService) updateTaskDone(ctx context.Context, taskId string, isDone bool, doneAt time.Time) error {
+	return db.dynamoDbRespository.updateTaskDone(ctx, taskId, isDone, doneAt)
+}
+
+func (db DatabaseService) getTasksByAssignee(ctx context.Context, userId string) ([]AddTaskModel, error) {
+	return db.dynamoDbRespository.getTasksByAssignee(ctx, userId)
+}
+
+func (db DatabaseService) updateCalendarToken(ctx context.Context, userId string, token string) error {
+	return db.dynamoDbRespository.updateCalendarToken(ctx, userId, token)
+}
+
+func (db DatabaseService) updateUserLocale(ctx context.Context, userId string, locale string, localizeOnDevice bool) error {
+	return db.dynamoDbRespository.updateUserLocale(ctx, userId, locale, localizeOnDevice)
+}
+
 func (db DatabaseService) addChatGroup(ctx context.Context, c AddChatGroupModel) error {
 	return db.dynamoDbRespository.addChatGroup(ctx, c)
 }
@@ -52,14 +81,30 @@ func (db DatabaseService) getChatGroupById(ctx context.Context, chatId string) (
 	return db.dynamoDbRespository.getChatGroupById(ctx, chatId)
 }
 
+func (db DatabaseService) updateChatGroup(ctx context.Context, cg AddChatGroupModel) error {
+	return db.dynamoDbRespository.updateChatGroup(ctx, cg)
+}
+
+func (db DatabaseService) deleteChatGroup(ctx context.Context, chatId string) error {
+	return db.dynamoDbRespository.deleteChatGroup(ctx, chatId)
+}
+
 func (db DatabaseService) addChatGroupMember(ctx context.Context, cgm AddChatGroupMemberModel) error {
 	return db.dynamoDbRespository.addChatGroupMember(ctx, cgm)
 }
 
+func (db DatabaseService) removeChatGroupMember(ctx context.Context, chatId string, memberUserId string) error {
+	return db.dynamoDbRespository.removeChatGroupMember(ctx, chatId, memberUserId)
+}
+
 func (db DatabaseService) getChatGroupMembers(ctx context.Context, chatId string) ([]AddChatGroupMemberModel, error) {
 	return db.dynamoDbRespository.getChatGroupMembers(ctx, chatId)
 }
 
+func (db DatabaseService) getChatGroupIdsByMember(ctx context.Context, userId string) ([]string, error) {
+	return db.dynamoDbRespository.getChatGroupIdsByMember(ctx, userId)
+}
+
 func (db DatabaseService) getMessageById(ctx context.Context, mid, userId string) (ServerPush, error) {
 	return db.dynamoDbRespository.getMessageById(ctx, mid, userId)
 }
@@ -68,3 +113,155 @@ func (db DatabaseService) removeMessageById(ctx context.Context, mid, userId str
 	return db.dynamoDbRespository.deleteMessageById(ctx, mid, userId)
 	// return errors.New("removeMessageById: function not implemented")
 }
+
+func (db DatabaseService) addTaskTemplate(ctx context.Context, t AddTaskTemplateModel) error {
+	return db.dynamoDbRespository.addTaskTemplate(ctx, t)
+}
+
+func (db DatabaseService) getTaskTemplates(ctx context.Context, chatId string) ([]AddTaskTemplateModel, error) {
+	return db.dynamoDbRespository.getTaskTemplates(ctx, chatId)
+}
+
+func (db DatabaseService) getTaskTemplateById(ctx context.Context, chatId string, templateId string) (AddTaskTemplateModel, error) {
+	return db.dynamoDbRespository.getTaskTemplateById(ctx, chatId, templateId)
+}
+
+func (db DatabaseService) addTaskEvent(ctx context.Context, e TaskEventModel) error {
+	return db.dynamoDbRespository.addTaskEvent(ctx, e)
+}
+
+func (db DatabaseService) getTaskEvents(ctx context.Context, chatId string, from time.Time, to time.Time) ([]TaskEventModel, error) {
+	return db.dynamoDbRespository.getTaskEvents(ctx, chatId, from, to)
+}
+
+func (db DatabaseService) addChatMessage(ctx context.Context, m AddChatMessageModel) error {
+	return db.dynamoDbRespository.addChatMessage(ctx, m)
+}
+
+func (db DatabaseService) getChatMessageById(ctx context.Context, chatId string, messageId string) (AddChatMessageModel, error) {
+	return db.dynamoDbRespository.getChatMessageById(ctx, chatId, messageId)
+}
+
+func (db DatabaseService) updateChatMessage(ctx context.Context, m AddChatMessageModel) error {
+	return db.dynamoDbRespository.updateChatMessage(ctx, m)
+}
+
+func (db DatabaseService) updateChatMessageLinkPreviews(ctx context.Context, chatId string, messageId string, previews []LinkPreviewModel) error {
+	return db.dynamoDbRespository.updateChatMessageLinkPreviews(ctx, chatId, messageId, previews)
+}
+
+func (db DatabaseService) addChatMessageReply(ctx context.Context, chatId string, parentId string, replyId string, repliedAt time.Time) error {
+	return db.dynamoDbRespository.addChatMessageReply(ctx, chatId, parentId, replyId, repliedAt)
+}
+
+func (db DatabaseService) removeChatMessageReply(ctx context.Context, chatId string, parentId string) error {
+	return db.dynamoDbRespository.removeChatMessageReply(ctx, chatId, parentId)
+}
+
+func (db DatabaseService) getChatMessageReplies(ctx context.Context, chatId string, parentId string, after string, limit int32) ([]AddChatMessageModel, string, error) {
+	return db.dynamoDbRespository.getChatMessageReplies(ctx, chatId, parentId, after, limit)
+}
+
+func (db DatabaseService) addReaction(ctx context.Context, r ReactionModel) (bool, error) {
+	return db.dynamoDbRespository.addReaction(ctx, r)
+}
+
+func (db DatabaseService) removeReaction(ctx context.Context, targetId string, id string) (bool, error) {
+	return db.dynamoDbRespository.removeReaction(ctx, targetId, id)
+}
+
+func (db DatabaseService) addReactionCount(ctx context.Context, targetType ReactionTargetType, chatId string, targetId string, emoji string, delta int) (map[string]int, error) {
+	return db.dynamoDbRespository.addReactionCount(ctx, targetType, chatId, targetId, emoji, delta)
+}
+
+func (db DatabaseService) addMention(ctx context.Context, m MentionModel) error {
+	return db.dynamoDbRespository.addMention(ctx, m)
+}
+
+func (db DatabaseService) getMentions(ctx context.Context, userId string, limit int32) ([]MentionModel, error) {
+	return db.dynamoDbRespository.getMentions(ctx, userId, limit)
+}
+
+func (db DatabaseService) addAttachment(ctx context.Context, a AttachmentModel) error {
+	return db.dynamoDbRespository.addAttachment(ctx, a)
+}
+
+func (db DatabaseService) getAttachmentById(ctx context.Context, attachmentId string) (AttachmentModel, error) {
+	return db.dynamoDbRespository.getAttachmentById(ctx, attachmentId)
+}
+
+func (db DatabaseService) updateAttachmentUpload(ctx context.Context, attachmentId string, offset int64, uploadedBytes int64, chunks int) error {
+	return db.dynamoDbRespository.updateAttachmentUpload(ctx, attachmentId, offset, uploadedBytes, chunks)
+}
+
+func (db DatabaseService) putNotificationPreferences(ctx context.Context, p NotificationPreferencesModel) error {
+	return db.dynamoDbRespository.putNotificationPreferences(ctx, p)
+}
+
+func (db DatabaseService) getNotificationPreferences(ctx context.Context, userId string) (NotificationPreferencesModel, error) {
+	return db.dynamoDbRespository.getNotificationPreferences(ctx, userId)
+}
+
+func (db DatabaseService) addUnread(ctx context.Context, u UnreadModel) error {
+	return db.dynamoDbRespository.addUnread(ctx, u)
+}
+
+func (db DatabaseService) setUnreadAcked(ctx context.Context, u UnreadModel) error {
+	return db.dynamoDbRespository.setUnreadAcked(ctx, u)
+}
+
+func (db DatabaseService) removeUnread(ctx context.Context, userId string, id string) error {
+	return db.dynamoDbRespository.removeUnread(ctx, userId, id)
+}
+
+func (db DatabaseService) getUnread(ctx context.Context, userId string) ([]UnreadModel, error) {
+	return db.dynamoDbRespository.getUnread(ctx, userId)
+}
+
+func (db DatabaseService) getEmailDigestSubscribers(ctx context.Context) ([]NotificationPreferencesModel, error) {
+	return db.dynamoDbRespository.getEmailDigestSubscribers(ctx)
+}
+
+func (db DatabaseService) updateEmailDigestSentAt(ctx context.Context, userId string, sentAt time.Time) error {
+	return db.dynamoDbRespository.updateEmailDigestSentAt(ctx, userId, sentAt)
+}
+
+func (db DatabaseService) addNotificationLog(ctx context.Context, e NotificationLogModel) error {
+	return db.dynamoDbRespository.addNotificationLog(ctx, e)
+}
+
+func (db DatabaseService) getNotificationLog(ctx context.Context, userId string, mid string, limit int) ([]NotificationLogModel, error) {
+	return db.dynamoDbRespository.getNotificationLog(ctx, userId, mid, limit)
+}
+
+func (db DatabaseService) addNotificationJob(ctx context.Context, job NotificationJobModel) error {
+	return db.dynamoDbRespository.addNotificationJob(ctx, job)
+}
+
+func (db DatabaseService) deleteNotificationJob(ctx context.Context, id string) error {
+	return db.dynamoDbRespository.deleteNotificationJob(ctx, id)
+}
+
+func (db DatabaseService) getNotificationJobs(ctx context.Context) ([]NotificationJobModel, error) {
+	return db.dynamoDbRespository.getNotificationJobs(ctx)
+}
+
+func (db DatabaseService) addNotificationDeadLetter(ctx context.Context, job NotificationJobModel) error {
+	return db.dynamoDbRespository.addNotificationDeadLetter(ctx, job)
+}
+
+func (db DatabaseService) getNotificationDeadLetters(ctx context.Context) ([]NotificationJobModel, error) {
+	return db.dynamoDbRespository.getNotificationDeadLetters(ctx)
+}
+
+func (db DatabaseService) addNotificationDigest(ctx context.Context, userId string, mid string, data NotificationData) error {
+	return db.dynamoDbRespository.addNotificationDigest(ctx, userId, mid, data)
+}
+
+func (db DatabaseService) getNotificationDigestUsers(ctx context.Context) ([]string, error) {
+	return db.dynamoDbRespository.getNotificationDigestUsers(ctx)
+}
+
+func (db DatabaseService) takeNotificationDigest(ctx context.Context, userId string) (*NotificationDigestModel, error) {
+	return db.dynamoDbRespository.takeNotificationDigest(ctx, userId)
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -18,14 +20,36 @@ type DynamoDbRepository struct {
 }
 
 const (
-	DDB_TABLE_USER              string = "User"
-	DDB_TABLE_USER_MESSAGES     string = "Messages"
-	DDB_TABLE_DEVICE_TOKEN      string = "DeviceToken"
-	DDB_TABLE_TASK              string = "Task"
-	DDB_TABLE_CHAT_GROUP        string = "ChatGroup"
-	DDB_TABLE_CHAT_GROUP_MEMBER string = "ChatGroupMember"
+	DDB_TABLE_USER                     string = "User"
+	DDB_TABLE_USER_MESSAGES            string = "Messages"
+	DDB_TABLE_DEVICE_TOKEN             string = "DeviceToken"
+	DDB_TABLE_TASK                     string = "Task"
+	DDB_TABLE_CHAT_GROUP               string = "ChatGroup"
+	DDB_TABLE_CHAT_GROUP_MEMBER        string = "ChatGroupMember"
+	DDB_TABLE_TASK_TEMPLATE            string = "TaskTemplate"
+	DDB_TABLE_TASK_EVENT               string = "TaskEvent"
+	DDB_TABLE_CHAT_MESSAGE             string = "ChatMessage"
+	DDB_TABLE_REACTION                 string = "Reaction"
+	DDB_TABLE_MENTION                  string = "Mention"
+	DDB_TABLE_ATTACHMENT               string = "Attachment"
+	DDB_TABLE_NOTIFICATION_PREFERENCES string = "NotificationPreferences"
+	DDB_TABLE_UNREAD                   string = "Unread"
+	DDB_TABLE_NOTIFICATION_LOG         string = "NotificationLog"
+	DDB_TABLE_NOTIFICATION_JOB         string = "NotificationJob"
+	DDB_TABLE_NOTIFICATION_DEAD_LETTER string = "NotificationDeadLetter"
+	DDB_TABLE_NOTIFICATION_DIGEST      string = "NotificationDigest"
 )
 
+const (
+	DDB_INDEX_TASK_ASSIGNEE            string = "assignedTo-index"
+	DDB_INDEX_TASK_EVENT_TIME          string = "chatId-timestamp-index"
+	DDB_INDEX_CHAT_REPLY               string = "replyToMessageId-index"
+	DDB_INDEX_NOTIFICATION_LOG_MESSAGE string = "messageId-index"
+)
+
+// ErrConcurrentUpdate is returned when an item changed since it was read
+var ErrConcurrentUpdate = errors.New("db: item was changed concurrently")
+
 func tableExists(d *dynamodb.Client, name string) bool {
 	tables, err := d.ListTables(context.TODO(), &dynamodb.ListTablesInput{})
 	if err != nil {
@@ -39,6 +63,77 @@ func tableExists(d *dynamodb.Client, name string) bool {
 	return false
 }
 
+// createTableIndex adds a global secondary index on the string attributes
+// hashKey and rangeKey to an existing table, and waits until it is active.
+// rangeKey may be empty.
+func createTableIndex(ctx context.Context, d *dynamodb.Client, table string, index string, hashKey string, rangeKey string) error {
+	desc, err := d.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)})
+	if err != nil {
+		log.Printf("Couldn't describe table %v. Here's why: %v\n", table, err)
+		return err
+	}
+	for _, i := range desc.Table.GlobalSecondaryIndexes {
+		if aws.ToString(i.IndexName) == index {
+			log.Printf("index=%v of table=%v already exists\n", index, table)
+			return nil
+		}
+	}
+
+	attributes := []types.AttributeDefinition{{
+		AttributeName: aws.String(hashKey),
+		AttributeType: types.ScalarAttributeTypeS,
+	}}
+	keySchema := []types.KeySchemaElement{{
+		AttributeName: aws.String(hashKey),
+		KeyType:       types.KeyTypeHash,
+	}}
+	if rangeKey != "" {
+		attributes = append(attributes, types.AttributeDefinition{
+			AttributeName: aws.String(rangeKey),
+			AttributeType: types.ScalarAttributeTypeS,
+		})
+		keySchema = append(keySchema, types.KeySchemaElement{
+			AttributeName: aws.String(rangeKey),
+			KeyType:       types.KeyTypeRange,
+		})
+	}
+
+	_, err = d.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+		TableName:            aws.String(table),
+		AttributeDefinitions: attributes,
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{{
+			Create: &types.CreateGlobalSecondaryIndexAction{
+				IndexName:  aws.String(index),
+				KeySchema:  keySchema,
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		}},
+	})
+	if err != nil {
+		log.Printf("Couldn't create index %v of table %v. Here's why: %v\n", index, table, err)
+		return err
+	}
+
+	// existing items are backfilled before the index can be queried
+	deadline := time.Now().Add(5 * time.Minute)
+	for time.Now().Before(deadline) {
+		time.Sleep(5 * time.Second)
+		desc, err = d.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)})
+		if err != nil {
+			log.Printf("Couldn't describe table %v. Here's why: %v\n", table, err)
+			return err
+		}
+		for _, i := range desc.Table.GlobalSecondaryIndexes {
+			if aws.ToString(i.IndexName) == index && i.IndexStatus == types.IndexStatusActive {
+				return nil
+			}
+		}
+	}
+	err = fmt.Errorf("index %v of table %v isn't active yet", index, table)
+	log.Printf("Wait for index failed. Here's why: %v\n", err)
+	return err
+}
+
 func createUserTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
 	if tableExists(d, DDB_TABLE_USER) {
 		log.Printf("table=%v already exists\n", DDB_TABLE_USER)
@@ -129,6 +224,15 @@ func (db DynamoDbRepository) getUserById(ctx context.Context, userId string) (Ad
 			}
 		}
 	}
+
+	if err != nil {
+		return AddUserModel{}, err
+	}
+
+	if len(movies) == 0 {
+		return AddUserModel{}, fmt.Errorf("db: no user found for userId (%v)", userId)
+	}
+
 	return movies[0], err
 }
 
@@ -335,6 +439,19 @@ func (db DynamoDbRepository) getDeviceTokens(ctx context.Context, userId string)
 	return movies, err
 }
 
+func (db DynamoDbRepository) deleteDeviceToken(ctx context.Context, userId string, token string) error {
+	_, err := db.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(DDB_TABLE_DEVICE_TOKEN), Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userId},
+			"token":  &types.AttributeValueMemberS{Value: token},
+		},
+	})
+	if err != nil {
+		log.Printf("Couldn't delete device token of %v from the table. Here's why: %v\n", userId, err)
+	}
+	return err
+}
+
 func createTaskTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
 	if tableExists(d, DDB_TABLE_TASK) {
 		log.Printf("table=%v already exists\n", DDB_TABLE_TASK)
@@ -381,6 +498,28 @@ func (db DynamoDbRepository) addTask(ctx context.Context, task AddTaskModel) err
 	return err
 }
 
+// addTasks writes tasks in one transaction, either all of them are added or
+// none is.
+func (db DynamoDbRepository) addTasks(ctx context.Context, tasks []AddTaskModel) error {
+	var items []types.TransactWriteItem
+	for _, task := range tasks {
+		item, err := attributevalue.MarshalMap(task)
+		if err != nil {
+			panic(err)
+		}
+		items = append(items, types.TransactWriteItem{Put: &types.Put{
+			TableName: aws.String(DDB_TABLE_TASK), Item: item,
+		}})
+	}
+	_, err := db.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	if err != nil {
+		log.Printf("%s : Couldn't add %v tasks to table. Here's why: %v\n", ctx.Value(logPrefix), len(tasks), err)
+	}
+	return err
+}
+
 func (db DynamoDbRepository) getTaskById(ctx context.Context, taskId string) (AddTaskModel, error) {
 	var err error
 	var response *dynamodb.QueryOutput
@@ -405,9 +544,159 @@ func (db DynamoDbRepository) getTaskById(ctx context.Context, taskId string) (Ad
 			}
 		}
 	}
+
+	if err != nil {
+		return AddTaskModel{}, err
+	}
+
+	if len(movies) == 0 {
+		return AddTaskModel{}, fmt.Errorf("db: no task found for taskId (%v)", taskId)
+	}
+
 	return movies[0], err
 }
 
+// updateTaskChecklist saves items if the checklist is still at version, and
+// returns ErrConcurrentUpdate if it isn't.
+func (db DynamoDbRepository) updateTaskChecklist(ctx context.Context, taskId string, items []TaskChecklistItemModel, version int) error {
+	update := expression.Set(expression.Name("checklistItems"), expression.Value(items)).
+		Set(expression.Name("checklistVersion"), expression.Value(version+1))
+	cond := expression.Name("checklistVersion").Equal(expression.Value(version))
+	if version == 0 {
+		// tasks saved before checklists were versioned
+		cond = cond.Or(expression.AttributeNotExists(expression.Name("checklistVersion")))
+	}
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for update. Here's why: %v\n", err)
+		return err
+	}
+
+	_, err = db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DDB_TABLE_TASK),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: taskId},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+	})
+	var conflict *types.ConditionalCheckFailedException
+	if errors.As(err, &conflict) {
+		return ErrConcurrentUpdate
+	}
+	if err != nil {
+		log.Printf("Couldn't update checklist for task %v. Here's why: %v\n", taskId, err)
+	}
+	return err
+}
+
+func (db DynamoDbRepository) updateTaskDone(ctx context.Context, taskId string, isDone bool, doneAt time.Time) error {
+	update := expression.Set(expression.Name("isDone"), expression.Value(isDone)).Set(expression.Name("doneAt"), expression.Value(doneAt))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for update. Here's why: %v\n", err)
+		return err
+	}
+
+	_, err = db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DDB_TABLE_TASK),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: taskId},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	})
+	if err != nil {
+		log.Printf("Couldn't update done state for task %v. Here's why: %v\n", taskId, err)
+	}
+	return err
+}
+
+func (db DynamoDbRepository) getTasksByAssignee(ctx context.Context, userId string) ([]AddTaskModel, error) {
+	var tasks []AddTaskModel
+	keyEx := expression.Key("assignedTo").Equal(expression.Value(userId))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for query. Here's why: %v\n", err)
+		return nil, err
+	}
+
+	paginator := dynamodb.NewQueryPaginator(db.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(DDB_TABLE_TASK),
+		IndexName:                 aws.String(DDB_INDEX_TASK_ASSIGNEE),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	})
+	for paginator.HasMorePages() {
+		response, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Printf("Couldn't query for tasks assigned to %v. Here's why: %v\n", userId, err)
+			return nil, err
+		}
+
+		var page []AddTaskModel
+		err = attributevalue.UnmarshalListOfMaps(response.Items, &page)
+		if err != nil {
+			log.Printf("Couldn't unmarshal query response. Here's why: %v\n", err)
+			return nil, err
+		}
+		tasks = append(tasks, page...)
+	}
+
+	return tasks, nil
+}
+
+func (db DynamoDbRepository) updateCalendarToken(ctx context.Context, userId string, token string) error {
+	update := expression.Set(expression.Name("calendarToken"), expression.Value(token))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for update. Here's why: %v\n", err)
+		return err
+	}
+
+	_, err = db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DDB_TABLE_USER),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userId},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	})
+	if err != nil {
+		log.Printf("Couldn't update calendar token for user %v. Here's why: %v\n", userId, err)
+	}
+	return err
+}
+
+func (db DynamoDbRepository) updateUserLocale(ctx context.Context, userId string, locale string, localizeOnDevice bool) error {
+	update := expression.Set(expression.Name("locale"), expression.Value(locale)).
+		Set(expression.Name("localizeOnDevice"), expression.Value(localizeOnDevice))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for update. Here's why: %v\n", err)
+		return err
+	}
+
+	_, err = db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DDB_TABLE_USER),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userId},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	})
+	if err != nil {
+		log.Printf("Couldn't update locale for user %v. Here's why: %v\n", userId, err)
+	}
+	return err
+}
+
 func createChatGroupTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
 	if tableExists(d, DDB_TABLE_CHAT_GROUP) {
 		log.Printf("table=%v already exists\n", DDB_TABLE_CHAT_GROUP)
@@ -478,9 +767,56 @@ func (db DynamoDbRepository) getChatGroupById(ctx context.Context, chatId string
 			}
 		}
 	}
+
+	if err != nil {
+		return AddChatGroupModel{}, err
+	}
+
+	if len(movies) == 0 {
+		return AddChatGroupModel{}, fmt.Errorf("db: no chat group found for chatId (%v)", chatId)
+	}
+
 	return movies[0], err
 }
 
+func (db DynamoDbRepository) updateChatGroup(ctx context.Context, cg AddChatGroupModel) error {
+	update := expression.Set(expression.Name("title"), expression.Value(cg.Title)).
+		Set(expression.Name("description"), expression.Value(cg.Description)).
+		Set(expression.Name("avatarUrl"), expression.Value(cg.AvatarUrl)).
+		Set(expression.Name("isArchived"), expression.Value(cg.IsArchived))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for update. Here's why: %v\n", err)
+		return err
+	}
+
+	_, err = db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DDB_TABLE_CHAT_GROUP),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: cg.Id},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	})
+	if err != nil {
+		log.Printf("Couldn't update chat group %v. Here's why: %v\n", cg.Id, err)
+	}
+	return err
+}
+
+func (db DynamoDbRepository) deleteChatGroup(ctx context.Context, chatId string) error {
+	_, err := db.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(DDB_TABLE_CHAT_GROUP), Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: chatId},
+		},
+	})
+	if err != nil {
+		log.Printf("Couldn't delete chat group %v from the table. Here's why: %v\n", chatId, err)
+	}
+	return err
+}
+
 func createChatGroupMemberTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
 	if tableExists(d, DDB_TABLE_CHAT_GROUP_MEMBER) {
 		log.Printf("table=%v already exists\n", DDB_TABLE_CHAT_GROUP_MEMBER)
@@ -533,6 +869,19 @@ func (db DynamoDbRepository) addChatGroupMember(ctx context.Context, m AddChatGr
 	return err
 }
 
+func (db DynamoDbRepository) removeChatGroupMember(ctx context.Context, chatId string, memberUserId string) error {
+	_, err := db.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(DDB_TABLE_CHAT_GROUP_MEMBER), Key: map[string]types.AttributeValue{
+			"chatId":       &types.AttributeValueMemberS{Value: chatId},
+			"memberUserId": &types.AttributeValueMemberS{Value: memberUserId},
+		},
+	})
+	if err != nil {
+		log.Printf("Couldn't delete chat group member %v from the table. Here's why: %v\n", memberUserId, err)
+	}
+	return err
+}
+
 func (db DynamoDbRepository) getChatGroupMembers(ctx context.Context, chatId string) ([]AddChatGroupMemberModel, error) {
 	var err error
 	var response *dynamodb.QueryOutput
@@ -559,3 +908,1521 @@ func (db DynamoDbRepository) getChatGroupMembers(ctx context.Context, chatId str
 	}
 	return movies, err
 }
+
+// getChatGroupIdsByMember returns the ids of the chat groups a user is a
+// member of. The table is keyed by chat, so this scans it.
+func (db DynamoDbRepository) getChatGroupIdsByMember(ctx context.Context, userId string) ([]string, error) {
+	chatIds := make([]string, 0)
+	filtEx := expression.Name("memberUserId").Equal(expression.Value(userId))
+	projEx := expression.NamesList(expression.Name("chatId"))
+	expr, err := expression.NewBuilder().WithFilter(filtEx).WithProjection(projEx).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for scan. Here's why: %v\n", err)
+		return chatIds, err
+	}
+
+	paginator := dynamodb.NewScanPaginator(db.client, &dynamodb.ScanInput{
+		TableName:                 aws.String(DDB_TABLE_CHAT_GROUP_MEMBER),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+	})
+	for paginator.HasMorePages() {
+		response, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Printf("Couldn't scan for chat groups of %v. Here's why: %v\n", userId, err)
+			return chatIds, err
+		}
+
+		var members []AddChatGroupMemberModel
+		if err := attributevalue.UnmarshalListOfMaps(response.Items, &members); err != nil {
+			log.Printf("Couldn't unmarshal scan response. Here's why: %v\n", err)
+			return chatIds, err
+		}
+		for _, m := range members {
+			chatIds = append(chatIds, m.ChatId)
+		}
+	}
+	return chatIds, nil
+}
+
+func createTaskTemplateTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
+	if tableExists(d, DDB_TABLE_TASK_TEMPLATE) {
+		log.Printf("table=%v already exists\n", DDB_TABLE_TASK_TEMPLATE)
+		return nil, nil
+	}
+	var tableDesc *types.TableDescription
+	table, err := d.CreateTable(ctx, &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("chatId"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}, {
+			AttributeName: aws.String("id"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("chatId"),
+			KeyType:       types.KeyTypeHash,
+		}, {
+			AttributeName: aws.String("id"),
+			KeyType:       types.KeyTypeRange,
+		}},
+		TableName:   aws.String(DDB_TABLE_TASK_TEMPLATE),
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		log.Printf("Couldn't create table %v. Here's why: %v\n", DDB_TABLE_TASK_TEMPLATE, err)
+	} else {
+		waiter := dynamodb.NewTableExistsWaiter(d)
+		err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(DDB_TABLE_TASK_TEMPLATE)}, 5*time.Minute)
+		if err != nil {
+			log.Printf("Wait for table exists failed. Here's why: %v\n", err)
+		}
+		tableDesc = table.TableDescription
+	}
+	return tableDesc, err
+}
+
+func (db DynamoDbRepository) addTaskTemplate(ctx context.Context, t AddTaskTemplateModel) error {
+	item, err := attributevalue.MarshalMap(t)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(DDB_TABLE_TASK_TEMPLATE), Item: item,
+	})
+	if err != nil {
+		log.Printf("Couldn't add task template to table. Here's why: %v\n", err)
+	}
+	return err
+}
+
+func (db DynamoDbRepository) getTaskTemplates(ctx context.Context, chatId string) ([]AddTaskTemplateModel, error) {
+	var err error
+	var response *dynamodb.QueryOutput
+	var templates []AddTaskTemplateModel
+	keyEx := expression.Key("chatId").Equal(expression.Value(chatId))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for query. Here's why: %v\n", err)
+	} else {
+		response, err = db.client.Query(ctx, &dynamodb.QueryInput{
+			TableName:                 aws.String(DDB_TABLE_TASK_TEMPLATE),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+			KeyConditionExpression:    expr.KeyCondition(),
+		})
+		if err != nil {
+			log.Printf("Couldn't query for task templates in chat group (%v). Here's why: %v\n", chatId, err)
+		} else {
+			err = attributevalue.UnmarshalListOfMaps(response.Items, &templates)
+			if err != nil {
+				log.Printf("Couldn't unmarshal query response. Here's why: %v\n", err)
+			}
+		}
+	}
+	return templates, err
+}
+
+func (db DynamoDbRepository) getTaskTemplateById(ctx context.Context, chatId string, templateId string) (AddTaskTemplateModel, error) {
+	var err error
+	var response *dynamodb.QueryOutput
+	var templates []AddTaskTemplateModel
+	keyEx := expression.KeyAnd(expression.Key("chatId").Equal(expression.Value(chatId)), expression.Key("id").Equal(expression.Value(templateId)))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for query. Here's why: %v\n", err)
+	} else {
+		response, err = db.client.Query(ctx, &dynamodb.QueryInput{
+			TableName:                 aws.String(DDB_TABLE_TASK_TEMPLATE),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+			KeyConditionExpression:    expr.KeyCondition(),
+		})
+		if err != nil {
+			log.Printf("Couldn't query for task template %v. Here's why: %v\n", templateId, err)
+		} else {
+			err = attributevalue.UnmarshalListOfMaps(response.Items, &templates)
+			if err != nil {
+				log.Printf("Couldn't unmarshal query response. Here's why: %v\n", err)
+			}
+		}
+	}
+
+	if err != nil {
+		return AddTaskTemplateModel{}, err
+	}
+
+	if len(templates) == 0 {
+		return AddTaskTemplateModel{}, fmt.Errorf("db: no task template found for chatId (%v) and templateId (%v)", chatId, templateId)
+	}
+
+	return templates[0], nil
+}
+
+func createTaskEventTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
+	if tableExists(d, DDB_TABLE_TASK_EVENT) {
+		log.Printf("table=%v already exists\n", DDB_TABLE_TASK_EVENT)
+		return nil, nil
+	}
+	var tableDesc *types.TableDescription
+	table, err := d.CreateTable(ctx, &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("chatId"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}, {
+			AttributeName: aws.String("id"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("chatId"),
+			KeyType:       types.KeyTypeHash,
+		}, {
+			AttributeName: aws.String("id"),
+			KeyType:       types.KeyTypeRange,
+		}},
+		TableName:   aws.String(DDB_TABLE_TASK_EVENT),
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		log.Printf("Couldn't create table %v. Here's why: %v\n", DDB_TABLE_TASK_EVENT, err)
+	} else {
+		waiter := dynamodb.NewTableExistsWaiter(d)
+		err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(DDB_TABLE_TASK_EVENT)}, 5*time.Minute)
+		if err != nil {
+			log.Printf("Wait for table exists failed. Here's why: %v\n", err)
+		}
+		tableDesc = table.TableDescription
+	}
+	return tableDesc, err
+}
+
+func (db DynamoDbRepository) addTaskEvent(ctx context.Context, e TaskEventModel) error {
+	item, err := attributevalue.MarshalMap(e)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(DDB_TABLE_TASK_EVENT), Item: item,
+	})
+	if err != nil {
+		log.Printf("Couldn't add task event to table. Here's why: %v\n", err)
+	}
+	return err
+}
+
+// getTaskEvents returns the events of a chat group with a timestamp in about
+// [from, to). Timestamps are RFC 3339 strings without trailing zeros, so the
+// bounds are widened by a second and callers filter the exact window.
+func (db DynamoDbRepository) getTaskEvents(ctx context.Context, chatId string, from time.Time, to time.Time) ([]TaskEventModel, error) {
+	var events []TaskEventModel
+	keyEx := expression.Key("chatId").Equal(expression.Value(chatId)).
+		And(expression.Key("timestamp").Between(
+			expression.Value(from.UTC().Add(-time.Second).Format(time.RFC3339)),
+			expression.Value(to.UTC().Add(time.Second).Format(time.RFC3339))))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for query. Here's why: %v\n", err)
+		return nil, err
+	}
+
+	paginator := dynamodb.NewQueryPaginator(db.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(DDB_TABLE_TASK_EVENT),
+		IndexName:                 aws.String(DDB_INDEX_TASK_EVENT_TIME),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	})
+	for paginator.HasMorePages() {
+		response, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Printf("Couldn't query for task events in chat group (%v). Here's why: %v\n", chatId, err)
+			return nil, err
+		}
+
+		var page []TaskEventModel
+		err = attributevalue.UnmarshalListOfMaps(response.Items, &page)
+		if err != nil {
+			log.Printf("Couldn't unmarshal query response. Here's why: %v\n", err)
+			return nil, err
+		}
+		events = append(events, page...)
+	}
+
+	return events, nil
+}
+
+func createChatMessageTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
+	if tableExists(d, DDB_TABLE_CHAT_MESSAGE) {
+		log.Printf("table=%v already exists\n", DDB_TABLE_CHAT_MESSAGE)
+		return nil, nil
+	}
+	var tableDesc *types.TableDescription
+	table, err := d.CreateTable(ctx, &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("chatId"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}, {
+			AttributeName: aws.String("id"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("chatId"),
+			KeyType:       types.KeyTypeHash,
+		}, {
+			AttributeName: aws.String("id"),
+			KeyType:       types.KeyTypeRange,
+		}},
+		TableName:   aws.String(DDB_TABLE_CHAT_MESSAGE),
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		log.Printf("Couldn't create table %v. Here's why: %v\n", DDB_TABLE_CHAT_MESSAGE, err)
+	} else {
+		waiter := dynamodb.NewTableExistsWaiter(d)
+		err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(DDB_TABLE_CHAT_MESSAGE)}, 5*time.Minute)
+		if err != nil {
+			log.Printf("Wait for table exists failed. Here's why: %v\n", err)
+		}
+		tableDesc = table.TableDescription
+	}
+	return tableDesc, err
+}
+
+func (db DynamoDbRepository) addChatMessage(ctx context.Context, m AddChatMessageModel) error {
+	item, err := attributevalue.MarshalMap(m)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(DDB_TABLE_CHAT_MESSAGE), Item: item,
+	})
+	if err != nil {
+		log.Printf("Couldn't add chat message to table. Here's why: %v\n", err)
+	}
+	return err
+}
+
+func (db DynamoDbRepository) getChatMessageById(ctx context.Context, chatId string, messageId string) (AddChatMessageModel, error) {
+	response, err := db.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(DDB_TABLE_CHAT_MESSAGE), Key: map[string]types.AttributeValue{
+			"chatId": &types.AttributeValueMemberS{Value: chatId},
+			"id":     &types.AttributeValueMemberS{Value: messageId},
+		},
+	})
+	if err != nil {
+		log.Printf("Couldn't get chat message %v. Here's why: %v\n", messageId, err)
+		return AddChatMessageModel{}, err
+	}
+
+	if response.Item == nil {
+		return AddChatMessageModel{}, fmt.Errorf("db: no chat message found for chatId (%v) and messageId (%v)", chatId, messageId)
+	}
+
+	var m AddChatMessageModel
+	err = attributevalue.UnmarshalMap(response.Item, &m)
+	if err != nil {
+		log.Printf("Couldn't unmarshal chat message. Here's why: %v\n", err)
+	}
+	return m, err
+}
+
+func (db DynamoDbRepository) updateChatMessage(ctx context.Context, m AddChatMessageModel) error {
+	update := expression.Set(expression.Name("message"), expression.Value(m.Message)).
+		Set(expression.Name("editedAt"), expression.Value(m.EditedAt)).
+		Set(expression.Name("isDeleted"), expression.Value(m.IsDeleted))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for update. Here's why: %v\n", err)
+		return err
+	}
+
+	_, err = db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DDB_TABLE_CHAT_MESSAGE),
+		Key: map[string]types.AttributeValue{
+			"chatId": &types.AttributeValueMemberS{Value: m.ChatId},
+			"id":     &types.AttributeValueMemberS{Value: m.Id},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	})
+	if err != nil {
+		log.Printf("Couldn't update chat message %v. Here's why: %v\n", m.Id, err)
+	}
+	return err
+}
+
+func (db DynamoDbRepository) updateChatMessageLinkPreviews(ctx context.Context, chatId string, messageId string, previews []LinkPreviewModel) error {
+	update := expression.Set(expression.Name("linkPreviews"), expression.Value(previews))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for update. Here's why: %v\n", err)
+		return err
+	}
+
+	_, err = db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DDB_TABLE_CHAT_MESSAGE),
+		Key: map[string]types.AttributeValue{
+			"chatId": &types.AttributeValueMemberS{Value: chatId},
+			"id":     &types.AttributeValueMemberS{Value: messageId},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	})
+	if err != nil {
+		log.Printf("Couldn't update link previews of chat message %v. Here's why: %v\n", messageId, err)
+	}
+	return err
+}
+
+// addChatMessageReply counts a reply on the parent message and remembers it
+// as the latest one.
+func (db DynamoDbRepository) addChatMessageReply(ctx context.Context, chatId string, parentId string, replyId string, repliedAt time.Time) error {
+	update := expression.Add(expression.Name("replyCount"), expression.Value(1)).
+		Set(expression.Name("latestReplyMessageId"), expression.Value(replyId)).
+		Set(expression.Name("latestReplyAt"), expression.Value(repliedAt))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for update. Here's why: %v\n", err)
+		return err
+	}
+
+	_, err = db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DDB_TABLE_CHAT_MESSAGE),
+		Key: map[string]types.AttributeValue{
+			"chatId": &types.AttributeValueMemberS{Value: chatId},
+			"id":     &types.AttributeValueMemberS{Value: parentId},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	})
+	if err != nil {
+		log.Printf("Couldn't add reply to chat message %v. Here's why: %v\n", parentId, err)
+	}
+	return err
+}
+
+// removeChatMessageReply uncounts a deleted reply on the parent message. The
+// count is decremented in place, so concurrent replies aren't lost.
+func (db DynamoDbRepository) removeChatMessageReply(ctx context.Context, chatId string, parentId string) error {
+	_, err := db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DDB_TABLE_CHAT_MESSAGE),
+		Key: map[string]types.AttributeValue{
+			"chatId": &types.AttributeValueMemberS{Value: chatId},
+			"id":     &types.AttributeValueMemberS{Value: parentId},
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":minusOne": &types.AttributeValueMemberN{Value: "-1"},
+			":zero":     &types.AttributeValueMemberN{Value: "0"},
+		},
+		ConditionExpression: aws.String("replyCount > :zero"),
+		UpdateExpression:    aws.String("ADD replyCount :minusOne"),
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		// the parent is gone or has no replies counted
+		return nil
+	}
+	if err != nil {
+		log.Printf("Couldn't remove reply from chat message %v. Here's why: %v\n", parentId, err)
+	}
+	return err
+}
+
+// getChatMessageReplies returns up to limit replies to parentId with ids
+// after the id after, and the id to continue after if there may be more.
+func (db DynamoDbRepository) getChatMessageReplies(ctx context.Context, chatId string, parentId string, after string, limit int32) ([]AddChatMessageModel, string, error) {
+	keyEx := expression.Key("replyToMessageId").Equal(expression.Value(parentId))
+	if after != "" {
+		keyEx = keyEx.And(expression.Key("id").GreaterThan(expression.Value(after)))
+	}
+	// parent ids come from clients and aren't unique across chats
+	filt := expression.Name("chatId").Equal(expression.Value(chatId))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithFilter(filt).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for query. Here's why: %v\n", err)
+		return nil, "", err
+	}
+
+	response, err := db.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(DDB_TABLE_CHAT_MESSAGE),
+		IndexName:                 aws.String(DDB_INDEX_CHAT_REPLY),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		Limit:                     aws.Int32(limit),
+	})
+	if err != nil {
+		log.Printf("Couldn't query for replies to chat message (%v). Here's why: %v\n", parentId, err)
+		return nil, "", err
+	}
+
+	var replies []AddChatMessageModel
+	err = attributevalue.UnmarshalListOfMaps(response.Items, &replies)
+	if err != nil {
+		log.Printf("Couldn't unmarshal query response. Here's why: %v\n", err)
+		return nil, "", err
+	}
+
+	var next string
+	if id, ok := response.LastEvaluatedKey["id"].(*types.AttributeValueMemberS); ok {
+		next = id.Value
+	}
+
+	return replies, next, nil
+}
+
+func createReactionTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
+	if tableExists(d, DDB_TABLE_REACTION) {
+		log.Printf("table=%v already exists\n", DDB_TABLE_REACTION)
+		return nil, nil
+	}
+	var tableDesc *types.TableDescription
+	table, err := d.CreateTable(ctx, &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("targetId"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}, {
+			AttributeName: aws.String("id"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("targetId"),
+			KeyType:       types.KeyTypeHash,
+		}, {
+			AttributeName: aws.String("id"),
+			KeyType:       types.KeyTypeRange,
+		}},
+		TableName:   aws.String(DDB_TABLE_REACTION),
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		log.Printf("Couldn't create table %v. Here's why: %v\n", DDB_TABLE_REACTION, err)
+	} else {
+		waiter := dynamodb.NewTableExistsWaiter(d)
+		err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(DDB_TABLE_REACTION)}, 5*time.Minute)
+		if err != nil {
+			log.Printf("Wait for table exists failed. Here's why: %v\n", err)
+		}
+		tableDesc = table.TableDescription
+	}
+	return tableDesc, err
+}
+
+// addReaction stores r. It returns false if the user had reacted with the
+// emoji already.
+func (db DynamoDbRepository) addReaction(ctx context.Context, r ReactionModel) (bool, error) {
+	item, err := attributevalue.MarshalMap(r)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(DDB_TABLE_REACTION), Item: item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return false, nil
+	}
+	if err != nil {
+		log.Printf("Couldn't add reaction to table. Here's why: %v\n", err)
+		return false, err
+	}
+	return true, nil
+}
+
+// removeReaction deletes a reaction. It returns false if there was none.
+func (db DynamoDbRepository) removeReaction(ctx context.Context, targetId string, id string) (bool, error) {
+	response, err := db.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(DDB_TABLE_REACTION), Key: map[string]types.AttributeValue{
+			"targetId": &types.AttributeValueMemberS{Value: targetId},
+			"id":       &types.AttributeValueMemberS{Value: id},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		log.Printf("Couldn't delete reaction %v from the table. Here's why: %v\n", id, err)
+		return false, err
+	}
+	return len(response.Attributes) > 0, nil
+}
+
+// reactionTargetKey returns the table and key of a reaction target.
+func reactionTargetKey(targetType ReactionTargetType, chatId string, targetId string) (string, map[string]types.AttributeValue) {
+	if targetType == ReactionTargetTask {
+		return DDB_TABLE_TASK, map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: targetId},
+		}
+	}
+
+	table := DDB_TABLE_CHAT_MESSAGE
+	if targetType == ReactionTargetTaskEvent {
+		table = DDB_TABLE_TASK_EVENT
+	}
+	return table, map[string]types.AttributeValue{
+		"chatId": &types.AttributeValueMemberS{Value: chatId},
+		"id":     &types.AttributeValueMemberS{Value: targetId},
+	}
+}
+
+// addReactionCount adds delta to the count of emoji on the reaction target
+// and returns the counts after the change. The count is added in place, so
+// concurrent reactions don't overwrite each other. Targets that don't exist
+// (anymore) are left alone.
+func (db DynamoDbRepository) addReactionCount(ctx context.Context, targetType ReactionTargetType, chatId string, targetId string, emoji string, delta int) (map[string]int, error) {
+	table, key := reactionTargetKey(targetType, chatId, targetId)
+
+	add := func() (*dynamodb.UpdateItemOutput, error) {
+		return db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                aws.String(table),
+			Key:                      key,
+			ExpressionAttributeNames: map[string]string{"#emoji": emoji},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":delta": &types.AttributeValueMemberN{Value: strconv.Itoa(delta)},
+			},
+			ConditionExpression: aws.String("attribute_exists(id) AND attribute_exists(reactionCounts)"),
+			UpdateExpression:    aws.String("ADD reactionCounts.#emoji :delta"),
+			ReturnValues:        types.ReturnValueAllNew,
+		})
+	}
+
+	response, err := add()
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		// the first reaction to the target, counts can only be added to an
+		// existing map
+		_, err = db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(table),
+			Key:       key,
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":empty": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{}},
+			},
+			ConditionExpression: aws.String("attribute_exists(id)"),
+			UpdateExpression:    aws.String("SET reactionCounts = if_not_exists(reactionCounts, :empty)"),
+		})
+		if errors.As(err, &ccf) {
+			return nil, nil
+		}
+		if err == nil {
+			response, err = add()
+		}
+	}
+	if err != nil {
+		log.Printf("Couldn't update reaction counts of %v. Here's why: %v\n", targetId, err)
+		return nil, err
+	}
+
+	var target struct {
+		ReactionCounts map[string]int `dynamodbav:"reactionCounts"`
+	}
+	if err := attributevalue.UnmarshalMap(response.Attributes, &target); err != nil {
+		log.Printf("Couldn't unmarshal reaction counts of %v. Here's why: %v\n", targetId, err)
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for e, n := range target.ReactionCounts {
+		if n > 0 {
+			counts[e] = n
+		}
+	}
+
+	if delta < 0 && target.ReactionCounts[emoji] <= 0 {
+		// drop the emoji unless somebody reacted with it in the meantime
+		_, err = db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                aws.String(table),
+			Key:                      key,
+			ExpressionAttributeNames: map[string]string{"#emoji": emoji},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":zero": &types.AttributeValueMemberN{Value: "0"},
+			},
+			ConditionExpression: aws.String("reactionCounts.#emoji <= :zero"),
+			UpdateExpression:    aws.String("REMOVE reactionCounts.#emoji"),
+		})
+		if err != nil && !errors.As(err, &ccf) {
+			log.Printf("Couldn't remove reaction count %v of %v. Here's why: %v\n", emoji, targetId, err)
+		}
+	}
+
+	return counts, nil
+}
+
+func createMentionTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
+	if tableExists(d, DDB_TABLE_MENTION) {
+		log.Printf("table=%v already exists\n", DDB_TABLE_MENTION)
+		return nil, nil
+	}
+	var tableDesc *types.TableDescription
+	table, err := d.CreateTable(ctx, &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("userId"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}, {
+			AttributeName: aws.String("id"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("userId"),
+			KeyType:       types.KeyTypeHash,
+		}, {
+			AttributeName: aws.String("id"),
+			KeyType:       types.KeyTypeRange,
+		}},
+		TableName:   aws.String(DDB_TABLE_MENTION),
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		log.Printf("Couldn't create table %v. Here's why: %v\n", DDB_TABLE_MENTION, err)
+	} else {
+		waiter := dynamodb.NewTableExistsWaiter(d)
+		err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(DDB_TABLE_MENTION)}, 5*time.Minute)
+		if err != nil {
+			log.Printf("Wait for table exists failed. Here's why: %v\n", err)
+		}
+		tableDesc = table.TableDescription
+	}
+	return tableDesc, err
+}
+
+func (db DynamoDbRepository) addMention(ctx context.Context, m MentionModel) error {
+	item, err := attributevalue.MarshalMap(m)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(DDB_TABLE_MENTION), Item: item,
+	})
+	if err != nil {
+		log.Printf("Couldn't add mention to table. Here's why: %v\n", err)
+	}
+	return err
+}
+
+// getMentions returns the latest mentions of a user, newest first. Mention
+// ids are time ordered.
+func (db DynamoDbRepository) getMentions(ctx context.Context, userId string, limit int32) ([]MentionModel, error) {
+	var mentions []MentionModel
+	keyEx := expression.Key("userId").Equal(expression.Value(userId))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for query. Here's why: %v\n", err)
+		return nil, err
+	}
+
+	response, err := db.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(DDB_TABLE_MENTION),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int32(limit),
+	})
+	if err != nil {
+		log.Printf("Couldn't query for mentions of %v. Here's why: %v\n", userId, err)
+		return nil, err
+	}
+
+	err = attributevalue.UnmarshalListOfMaps(response.Items, &mentions)
+	if err != nil {
+		log.Printf("Couldn't unmarshal query response. Here's why: %v\n", err)
+	}
+	return mentions, err
+}
+
+func createAttachmentTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
+	if tableExists(d, DDB_TABLE_ATTACHMENT) {
+		log.Printf("table=%v already exists\n", DDB_TABLE_ATTACHMENT)
+		return nil, nil
+	}
+	var tableDesc *types.TableDescription
+	table, err := d.CreateTable(ctx, &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("id"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("id"),
+			KeyType:       types.KeyTypeHash,
+		}},
+		TableName:   aws.String(DDB_TABLE_ATTACHMENT),
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		log.Printf("Couldn't create table %v. Here's why: %v\n", DDB_TABLE_ATTACHMENT, err)
+	} else {
+		waiter := dynamodb.NewTableExistsWaiter(d)
+		err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(DDB_TABLE_ATTACHMENT)}, 5*time.Minute)
+		if err != nil {
+			log.Printf("Wait for table exists failed. Here's why: %v\n", err)
+		}
+		tableDesc = table.TableDescription
+	}
+	return tableDesc, err
+}
+
+func (db DynamoDbRepository) addAttachment(ctx context.Context, a AttachmentModel) error {
+	item, err := attributevalue.MarshalMap(a)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(DDB_TABLE_ATTACHMENT), Item: item,
+	})
+	if err != nil {
+		log.Printf("Couldn't add attachment to table. Here's why: %v\n", err)
+	}
+	return err
+}
+
+func (db DynamoDbRepository) getAttachmentById(ctx context.Context, attachmentId string) (AttachmentModel, error) {
+	response, err := db.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(DDB_TABLE_ATTACHMENT), Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: attachmentId},
+		},
+	})
+	if err != nil {
+		log.Printf("Couldn't get attachment %v. Here's why: %v\n", attachmentId, err)
+		return AttachmentModel{}, err
+	}
+
+	if response.Item == nil {
+		return AttachmentModel{}, fmt.Errorf("db: no attachment found for attachmentId (%v)", attachmentId)
+	}
+
+	var a AttachmentModel
+	err = attributevalue.UnmarshalMap(response.Item, &a)
+	if err != nil {
+		log.Printf("Couldn't unmarshal attachment. Here's why: %v\n", err)
+	}
+	return a, err
+}
+
+// updateAttachmentUpload records an uploaded chunk, provided nothing else was
+// uploaded since offset.
+func (db DynamoDbRepository) updateAttachmentUpload(ctx context.Context, attachmentId string, offset int64, uploadedBytes int64, chunks int) error {
+	update := expression.Set(expression.Name("uploadedBytes"), expression.Value(uploadedBytes)).
+		Set(expression.Name("chunks"), expression.Value(chunks))
+	cond := expression.Name("uploadedBytes").Equal(expression.Value(offset))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for update. Here's why: %v\n", err)
+		return err
+	}
+
+	_, err = db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DDB_TABLE_ATTACHMENT),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: attachmentId},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConditionExpression:       expr.Condition(),
+		UpdateExpression:          expr.Update(),
+	})
+	if err != nil {
+		log.Printf("Couldn't update upload of attachment %v. Here's why: %v\n", attachmentId, err)
+	}
+	return err
+}
+
+func createNotificationPreferencesTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
+	if tableExists(d, DDB_TABLE_NOTIFICATION_PREFERENCES) {
+		log.Printf("table=%v already exists\n", DDB_TABLE_NOTIFICATION_PREFERENCES)
+		return nil, nil
+	}
+	var tableDesc *types.TableDescription
+	table, err := d.CreateTable(ctx, &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("userId"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("userId"),
+			KeyType:       types.KeyTypeHash,
+		}},
+		TableName:   aws.String(DDB_TABLE_NOTIFICATION_PREFERENCES),
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		log.Printf("Couldn't create table %v. Here's why: %v\n", DDB_TABLE_NOTIFICATION_PREFERENCES, err)
+	} else {
+		waiter := dynamodb.NewTableExistsWaiter(d)
+		err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(DDB_TABLE_NOTIFICATION_PREFERENCES)}, 5*time.Minute)
+		if err != nil {
+			log.Printf("Wait for table exists failed. Here's why: %v\n", err)
+		}
+		tableDesc = table.TableDescription
+	}
+	return tableDesc, err
+}
+
+func (db DynamoDbRepository) putNotificationPreferences(ctx context.Context, p NotificationPreferencesModel) error {
+	item, err := attributevalue.MarshalMap(p)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(DDB_TABLE_NOTIFICATION_PREFERENCES), Item: item,
+	})
+	if err != nil {
+		log.Printf("Couldn't add notification preferences to table. Here's why: %v\n", err)
+	}
+	return err
+}
+
+// getEmailDigestSubscribers returns the preferences of users with the email
+// digest enabled.
+func (db DynamoDbRepository) getEmailDigestSubscribers(ctx context.Context) ([]NotificationPreferencesModel, error) {
+	var subscribers []NotificationPreferencesModel
+	filtEx := expression.Name("emailDigest.isEnabled").Equal(expression.Value(true))
+	expr, err := expression.NewBuilder().WithFilter(filtEx).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for scan. Here's why: %v\n", err)
+		return nil, err
+	}
+
+	paginator := dynamodb.NewScanPaginator(db.client, &dynamodb.ScanInput{
+		TableName:                 aws.String(DDB_TABLE_NOTIFICATION_PREFERENCES),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+	})
+	for paginator.HasMorePages() {
+		response, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Printf("Couldn't scan for email digest subscribers. Here's why: %v\n", err)
+			return nil, err
+		}
+
+		var page []NotificationPreferencesModel
+		err = attributevalue.UnmarshalListOfMaps(response.Items, &page)
+		if err != nil {
+			log.Printf("Couldn't unmarshal scan response. Here's why: %v\n", err)
+			return nil, err
+		}
+		subscribers = append(subscribers, page...)
+	}
+
+	return subscribers, nil
+}
+
+func (db DynamoDbRepository) updateEmailDigestSentAt(ctx context.Context, userId string, sentAt time.Time) error {
+	update := expression.Set(expression.Name("emailDigest.lastSentAt"), expression.Value(sentAt))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for update. Here's why: %v\n", err)
+		return err
+	}
+
+	_, err = db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DDB_TABLE_NOTIFICATION_PREFERENCES),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userId},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	})
+	if err != nil {
+		log.Printf("Couldn't update email digest of user %v. Here's why: %v\n", userId, err)
+	}
+	return err
+}
+
+// getNotificationPreferences returns the defaults for users who never saved
+// their preferences.
+func (db DynamoDbRepository) getNotificationPreferences(ctx context.Context, userId string) (NotificationPreferencesModel, error) {
+	p := NotificationPreferencesModel{UserId: userId}
+	response, err := db.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(DDB_TABLE_NOTIFICATION_PREFERENCES), Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userId},
+		},
+	})
+	if err != nil {
+		log.Printf("Couldn't get notification preferences of %v. Here's why: %v\n", userId, err)
+		return p, err
+	}
+
+	if response.Item == nil {
+		return p, nil
+	}
+
+	err = attributevalue.UnmarshalMap(response.Item, &p)
+	if err != nil {
+		log.Printf("Couldn't unmarshal notification preferences. Here's why: %v\n", err)
+	}
+	return p, err
+}
+
+func createUnreadTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
+	if tableExists(d, DDB_TABLE_UNREAD) {
+		log.Printf("table=%v already exists\n", DDB_TABLE_UNREAD)
+		return nil, enableTimeToLive(ctx, d, DDB_TABLE_UNREAD)
+	}
+	var tableDesc *types.TableDescription
+	table, err := d.CreateTable(ctx, &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("userId"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}, {
+			AttributeName: aws.String("id"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("userId"),
+			KeyType:       types.KeyTypeHash,
+		}, {
+			AttributeName: aws.String("id"),
+			KeyType:       types.KeyTypeRange,
+		}},
+		TableName:   aws.String(DDB_TABLE_UNREAD),
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		log.Printf("Couldn't create table %v. Here's why: %v\n", DDB_TABLE_UNREAD, err)
+		return nil, err
+	}
+	waiter := dynamodb.NewTableExistsWaiter(d)
+	err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(DDB_TABLE_UNREAD)}, 5*time.Minute)
+	if err != nil {
+		log.Printf("Wait for table exists failed. Here's why: %v\n", err)
+		return nil, err
+	}
+	tableDesc = table.TableDescription
+
+	// acked items are deleted once they pass expiresAt
+	return tableDesc, enableTimeToLive(ctx, d, DDB_TABLE_UNREAD)
+}
+
+// enableTimeToLive makes DynamoDB delete the items of table once they pass
+// expiresAt, unless it does already.
+func enableTimeToLive(ctx context.Context, d *dynamodb.Client, table string) error {
+	ttl, err := d.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(table)})
+	if err != nil {
+		log.Printf("Couldn't describe time to live of %v. Here's why: %v\n", table, err)
+		return err
+	}
+	if s := ttl.TimeToLiveDescription; s != nil && (s.TimeToLiveStatus == types.TimeToLiveStatusEnabled || s.TimeToLiveStatus == types.TimeToLiveStatusEnabling) {
+		return nil
+	}
+
+	_, err = d.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(table),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String("expiresAt"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		log.Printf("Couldn't enable time to live on %v. Here's why: %v\n", table, err)
+	}
+	return err
+}
+
+// addUnread counts u as unread, unless the message was counted or acked
+// before.
+func (db DynamoDbRepository) addUnread(ctx context.Context, u UnreadModel) error {
+	item, err := attributevalue.MarshalMap(u)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(DDB_TABLE_UNREAD),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Couldn't add unread message to table. Here's why: %v\n", err)
+	}
+	return err
+}
+
+// setUnreadAcked replaces the unread item of a received message with the
+// acked one u.
+func (db DynamoDbRepository) setUnreadAcked(ctx context.Context, u UnreadModel) error {
+	item, err := attributevalue.MarshalMap(u)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(DDB_TABLE_UNREAD), Item: item,
+	})
+	if err != nil {
+		log.Printf("Couldn't mark unread message %v as acked. Here's why: %v\n", u.Id, err)
+	}
+	return err
+}
+
+func (db DynamoDbRepository) removeUnread(ctx context.Context, userId string, id string) error {
+	_, err := db.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(DDB_TABLE_UNREAD), Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userId},
+			"id":     &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		log.Printf("Couldn't delete unread message %v from the table. Here's why: %v\n", id, err)
+	}
+	return err
+}
+
+func (db DynamoDbRepository) getUnread(ctx context.Context, userId string) ([]UnreadModel, error) {
+	var items []UnreadModel
+	keyEx := expression.Key("userId").Equal(expression.Value(userId))
+	// acked messages were read in the app
+	filt := expression.AttributeNotExists(expression.Name("acked"))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithFilter(filt).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for query. Here's why: %v\n", err)
+		return nil, err
+	}
+
+	paginator := dynamodb.NewQueryPaginator(db.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(DDB_TABLE_UNREAD),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+	})
+	for paginator.HasMorePages() {
+		response, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Printf("Couldn't query for unread messages of %v. Here's why: %v\n", userId, err)
+			return nil, err
+		}
+
+		var page []UnreadModel
+		err = attributevalue.UnmarshalListOfMaps(response.Items, &page)
+		if err != nil {
+			log.Printf("Couldn't unmarshal query response. Here's why: %v\n", err)
+			return nil, err
+		}
+		items = append(items, page...)
+	}
+
+	return items, nil
+}
+
+func createNotificationLogTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
+	if tableExists(d, DDB_TABLE_NOTIFICATION_LOG) {
+		log.Printf("table=%v already exists\n", DDB_TABLE_NOTIFICATION_LOG)
+		return nil, nil
+	}
+	var tableDesc *types.TableDescription
+	table, err := d.CreateTable(ctx, &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("userId"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}, {
+			AttributeName: aws.String("id"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("userId"),
+			KeyType:       types.KeyTypeHash,
+		}, {
+			AttributeName: aws.String("id"),
+			KeyType:       types.KeyTypeRange,
+		}},
+		TableName:   aws.String(DDB_TABLE_NOTIFICATION_LOG),
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		log.Printf("Couldn't create table %v. Here's why: %v\n", DDB_TABLE_NOTIFICATION_LOG, err)
+		return nil, err
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(d)
+	err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(DDB_TABLE_NOTIFICATION_LOG)}, 5*time.Minute)
+	if err != nil {
+		log.Printf("Wait for table exists failed. Here's why: %v\n", err)
+		return nil, err
+	}
+	tableDesc = table.TableDescription
+
+	// entries are deleted once they pass expiresAt
+	_, err = d.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(DDB_TABLE_NOTIFICATION_LOG),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String("expiresAt"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		log.Printf("Couldn't enable time to live on %v. Here's why: %v\n", DDB_TABLE_NOTIFICATION_LOG, err)
+	}
+	return tableDesc, err
+}
+
+func (db DynamoDbRepository) addNotificationLog(ctx context.Context, e NotificationLogModel) error {
+	item, err := attributevalue.MarshalMap(e)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(DDB_TABLE_NOTIFICATION_LOG), Item: item,
+	})
+	if err != nil {
+		log.Printf("Couldn't add notification log entry to table. Here's why: %v\n", err)
+	}
+	return err
+}
+
+// getNotificationLog returns up to limit entries of userId, newest first, or
+// of message mid. Without userId all entries of the message are scanned for.
+// Expired entries DynamoDB hasn't deleted yet are left out.
+// getNotificationLog returns the newest entries of userId, or of message mid
+// when there is no userId, from the messageId index.
+func (db DynamoDbRepository) getNotificationLog(ctx context.Context, userId string, mid string, limit int) ([]NotificationLogModel, error) {
+	var entries []NotificationLogModel
+	filtEx := expression.Name("expiresAt").GreaterThan(expression.Value(time.Now().Unix()))
+	keyEx := expression.Key("messageId").Equal(expression.Value(mid))
+	var index *string
+	if userId != "" {
+		keyEx = expression.Key("userId").Equal(expression.Value(userId))
+		if mid != "" {
+			filtEx = filtEx.And(expression.Name("messageId").Equal(expression.Value(mid)))
+		}
+	} else {
+		index = aws.String(DDB_INDEX_NOTIFICATION_LOG_MESSAGE)
+	}
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).WithFilter(filtEx).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for query. Here's why: %v\n", err)
+		return nil, err
+	}
+
+	paginator := dynamodb.NewQueryPaginator(db.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(DDB_TABLE_NOTIFICATION_LOG),
+		IndexName:                 index,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ScanIndexForward:          aws.Bool(false),
+	})
+	for paginator.HasMorePages() && len(entries) < limit {
+		response, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Printf("Couldn't query for notification log of %v%v. Here's why: %v\n", userId, mid, err)
+			return nil, err
+		}
+
+		var page []NotificationLogModel
+		err = attributevalue.UnmarshalListOfMaps(response.Items, &page)
+		if err != nil {
+			log.Printf("Couldn't unmarshal query response. Here's why: %v\n", err)
+			return nil, err
+		}
+		entries = append(entries, page...)
+	}
+
+	return entries, nil
+}
+
+func createNotificationJobTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
+	if tableExists(d, DDB_TABLE_NOTIFICATION_JOB) {
+		log.Printf("table=%v already exists\n", DDB_TABLE_NOTIFICATION_JOB)
+		return nil, nil
+	}
+	var tableDesc *types.TableDescription
+	table, err := d.CreateTable(ctx, &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("id"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("id"),
+			KeyType:       types.KeyTypeHash,
+		}},
+		TableName:   aws.String(DDB_TABLE_NOTIFICATION_JOB),
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		log.Printf("Couldn't create table %v. Here's why: %v\n", DDB_TABLE_NOTIFICATION_JOB, err)
+	} else {
+		waiter := dynamodb.NewTableExistsWaiter(d)
+		err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(DDB_TABLE_NOTIFICATION_JOB)}, 5*time.Minute)
+		if err != nil {
+			log.Printf("Wait for table exists failed. Here's why: %v\n", err)
+		}
+		tableDesc = table.TableDescription
+	}
+	return tableDesc, err
+}
+
+func (db DynamoDbRepository) addNotificationJob(ctx context.Context, job NotificationJobModel) error {
+	item, err := attributevalue.MarshalMap(job)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(DDB_TABLE_NOTIFICATION_JOB), Item: item,
+	})
+	if err != nil {
+		log.Printf("Couldn't add notification job to table. Here's why: %v\n", err)
+	}
+	return err
+}
+
+func (db DynamoDbRepository) getNotificationJobs(ctx context.Context) ([]NotificationJobModel, error) {
+	var jobs []NotificationJobModel
+	paginator := dynamodb.NewScanPaginator(db.client, &dynamodb.ScanInput{
+		TableName: aws.String(DDB_TABLE_NOTIFICATION_JOB),
+	})
+	for paginator.HasMorePages() {
+		response, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Printf("Couldn't scan for notification jobs. Here's why: %v\n", err)
+			return nil, err
+		}
+
+		var page []NotificationJobModel
+		err = attributevalue.UnmarshalListOfMaps(response.Items, &page)
+		if err != nil {
+			log.Printf("Couldn't unmarshal scan response. Here's why: %v\n", err)
+			return nil, err
+		}
+		jobs = append(jobs, page...)
+	}
+
+	return jobs, nil
+}
+
+func (db DynamoDbRepository) deleteNotificationJob(ctx context.Context, id string) error {
+	_, err := db.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(DDB_TABLE_NOTIFICATION_JOB), Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		log.Printf("Couldn't delete notification job %v from the table. Here's why: %v\n", id, err)
+	}
+	return err
+}
+
+func createNotificationDeadLetterTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
+	if tableExists(d, DDB_TABLE_NOTIFICATION_DEAD_LETTER) {
+		log.Printf("table=%v already exists\n", DDB_TABLE_NOTIFICATION_DEAD_LETTER)
+		return nil, nil
+	}
+	var tableDesc *types.TableDescription
+	table, err := d.CreateTable(ctx, &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("id"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("id"),
+			KeyType:       types.KeyTypeHash,
+		}},
+		TableName:   aws.String(DDB_TABLE_NOTIFICATION_DEAD_LETTER),
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		log.Printf("Couldn't create table %v. Here's why: %v\n", DDB_TABLE_NOTIFICATION_DEAD_LETTER, err)
+	} else {
+		waiter := dynamodb.NewTableExistsWaiter(d)
+		err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(DDB_TABLE_NOTIFICATION_DEAD_LETTER)}, 5*time.Minute)
+		if err != nil {
+			log.Printf("Wait for table exists failed. Here's why: %v\n", err)
+		}
+		tableDesc = table.TableDescription
+	}
+	return tableDesc, err
+}
+
+func (db DynamoDbRepository) addNotificationDeadLetter(ctx context.Context, job NotificationJobModel) error {
+	item, err := attributevalue.MarshalMap(job)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(DDB_TABLE_NOTIFICATION_DEAD_LETTER), Item: item,
+	})
+	if err != nil {
+		log.Printf("Couldn't add notification dead letter to table. Here's why: %v\n", err)
+	}
+	return err
+}
+
+func (db DynamoDbRepository) getNotificationDeadLetters(ctx context.Context) ([]NotificationJobModel, error) {
+	var jobs []NotificationJobModel
+	paginator := dynamodb.NewScanPaginator(db.client, &dynamodb.ScanInput{
+		TableName: aws.String(DDB_TABLE_NOTIFICATION_DEAD_LETTER),
+	})
+	for paginator.HasMorePages() {
+		response, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Printf("Couldn't scan for notification dead letters. Here's why: %v\n", err)
+			return nil, err
+		}
+
+		var page []NotificationJobModel
+		err = attributevalue.UnmarshalListOfMaps(response.Items, &page)
+		if err != nil {
+			log.Printf("Couldn't unmarshal scan response. Here's why: %v\n", err)
+			return nil, err
+		}
+		jobs = append(jobs, page...)
+	}
+
+	return jobs, nil
+}
+
+func createNotificationDigestTable(ctx context.Context, d *dynamodb.Client) (*types.TableDescription, error) {
+	if tableExists(d, DDB_TABLE_NOTIFICATION_DIGEST) {
+		log.Printf("table=%v already exists\n", DDB_TABLE_NOTIFICATION_DIGEST)
+		return nil, nil
+	}
+	var tableDesc *types.TableDescription
+	table, err := d.CreateTable(ctx, &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{{
+			AttributeName: aws.String("userId"),
+			AttributeType: types.ScalarAttributeTypeS,
+		}},
+		KeySchema: []types.KeySchemaElement{{
+			AttributeName: aws.String("userId"),
+			KeyType:       types.KeyTypeHash,
+		}},
+		TableName:   aws.String(DDB_TABLE_NOTIFICATION_DIGEST),
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		log.Printf("Couldn't create table %v. Here's why: %v\n", DDB_TABLE_NOTIFICATION_DIGEST, err)
+	} else {
+		waiter := dynamodb.NewTableExistsWaiter(d)
+		err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(DDB_TABLE_NOTIFICATION_DIGEST)}, 5*time.Minute)
+		if err != nil {
+			log.Printf("Wait for table exists failed. Here's why: %v\n", err)
+		}
+		tableDesc = table.TableDescription
+	}
+	return tableDesc, err
+}
+
+// addNotificationDigest adds the notification for message mid to the digest
+// of userId. The update is atomic, so concurrent notifications are all
+// counted, and the message id goes into a set, so a retried one is counted
+// once.
+func (db DynamoDbRepository) addNotificationDigest(ctx context.Context, userId string, mid string, data NotificationData) error {
+	first, err := attributevalue.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+	update := "SET #first = if_not_exists(#first, :first) ADD #mids :mid"
+	names := map[string]string{"#first": "first", "#mids": "mids"}
+	values := map[string]types.AttributeValue{
+		":first": first,
+		":mid":   &types.AttributeValueMemberSS{Value: []string{mid}},
+	}
+	// string sets can't hold empty strings
+	if mid == "" {
+		update = "SET #first = if_not_exists(#first, :first) ADD #count :one"
+		names = map[string]string{"#first": "first", "#count": "count"}
+		values = map[string]types.AttributeValue{
+			":first": first,
+			":one":   &types.AttributeValueMemberN{Value: "1"},
+		}
+	}
+	// string sets can't hold empty strings
+	if data.Sender.Uid != "" {
+		update += ", #senders :sender"
+		names["#senders"] = "senders"
+		values[":sender"] = &types.AttributeValueMemberSS{Value: []string{data.Sender.Uid}}
+	}
+
+	_, err = db.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(DDB_TABLE_NOTIFICATION_DIGEST),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userId},
+		},
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		UpdateExpression:          aws.String(update),
+	})
+	if err != nil {
+		log.Printf("Couldn't add notification to the digest of %v. Here's why: %v\n", userId, err)
+	}
+	return err
+}
+
+func (db DynamoDbRepository) getNotificationDigestUsers(ctx context.Context) ([]string, error) {
+	userIds := make([]string, 0)
+	projEx := expression.NamesList(expression.Name("userId"))
+	expr, err := expression.NewBuilder().WithProjection(projEx).Build()
+	if err != nil {
+		log.Printf("Couldn't build epxression for scan. Here's why: %v\n", err)
+		return userIds, err
+	}
+
+	paginator := dynamodb.NewScanPaginator(db.client, &dynamodb.ScanInput{
+		TableName:                aws.String(DDB_TABLE_NOTIFICATION_DIGEST),
+		ExpressionAttributeNames: expr.Names(),
+		ProjectionExpression:     expr.Projection(),
+	})
+	for paginator.HasMorePages() {
+		response, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Printf("Couldn't scan for notification digests. Here's why: %v\n", err)
+			return userIds, err
+		}
+
+		var digests []NotificationDigestModel
+		if err := attributevalue.UnmarshalListOfMaps(response.Items, &digests); err != nil {
+			log.Printf("Couldn't unmarshal scan response. Here's why: %v\n", err)
+			return userIds, err
+		}
+		for _, d := range digests {
+			userIds = append(userIds, d.UserId)
+		}
+	}
+	return userIds, nil
+}
+
+// takeNotificationDigest deletes the digest of userId and returns it as it
+// was deleted, or nil if there is none. Notifications added after it start
+// the next digest.
+func (db DynamoDbRepository) takeNotificationDigest(ctx context.Context, userId string) (*NotificationDigestModel, error) {
+	response, err := db.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(DDB_TABLE_NOTIFICATION_DIGEST), Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userId},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		log.Printf("Couldn't delete notification digest of %v from the table. Here's why: %v\n", userId, err)
+		return nil, err
+	}
+	if len(response.Attributes) == 0 {
+		return nil, nil
+	}
+
+	var digest NotificationDigestModel
+	if err := attributevalue.UnmarshalMap(response.Attributes, &digest); err != nil {
+		log.Printf("Couldn't unmarshal notification digest. Here's why: %v\n", err)
+		return nil, err
+	}
+	return &digest, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/mail"
+	"sort"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultEmailDigestHours = 24
+	// a week
+	maxEmailDigestHours = 168
+	// How often the digester looks for digests that are due
+	emailDigestCheckInterval = 15 * time.Minute
+	// Only the latest mentions are looked at
+	maxEmailDigestMentions = 50
+)
+
+//go:embed email_templates/*
+var emailTemplateFiles embed.FS
+
+var (
+	emailDigestText = template.Must(template.ParseFS(emailTemplateFiles, "email_templates/digest.txt"))
+	emailDigestHTML = htmltemplate.Must(htmltemplate.ParseFS(emailTemplateFiles, "email_templates/digest.html"))
+)
+
+// EmailDigestModel subscribes a user to a digest of their tasks and mentions
+// by email.
+type EmailDigestModel struct {
+	IsEnabled bool   `json:"isEnabled" dynamodbav:"isEnabled"`
+	Address   string `json:"address" dynamodbav:"address"`
+	// Hours between digests, daily by default
+	IntervalHours int `json:"intervalHours" dynamodbav:"intervalHours"`
+	// Set by the server
+	LastSentAt time.Time `json:"lastSentAt" dynamodbav:"lastSentAt"`
+}
+
+type EmailDigestMentionModel struct {
+	MentionModel
+	SenderName string
+}
+
+// EmailDigestContent is what the digest templates render.
+type EmailDigestContent struct {
+	User         AddUserModel
+	OverdueTasks []AddTaskModel
+	// Open tasks assigned to the user that aren't overdue
+	OpenTasks      []AddTaskModel
+	UnreadMentions []EmailDigestMentionModel
+	Since          time.Time
+	Now            time.Time
+	// Times are shown in the time zone of the user
+	Location *time.Location
+}
+
+func (c EmailDigestContent) isEmpty() bool {
+	return len(c.OverdueTasks) == 0 && len(c.OpenTasks) == 0 && len(c.UnreadMentions) == 0
+}
+
+func mailAddress(address string) (string, error) {
+	a, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+	return a.Address, nil
+}
+
+// validateEmailDigest checks d, reduces the address to its bare form, like
+// a@b.com for "Name <a@b.com>", and fills in the default interval.
+func validateEmailDigest(d *EmailDigestModel) error {
+	if !d.IsEnabled {
+		return nil
+	}
+	address, err := mailAddress(d.Address)
+	if err != nil {
+		return fmt.Errorf("invalid email address %q", d.Address)
+	}
+	d.Address = address
+	if d.IntervalHours == 0 {
+		d.IntervalHours = defaultEmailDigestHours
+	}
+	if d.IntervalHours < 1 || d.IntervalHours > maxEmailDigestHours {
+		return fmt.Errorf("digest interval must be between 1 and %v hours", maxEmailDigestHours)
+	}
+	return nil
+}
+
+// isDue reports whether the next digest should go out at now.
+func (d EmailDigestModel) isDue(now time.Time) bool {
+	if !d.IsEnabled {
+		return false
+	}
+	hours := d.IntervalHours
+	if hours == 0 {
+		hours = defaultEmailDigestHours
+	}
+	return !now.Before(d.LastSentAt.Add(time.Duration(hours) * time.Hour))
+}
+
+// sortDigestTasks splits the open tasks into overdue and other ones, both
+// sorted by due date. Tasks without a due date come last.
+func sortDigestTasks(tasks []AddTaskModel, now time.Time) (overdue []AddTaskModel, open []AddTaskModel) {
+	for _, t := range tasks {
+		if t.IsDone {
+			continue
+		}
+		if !t.DueDate.IsZero() && t.DueDate.Before(now) {
+			overdue = append(overdue, t)
+		} else {
+			open = append(open, t)
+		}
+	}
+
+	byDueDate := func(tasks []AddTaskModel) func(i, j int) bool {
+		return func(i, j int) bool {
+			a, b := tasks[i].DueDate, tasks[j].DueDate
+			if a.IsZero() != b.IsZero() {
+				return b.IsZero()
+			}
+			return a.Before(b)
+		}
+	}
+	sort.SliceStable(overdue, byDueDate(overdue))
+	sort.SliceStable(open, byDueDate(open))
+	return overdue, open
+}
+
+// buildEmailDigest collects the digest of userId. Mentions count if they came
+// after since and the message is still unread.
+func buildEmailDigest(ctx context.Context, userId string, since time.Time, now time.Time) (EmailDigestContent, error) {
+	c := EmailDigestContent{Since: since, Now: now, Location: time.UTC}
+
+	user, err := dbService.getUserById(ctx, userId)
+	if err != nil {
+		return c, err
+	}
+	c.User = user
+
+	tasks, err := dbService.getTasksByAssignee(ctx, userId)
+	if err != nil {
+		return c, err
+	}
+	c.OverdueTasks, c.OpenTasks = sortDigestTasks(tasks, now)
+
+	mentions, err := dbService.getMentions(ctx, userId, maxEmailDigestMentions)
+	if err != nil {
+		return c, err
+	}
+	unread, err := dbService.getUnread(ctx, userId)
+	if err != nil {
+		return c, err
+	}
+	isUnread := make(map[string]bool)
+	for _, u := range unread {
+		isUnread[u.Id] = true
+	}
+
+	senders := make(map[string]string)
+	for _, m := range mentions {
+		if m.Timestamp.Before(since) || !isUnread[m.MessageId] {
+			continue
+		}
+		name, ok := senders[m.SentBy]
+		if !ok {
+			if sender, err := dbService.getUserById(ctx, m.SentBy); err == nil {
+				name = sender.FirstName + " " + sender.LastName
+			}
+			senders[m.SentBy] = name
+		}
+		c.UnreadMentions = append(c.UnreadMentions, EmailDigestMentionModel{MentionModel: m, SenderName: name})
+	}
+	return c, nil
+}
+
+func renderEmailDigest(c EmailDigestContent) (MailMessage, error) {
+	m := MailMessage{
+		Subject: fmt.Sprintf("%d overdue, %d open tasks and %d mentions", len(c.OverdueTasks), len(c.OpenTasks), len(c.UnreadMentions)),
+	}
+
+	var text bytes.Buffer
+	if err := emailDigestText.Execute(&text, c); err != nil {
+		return m, err
+	}
+	var html bytes.Buffer
+	if err := emailDigestHTML.Execute(&html, c); err != nil {
+		return m, err
+	}
+	m.Text = text.String()
+	m.HTML = html.String()
+	return m, nil
+}
+
+// EmailDigester mails the digests of all subscribed users when they are due.
+type EmailDigester struct {
+	sender MailSender
+}
+
+func (d EmailDigester) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(emailDigestCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				d.sendDueDigests(ctx, time.Now().UTC())
+			}
+		}
+	}()
+}
+
+func (d EmailDigester) sendDueDigests(ctx context.Context, now time.Time) {
+	subscribers, err := dbService.getEmailDigestSubscribers(ctx)
+	if err != nil {
+		log.Printf("Couldn't load email digest subscribers. Here's why: %v\n", err)
+		return
+	}
+
+	for _, p := range subscribers {
+		if !p.EmailDigest.isDue(now) {
+			continue
+		}
+		c := context.WithValue(ctx, logPrefix, p.UserId+"/emailDigest")
+		if err := d.sendDigest(c, p, now); err != nil {
+			log.Printf("%s : Couldn't send email digest. Here's why: %v\n", c.Value(logPrefix), err)
+		}
+	}
+}
+
+func (d EmailDigester) sendDigest(ctx context.Context, p NotificationPreferencesModel, now time.Time) error {
+	since := p.EmailDigest.LastSentAt
+	if since.IsZero() {
+		since = now.Add(-time.Duration(p.EmailDigest.IntervalHours) * time.Hour)
+	}
+
+	content, err := buildEmailDigest(ctx, p.UserId, since, now)
+	if err != nil {
+		return err
+	}
+	if loc, err := time.LoadLocation(p.DoNotDisturb.TimeZone); err == nil && p.DoNotDisturb.TimeZone != "" {
+		content.Location = loc
+	}
+
+	// nothing to tell, try again next interval
+	if !content.isEmpty() {
+		m, err := renderEmailDigest(content)
+		if err != nil {
+			return err
+		}
+		m.To = p.EmailDigest.Address
+		if err := d.sender.Send(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	return dbService.updateEmailDigestSentAt(ctx, p.UserId, now)
+}
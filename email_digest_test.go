@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSortDigestTasks(t *testing.T) {
+	now := time.Date(2022, 5, 10, 12, 0, 0, 0, time.UTC)
+	tasks := []AddTaskModel{
+		{Id: "later", DueDate: now.Add(48 * time.Hour)},
+		{Id: "undated"},
+		{Id: "done", DueDate: now.Add(-time.Hour), IsDone: true},
+		{Id: "overdue", DueDate: now.Add(-time.Hour)},
+		{Id: "soon", DueDate: now.Add(time.Hour)},
+		{Id: "long overdue", DueDate: now.Add(-48 * time.Hour)},
+	}
+
+	overdue, open := sortDigestTasks(tasks, now)
+	ids := func(tasks []AddTaskModel) string {
+		var ids []string
+		for _, t := range tasks {
+			ids = append(ids, t.Id)
+		}
+		return strings.Join(ids, ",")
+	}
+	if got := ids(overdue); got != "long overdue,overdue" {
+		t.Errorf("overdue = %v", got)
+	}
+	if got := ids(open); got != "soon,later,undated" {
+		t.Errorf("open = %v", got)
+	}
+}
+
+func TestEmailDigestSchedule(t *testing.T) {
+	d := EmailDigestModel{IsEnabled: true, Address: "Ann <ann@example.com>"}
+	if err := validateEmailDigest(&d); err != nil || d.IntervalHours != defaultEmailDigestHours || d.Address != "ann@example.com" {
+		t.Errorf("digest = %+v, %v", d, err)
+	}
+	if err := validateEmailDigest(&EmailDigestModel{IsEnabled: true, Address: "ann"}); err == nil {
+		t.Errorf("invalid address was accepted")
+	}
+	if err := validateEmailDigest(&EmailDigestModel{IsEnabled: true, Address: "ann@example.com", IntervalHours: 1000}); err == nil {
+		t.Errorf("interval of 1000 hours was accepted")
+	}
+
+	now := time.Now()
+	d.LastSentAt = now.Add(-23 * time.Hour)
+	if d.isDue(now) {
+		t.Errorf("digest is due after 23 hours")
+	}
+	d.LastSentAt = now.Add(-24 * time.Hour)
+	if !d.isDue(now) {
+		t.Errorf("digest isn't due after 24 hours")
+	}
+}
+
+func TestRenderEmailDigest(t *testing.T) {
+	colombo, _ := time.LoadLocation("Asia/Colombo")
+	now := time.Date(2022, 5, 10, 12, 0, 0, 0, time.UTC)
+	c := EmailDigestContent{
+		User:         AddUserModel{FirstName: "Ann"},
+		OverdueTasks: []AddTaskModel{{Title: "Defrost <freezer>", DueDate: now.Add(-time.Hour), IsUrgent: true}},
+		UnreadMentions: []EmailDigestMentionModel{
+			{MentionModel: MentionModel{Message: "@Ann see this", TaskTitle: "Stock"}, SenderName: "Bob"},
+		},
+		Since:    now.Add(-24 * time.Hour),
+		Now:      now,
+		Location: colombo,
+	}
+
+	m, err := renderEmailDigest(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject != "1 overdue, 0 open tasks and 1 mentions" {
+		t.Errorf("subject = %q", m.Subject)
+	}
+	if !strings.Contains(m.Text, "- Defrost <freezer> (urgent), due Tue May 10 16:30") || !strings.Contains(m.Text, "- Bob in Stock: @Ann see this") {
+		t.Errorf("text = %v", m.Text)
+	}
+	if strings.Contains(m.Text, "Open tasks") {
+		t.Errorf("text has empty section: %v", m.Text)
+	}
+	if !strings.Contains(m.HTML, "Defrost &lt;freezer&gt;") {
+		t.Errorf("html isn't escaped: %v", m.HTML)
+	}
+}
+
+func TestFileMailSender(t *testing.T) {
+	dir := t.TempDir()
+	s := FileMailSender{dir: dir, from: "Hamuwemu <no-reply@hamuwemu.app>"}
+	err := s.Send(context.Background(), MailMessage{To: "ann@example.com", Subject: "Déjà vu", Text: "plain", HTML: "<p>html</p>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("%v mails captured", len(files))
+	}
+	data, _ := os.ReadFile(files[0])
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if subject != "Déjà vu" || msg.Header.Get("To") != "ann@example.com" {
+		t.Errorf("header = %v", msg.Header)
+	}
+
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Type")+" "+string(body))
+	}
+	if len(parts) != 2 || parts[0] != "text/plain; charset=utf-8 plain" || parts[1] != "text/html; charset=utf-8 <p>html</p>" {
+		t.Errorf("parts = %q", parts)
+	}
+}
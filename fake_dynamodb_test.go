@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeDynamoDbCall is a request to fakeDynamoDb, like PutItem on ChatMessage.
+type fakeDynamoDbCall struct {
+	Op    string
+	Table string
+	Body  map[string]interface{}
+}
+
+// fakeDynamoDb answers the DynamoDB API over HTTP for handler tests. Reads
+// return every item of the table. PutItem and DeleteItem change the items,
+// which are told apart by their id, other writes are only recorded.
+type fakeDynamoDb struct {
+	mu    sync.Mutex
+	items map[string][]map[string]interface{}
+	calls []fakeDynamoDbCall
+}
+
+// useFakeDynamoDb points dbService to a fake until the test ends.
+func useFakeDynamoDb(t *testing.T) *fakeDynamoDb {
+	f := &fakeDynamoDb{items: make(map[string][]map[string]interface{})}
+	server := httptest.NewServer(f)
+	client := dynamodb.New(dynamodb.Options{
+		Region: "local",
+		// with a signing region the resolver is safe for concurrent use
+		EndpointResolver: dynamodb.EndpointResolverFromURL(server.URL, func(e *aws.Endpoint) { e.SigningRegion = "local" }),
+		Credentials:      credentials.NewStaticCredentialsProvider("fake", "fake", ""),
+		Retryer:          aws.NopRetryer{},
+	})
+
+	old := dbService
+	dbService = &DatabaseService{dynamoDbRespository: &DynamoDbRepository{client: client}}
+	t.Cleanup(func() {
+		dbService = old
+		server.Close()
+	})
+	return f
+}
+
+// useTestHub sets up a hub without clients until the test ends, pushes are
+// only saved to dbService.
+func useTestHub(t *testing.T) {
+	old := hub
+	hub = &Hub{clients: make(map[string]*Client)}
+	t.Cleanup(func() { hub = old })
+}
+
+// add puts items into table, they are marshalled like the repository does.
+func (f *fakeDynamoDb) add(table string, items ...interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, item := range items {
+		av, err := attributevalue.MarshalMap(item)
+		if err != nil {
+			panic(err)
+		}
+		wire := wireAttributeValue(&types.AttributeValueMemberM{Value: av}).(map[string]interface{})["M"]
+		f.items[table] = append(f.items[table], wire.(map[string]interface{}))
+	}
+}
+
+// find returns the index of the item of table with the id of key, or -1.
+func (f *fakeDynamoDb) find(table string, key map[string]interface{}) int {
+	for i, item := range f.items[table] {
+		if fmtJSON(item["id"]) == fmtJSON(key["id"]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// writes returns the calls that would have changed table.
+func (f *fakeDynamoDb) writes(table string) []fakeDynamoDbCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var writes []fakeDynamoDbCall
+	for _, c := range f.calls {
+		switch c.Op {
+		case "Query", "Scan", "GetItem", "DescribeTable":
+			continue
+		}
+		if c.Table == table || (c.Op == "TransactWriteItems" && strings.Contains(fmtJSON(c.Body), `"`+table+`"`)) {
+			writes = append(writes, c)
+		}
+	}
+	return writes
+}
+
+// waitForCalls waits until n calls of op on table were made, by goroutines
+// that a handler started.
+func (f *fakeDynamoDb) waitForCalls(t *testing.T, op string, table string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.mu.Lock()
+		count := 0
+		for _, c := range f.calls {
+			if c.Op == op && c.Table == table {
+				count++
+			}
+		}
+		f.mu.Unlock()
+
+		if count >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v calls of %v on %v, want %v", count, op, table, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (f *fakeDynamoDb) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	op := r.Header.Get("X-Amz-Target")
+	op = op[strings.LastIndex(op, ".")+1:]
+	data, _ := io.ReadAll(r.Body)
+	var body map[string]interface{}
+	json.Unmarshal(data, &body)
+	table, _ := body["TableName"].(string)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fakeDynamoDbCall{Op: op, Table: table, Body: body})
+
+	items := []interface{}{}
+	for _, item := range f.items[table] {
+		items = append(items, item)
+	}
+
+	response := map[string]interface{}{}
+	switch op {
+	case "Query", "Scan":
+		response["Items"] = items
+		response["Count"] = len(items)
+	case "GetItem":
+		if len(items) > 0 {
+			response["Item"] = items[0]
+		}
+	case "PutItem":
+		item, _ := body["Item"].(map[string]interface{})
+		i := f.find(table, item)
+		if i >= 0 && strings.Contains(fmt.Sprint(body["ConditionExpression"]), "attribute_not_exists") {
+			w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"__type":  "com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException",
+				"message": "The conditional request failed",
+			})
+			return
+		}
+		if i >= 0 {
+			f.items[table][i] = item
+		} else {
+			f.items[table] = append(f.items[table], item)
+		}
+	case "DeleteItem":
+		key, _ := body["Key"].(map[string]interface{})
+		if i := f.find(table, key); i >= 0 {
+			if body["ReturnValues"] == "ALL_OLD" {
+				response["Attributes"] = f.items[table][i]
+			}
+			f.items[table] = append(f.items[table][:i], f.items[table][i+1:]...)
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(response)
+}
+
+// wireAttributeValue is av in the JSON of the DynamoDB API.
+func wireAttributeValue(av types.AttributeValue) interface{} {
+	switch v := av.(type) {
+	case *types.AttributeValueMemberS:
+		return map[string]interface{}{"S": v.Value}
+	case *types.AttributeValueMemberN:
+		return map[string]interface{}{"N": v.Value}
+	case *types.AttributeValueMemberBOOL:
+		return map[string]interface{}{"BOOL": v.Value}
+	case *types.AttributeValueMemberNULL:
+		return map[string]interface{}{"NULL": true}
+	case *types.AttributeValueMemberB:
+		return map[string]interface{}{"B": v.Value}
+	case *types.AttributeValueMemberSS:
+		return map[string]interface{}{"SS": v.Value}
+	case *types.AttributeValueMemberNS:
+		return map[string]interface{}{"NS": v.Value}
+	case *types.AttributeValueMemberL:
+		l := make([]interface{}, len(v.Value))
+		for i, e := range v.Value {
+			l[i] = wireAttributeValue(e)
+		}
+		return map[string]interface{}{"L": l}
+	case *types.AttributeValueMemberM:
+		m := make(map[string]interface{}, len(v.Value))
+		for k, e := range v.Value {
+			m[k] = wireAttributeValue(e)
+		}
+		return map[string]interface{}{"M": m}
+	}
+	panic("unsupported attribute value")
+}
+
+func fmtJSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
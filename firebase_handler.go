@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/kjk/betterguid"
@@ -201,7 +203,7 @@ func handleTextMessage(ctx context.Context, message AddMessageModel, replyId uin
 	}
 
 	// log.Printf("%s : Sent message to %v members\n", ctx.Value(logPrefix), len(chatGroup.Members))
-	go sendNewMessageNotification(ctx, message, messageData.ThreadId, messageData.ThreadName, messageData.Recepients)
+	sendNewMessageNotification(ctx, message, messageData.ThreadId, messageData.ThreadName, messageData.Recepients)
 }
 
 type AddThreadModel struct {
@@ -218,6 +220,8 @@ type SystemMessageType int16
 const (
 	SystemMessageAddThread         SystemMessageType = 1
 	SystemMessageUpdateThreadTitle SystemMessageType = 6
+	SystemMessageUpdateChatGroup   SystemMessageType = 7
+	SystemMessageDeleteChatGroup   SystemMessageType = 8
 )
 
 type AddSystemMessageModel struct {
@@ -323,6 +327,7 @@ func hadleClientAck(c context.Context, uid string, mid string) {
 	if err := dbService.removeMessageById(c, mid, uid); err != nil {
 		log.Fatalln("Error removing delivered message:", err)
 	}
+	markAcked(c, uid, mid)
 
 	//send delivered receipt to message author
 	if pm.Type == ServerPushAddChatMessage {
@@ -471,6 +476,7 @@ func handleReadReceipts(ctx context.Context, receipts AddReadReceiptModel, uid s
 		}
 
 		go hub.send(ctx, receipt.Author, serverPushReceipt, true)
+		markRead(ctx, uid, receipt.MessageId)
 	}
 
 	serverPushReply := ServerPush{
@@ -486,19 +492,118 @@ func handleReadReceipts(ctx context.Context, receipts AddReadReceiptModel, uid s
 }
 
 type AddTaskModel struct {
-	Id                           string    `json:"id" dynamodbav:"id"`
-	Title                        string    `json:"title" dynamodbav:"title"`
-	Description                  string    `json:"description" dynamodbav:"description"`
-	AssginedTo                   string    `json:"assignedTo" dynamodbav:"assignedTo"`
-	AssignedBy                   string    `json:"assignedBy" dynamodbav:"assignedBy"`
-	IsUrgent                     bool      `json:"isUrgent" dynamodbav:"isUrgent"`
-	DueDate                      time.Time `json:"dueDate" dynamodbav:"dueDate"`
-	GroupUid                     string    `json:"groupUid" dynamodbav:"groupUid"`
-	IsRepeatWeekly               bool      `json:"isRepeatWeekly" dynamodbav:"isRepeatWeekly"`
-	RepeatWeekday                int8      `json:"repeatWeekday" dynamodbav:"repeatWeekday"`
-	IsRepeatingTask              bool      `json:"isRepeatingTask" dynamodbav:"isRepeatingTask"`
-	TaskRepeatType               int8      `json:"taskRepeatType" dynamodbav:"taskRepeatType"`
-	LatestRecurringTaskCreatedAt time.Time `json:"latestRecurringTaskCreatedAt" dynamodbav:"latestRecurringTaskCreatedAt"`
+	Id                           string                   `json:"id" dynamodbav:"id"`
+	Title                        string                   `json:"title" dynamodbav:"title"`
+	Description                  string                   `json:"description" dynamodbav:"description"`
+	AssginedTo                   string                   `json:"assignedTo" dynamodbav:"assignedTo"`
+	AssignedBy                   string                   `json:"assignedBy" dynamodbav:"assignedBy"`
+	IsUrgent                     bool                     `json:"isUrgent" dynamodbav:"isUrgent"`
+	DueDate                      time.Time                `json:"dueDate" dynamodbav:"dueDate"`
+	GroupUid                     string                   `json:"groupUid" dynamodbav:"groupUid"`
+	IsRepeatWeekly               bool                     `json:"isRepeatWeekly" dynamodbav:"isRepeatWeekly"`
+	RepeatWeekday                int8                     `json:"repeatWeekday" dynamodbav:"repeatWeekday"`
+	IsRepeatingTask              bool                     `json:"isRepeatingTask" dynamodbav:"isRepeatingTask"`
+	TaskRepeatType               int8                     `json:"taskRepeatType" dynamodbav:"taskRepeatType"`
+	LatestRecurringTaskCreatedAt time.Time                `json:"latestRecurringTaskCreatedAt" dynamodbav:"latestRecurringTaskCreatedAt"`
+	ChecklistItems               []TaskChecklistItemModel `json:"checklistItems" dynamodbav:"checklistItems"`
+	IsDone                       bool                     `json:"isDone" dynamodbav:"isDone"`
+	DoneAt                       time.Time                `json:"doneAt" dynamodbav:"doneAt"`
+	ReactionCounts               map[string]int           `json:"reactionCounts,omitempty" dynamodbav:"reactionCounts,omitempty"`
+	// Counts checklist updates, so concurrent ones don't overwrite each other
+	ChecklistVersion int `json:"checklistVersion" dynamodbav:"checklistVersion"`
+}
+
+type TaskChecklistItemType int16
+
+const (
+	TaskChecklistItemCheck TaskChecklistItemType = iota
+	TaskChecklistItemSubtask
+)
+
+type TaskChecklistItemModel struct {
+	Id         string                `json:"id" dynamodbav:"id"`
+	Type       TaskChecklistItemType `json:"type" dynamodbav:"type"`
+	Title      string                `json:"title" dynamodbav:"title"`
+	AssignedTo string                `json:"assignedTo,omitempty" dynamodbav:"assignedTo,omitempty"`
+	IsDone     bool                  `json:"isDone" dynamodbav:"isDone"`
+	DoneBy     string                `json:"doneBy,omitempty" dynamodbav:"doneBy,omitempty"`
+	DoneAt     time.Time             `json:"doneAt" dynamodbav:"doneAt"`
+	CreatedAt  time.Time             `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+// checklistCounts returns how many of the checklist items and subtasks of a
+// task are done, and how many there are.
+func checklistCounts(items []TaskChecklistItemModel) (done int, total int) {
+	for _, i := range items {
+		if i.IsDone {
+			done++
+		}
+	}
+	return done, len(items)
+}
+
+// Times a checklist update is tried when other updates come in between
+const maxChecklistUpdateAttempts = 5
+
+var ErrChecklistItemNotFound = errors.New("checklist item not found")
+
+// updateChecklist applies change to the checklist of a task. The checklist is
+// saved only if nobody else changed it since it was read, otherwise change is
+// applied again to the new checklist. A change that returns false is
+// abandoned with ErrChecklistItemNotFound.
+func updateChecklist(ctx context.Context, taskId string, change func(items []TaskChecklistItemModel) ([]TaskChecklistItemModel, bool)) error {
+	var err error
+	for attempt := 0; attempt < maxChecklistUpdateAttempts; attempt++ {
+		var task AddTaskModel
+		task, err = dbService.getTaskById(ctx, taskId)
+		if err != nil {
+			return err
+		}
+
+		items, ok := change(task.ChecklistItems)
+		if !ok {
+			return ErrChecklistItemNotFound
+		}
+
+		err = dbService.updateTaskChecklist(ctx, taskId, items, task.ChecklistVersion)
+		if !errors.Is(err, ErrConcurrentUpdate) {
+			return err
+		}
+	}
+	return err
+}
+
+// addChecklistItem appends item, unless an item with its id is there
+// already.
+func addChecklistItem(items []TaskChecklistItemModel, item TaskChecklistItemModel) []TaskChecklistItemModel {
+	for _, i := range items {
+		if i.Id == item.Id {
+			return items
+		}
+	}
+	return append(items, item)
+}
+
+// setChecklistItemStatus marks the item of m as done or not done. It returns
+// false if there is no such item.
+func setChecklistItemStatus(items []TaskChecklistItemModel, m AddChecklistStatusModel) ([]TaskChecklistItemModel, bool) {
+	found := false
+	for i := range items {
+		if items[i].Id != m.ItemId {
+			continue
+		}
+
+		found = true
+		items[i].IsDone = m.IsDone
+		if m.IsDone {
+			items[i].DoneBy = m.SentBy
+			items[i].DoneAt = m.Timestamp
+		} else {
+			items[i].DoneBy = ""
+			items[i].DoneAt = time.Time{}
+		}
+	}
+	return items, found
 }
 
 type AddTaskLogItemModel struct {
@@ -581,11 +686,11 @@ func handleTaskLogItem(ctx context.Context, update AddTaskLogItemModel) {
 			log.Fatalln("Error reading value:", err)
 		}
 
-		go sendNewTaskNotification(ctx, update.Task, []AppUser{assignee})
+		sendNewTaskNotification(ctx, update.Task, []AppUser{assignee})
 
 	} else if update.Status == TaskStatusCompleted {
 		//Send new task notification to assignee.
-		go sendTaskCompletedNotification(ctx, update.Task, recepients)
+		sendTaskCompletedNotification(ctx, update.Task, recepients)
 	} else if update.Status == TaskStatusWaiting {
 		//Send task log entry to all members in the group.
 		for _, member := range recepients {
@@ -599,18 +704,124 @@ func handleTaskLogItem(ctx context.Context, update AddTaskLogItemModel) {
 		}
 
 		//Send new task notification to assignee.
-		go sendTaskPendingNotification(ctx, update.Task, recepients)
+		sendTaskPendingNotification(ctx, update.Task, recepients)
 	}
 }
 
 func handleAddTask(ctx context.Context, task AddTaskModel) {
+	if isChatGroupArchived(ctx, task.GroupUid) {
+		log.Printf("%s : Ignoring task %v, chat group %v is archived\n", ctx.Value(logPrefix), task.Id, task.GroupUid)
+		return
+	}
+
 	//save task to db
 	dbService.addTask(ctx, task)
+	indexTask(ctx, task)
+
+	recordTaskEvent(ctx, TaskEventModel{
+		ChatId:  task.GroupUid,
+		TaskId:  task.Id,
+		Type:    TaskEventCreated,
+		SentBy:  task.AssignedBy,
+		SentTo:  task.AssginedTo,
+		DueDate: task.DueDate,
+	})
 
 	//send task
 	go hub.sendToChat(ctx, task.GroupUid, task.Id, ServerPushAddTask, task, true, task.AssignedBy)
 
-	go notificationService.sendNewTaskNotification(ctx, task, task.Id)
+	notificationService.enqueue(ctx, NotificationJobModel{Kind: NotificationJobNewTask, Task: &task})
+}
+
+type AddChecklistItemModel struct {
+	Id        string                 `json:"id" dynamodbav:"id"`
+	TaskId    string                 `json:"taskId" dynamodbav:"taskId"`
+	ChatId    string                 `json:"chatId" dynamodbav:"chatId"`
+	Item      TaskChecklistItemModel `json:"item" dynamodbav:"item"`
+	SentBy    string                 `json:"sentBy" dynamodbav:"sentBy"`
+	Timestamp time.Time              `json:"timestamp" dynamodbav:"timestamp"`
+}
+
+func handleAddChecklistItem(ctx context.Context, m AddChecklistItemModel) {
+	// send receipt
+	mr := MessageReceiptModel{
+		Type:      Sent,
+		MessageId: m.Id,
+		Timestamp: time.Now().UTC(),
+	}
+
+	receiptId := betterguid.New()
+
+	pr := ServerPush{
+		Id:     receiptId,
+		UserId: m.SentBy,
+		Type:   ServerPushMessageReceipt,
+		Data:   mr,
+	}
+
+	go hub.send(ctx, m.SentBy, pr, true)
+
+	if m.Item.CreatedAt.IsZero() {
+		m.Item.CreatedAt = m.Timestamp
+	}
+
+	//save checklist alongside the task
+	err := updateChecklist(ctx, m.TaskId, func(items []TaskChecklistItemModel) ([]TaskChecklistItemModel, bool) {
+		return addChecklistItem(items, m.Item), true
+	})
+	if err != nil {
+		log.Printf("%s : Couldn't add checklist item to task %v. Here's why: %v\n", ctx.Value(logPrefix), m.TaskId, err)
+		return
+	}
+
+	//send checklist item
+	go hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushAddChecklistItem, m, true, m.SentBy)
+}
+
+type AddChecklistStatusModel struct {
+	Id        string    `json:"id" dynamodbav:"id"`
+	TaskId    string    `json:"taskId" dynamodbav:"taskId"`
+	ChatId    string    `json:"chatId" dynamodbav:"chatId"`
+	ItemId    string    `json:"itemId" dynamodbav:"itemId"`
+	IsDone    bool      `json:"isDone" dynamodbav:"isDone"`
+	SentBy    string    `json:"sentBy" dynamodbav:"sentBy"`
+	Timestamp time.Time `json:"timestamp" dynamodbav:"timestamp"`
+}
+
+func handleAddChecklistStatus(ctx context.Context, m AddChecklistStatusModel) {
+	// send receipt
+	mr := MessageReceiptModel{
+		Type:      Sent,
+		MessageId: m.Id,
+		Timestamp: time.Now().UTC(),
+	}
+
+	receiptId := betterguid.New()
+
+	pr := ServerPush{
+		Id:     receiptId,
+		UserId: m.SentBy,
+		Type:   ServerPushMessageReceipt,
+		Data:   mr,
+	}
+
+	go hub.send(ctx, m.SentBy, pr, true)
+
+	//save checklist alongside the task
+	err := updateChecklist(ctx, m.TaskId, func(items []TaskChecklistItemModel) ([]TaskChecklistItemModel, bool) {
+		return setChecklistItemStatus(items, m)
+	})
+	if errors.Is(err, ErrChecklistItemNotFound) {
+		log.Printf("%s : Checklist item %v not found in task %v\n", ctx.Value(logPrefix), m.ItemId, m.TaskId)
+		return
+	}
+	if err != nil {
+		log.Printf("%s : Couldn't update checklist of task %v. Here's why: %v\n", ctx.Value(logPrefix), m.TaskId, err)
+		return
+	}
+
+	//send checklist item status
+	go hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushAddChecklistStatus, m, true, m.SentBy)
 }
 
 type AddTaskStatusModel struct {
@@ -656,9 +867,22 @@ type AddTaskMessageModel struct {
 	SentBy    string    `json:"sentBy" dynamodbav:"sentBy"`
 	TaskTitle string    `json:"taskTitle" dynamodbav:"taskTitle"`
 	Timestamp time.Time `json:"timestamp" dynamodbav:"timestamp"`
+	// Users and tasks mentioned in Message, validated by the server.
+	Mentions     []Mention     `json:"mentions,omitempty" dynamodbav:"mentions,omitempty"`
+	TaskMentions []TaskMention `json:"taskMentions,omitempty" dynamodbav:"taskMentions,omitempty"`
+
+	AttachmentIds []string `json:"attachmentIds,omitempty" dynamodbav:"attachmentIds,omitempty"`
+	// Attachments of AttachmentIds, set by the server. Only the metadata is
+	// stored, download URLs are signed when the message is delivered.
+	Attachments []AttachmentModel `json:"attachments,omitempty" dynamodbav:"attachments,omitempty"`
 }
 
 func handleAddTaskMessage(ctx context.Context, m AddTaskMessageModel) {
+	if isChatGroupArchived(ctx, m.ChatId) {
+		log.Printf("%s : Ignoring task message %v, chat group %v is archived\n", ctx.Value(logPrefix), m.Id, m.ChatId)
+		return
+	}
+
 	// send receipt
 	mr := MessageReceiptModel{
 		Type:      Sent,
@@ -677,11 +901,37 @@ func handleAddTaskMessage(ctx context.Context, m AddTaskMessageModel) {
 
 	go hub.send(ctx, m.SentBy, pr, true)
 
+	members, err := dbService.getChatGroupMembers(ctx, m.ChatId)
+	if err != nil {
+		log.Printf("Couldn't fetch chat group members. Here's why: %v\n", err)
+	}
+	m.Mentions = validateMentions(m.Message, m.Mentions, members, m.SentBy)
+	m.TaskMentions = validateTaskMentions(ctx, m.Message, m.TaskMentions, m.ChatId)
+	m.AttachmentIds, m.Attachments = resolveAttachments(ctx, m.ChatId, m.AttachmentIds)
+
+	indexTaskMessage(ctx, m)
+
 	//send task text message
 	go hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushAddTaskMessage, m, true, m.SentBy)
 
-	// send notification
-	notificationService.sendTaskTextMessageNotification(ctx, m.Message, m.SentBy, m.SentTo, m.TaskId, m.TaskTitle, m.Id)
+	linkUnfurler.enqueue(ctx, LinkPreviewsModel{ChatId: m.ChatId, MessageId: m.Id, TaskId: m.TaskId}, m.Message)
+
+	// send notification, mentioned users get a mention notification instead
+	if !isMentioned(m.Mentions, m.SentTo) {
+		job := taskNotificationJob(NotificationJobTaskMessage, m.SentBy, m.SentTo, m.ChatId, m.TaskId, m.TaskTitle, m.Id)
+		job.Event.Message = m.Message
+		notificationService.enqueue(ctx, job)
+	}
+
+	saveMentions(ctx, m.Mentions, MentionModel{
+		ChatId:    m.ChatId,
+		MessageId: m.Id,
+		TaskId:    m.TaskId,
+		TaskTitle: m.TaskTitle,
+		Message:   m.Message,
+		SentBy:    m.SentBy,
+		Timestamp: m.Timestamp,
+	})
 }
 
 type AddChatModel struct {
@@ -735,15 +985,41 @@ func handleAddChat(ctx context.Context, c AddChatModel) {
 }
 
 type AddChatMessageModel struct {
-	Id        string    `json:"id" dynamodbav:"id"`
-	ChatId    string    `json:"chatId" dynamodbav:"chatId"`
-	Message   string    `json:"message" dynamodbav:"message"`
-	SentTo    string    `json:"sentTo" dynamodbav:"sentTo"`
-	SentBy    string    `json:"sentBy" dynamodbav:"sentBy"`
-	Timestamp time.Time `json:"timestamp" dynamodbav:"timestamp"`
+	Id             string         `json:"id" dynamodbav:"id"`
+	ChatId         string         `json:"chatId" dynamodbav:"chatId"`
+	Message        string         `json:"message" dynamodbav:"message"`
+	SentTo         string         `json:"sentTo" dynamodbav:"sentTo"`
+	SentBy         string         `json:"sentBy" dynamodbav:"sentBy"`
+	Timestamp      time.Time      `json:"timestamp" dynamodbav:"timestamp"`
+	ReactionCounts map[string]int `json:"reactionCounts,omitempty" dynamodbav:"reactionCounts,omitempty"`
+	EditedAt       time.Time      `json:"editedAt,omitempty" dynamodbav:"editedAt,omitempty"`
+	IsDeleted      bool           `json:"isDeleted,omitempty" dynamodbav:"isDeleted,omitempty"`
+	// When the server received the message. Timestamp is set by the client.
+	ReceivedAt time.Time `json:"receivedAt,omitempty" dynamodbav:"receivedAt,omitempty"`
+	// Message this message replies to, in the same chat.
+	ReplyToMessageId string `json:"replyToMessageId,omitempty" dynamodbav:"replyToMessageId,omitempty"`
+	// Maintained by the server on the parent message.
+	ReplyCount           int       `json:"replyCount,omitempty" dynamodbav:"replyCount,omitempty"`
+	LatestReplyMessageId string    `json:"latestReplyMessageId,omitempty" dynamodbav:"latestReplyMessageId,omitempty"`
+	LatestReplyAt        time.Time `json:"latestReplyAt,omitempty" dynamodbav:"latestReplyAt,omitempty"`
+	// Users and tasks mentioned in Message, validated by the server.
+	Mentions     []Mention     `json:"mentions,omitempty" dynamodbav:"mentions,omitempty"`
+	TaskMentions []TaskMention `json:"taskMentions,omitempty" dynamodbav:"taskMentions,omitempty"`
+
+	AttachmentIds []string `json:"attachmentIds,omitempty" dynamodbav:"attachmentIds,omitempty"`
+	// Attachments of AttachmentIds, set by the server. Only the metadata is
+	// stored, download URLs are signed when the message is delivered.
+	Attachments []AttachmentModel `json:"attachments,omitempty" dynamodbav:"attachments,omitempty"`
+	// Previews of the links in Message, added by the server after the message is sent.
+	LinkPreviews []LinkPreviewModel `json:"linkPreviews,omitempty" dynamodbav:"linkPreviews,omitempty"`
 }
 
 func handleAddChatMessage(ctx context.Context, m AddChatMessageModel) {
+	if isChatGroupArchived(ctx, m.ChatId) {
+		log.Printf("%s : Ignoring message %v, chat group %v is archived\n", ctx.Value(logPrefix), m.Id, m.ChatId)
+		return
+	}
+
 	// send receipt
 	mr := MessageReceiptModel{
 		Type:      Sent,
@@ -762,10 +1038,63 @@ func handleAddChatMessage(ctx context.Context, m AddChatMessageModel) {
 
 	go hub.send(ctx, m.SentBy, pr, true)
 
+	var parent AddChatMessageModel
+	if m.ReplyToMessageId != "" {
+		var err error
+		parent, err = dbService.getChatMessageById(ctx, m.ChatId, m.ReplyToMessageId)
+		if err != nil {
+			log.Printf("%s : Couldn't fetch parent message %v, sending as a regular message. Here's why: %v\n", ctx.Value(logPrefix), m.ReplyToMessageId, err)
+			m.ReplyToMessageId = ""
+		}
+	}
+
+	members, err := dbService.getChatGroupMembers(ctx, m.ChatId)
+	if err != nil {
+		log.Printf("Couldn't fetch chat group members. Here's why: %v\n", err)
+	}
+	m.Mentions = validateMentions(m.Message, m.Mentions, members, m.SentBy)
+	m.TaskMentions = validateTaskMentions(ctx, m.Message, m.TaskMentions, m.ChatId)
+	m.AttachmentIds, m.Attachments = resolveAttachments(ctx, m.ChatId, m.AttachmentIds)
+
+	// the counters of a new message are maintained by the server
+	m.ReceivedAt = time.Now().UTC()
+	m.ReplyCount = 0
+	m.LatestReplyMessageId = ""
+	m.LatestReplyAt = time.Time{}
+	m.LinkPreviews = nil
+
+	//save message history
+	dbService.addChatMessage(ctx, m)
+	indexChatMessage(ctx, m)
+
+	if m.ReplyToMessageId != "" {
+		dbService.addChatMessageReply(ctx, m.ChatId, m.ReplyToMessageId, m.Id, m.Timestamp)
+	}
+
 	//send new chat message to assignee
 	go hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushAddChatMessage, m, true, m.SentBy)
 
-	notificationService.sendChatTextMessageNotification(ctx, m.Message, m.SentBy, m.ChatId, m.Id)
+	linkUnfurler.enqueue(ctx, LinkPreviewsModel{ChatId: m.ChatId, MessageId: m.Id}, m.Message)
+
+	except, notifyParent := chatMessageNotificationExcept(m, parent)
+	if notifyParent {
+		notificationService.enqueue(ctx, NotificationJobModel{Kind: NotificationJobReply, ChatMessage: &m, Parent: &parent})
+	}
+	notificationService.enqueue(ctx, NotificationJobModel{Kind: NotificationJobChatMessage, Event: &NotificationEventModel{
+		Message: m.Message,
+		SentBy:  m.SentBy,
+		ChatId:  m.ChatId,
+		Mid:     m.Id,
+		Except:  except,
+	}})
+
+	saveMentions(ctx, m.Mentions, MentionModel{
+		ChatId:    m.ChatId,
+		MessageId: m.Id,
+		Message:   m.Message,
+		SentBy:    m.SentBy,
+		Timestamp: m.Timestamp,
+	})
 }
 
 type AddTaskReminderModel struct {
@@ -801,8 +1130,18 @@ func handleAddTaskReminder(ctx context.Context, m AddTaskReminderModel) {
 	//send reminder
 	go hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushAddTaskReminder, m, true, m.SentBy)
 
+	recordTaskEvent(ctx, TaskEventModel{
+		Id:        m.Id,
+		ChatId:    m.ChatId,
+		TaskId:    m.TaskId,
+		Type:      TaskEventReminder,
+		SentBy:    m.SentBy,
+		SentTo:    m.SentTo,
+		Timestamp: m.Timestamp,
+	})
+
 	// send notification
-	notificationService.sendTaskReminderNotification(ctx, m.SentBy, m.SentTo, m.TaskId, m.TaskTitle, m.Id)
+	notificationService.enqueue(ctx, taskNotificationJob(NotificationJobTaskReminder, m.SentBy, m.SentTo, m.ChatId, m.TaskId, m.TaskTitle, m.Id))
 }
 
 type AddTaskDoneModel struct {
@@ -835,11 +1174,25 @@ func handleAddTaskDone(ctx context.Context, m AddTaskDoneModel) {
 
 	go hub.send(ctx, m.SentBy, pr, true)
 
+	//save done state on the task
+	dbService.updateTaskDone(ctx, m.TaskId, true, m.Timestamp)
+
 	//send done
 	go hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushAddTaskDone, m, true, m.SentBy)
 
+	recordTaskEvent(ctx, TaskEventModel{
+		Id:        m.Id,
+		ChatId:    m.ChatId,
+		TaskId:    m.TaskId,
+		Type:      TaskEventDone,
+		SentBy:    m.SentBy,
+		SentTo:    m.SentTo,
+		DueDate:   m.DueDate,
+		Timestamp: m.Timestamp,
+	})
+
 	//send notification
-	notificationService.sendTaskDoneNotification(ctx, m.SentBy, m.SentTo, m.TaskId, m.TaskTitle, m.Id)
+	notificationService.enqueue(ctx, taskNotificationJob(NotificationJobTaskDone, m.SentBy, m.SentTo, m.ChatId, m.TaskId, m.TaskTitle, m.Id))
 }
 
 type AddTaskNotDoneModel struct {
@@ -872,10 +1225,24 @@ func handleAddTaskNotDone(ctx context.Context, m AddTaskNotDoneModel) {
 
 	go hub.send(ctx, m.SentBy, pr, true)
 
+	//reopen the task
+	dbService.updateTaskDone(ctx, m.TaskId, false, time.Time{})
+
 	//send not done
 	go hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushAddTaskNotDone, m, true, m.SentBy)
 
-	notificationService.sendTaskNotDoneNotification(ctx, m.SentBy, m.SentTo, m.TaskId, m.TaskTitle, m.Id)
+	recordTaskEvent(ctx, TaskEventModel{
+		Id:        m.Id,
+		ChatId:    m.ChatId,
+		TaskId:    m.TaskId,
+		Type:      TaskEventNotDone,
+		SentBy:    m.SentBy,
+		SentTo:    m.SentTo,
+		DueDate:   m.DueDate,
+		Timestamp: m.Timestamp,
+	})
+
+	notificationService.enqueue(ctx, taskNotificationJob(NotificationJobTaskNotDone, m.SentBy, m.SentTo, m.ChatId, m.TaskId, m.TaskTitle, m.Id))
 }
 
 type AddWaitingRequestModel struct {
@@ -911,7 +1278,18 @@ func handleAddWaitingRequest(ctx context.Context, m AddWaitingRequestModel) {
 	//send waiting request
 	go hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushAddWaitingRequest, m, true, m.SentBy)
 
-	notificationService.sendTaskWaitingRequestNotification(ctx, m.SentBy, m.SentTo, m.TaskId, m.TaskTitle, m.Id)
+	recordTaskEvent(ctx, TaskEventModel{
+		Id:        m.Id,
+		ChatId:    m.ChatId,
+		TaskId:    m.TaskId,
+		Type:      TaskEventWaitingRequest,
+		SentBy:    m.SentBy,
+		SentTo:    m.SentTo,
+		DueDate:   m.DueDate,
+		Timestamp: m.Timestamp,
+	})
+
+	notificationService.enqueue(ctx, taskNotificationJob(NotificationJobWaitingRequest, m.SentBy, m.SentTo, m.ChatId, m.TaskId, m.TaskTitle, m.Id))
 }
 
 type AcceptWaitingRequestModel struct {
@@ -948,7 +1326,7 @@ func handleAcceptWaitingRequest(ctx context.Context, m AcceptWaitingRequestModel
 	//send accept
 	go hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushAcceptWaitingRequest, m, true, m.SentBy)
 
-	notificationService.sendTaskAcceptWaitingRequestNotification(ctx, m.SentBy, m.SentTo, m.TaskId, m.TaskTitle, m.Id)
+	notificationService.enqueue(ctx, taskNotificationJob(NotificationJobWaitingRequestAccepted, m.SentBy, m.SentTo, m.ChatId, m.TaskId, m.TaskTitle, m.Id))
 }
 
 type DenyWaitingRequestModel struct {
@@ -985,38 +1363,111 @@ func handleDenyWaitingRequest(ctx context.Context, m DenyWaitingRequestModel) {
 	//send deny
 	go hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushDenyWaitingRequest, m, true, m.SentBy)
 
-	notificationService.sendTaskDenyWaitingRequestNotification(ctx, m.SentBy, m.SentTo, m.TaskId, m.TaskTitle, m.Id)
+	notificationService.enqueue(ctx, taskNotificationJob(NotificationJobWaitingRequestDenied, m.SentBy, m.SentTo, m.ChatId, m.TaskId, m.TaskTitle, m.Id))
 }
 
 type AddChatGroupModel struct {
-	Id        string    `json:"id" dynamodbav:"id"`
-	Title     string    `json:"title" dynamodbav:"title"`
-	SentBy    string    `json:"sentBy" dynamodbav:"sentBy"`
-	CreatedAt time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	Id          string    `json:"id" dynamodbav:"id"`
+	Title       string    `json:"title" dynamodbav:"title"`
+	Description string    `json:"description,omitempty" dynamodbav:"description,omitempty"`
+	AvatarUrl   string    `json:"avatarUrl,omitempty" dynamodbav:"avatarUrl,omitempty"`
+	IsArchived  bool      `json:"isArchived,omitempty" dynamodbav:"isArchived,omitempty"`
+	SentBy      string    `json:"sentBy" dynamodbav:"sentBy"`
+	CreatedAt   time.Time `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+// UpdateChatGroupModel changes the fields that are set and leaves the others
+// as they are.
+type UpdateChatGroupModel struct {
+	Id          string    `json:"id"`
+	ChatId      string    `json:"chatId"`
+	Title       *string   `json:"title,omitempty"`
+	Description *string   `json:"description,omitempty"`
+	AvatarUrl   *string   `json:"avatarUrl,omitempty"`
+	SentBy      string    `json:"sentBy"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+type DeleteChatGroupModel struct {
+	Id     string `json:"id"`
+	ChatId string `json:"chatId"`
+	// Archived groups keep their members and history and can't be updated
+	// anymore. Otherwise the group and its members are deleted.
+	Archive   bool      `json:"archive"`
+	SentBy    string    `json:"sentBy"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
 func handleAddChatGroup(ctx context.Context, m AddChatGroupModel) {
 	//save group
 	dbService.addChatGroup(ctx, m)
 
-	//add group member
+	//add group creator as admin
 	cgm := AddChatGroupMemberModel{
 		Id:           betterguid.New(),
 		ChatId:       m.Id,
 		MemberUserId: m.SentBy,
+		Role:         ChatGroupRoleAdmin,
 		SentBy:       m.SentBy,
 	}
 	dbService.addChatGroupMember(ctx, cgm)
 }
 
+type ChatGroupRole int16
+
+const (
+	ChatGroupRoleMember ChatGroupRole = iota
+	ChatGroupRoleAdmin
+)
+
 type AddChatGroupMemberModel struct {
-	Id           string `json:"id" dynamodbav:"id"`
-	ChatId       string `json:"chatId" dynamodbav:"chatId"`
-	MemberUserId string `json:"memberUserId" dynamodbav:"memberUserId"`
-	SentBy       string `json:"sentBy" dynamodbav:"sentBy"`
+	Id           string        `json:"id" dynamodbav:"id"`
+	ChatId       string        `json:"chatId" dynamodbav:"chatId"`
+	MemberUserId string        `json:"memberUserId" dynamodbav:"memberUserId"`
+	Role         ChatGroupRole `json:"role" dynamodbav:"role"`
+	SentBy       string        `json:"sentBy" dynamodbav:"sentBy"`
 }
 
-func handleAddChatGroupMember(ctx context.Context, m AddChatGroupMemberModel) {
+type RemoveChatGroupMemberModel struct {
+	Id           string    `json:"id"`
+	ChatId       string    `json:"chatId"`
+	MemberUserId string    `json:"memberUserId"`
+	SentBy       string    `json:"sentBy"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// isChatGroupAdmin reports whether userId may add, remove, rename or delete
+// the chat group. Groups created before roles existed have no admins, there
+// every member keeps the permissions they always had.
+func isChatGroupAdmin(members []AddChatGroupMemberModel, userId string) bool {
+	hasAdmin := false
+	for _, m := range members {
+		if m.Role == ChatGroupRoleAdmin {
+			hasAdmin = true
+			if m.MemberUserId == userId {
+				return true
+			}
+		}
+	}
+	return !hasAdmin && isChatGroupMember(members, userId)
+}
+
+// handleAddChatGroupMember adds a member for uid, the user of the
+// connection. The sentBy of the message is only the client's claim, uid
+// replaces it, like in the other chat group handlers.
+func handleAddChatGroupMember(ctx context.Context, uid string, m AddChatGroupMemberModel) {
+	m.SentBy = uid
+	members, err := dbService.getChatGroupMembers(ctx, m.ChatId)
+	if err != nil {
+		log.Printf("Couldn't fetch chat group members. Here's why: %v\n", err)
+		return
+	}
+
+	if !isChatGroupAdmin(members, m.SentBy) {
+		log.Printf("%s : %v is not allowed to add members to chat group %v\n", ctx.Value(logPrefix), m.SentBy, m.ChatId)
+		return
+	}
+
 	//send chat group details to new member
 	cg, err := dbService.getChatGroupById(ctx, m.ChatId)
 	if err != nil {
@@ -1032,11 +1483,6 @@ func handleAddChatGroupMember(ctx context.Context, m AddChatGroupMemberModel) {
 
 	go hub.send(ctx, m.MemberUserId, cgsp, true)
 
-	members, err := dbService.getChatGroupMembers(ctx, m.ChatId)
-	if err != nil {
-		log.Printf("Couldn't fetch chat group members. Here's why: %v\n", err)
-	}
-
 	//send current group members to new member
 	for _, member := range members {
 		sp := ServerPush{
@@ -1070,6 +1516,302 @@ func handleAddChatGroupMember(ctx context.Context, m AddChatGroupMemberModel) {
 	dbService.addChatGroupMember(ctx, m)
 }
 
+var (
+	ErrNotChatGroupAdmin  = errors.New("not an admin of the chat group")
+	ErrNotChatGroupMember = errors.New("not a member of the chat group")
+)
+
+func handleRemoveChatGroupMember(ctx context.Context, uid string, m RemoveChatGroupMemberModel) error {
+	m.SentBy = uid
+	members, err := dbService.getChatGroupMembers(ctx, m.ChatId)
+	if err != nil {
+		log.Printf("Couldn't fetch chat group members. Here's why: %v\n", err)
+		return err
+	}
+
+	// anyone may leave, only admins may remove others
+	if m.MemberUserId != m.SentBy && !isChatGroupAdmin(members, m.SentBy) {
+		log.Printf("%s : %v is not allowed to remove members from chat group %v\n", ctx.Value(logPrefix), m.SentBy, m.ChatId)
+		return ErrNotChatGroupAdmin
+	}
+
+	if !isChatGroupMember(members, m.MemberUserId) {
+		log.Printf("%s : %v is not a member of chat group %v\n", ctx.Value(logPrefix), m.MemberUserId, m.ChatId)
+		return ErrNotChatGroupMember
+	}
+
+	if err := dbService.removeChatGroupMember(ctx, m.ChatId, m.MemberUserId); err != nil {
+		return err
+	}
+
+	//send removal to remaining members and the removed member
+	for _, member := range members {
+		// the message sender already knows that the member was removed
+		if member.MemberUserId == m.SentBy {
+			continue
+		}
+
+		sp := ServerPush{
+			Id:     betterguid.New(),
+			UserId: member.MemberUserId,
+			Type:   ServerPushRemoveGroupMember,
+			Data:   m,
+		}
+
+		go hub.send(ctx, member.MemberUserId, sp, true)
+	}
+
+	//make sure the group keeps an admin when the last one leaves
+	var remaining []AddChatGroupMemberModel
+	wasAdmin := false
+	for _, member := range members {
+		if member.MemberUserId == m.MemberUserId {
+			wasAdmin = member.Role == ChatGroupRoleAdmin
+		} else {
+			remaining = append(remaining, member)
+		}
+	}
+	if wasAdmin && len(remaining) > 0 && !hasChatGroupAdmin(remaining) {
+		next := remaining[0]
+		next.Role = ChatGroupRoleAdmin
+		next.SentBy = m.SentBy
+		setChatGroupRole(ctx, next, remaining)
+	}
+
+	return nil
+}
+
+func hasChatGroupAdmin(members []AddChatGroupMemberModel) bool {
+	for _, m := range members {
+		if m.Role == ChatGroupRoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func handleSetChatGroupRole(ctx context.Context, uid string, m AddChatGroupMemberModel) {
+	m.SentBy = uid
+	members, err := dbService.getChatGroupMembers(ctx, m.ChatId)
+	if err != nil {
+		log.Printf("Couldn't fetch chat group members. Here's why: %v\n", err)
+		return
+	}
+
+	if !isChatGroupAdmin(members, m.SentBy) {
+		log.Printf("%s : %v is not allowed to change roles in chat group %v\n", ctx.Value(logPrefix), m.SentBy, m.ChatId)
+		return
+	}
+
+	var member *AddChatGroupMemberModel
+	for i := range members {
+		if members[i].MemberUserId == m.MemberUserId {
+			member = &members[i]
+		}
+	}
+	if member == nil {
+		log.Printf("%s : %v is not a member of chat group %v\n", ctx.Value(logPrefix), m.MemberUserId, m.ChatId)
+		return
+	}
+
+	updated := *member
+	updated.Role = m.Role
+	updated.SentBy = m.SentBy
+	member.Role = m.Role
+
+	// a group that has admins can't lose the last one
+	if !hasChatGroupAdmin(members) {
+		log.Printf("%s : Can't remove the last admin of chat group %v\n", ctx.Value(logPrefix), m.ChatId)
+		return
+	}
+
+	setChatGroupRole(ctx, updated, members)
+}
+
+var (
+	ErrChatGroupArchived   = errors.New("chat group is archived")
+	ErrEmptyChatGroupTitle = errors.New("chat group title is empty")
+)
+
+// isChatGroupArchived reports whether chatId is an archived group, which
+// doesn't take new messages or tasks anymore. Chats that aren't groups are
+// never archived.
+func isChatGroupArchived(ctx context.Context, chatId string) bool {
+	cg, err := dbService.getChatGroupById(ctx, chatId)
+	return err == nil && cg.IsArchived
+}
+
+// updatedChatGroup applies m to cg and describes the changes, e.g. "changed
+// the group description". Archived groups can't be updated.
+func updatedChatGroup(cg AddChatGroupModel, m UpdateChatGroupModel) (AddChatGroupModel, []string, error) {
+	if cg.IsArchived {
+		return cg, nil, ErrChatGroupArchived
+	}
+
+	var changes []string
+	if m.Title != nil && *m.Title != cg.Title {
+		if strings.TrimSpace(*m.Title) == "" {
+			return cg, nil, ErrEmptyChatGroupTitle
+		}
+		cg.Title = *m.Title
+		changes = append(changes, "changed the group name to \""+cg.Title+"\"")
+	}
+	if m.Description != nil && *m.Description != cg.Description {
+		cg.Description = *m.Description
+		changes = append(changes, "changed the group description")
+	}
+	if m.AvatarUrl != nil && *m.AvatarUrl != cg.AvatarUrl {
+		cg.AvatarUrl = *m.AvatarUrl
+		changes = append(changes, "changed the group photo")
+	}
+
+	return cg, changes, nil
+}
+
+func handleUpdateChatGroup(ctx context.Context, uid string, m UpdateChatGroupModel) {
+	m.SentBy = uid
+	members, err := dbService.getChatGroupMembers(ctx, m.ChatId)
+	if err != nil {
+		log.Printf("Couldn't fetch chat group members. Here's why: %v\n", err)
+		return
+	}
+
+	if !isChatGroupAdmin(members, m.SentBy) {
+		log.Printf("%s : %v is not allowed to update chat group %v\n", ctx.Value(logPrefix), m.SentBy, m.ChatId)
+		return
+	}
+
+	cg, err := dbService.getChatGroupById(ctx, m.ChatId)
+	if err != nil {
+		return
+	}
+
+	cg, changes, err := updatedChatGroup(cg, m)
+	if err != nil {
+		log.Printf("%s : Ignoring update of chat group %v. Here's why: %v\n", ctx.Value(logPrefix), m.ChatId, err)
+		return
+	}
+
+	if len(changes) == 0 {
+		return
+	}
+
+	//save
+	if err := dbService.updateChatGroup(ctx, cg); err != nil {
+		return
+	}
+
+	//send updated group to members
+	go hub.sendToChat(ctx, cg.Id, m.Id, ServerPushUpdateChatGroup, cg, true, m.SentBy)
+
+	sendChatGroupSystemMessage(ctx, SystemMessageUpdateChatGroup, m.ChatId, uid, strings.Join(changes, " and "))
+}
+
+func handleDeleteChatGroup(ctx context.Context, uid string, m DeleteChatGroupModel) {
+	m.SentBy = uid
+	members, err := dbService.getChatGroupMembers(ctx, m.ChatId)
+	if err != nil {
+		log.Printf("Couldn't fetch chat group members. Here's why: %v\n", err)
+		return
+	}
+
+	if !isChatGroupAdmin(members, m.SentBy) {
+		log.Printf("%s : %v is not allowed to delete chat group %v\n", ctx.Value(logPrefix), m.SentBy, m.ChatId)
+		return
+	}
+
+	if m.Archive {
+		cg, err := dbService.getChatGroupById(ctx, m.ChatId)
+		if err != nil {
+			return
+		}
+
+		if cg.IsArchived {
+			log.Printf("%s : Chat group %v is already archived\n", ctx.Value(logPrefix), m.ChatId)
+			return
+		}
+
+		cg.IsArchived = true
+		if err := dbService.updateChatGroup(ctx, cg); err != nil {
+			return
+		}
+
+		sendChatGroupSystemMessage(ctx, SystemMessageDeleteChatGroup, m.ChatId, uid, "archived the group")
+	} else {
+		// members have to be told before they are removed from the group
+		sendChatGroupSystemMessage(ctx, SystemMessageDeleteChatGroup, m.ChatId, uid, "deleted the group")
+	}
+
+	if m.Id == "" {
+		m.Id = betterguid.New()
+	}
+
+	//send deletion to members, before they are removed
+	hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushDeleteChatGroup, m, true, m.SentBy)
+
+	if m.Archive {
+		return
+	}
+
+	for _, member := range members {
+		dbService.removeChatGroupMember(ctx, m.ChatId, member.MemberUserId)
+	}
+	dbService.deleteChatGroup(ctx, m.ChatId)
+}
+
+// sendChatGroupSystemMessage tells all members, including the sender, what
+// sentBy did to the group, e.g. "@94771234567 archived the group".
+func sendChatGroupSystemMessage(ctx context.Context, t SystemMessageType, chatId string, sentBy string, action string) {
+	sender, err := dbService.getUserById(ctx, sentBy)
+	if err != nil {
+		log.Printf("%s : Couldn't fetch user %v. Here's why: %v\n", ctx.Value(logPrefix), sentBy, err)
+		return
+	}
+
+	systemMessage := AddSystemMessageModel{
+		Type:      t,
+		Id:        betterguid.New(),
+		Timestamp: time.Now().UTC(),
+		Group:     chatId,
+		Message: Message{
+			Content: "@" + sender.PhoneNumber + " " + action,
+			Mentions: []Mention{{
+				Id:          betterguid.New(),
+				Uid:         sentBy,
+				PhoneNumber: sender.PhoneNumber,
+				Range:       [2]int{0, len(sender.PhoneNumber) + 1},
+			}},
+			Links: make([]string, 0),
+		},
+	}
+
+	// an empty sender sends to every member
+	hub.sendToChat(ctx, chatId, systemMessage.Id, ServerPushSystemMessage, systemMessage, true, "")
+}
+
+func setChatGroupRole(ctx context.Context, m AddChatGroupMemberModel, members []AddChatGroupMemberModel) {
+	//save
+	if err := dbService.addChatGroupMember(ctx, m); err != nil {
+		return
+	}
+
+	//send role to members
+	for _, member := range members {
+		if member.MemberUserId == m.SentBy {
+			continue
+		}
+
+		sp := ServerPush{
+			Id:     betterguid.New(),
+			UserId: member.MemberUserId,
+			Type:   ServerPushSetChatGroupRole,
+			Data:   m,
+		}
+
+		go hub.send(ctx, member.MemberUserId, sp, true)
+	}
+}
+
 func handleAddPresence(ctx context.Context, m AddPresenceModel) {
 	//save presence
 	presenceMap[m.SentBy] = m
@@ -1115,9 +1857,38 @@ func handleAddGoodJobMessage(ctx context.Context, m AddGoodJobMessageModel) {
 
 	go hub.send(ctx, m.SentBy, pr, true)
 
+	//save as a reaction to the task
+	r := AddReactionModel{
+		Id:         m.Id,
+		ChatId:     m.ChatId,
+		TargetId:   m.TaskId,
+		TargetType: ReactionTargetTask,
+		TaskId:     m.TaskId,
+		TaskTitle:  m.TaskTitle,
+		Emoji:      messageReactionEmoji[m.Type],
+		SentTo:     m.SentTo,
+		SentBy:     m.SentBy,
+		Timestamp:  m.Timestamp,
+	}
+	if err := updateReactions(ctx, &r, false); err != nil {
+		log.Printf("%s : Couldn't save good job reaction to %v. Here's why: %v\n", ctx.Value(logPrefix), m.TaskId, err)
+	}
+
 	//send done
 	go hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushAddGoodJobMessage, m, true, m.SentBy)
 
+	recordTaskEvent(ctx, TaskEventModel{
+		Id:        m.Id,
+		ChatId:    m.ChatId,
+		TaskId:    m.TaskId,
+		Type:      TaskEventGoodJob,
+		SentBy:    m.SentBy,
+		SentTo:    m.SentTo,
+		Timestamp: m.Timestamp,
+	})
+
 	//send notification
-	notificationService.sendGoodJobNotification(ctx, m.SentBy, m.SentTo, m.TaskId, m.TaskTitle, m.Id, m.Type)
+	job := taskNotificationJob(NotificationJobGoodJob, m.SentBy, m.SentTo, m.ChatId, m.TaskId, m.TaskTitle, m.Id)
+	job.Event.ReactionType = m.Type
+	notificationService.enqueue(ctx, job)
 }
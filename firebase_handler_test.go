@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIsChatGroupAdmin(t *testing.T) {
+	members := []AddChatGroupMemberModel{
+		{ChatId: "g1", MemberUserId: "alice", Role: ChatGroupRoleAdmin},
+		{ChatId: "g1", MemberUserId: "bob"},
+	}
+
+	if !isChatGroupAdmin(members, "alice") {
+		t.Errorf("alice should be an admin")
+	}
+	if isChatGroupAdmin(members, "bob") {
+		t.Errorf("bob should not be an admin")
+	}
+	if isChatGroupAdmin(members, "carol") {
+		t.Errorf("carol is not a member")
+	}
+
+	// groups created before roles existed
+	legacy := []AddChatGroupMemberModel{
+		{ChatId: "g2", MemberUserId: "alice"},
+		{ChatId: "g2", MemberUserId: "bob"},
+	}
+	if !isChatGroupAdmin(legacy, "bob") || isChatGroupAdmin(legacy, "carol") {
+		t.Errorf("every member of a legacy group should be an admin")
+	}
+}
+
+func TestChecklistItems(t *testing.T) {
+	done := time.Date(2022, 5, 10, 12, 0, 0, 0, time.UTC)
+	items := addChecklistItem(nil, TaskChecklistItemModel{Id: "i1", Title: "Milk"})
+	items = addChecklistItem(items, TaskChecklistItemModel{Id: "i2", Title: "Bread", Type: TaskChecklistItemSubtask, AssignedTo: "bob"})
+	// a retried add
+	items = addChecklistItem(items, TaskChecklistItemModel{Id: "i1", Title: "Milk"})
+	if len(items) != 2 {
+		t.Fatalf("items = %+v", items)
+	}
+
+	items, ok := setChecklistItemStatus(items, AddChecklistStatusModel{ItemId: "i2", IsDone: true, SentBy: "bob", Timestamp: done})
+	if !ok || !items[1].IsDone || items[1].DoneBy != "bob" || !items[1].DoneAt.Equal(done) {
+		t.Errorf("items = %+v", items)
+	}
+	if d, total := checklistCounts(items); d != 1 || total != 2 {
+		t.Errorf("counts = %v/%v", d, total)
+	}
+
+	items, ok = setChecklistItemStatus(items, AddChecklistStatusModel{ItemId: "i2", IsDone: false, SentBy: "alice"})
+	if !ok || items[1].IsDone || items[1].DoneBy != "" || !items[1].DoneAt.IsZero() {
+		t.Errorf("items = %+v", items)
+	}
+
+	if _, ok := setChecklistItemStatus(items, AddChecklistStatusModel{ItemId: "i3", IsDone: true}); ok {
+		t.Errorf("status of a missing item was set")
+	}
+}
+
+func TestUpdatedChatGroup(t *testing.T) {
+	cg := AddChatGroupModel{Id: "g1", Title: "Store", Description: "Main street"}
+	title := "Store 1"
+	description := "Main street"
+	avatar := "https://example.com/store.png"
+
+	updated, changes, err := updatedChatGroup(cg, UpdateChatGroupModel{Title: &title, Description: &description, AvatarUrl: &avatar})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Title != title || updated.AvatarUrl != avatar || cg.Title != "Store" {
+		t.Errorf("updated = %+v", updated)
+	}
+	// the description didn't change
+	if len(changes) != 2 || changes[0] != "changed the group name to \"Store 1\"" || changes[1] != "changed the group photo" {
+		t.Errorf("changes = %v", changes)
+	}
+
+	empty := " "
+	if _, _, err := updatedChatGroup(cg, UpdateChatGroupModel{Title: &empty}); err != ErrEmptyChatGroupTitle {
+		t.Errorf("err = %v", err)
+	}
+
+	cg.IsArchived = true
+	if _, _, err := updatedChatGroup(cg, UpdateChatGroupModel{Title: &title}); err != ErrChatGroupArchived {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestChatGroupHandlersIgnoreSpoofedSender(t *testing.T) {
+	db := useFakeDynamoDb(t)
+	db.add(DDB_TABLE_CHAT_GROUP_MEMBER,
+		AddChatGroupMemberModel{Id: "1", ChatId: "g1", MemberUserId: "alice", Role: ChatGroupRoleAdmin},
+		AddChatGroupMemberModel{Id: "2", ChatId: "g1", MemberUserId: "bob"},
+		AddChatGroupMemberModel{Id: "3", ChatId: "g1", MemberUserId: "mallory"},
+	)
+	ctx := context.Background()
+
+	// mallory claims to be alice, the admin
+	err := handleRemoveChatGroupMember(ctx, "mallory", RemoveChatGroupMemberModel{ChatId: "g1", MemberUserId: "bob", SentBy: "alice"})
+	if !errors.Is(err, ErrNotChatGroupAdmin) {
+		t.Errorf("removal by mallory = %v", err)
+	}
+	handleSetChatGroupRole(ctx, "mallory", AddChatGroupMemberModel{ChatId: "g1", MemberUserId: "mallory", Role: ChatGroupRoleAdmin, SentBy: "alice"})
+	handleAddChatGroupMember(ctx, "mallory", AddChatGroupMemberModel{Id: "4", ChatId: "g1", MemberUserId: "eve", SentBy: "alice"})
+
+	if writes := db.writes(DDB_TABLE_CHAT_GROUP_MEMBER); len(writes) != 0 {
+		t.Errorf("spoofed requests changed the members: %+v", writes)
+	}
+}
+
+func TestChatGroupUpdatesIgnoreSpoofedSender(t *testing.T) {
+	db := useFakeDynamoDb(t)
+	db.add(DDB_TABLE_CHAT_GROUP_MEMBER,
+		AddChatGroupMemberModel{Id: "1", ChatId: "g1", MemberUserId: "alice", Role: ChatGroupRoleAdmin},
+		AddChatGroupMemberModel{Id: "2", ChatId: "g1", MemberUserId: "mallory"},
+	)
+	db.add(DDB_TABLE_CHAT_GROUP, AddChatGroupModel{Id: "g1", Title: "Home"})
+	ctx := context.Background()
+
+	// mallory claims to be alice, the admin
+	title := "Mallory's"
+	handleUpdateChatGroup(ctx, "mallory", UpdateChatGroupModel{ChatId: "g1", Title: &title, SentBy: "alice"})
+	handleDeleteChatGroup(ctx, "mallory", DeleteChatGroupModel{ChatId: "g1", Archive: true, SentBy: "alice"})
+	handleDeleteChatGroup(ctx, "mallory", DeleteChatGroupModel{ChatId: "g1", SentBy: "alice"})
+
+	if writes := db.writes(DDB_TABLE_CHAT_GROUP); len(writes) != 0 {
+		t.Errorf("spoofed requests changed the group: %+v", writes)
+	}
+	if writes := db.writes(DDB_TABLE_CHAT_GROUP_MEMBER); len(writes) != 0 {
+		t.Errorf("spoofed requests changed the members: %+v", writes)
+	}
+}
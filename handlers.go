@@ -138,6 +138,16 @@ const (
 	ServerPushAddChatGroupMember                         //25
 	ServerPushAddPresence                                //26
 	ServerPushAddGoodJobMessage                          //27
+	ServerPushAddChecklistItem                           //28
+	ServerPushAddChecklistStatus                         //29
+	ServerPushAddReaction                                //30
+	ServerPushRemoveReaction                             //31
+	ServerPushSetChatGroupRole                           //32
+	ServerPushUpdateChatGroup                            //33
+	ServerPushDeleteChatGroup                            //34
+	ServerPushEditChatMessage                            //35
+	ServerPushDeleteChatMessage                          //36
+	ServerPushLinkPreviews                               //37
 )
 
 type ServerPush struct {
@@ -562,6 +572,17 @@ const (
 	ClientPushAddChatGroupMember   ClientPushType = 20
 	ClientPushAddPresence          ClientPushType = 21
 	ClientPushAddGoodJobMessage    ClientPushType = 22
+	ClientPushAddChecklistItem     ClientPushType = 23
+	ClientPushAddChecklistStatus   ClientPushType = 24
+	ClientPushAddReaction          ClientPushType = 25
+	ClientPushRemoveReaction       ClientPushType = 26
+	ClientPushRemoveGroupMember    ClientPushType = 27
+	ClientPushLeaveChatGroup       ClientPushType = 28
+	ClientPushSetChatGroupRole     ClientPushType = 29
+	ClientPushUpdateChatGroup      ClientPushType = 30
+	ClientPushDeleteChatGroup      ClientPushType = 31
+	ClientPushEditChatMessage      ClientPushType = 32
+	ClientPushDeleteChatMessage    ClientPushType = 33
 )
 
 type ClientPush struct {
@@ -639,6 +660,12 @@ type AddUserModel struct {
 	PublicKey   string `json:"publicKey" dynamodbav:"publicKey"`
 	FirstName   string `json:"firstName" dynamodbav:"firstName"`
 	LastName    string `json:"lastName" dynamodbav:"lastName"`
+	// Secret for the calendar feed. Never sent to clients.
+	CalendarToken string `json:"-" dynamodbav:"calendarToken,omitempty"`
+	// Language of the notifications, like "si" or "ta-LK"
+	Locale string `json:"locale" dynamodbav:"locale,omitempty"`
+	// Notifications carry APNs loc keys and are localized by the app
+	LocalizeOnDevice bool `json:"localizeOnDevice" dynamodbav:"localizeOnDevice,omitempty"`
 }
 
 type AddWorkspaceModel struct {
@@ -772,6 +799,12 @@ type AddTokenModel struct {
 	Token     string    `json:"token" dynamodbav:"token"`
 	Timestamp time.Time `json:"timestamp" dynamodbav:"timestamp"`
 	Debug     bool      `json:"debug" dynamodbav:"debug"`
+	// Push service of the token, APNs when empty
+	Platform PushPlatform `json:"platform,omitempty" dynamodbav:"platform,omitempty"`
+	// Keys of a web push subscription, whose token is the endpoint
+	WebPushKeys *WebPushKeysModel `json:"webPushKeys,omitempty" dynamodbav:"webPushKeys,omitempty"`
+	// Legacy FCM token kept in Firebase instead of the DeviceToken table
+	Firebase bool `json:"-" dynamodbav:"firebase,omitempty"`
 }
 
 func addToken(c *gin.Context) {
@@ -783,6 +816,11 @@ func addToken(c *gin.Context) {
 		return
 	}
 
+	if !isValidPushPlatform(token.Platform) {
+		respondWithError(c, http.StatusBadRequest, "Invalid platform")
+		return
+	}
+
 	err := dbService.addDeviceToken(c, token)
 	if err != nil {
 		log.Fatalln("Error setting value:", err)
@@ -806,6 +844,7 @@ func getMessages(c *gin.Context) {
 		if err := r.Unmarshal(&m); err != nil {
 			log.Fatalln("Error unmarshaling result:", err)
 		}
+		signServerPushAttachments(&m, time.Now())
 		snapshot[i] = m
 	}
 
@@ -1138,13 +1177,28 @@ func addTask(c *gin.Context) {
 	}
 
 	ctx := c.Copy()
+	if isChatGroupArchived(ctx, task.GroupUid) {
+		respondWithError(c, http.StatusForbidden, "The chat group is archived")
+		return
+	}
+
 	//save task to db
 	dbService.addTask(ctx, task)
+	indexTask(ctx, task)
+
+	recordTaskEvent(ctx, TaskEventModel{
+		ChatId:  task.GroupUid,
+		TaskId:  task.Id,
+		Type:    TaskEventCreated,
+		SentBy:  task.AssignedBy,
+		SentTo:  task.AssginedTo,
+		DueDate: task.DueDate,
+	})
 
 	//send task
 	go hub.sendToChat(ctx, task.GroupUid, task.Id, ServerPushAddTask, task, true, task.AssignedBy)
 
-	go notificationService.sendNewTaskNotification(ctx, task, task.Id)
+	notificationService.enqueue(ctx, NotificationJobModel{Kind: NotificationJobNewTask, Task: &task})
 
 	c.IndentedJSON(http.StatusOK, task)
 }
@@ -1162,11 +1216,12 @@ func addChatGroup(c *gin.Context) {
 	//save group
 	dbService.addChatGroup(ctx, m)
 
-	//add group member
+	//add group creator as admin
 	cgm := AddChatGroupMemberModel{
 		Id:           betterguid.New(),
 		ChatId:       m.Id,
 		MemberUserId: m.SentBy,
+		Role:         ChatGroupRoleAdmin,
 		SentBy:       m.SentBy,
 	}
 	dbService.addChatGroupMember(ctx, cgm)
@@ -1175,15 +1230,35 @@ func addChatGroup(c *gin.Context) {
 }
 
 func addChatGroupMember(c *gin.Context) {
-	// uid := c.MustGet(uidKey).(string)
+	uid := c.MustGet(uidKey).(string)
+	groupId := c.Param("groupId")
 
 	var m AddChatGroupMemberModel
 	if err := c.BindJSON(&m); err != nil {
 		c.AbortWithError(400, err)
 		return
 	}
+	m.ChatId = groupId
+	m.SentBy = uid
 
 	ctx := c.Copy()
+	members, err := dbService.getChatGroupMembers(ctx, m.ChatId)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if !isChatGroupAdmin(members, uid) {
+		respondWithError(c, http.StatusForbidden, "Only admins can add members to the chat group")
+		return
+	}
+
+	//save
+	if err := dbService.addChatGroupMember(ctx, m); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
 	//send chat group details to new member
 	cg, err := dbService.getChatGroupById(ctx, m.ChatId)
 	if err != nil {
@@ -1199,11 +1274,6 @@ func addChatGroupMember(c *gin.Context) {
 
 	go hub.send(ctx, m.MemberUserId, cgsp, true)
 
-	members, err := dbService.getChatGroupMembers(ctx, m.ChatId)
-	if err != nil {
-		log.Printf("Couldn't fetch chat group members. Here's why: %v\n", err)
-	}
-
 	//send current group members to new member
 	for _, member := range members {
 		sp := ServerPush{
@@ -1233,8 +1303,50 @@ func addChatGroupMember(c *gin.Context) {
 		go hub.send(ctx, member.MemberUserId, sp, true)
 	}
 
-	//save
-	dbService.addChatGroupMember(ctx, m)
+	c.IndentedJSON(http.StatusOK, m)
+}
+
+func removeChatGroupMember(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+	groupId := c.Param("groupId")
+	memberUserId := c.Param("userId")
+
+	members, err := dbService.getChatGroupMembers(c, groupId)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// anyone may leave, only admins may remove others
+	if memberUserId != uid && !isChatGroupAdmin(members, uid) {
+		respondWithError(c, http.StatusForbidden, "Only admins can remove members from the chat group")
+		return
+	}
+
+	if !isChatGroupMember(members, memberUserId) {
+		respondWithError(c, http.StatusNotFound, "Not a member of the chat group")
+		return
+	}
+
+	m := RemoveChatGroupMemberModel{
+		Id:           betterguid.New(),
+		ChatId:       groupId,
+		MemberUserId: memberUserId,
+		SentBy:       uid,
+		Timestamp:    time.Now().UTC(),
+	}
+
+	if err := handleRemoveChatGroupMember(c.Copy(), uid, m); err != nil {
+		switch {
+		case errors.Is(err, ErrNotChatGroupAdmin):
+			respondWithError(c, http.StatusForbidden, "Only admins can remove members from the chat group")
+		case errors.Is(err, ErrNotChatGroupMember):
+			respondWithError(c, http.StatusNotFound, "Not a member of the chat group")
+		default:
+			c.AbortWithError(http.StatusInternalServerError, err)
+		}
+		return
+	}
 
 	c.IndentedJSON(http.StatusOK, m)
 }
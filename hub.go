@@ -185,5 +185,45 @@ func serverPushTypeString(t ServerPushType) string {
 		return "good job"
 	}
 
+	if t == ServerPushAddChecklistItem {
+		return "checklist item"
+	}
+
+	if t == ServerPushAddChecklistStatus {
+		return "checklist status"
+	}
+
+	if t == ServerPushAddReaction {
+		return "reaction"
+	}
+
+	if t == ServerPushRemoveReaction {
+		return "remove reaction"
+	}
+
+	if t == ServerPushSetChatGroupRole {
+		return "chat group role"
+	}
+
+	if t == ServerPushUpdateChatGroup {
+		return "update chat group"
+	}
+
+	if t == ServerPushDeleteChatGroup {
+		return "delete chat group"
+	}
+
+	if t == ServerPushEditChatMessage {
+		return "edit chat message"
+	}
+
+	if t == ServerPushDeleteChatMessage {
+		return "delete chat message"
+	}
+
+	if t == ServerPushLinkPreviews {
+		return "link previews"
+	}
+
 	return "unknown"
 }
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/buckket/go-blurhash"
+	"golang.org/x/image/draw"
+)
+
+// Thumbnails fit into a square of this size.
+const thumbnailSize = 320
+
+// Images with more pixels than this aren't decoded.
+const maxImagePixels = 50 * 1000 * 1000
+
+// ErrInvalidImage is returned when an attachment claims to be an image but can't be decoded
+var ErrInvalidImage = errors.New("attachment is not a valid image")
+
+type processedImage struct {
+	// The original image without GPS data and XMP metadata
+	Data            []byte
+	Width           int
+	Height          int
+	Thumbnail       []byte
+	ThumbnailWidth  int
+	ThumbnailHeight int
+	BlurHash        string
+}
+
+func isProcessableImage(contentType string) bool {
+	return contentType == "image/jpeg" || contentType == "image/png"
+}
+
+// processImage strips GPS data and XMP metadata, which can contain the
+// location too, from a JPEG or PNG image and renders a JPEG
+// thumbnail and a BlurHash for previews.
+func processImage(data []byte, contentType string) (processedImage, error) {
+	var p processedImage
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width*cfg.Height > maxImagePixels {
+		return p, ErrInvalidImage
+	}
+
+	var img image.Image
+	orientation := 1
+	if contentType == "image/jpeg" {
+		img, err = jpeg.Decode(bytes.NewReader(data))
+		p.Data = stripJPEGXMP(data)
+		if tiff := jpegExif(p.Data); tiff != nil {
+			orientation = exifOrientation(tiff)
+			stripExifGPS(tiff)
+		}
+	} else {
+		img, err = png.Decode(bytes.NewReader(data))
+		p.Data = stripPNGMetadata(data)
+	}
+	if err != nil {
+		return p, ErrInvalidImage
+	}
+
+	thumb := orientImage(scaleImage(img, thumbnailSize), orientation)
+	p.Width, p.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	if orientation >= 5 {
+		p.Width, p.Height = p.Height, p.Width
+	}
+	p.ThumbnailWidth, p.ThumbnailHeight = thumb.Bounds().Dx(), thumb.Bounds().Dy()
+
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		return p, err
+	}
+	p.Thumbnail = b.Bytes()
+
+	p.BlurHash, err = blurhash.Encode(4, 3, thumb)
+	return p, err
+}
+
+// scaleImage scales img down to fit into a size x size square.
+func scaleImage(img image.Image, size int) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	if w > h {
+		h = h * size / w
+		w = size
+	} else {
+		w = w * size / h
+		h = size
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// orientImage applies an EXIF orientation, so the result is upright.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// jpegExif returns the TIFF structure of the EXIF segment of a JPEG image.
+// It shares memory with data, so changes to it change the image.
+func jpegExif(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return nil
+		}
+		marker := data[i+1]
+		// start of scan, the metadata is over
+		if marker == 0xDA {
+			return nil
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+
+		segment := data[i+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		i = end
+	}
+	return nil
+}
+
+const (
+	exifTagOrientation = 0x0112
+	exifTagGPSInfo     = 0x8825
+)
+
+// Size in bytes of the EXIF field types, by type id.
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+type exifEntry struct {
+	// offset of the 12 byte entry in the TIFF structure
+	offset int
+	tag    uint16
+	typ    uint16
+	count  uint32
+	value  uint32
+}
+
+func exifByteOrder(tiff []byte) binary.ByteOrder {
+	if len(tiff) < 8 {
+		return nil
+	}
+	if tiff[0] == 'I' && tiff[1] == 'I' {
+		return binary.LittleEndian
+	}
+	if tiff[0] == 'M' && tiff[1] == 'M' {
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// exifIFD reads the entries of the IFD at offset.
+func exifIFD(tiff []byte, order binary.ByteOrder, offset int) []exifEntry {
+	if offset < 8 || offset+2 > len(tiff) {
+		return nil
+	}
+
+	n := int(order.Uint16(tiff[offset:]))
+	var entries []exifEntry
+	for i := 0; i < n; i++ {
+		o := offset + 2 + i*12
+		if o+12 > len(tiff) {
+			break
+		}
+		entries = append(entries, exifEntry{
+			offset: o,
+			tag:    order.Uint16(tiff[o:]),
+			typ:    order.Uint16(tiff[o+2:]),
+			count:  order.Uint32(tiff[o+4:]),
+			value:  order.Uint32(tiff[o+8:]),
+		})
+	}
+	return entries
+}
+
+func exifOrientation(tiff []byte) int {
+	order := exifByteOrder(tiff)
+	if order == nil {
+		return 1
+	}
+
+	for _, e := range exifIFD(tiff, order, int(order.Uint32(tiff[4:]))) {
+		if e.tag == exifTagOrientation && e.typ == 3 {
+			return int(order.Uint16(tiff[e.offset+8:]))
+		}
+	}
+	return 1
+}
+
+// stripExifGPS empties the GPS IFD in place. Its entries and their values are
+// zeroed, so the image keeps its size and all other metadata.
+func stripExifGPS(tiff []byte) {
+	order := exifByteOrder(tiff)
+	if order == nil {
+		return
+	}
+
+	for _, e := range exifIFD(tiff, order, int(order.Uint32(tiff[4:]))) {
+		if e.tag != exifTagGPSInfo {
+			continue
+		}
+
+		gpsOffset := int(e.value)
+		if gpsOffset < 8 || gpsOffset+2 > len(tiff) {
+			return
+		}
+
+		for _, g := range exifIFD(tiff, order, gpsOffset) {
+			size := exifTypeSizes[g.typ] * int(g.count)
+			if size > 4 && int(g.value)+size <= len(tiff) {
+				zeroBytes(tiff[g.value : int(g.value)+size])
+			}
+			zeroBytes(tiff[g.offset : g.offset+12])
+		}
+		order.PutUint16(tiff[gpsOffset:], 0)
+	}
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Signatures of the APP1 segments of standard and extended XMP packets.
+var (
+	jpegXMPSignature         = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegExtendedXMPSignature = []byte("http://ns.adobe.com/xmp/extension/\x00")
+)
+
+// stripJPEGXMP returns a copy of a JPEG image without its XMP segments.
+func stripJPEGXMP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return append(out, data...)
+	}
+
+	out = append(out, data[:2]...)
+	i := 2
+	for i+4 <= len(data) {
+		marker := data[i+1]
+		// start of scan, the metadata is over
+		if data[i] != 0xFF || marker == 0xDA {
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+
+		segment := data[i+4 : end]
+		if marker != 0xE1 || !(bytes.HasPrefix(segment, jpegXMPSignature) || bytes.HasPrefix(segment, jpegExtendedXMPSignature)) {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return append(out, data[i:]...)
+}
+
+// Keyword of the iTXt chunk that holds the XMP packet of a PNG image.
+const pngXMPKeyword = "XML:com.adobe.xmp\x00"
+
+// stripPNGMetadata removes eXIf chunks and the iTXt chunk with the XMP
+// packet, the places PNG images keep GPS data.
+func stripPNGMetadata(data []byte) []byte {
+	const signatureLength = 8
+	if len(data) < signatureLength {
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:signatureLength]...)
+	i := signatureLength
+	for i+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		// length, type, data and CRC
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return data
+		}
+
+		switch typ := string(data[i+4 : i+8]); {
+		case typ == "eXIf":
+		case typ == "iTXt" && bytes.HasPrefix(data[i+8:end-4], []byte(pngXMPKeyword)):
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out
+}
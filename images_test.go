@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testExif builds a little endian EXIF structure with an orientation and a
+// GPS latitude of 0x11 bytes.
+func testExif(orientation uint16) []byte {
+	le := binary.LittleEndian
+	tiff := make([]byte, 80)
+	copy(tiff, "II")
+	le.PutUint16(tiff[2:], 42)
+	le.PutUint32(tiff[4:], 8)
+
+	// IFD0 with orientation and GPS pointer
+	le.PutUint16(tiff[8:], 2)
+	le.PutUint16(tiff[10:], exifTagOrientation)
+	le.PutUint16(tiff[12:], 3)
+	le.PutUint32(tiff[14:], 1)
+	le.PutUint16(tiff[18:], orientation)
+	le.PutUint16(tiff[22:], exifTagGPSInfo)
+	le.PutUint16(tiff[24:], 4)
+	le.PutUint32(tiff[26:], 1)
+	le.PutUint32(tiff[30:], 38)
+
+	// GPS IFD with the latitude as three rationals
+	le.PutUint16(tiff[38:], 1)
+	le.PutUint16(tiff[40:], 2)
+	le.PutUint16(tiff[42:], 5)
+	le.PutUint32(tiff[44:], 3)
+	le.PutUint32(tiff[48:], 56)
+	for i := 56; i < 80; i++ {
+		tiff[i] = 0x11
+	}
+
+	return tiff
+}
+
+func testJPEG(t *testing.T, w int, h int, exif []byte) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(2+6+len(exif)))
+	app1 = append(app1, "Exif\x00\x00"...)
+	app1 = append(app1, exif...)
+
+	return append(append([]byte{0xFF, 0xD8}, app1...), data[2:]...)
+}
+
+func TestProcessImage(t *testing.T) {
+	data := testJPEG(t, 640, 480, testExif(6))
+
+	p, err := processImage(data, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.Data) != len(data) {
+		t.Errorf("len(data) = %v, want %v", len(p.Data), len(data))
+	}
+	if bytes.Contains(p.Data, bytes.Repeat([]byte{0x11}, 24)) {
+		t.Errorf("GPS data wasn't removed")
+	}
+	if !bytes.Contains(data, bytes.Repeat([]byte{0x11}, 24)) {
+		t.Errorf("the upload was changed")
+	}
+	if o := exifOrientation(jpegExif(p.Data)); o != 6 {
+		t.Errorf("orientation = %v, want 6", o)
+	}
+
+	// rotated by 90 degrees
+	if p.Width != 480 || p.Height != 640 {
+		t.Errorf("size = %vx%v", p.Width, p.Height)
+	}
+	if p.ThumbnailWidth != 240 || p.ThumbnailHeight != thumbnailSize {
+		t.Errorf("thumbnail size = %vx%v", p.ThumbnailWidth, p.ThumbnailHeight)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(p.Thumbnail)); err != nil {
+		t.Errorf("thumbnail: %v", err)
+	}
+	if len(p.BlurHash) != 28 {
+		t.Errorf("blurhash = %q", p.BlurHash)
+	}
+
+	if _, err := processImage([]byte("not an image"), "image/jpeg"); err != ErrInvalidImage {
+		t.Errorf("invalid image: %v", err)
+	}
+}
+
+const testXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><exif:GPSLatitude>6,55.0N</exif:GPSLatitude></x:xmpmeta>`
+
+func TestStripJPEGXMP(t *testing.T) {
+	data := testJPEG(t, 64, 48, testExif(6))
+
+	xmp := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(xmp[2:], uint16(2+len(jpegXMPSignature)+len(testXMP)))
+	xmp = append(append(xmp, jpegXMPSignature...), testXMP...)
+	data = append(append(append([]byte{}, data[:2]...), xmp...), data[2:]...)
+
+	p, err := processImage(data, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(p.Data, []byte("GPSLatitude")) {
+		t.Errorf("XMP wasn't removed")
+	}
+	if len(p.Data) != len(data)-len(xmp) {
+		t.Errorf("len(data) = %v, want %v", len(p.Data), len(data)-len(xmp))
+	}
+	if o := exifOrientation(jpegExif(p.Data)); o != 6 {
+		t.Errorf("orientation = %v, want 6", o)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(p.Data)); err != nil {
+		t.Errorf("stripped image: %v", err)
+	}
+	if !bytes.Contains(data, []byte("GPSLatitude")) {
+		t.Errorf("the upload was changed")
+	}
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+
+	chunk := func(typ string, content string) []byte {
+		c := make([]byte, 4, 12+len(content))
+		binary.BigEndian.PutUint32(c, uint32(len(content)))
+		c = append(append(c, typ...), content...)
+		crc := make([]byte, 4)
+		binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(c[4:]))
+		return append(c, crc...)
+	}
+	// after the signature and IHDR
+	ihdrEnd := 8 + 12 + 13
+	var withMetadata []byte
+	withMetadata = append(withMetadata, data[:ihdrEnd]...)
+	withMetadata = append(withMetadata, chunk("iTXt", pngXMPKeyword+"\x00\x00\x00\x00"+testXMP)...)
+	withMetadata = append(withMetadata, chunk("eXIf", string(testExif(1)))...)
+	withMetadata = append(withMetadata, chunk("iTXt", "Comment\x00\x00\x00\x00\x00Freezer")...)
+	withMetadata = append(withMetadata, data[ihdrEnd:]...)
+
+	stripped := stripPNGMetadata(withMetadata)
+	if bytes.Contains(stripped, []byte("GPSLatitude")) || bytes.Contains(stripped, []byte("eXIf")) {
+		t.Errorf("metadata wasn't removed")
+	}
+	if !bytes.Contains(stripped, []byte("Freezer")) {
+		t.Errorf("other text was removed")
+	}
+	if _, err := png.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("stripped image: %v", err)
+	}
+}
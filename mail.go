@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kjk/betterguid"
+)
+
+type MailMessage struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+type MailSender interface {
+	Send(ctx context.Context, m MailMessage) error
+}
+
+// newMailSender picks the sender from the environment: mails are written to
+// MAIL_CAPTURE_DIR if it is set, sent to the SMTP server at SMTP_ADDR
+// otherwise. Without either there is no email channel and nil is returned.
+func newMailSender() MailSender {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Hamuwemu <no-reply@hamuwemu.app>"
+	}
+
+	if dir := os.Getenv("MAIL_CAPTURE_DIR"); dir != "" {
+		return FileMailSender{dir: dir, from: from}
+	}
+
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return nil
+	}
+	s := SMTPMailSender{addr: addr, from: from}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		s.auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return s
+}
+
+// SMTPMailSender sends through an SMTP server, with STARTTLS if the server
+// offers it.
+type SMTPMailSender struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (s SMTPMailSender) Send(ctx context.Context, m MailMessage) error {
+	msg, err := buildMail(s.from, m, time.Now())
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.addr, s.auth, envelopeAddress(s.from), []string{envelopeAddress(m.To)}, msg)
+}
+
+// FileMailSender writes each mail to an .eml file in dir instead of sending
+// it, for local testing.
+type FileMailSender struct {
+	dir  string
+	from string
+}
+
+func (s FileMailSender) Send(ctx context.Context, m MailMessage) error {
+	msg, err := buildMail(s.from, m, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	name := filepath.Join(s.dir, betterguid.New()+".eml")
+	if err := os.WriteFile(name, msg, 0644); err != nil {
+		return err
+	}
+	log.Printf("%s : Captured mail to %v in %v\n", ctx.Value(logPrefix), m.To, name)
+	return nil
+}
+
+// envelopeAddress strips the display name off an address like
+// "Hamuwemu <no-reply@hamuwemu.app>".
+func envelopeAddress(address string) string {
+	if a, err := mailAddress(address); err == nil {
+		return a
+	}
+	return address
+}
+
+// buildMail renders m as a multipart/alternative message with a plain text
+// and an HTML part.
+func buildMail(from string, m MailMessage, date time.Time) ([]byte, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	}
+	for _, p := range parts {
+		if p.content == "" {
+			continue
+		}
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(p.content)); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", m.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n", w.Boundary())
+	fmt.Fprintf(&msg, "\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"expvar"
 	"net/http"
 	"time"
 
@@ -63,7 +64,9 @@ var dynamoDbClient *dynamodb.Client
 var dbService *DatabaseService
 var dynamoDbRepository DynamoDbRepository
 var apnsClient *apns2.Client
+var apnsDevelopmentClient *apns2.Client
 var notificationService *NotificationService
+var webPushKeys *VAPIDKeys
 var presenceMap map[string]AddPresenceModel
 var presenceSubscribers map[string][]string
 
@@ -236,7 +239,9 @@ func configureKafka() {
 	writerCtxCancel = cancel
 }
 
-func configAPNSClient() *apns2.Client {
+// configAPNSClients returns clients for the production and the development
+// APNs environment, Xcode builds get development tokens.
+func configAPNSClients() (*apns2.Client, *apns2.Client) {
 	authKeyFile, err := readAPNSAuthKeyFileJson()
 	if err != nil {
 		log.Fatal("token error:", err)
@@ -263,7 +268,7 @@ func configAPNSClient() *apns2.Client {
 	// 	}
 	// `)
 
-	return apns2.NewTokenClient(token).Production()
+	return apns2.NewTokenClient(token).Production(), apns2.NewTokenClient(token).Development()
 	// res, err := client.Push(notification)
 
 	// if err != nil {
@@ -290,18 +295,22 @@ func main() {
 		done:       make(chan bool, 1),
 	}
 
+	configMessageEditWindow()
+	configAttachmentUrlSecret()
+
 	go hub.run(ctx)
 
 	dynamoDbClient = configureDynamoDbClient(ctx)
-	apnsClient = configAPNSClient()
+	apnsClient, apnsDevelopmentClient = configAPNSClients()
+	blobStore = configureBlobStore(ctx)
 	dbService = &DatabaseService{
 		dynamoDbRespository: &DynamoDbRepository{
 			client: dynamoDbClient,
 		},
 	}
-	notificationService = &NotificationService{
-		apnsClient: apnsClient,
-	}
+	searchIndex = openSearchIndex()
+	linkUnfurler = NewUnfurler()
+	linkUnfurler.start(ctx, unfurlWorkers)
 	presenceMap = make(map[string]AddPresenceModel)
 	presenceSubscribers = make(map[string][]string)
 
@@ -309,8 +318,24 @@ func main() {
 	createMessageTable(ctx, dynamoDbClient)
 	createDeviceTokenTable(ctx, dynamoDbClient)
 	createTaskTable(ctx, dynamoDbClient)
+	createTableIndex(ctx, dynamoDbClient, DDB_TABLE_TASK, DDB_INDEX_TASK_ASSIGNEE, "assignedTo", "")
 	createChatGroupTable(ctx, dynamoDbClient)
 	createChatGroupMemberTable(ctx, dynamoDbClient)
+	createTaskTemplateTable(ctx, dynamoDbClient)
+	createTaskEventTable(ctx, dynamoDbClient)
+	createTableIndex(ctx, dynamoDbClient, DDB_TABLE_TASK_EVENT, DDB_INDEX_TASK_EVENT_TIME, "chatId", "timestamp")
+	createChatMessageTable(ctx, dynamoDbClient)
+	createTableIndex(ctx, dynamoDbClient, DDB_TABLE_CHAT_MESSAGE, DDB_INDEX_CHAT_REPLY, "replyToMessageId", "id")
+	createReactionTable(ctx, dynamoDbClient)
+	createMentionTable(ctx, dynamoDbClient)
+	createAttachmentTable(ctx, dynamoDbClient)
+	createNotificationPreferencesTable(ctx, dynamoDbClient)
+	createUnreadTable(ctx, dynamoDbClient)
+	createNotificationLogTable(ctx, dynamoDbClient)
+	createTableIndex(ctx, dynamoDbClient, DDB_TABLE_NOTIFICATION_LOG, DDB_INDEX_NOTIFICATION_LOG_MESSAGE, "messageId", "id")
+	createNotificationJobTable(ctx, dynamoDbClient)
+	createNotificationDeadLetterTable(ctx, dynamoDbClient)
+	createNotificationDigestTable(ctx, dynamoDbClient)
 
 	// Build the request with its input parameters
 	resp, err := dynamoDbClient.ListTables(ctx, &dynamodb.ListTablesInput{
@@ -326,6 +351,45 @@ func main() {
 	}
 
 	configureFirebase()
+	// FCM needs the Firebase app
+	apnsProvider := NewAPNsProvider(apnsClient, apnsDevelopmentClient)
+	apnsProvider.onEnvironmentChanged = func(ctx context.Context, t AddTokenModel) {
+		dbService.addDeviceToken(ctx, t)
+	}
+	webPushKeys, err = loadVAPIDKeys(gin.Mode() == gin.ReleaseMode)
+	if err != nil {
+		log.Fatalf("failed to load VAPID keys, %v", err)
+	}
+	vapidSubject := os.Getenv("VAPID_SUBJECT")
+	if vapidSubject == "" {
+		vapidSubject = "mailto:no-reply@hamuwemu.app"
+	}
+	notificationService = &NotificationService{
+		providers: map[PushPlatform]PushProvider{
+			PushPlatformAPNs:    apnsProvider,
+			PushPlatformFCM:     FCMProvider{client: cloudMessagingClient},
+			PushPlatformWebPush: NewWebPushProvider(webPushKeys, vapidSubject),
+		},
+		reactionThrottle: newNotificationThrottle(reactionNotificationWindow),
+		templates:        openNotificationTemplates(),
+		auditLog:         newDbNotificationAuditLog(),
+	}
+	// the service is complete only after the aggregator and queue are set
+	notificationService.aggregator = newNotificationAggregator(notificationCollapseWindow, digestInterval, DbNotificationDigestStore{}, func(ctx context.Context, userId string, name NotificationTemplateName, data NotificationData, threadId string, collapseId string) {
+		notificationService.sendSummary(ctx, userId, name, data, threadId, collapseId)
+	})
+	notificationService.aggregator.start(ctx)
+	notificationService.queue = newNotificationQueue(DbNotificationJobStore{}, notificationWorkers(), func(ctx context.Context, job *NotificationJobModel) error {
+		return notificationService.handleJob(ctx, job)
+	})
+	notificationService.queue.start()
+
+	if sender := newMailSender(); sender != nil {
+		EmailDigester{sender: sender}.start(ctx)
+	} else {
+		log.Println("No SMTP_ADDR or MAIL_CAPTURE_DIR, email digests are off")
+	}
+
 	cognitoJWTAuth = configureAuthMiddleware()
 
 	router := gin.New()
@@ -358,6 +422,10 @@ func main() {
 
 	// router.GET("/users/:userId/messages/:messageId", getMessageByUserId)
 	router.POST("/users/:userId/messages/:messageId/ack", ackMessage)
+	router.GET("/users/:userId/tasks.ics", getUserTasksCalendar)
+	router.GET("/attachments/:attachmentId/content", getAttachmentContent)
+	router.GET("/attachments/:attachmentId/thumbnail", getAttachmentThumbnail)
+	router.GET("/webpush/vapid-public-key", getVAPIDPublicKey)
 
 	// Authorization group
 	// authorized := r.Group("/", AuthRequired())
@@ -371,6 +439,8 @@ func main() {
 		authorized.POST("/sync", syncContacts)
 		authorized.GET("/chatIds", getChatIds)
 		authorized.POST("/tokens", addToken)
+		authorized.POST("/webpush/subscriptions", addWebPushSubscription)
+		authorized.DELETE("/webpush/subscriptions", removeWebPushSubscription)
 		// authorized.POST("/groups", addGroup)
 		authorized.GET("/messages", getMessages)
 		authorized.POST("/ack", addDeliveredReceipt)
@@ -383,16 +453,45 @@ func main() {
 		authorized.GET("/workspaces/members", getWorkspaceMembers)
 		authorized.GET("/users", getUsers)
 		authorized.GET("/users/:userId", getUserById)
+		authorized.POST("/users/me/calendar", addCalendarFeed)
+		authorized.GET("/users/me/mentions", getUserMentions)
+		authorized.GET("/users/me/unread", getUnreadCounts)
+		authorized.PUT("/users/me/locale", updateUserLocale)
+		authorized.GET("/users/me/notification-preferences", getNotificationPreferences)
+		authorized.PUT("/users/me/notification-preferences", updateNotificationPreferences)
 		authorized.GET("/presence/:peerId", getUserPresenceById)
 		authorized.POST("/tasks", addTask)
 		authorized.POST("/groups", addChatGroup)
 		authorized.POST("/groups/:groupId/members", addChatGroupMember)
+		authorized.DELETE("/groups/:groupId/members/:userId", removeChatGroupMember)
+		authorized.POST("/groups/:groupId/templates", addTaskTemplate)
+		authorized.GET("/groups/:groupId/templates", getTaskTemplates)
+		authorized.POST("/groups/:groupId/tasks", addBulkTasks)
+		authorized.GET("/groups/:groupId/analytics", getGroupAnalytics)
 		authorized.POST("/chats", addChat)
+		authorized.GET("/chats/:chatId/messages/:messageId/replies", getChatMessageReplies)
+		authorized.PUT("/chats/:chatId/mute", setChatMute)
+		authorized.DELETE("/chats/:chatId/mute", setChatMute)
+		authorized.POST("/attachments", addAttachment)
+		authorized.GET("/attachments/:attachmentId", getAttachment)
+		authorized.GET("/search", search)
+		authorized.PUT("/attachments/:attachmentId/chunks", addAttachmentChunk)
+		authorized.POST("/attachments/:attachmentId/complete", completeAttachment)
 		authorized.GET("/ws", func(c *gin.Context) {
 			userUid := c.MustGet(uidKey).(string)
 			serveWs(ctx, hub, c.Writer, c.Request, userUid, 0)
 			fmt.Println("Listening for events from ", userUid)
 		})
+
+		admin := authorized.Group("/admin")
+		admin.Use(AdminRequiredMiddleware())
+		{
+			admin.GET("/notifications", getNotificationLog)
+			admin.GET("/notifications/stats", getNotificationStats)
+			admin.GET("/notifications/dead-letters", getNotificationDeadLetters)
+			// counters like push_failures
+			admin.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+		}
 	}
 
 	// router.Run("localhost:8080")
@@ -419,6 +518,16 @@ func main() {
 		cancel()
 		<-hub.done
 
+		log.Println("Draining notification queue")
+		if !notificationService.queue.drain(notificationQueueDrainTimeout) {
+			log.Println("Notification queue didn't drain, the rest is sent on the next start")
+		}
+
+		log.Println("Closing search index")
+		if err := searchIndex.Close(); err != nil {
+			log.Printf("failed to close search index: %v", err)
+		}
+
 		log.Println("Closing Writer")
 		if err := w.Close(); err != nil {
 			log.Fatal("failed to close writer:", err)
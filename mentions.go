@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kjk/betterguid"
+)
+
+// Upper bound for the mentions in a single message, anything beyond is dropped.
+const maxMentions = 20
+
+// Number of mentions returned by GET /users/me/mentions when no limit is
+// given, and the most it returns.
+const (
+	defaultMentionsLimit = 50
+	maxMentionsLimit     = 200
+)
+
+// MentionModel is a mention of a user, stored per mentioned user so they can
+// list them later.
+type MentionModel struct {
+	UserId    string    `json:"userId" dynamodbav:"userId"`
+	Id        string    `json:"id" dynamodbav:"id"`
+	ChatId    string    `json:"chatId" dynamodbav:"chatId"`
+	MessageId string    `json:"messageId" dynamodbav:"messageId"`
+	TaskId    string    `json:"taskId,omitempty" dynamodbav:"taskId,omitempty"`
+	TaskTitle string    `json:"taskTitle,omitempty" dynamodbav:"taskTitle,omitempty"`
+	Message   string    `json:"message" dynamodbav:"message"`
+	SentBy    string    `json:"sentBy" dynamodbav:"sentBy"`
+	Timestamp time.Time `json:"timestamp" dynamodbav:"timestamp"`
+}
+
+// isValidMentionRange checks that r, a location and length in UTF-16 code
+// units like an NSRange on iOS, lies within message.
+func isValidMentionRange(message string, r [2]int) bool {
+	length := len(utf16.Encode([]rune(message)))
+	return r[0] >= 0 && r[1] > 0 && r[0]+r[1] <= length
+}
+
+// validateMentions drops mentions with invalid ranges, of users that aren't
+// members of the chat and of the sender, and keeps one mention per user.
+func validateMentions(message string, mentions []Mention, members []AddChatGroupMemberModel, sentBy string) []Mention {
+	var valid []Mention
+	seen := make(map[string]bool)
+	for _, m := range mentions {
+		if len(valid) == maxMentions {
+			break
+		}
+
+		if seen[m.Uid] || m.Uid == sentBy || !isChatGroupMember(members, m.Uid) || !isValidMentionRange(message, m.Range) {
+			continue
+		}
+		seen[m.Uid] = true
+
+		if m.Id == "" {
+			m.Id = betterguid.New()
+		}
+		valid = append(valid, m)
+	}
+	return valid
+}
+
+// validateTaskMentions drops mentions with invalid ranges and of tasks that
+// don't belong to the chat. The title is always the current task title.
+func validateTaskMentions(ctx context.Context, message string, mentions []TaskMention, chatId string) []TaskMention {
+	var valid []TaskMention
+	seen := make(map[string]bool)
+	for _, m := range mentions {
+		if len(valid) == maxMentions {
+			break
+		}
+
+		if seen[m.Uid] || !isValidMentionRange(message, m.Range) {
+			continue
+		}
+
+		task, err := dbService.getTaskById(ctx, m.Uid)
+		if err != nil || task.GroupUid != chatId {
+			continue
+		}
+		seen[m.Uid] = true
+
+		if m.Id == "" {
+			m.Id = betterguid.New()
+		}
+		m.Title = task.Title
+		valid = append(valid, m)
+	}
+	return valid
+}
+
+func isMentioned(mentions []Mention, userId string) bool {
+	for _, m := range mentions {
+		if m.Uid == userId {
+			return true
+		}
+	}
+	return false
+}
+
+func mentionedUserIds(mentions []Mention) []string {
+	var ids []string
+	for _, m := range mentions {
+		ids = append(ids, m.Uid)
+	}
+	return ids
+}
+
+// saveMentions stores the mentions of a message and notifies the mentioned users.
+func saveMentions(ctx context.Context, mentions []Mention, mention MentionModel) {
+	for _, m := range mentions {
+		mention.UserId = m.Uid
+		mention.Id = betterguid.New()
+		if err := dbService.addMention(ctx, mention); err != nil {
+			log.Printf("%s : Couldn't save mention of %v. Here's why: %v\n", ctx.Value(logPrefix), m.Uid, err)
+		}
+
+		mention := mention
+		notificationService.enqueue(ctx, NotificationJobModel{Kind: NotificationJobMention, Mention: &mention})
+	}
+}
+
+func getUserMentions(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+
+	limit := defaultMentionsLimit
+	if v := c.Query("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 {
+			respondWithError(c, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = l
+	}
+	if limit > maxMentionsLimit {
+		limit = maxMentionsLimit
+	}
+
+	mentions, err := dbService.getMentions(c, uid, int32(limit))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"data": mentions})
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestValidateMentions(t *testing.T) {
+	members := []AddChatGroupMemberModel{
+		{ChatId: "g1", MemberUserId: "alice"},
+		{ChatId: "g1", MemberUserId: "bob"},
+		{ChatId: "g1", MemberUserId: "carol"},
+	}
+
+	// "🎉" is two UTF-16 code units
+	message := "🎉 @bob and @carol, see @dave"
+	mentions := []Mention{
+		{Uid: "bob", Range: [2]int{3, 4}},
+		{Uid: "bob", Range: [2]int{3, 4}},
+		{Uid: "carol", Range: [2]int{12, 6}},
+		{Uid: "dave", Range: [2]int{24, 5}},
+		{Uid: "alice", Range: [2]int{0, 2}},
+		{Uid: "carol", Range: [2]int{25, 10}},
+	}
+
+	valid := validateMentions(message, mentions, members, "alice")
+	if len(valid) != 2 || valid[0].Uid != "bob" || valid[1].Uid != "carol" {
+		t.Fatalf("valid = %+v", valid)
+	}
+	if valid[0].Id == "" {
+		t.Errorf("mention id not set")
+	}
+
+	if isValidMentionRange(message, [2]int{24, 6}) || !isValidMentionRange(message, [2]int{24, 5}) {
+		t.Errorf("unexpected range validation")
+	}
+}
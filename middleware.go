@@ -3,6 +3,8 @@ package main
 import (
 	"errors"
 	"log"
+	"net/http"
+	"os"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -130,3 +132,23 @@ func FirebaseJWTTokenAuthMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// AdminRequiredMiddleware lets through the users in ADMIN_USER_IDS, a comma
+// separated list of user ids. It has to run after the token was verified.
+func AdminRequiredMiddleware() gin.HandlerFunc {
+	admins := make(map[string]bool)
+	for _, id := range strings.Split(os.Getenv("ADMIN_USER_IDS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			admins[id] = true
+		}
+	}
+
+	return func(c *gin.Context) {
+		uid := c.MustGet(uidKey).(string)
+		if !admins[uid] {
+			respondWithError(c, http.StatusForbidden, "Admins only")
+			return
+		}
+		c.Next()
+	}
+}
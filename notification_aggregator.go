@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// Notifications for a thread that follow within this long of each other
+	// are collapsed into one alert.
+	notificationCollapseWindow = 10 * time.Second
+	digestInterval             = time.Hour
+	// APNs rejects longer collapse ids
+	maxCollapseIdLength = 64
+)
+
+// notificationBurst is a series of notifications to one user about one
+// thread. The first is sent right away, the others are summed up in an
+// alert that replaces it on the device.
+type notificationBurst struct {
+	threadId   string
+	collapseId string
+	firstMid   string
+	first      NotificationData
+	senders    map[string]bool
+	// ids of the messages, so a retried notification is counted once
+	mids map[string]bool
+	// notifications since the last alert of the burst
+	pending int
+}
+
+// NotificationDigestModel collects the notifications of a user in digest
+// mode until the next digest.
+type NotificationDigestModel struct {
+	UserId string           `dynamodbav:"userId"`
+	First  NotificationData `dynamodbav:"first"`
+	// Uids of the senders
+	Senders []string `dynamodbav:"senders,stringset,omitempty"`
+	// Ids of the messages, so a retried notification is counted once
+	MessageIds []string `dynamodbav:"mids,stringset,omitempty"`
+	// Notifications without a message id
+	Count int `dynamodbav:"count"`
+}
+
+// notifications is the number of notifications in the digest.
+func (d NotificationDigestModel) notifications() int {
+	return len(d.MessageIds) + d.Count
+}
+
+// NotificationDigestStore keeps the digests until they are sent, so they
+// survive a restart.
+type NotificationDigestStore interface {
+	add(ctx context.Context, userId string, mid string, data NotificationData) error
+	// take removes and returns every digest
+	take(ctx context.Context) ([]NotificationDigestModel, error)
+}
+
+// DbNotificationDigestStore keeps digests in the NotificationDigest table.
+type DbNotificationDigestStore struct{}
+
+func (DbNotificationDigestStore) add(ctx context.Context, userId string, mid string, data NotificationData) error {
+	return dbService.addNotificationDigest(ctx, userId, mid, data)
+}
+
+func (DbNotificationDigestStore) take(ctx context.Context) ([]NotificationDigestModel, error) {
+	userIds, err := dbService.getNotificationDigestUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var digests []NotificationDigestModel
+	for _, userId := range userIds {
+		d, err := dbService.takeNotificationDigest(ctx, userId)
+		if err != nil {
+			// left for the next digest
+			continue
+		}
+		if d != nil {
+			digests = append(digests, *d)
+		}
+	}
+	return digests, nil
+}
+
+type NotificationAggregator struct {
+	window         time.Duration
+	digestInterval time.Duration
+	digests        NotificationDigestStore
+	// summarize renders template name and sends it to userId
+	summarize func(ctx context.Context, userId string, name NotificationTemplateName, data NotificationData, threadId string, collapseId string)
+
+	mu     sync.Mutex
+	bursts map[string]*notificationBurst
+}
+
+func newNotificationAggregator(window time.Duration, digestInterval time.Duration, digests NotificationDigestStore, summarize func(ctx context.Context, userId string, name NotificationTemplateName, data NotificationData, threadId string, collapseId string)) *NotificationAggregator {
+	return &NotificationAggregator{
+		window:         window,
+		digestInterval: digestInterval,
+		digests:        digests,
+		summarize:      summarize,
+		bursts:         make(map[string]*notificationBurst),
+	}
+}
+
+// collapseIdFor returns the collapse id of a burst starting with message mid.
+func collapseIdFor(threadId string, mid string) string {
+	id := threadId + "." + mid
+	if len(id) > maxCollapseIdLength {
+		return fmt.Sprintf("%x", sha1.Sum([]byte(id)))
+	}
+	return id
+}
+
+// add counts a notification for threadId. It returns true when the
+// notification starts a burst and has to be sent now, with the returned
+// collapse id. Otherwise it is part of the next summary. A notification for
+// message mid is counted once, however often its job is retried.
+func (a *NotificationAggregator) add(userId string, threadId string, mid string, data NotificationData) (string, bool) {
+	key := userId + "/" + threadId
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if b, ok := a.bursts[key]; ok {
+		if b.mids[mid] {
+			// a retry, the first notification is sent again if it failed
+			return b.collapseId, mid == b.firstMid
+		}
+		b.mids[mid] = true
+		b.pending++
+		b.senders[data.Sender.Uid] = true
+		return b.collapseId, false
+	}
+
+	b := &notificationBurst{
+		threadId:   threadId,
+		collapseId: collapseIdFor(threadId, mid),
+		firstMid:   mid,
+		first:      data,
+		senders:    map[string]bool{data.Sender.Uid: true},
+		mids:       map[string]bool{mid: true},
+	}
+	a.bursts[key] = b
+	time.AfterFunc(a.window, func() { a.flushBurst(userId, key) })
+	return b.collapseId, true
+}
+
+// flushBurst sends the summary of the notifications that came in since the
+// last alert. The burst ends after a window without notifications.
+func (a *NotificationAggregator) flushBurst(userId string, key string) {
+	a.mu.Lock()
+	b, ok := a.bursts[key]
+	if !ok {
+		a.mu.Unlock()
+		return
+	}
+	if b.pending == 0 {
+		delete(a.bursts, key)
+		a.mu.Unlock()
+		return
+	}
+
+	data := b.first
+	data.Count = len(b.mids)
+	data.Others = len(b.senders) - 1
+	b.pending = 0
+	time.AfterFunc(a.window, func() { a.flushBurst(userId, key) })
+	a.mu.Unlock()
+
+	ctx := context.WithValue(context.Background(), logPrefix, userId+"/collapsedNotification")
+	a.summarize(ctx, userId, TemplateCollapsed, data, b.threadId, b.collapseId)
+}
+
+// addToDigest holds the notification for message mid for the next digest of
+// userId.
+func (a *NotificationAggregator) addToDigest(ctx context.Context, userId string, mid string, data NotificationData) error {
+	err := a.digests.add(ctx, userId, mid, data)
+	if err != nil {
+		log.Printf("%s : Couldn't hold notification for the digest of %v. Here's why: %v\n", ctx.Value(logPrefix), userId, err)
+	}
+	return err
+}
+
+// flushDigests sends every user with held notifications their digest.
+func (a *NotificationAggregator) flushDigests() {
+	digests, err := a.digests.take(context.Background())
+	if err != nil {
+		log.Printf("Couldn't load notification digests. Here's why: %v\n", err)
+		return
+	}
+
+	for _, d := range digests {
+		data := NotificationData{
+			Sender: d.First.Sender,
+			Count:  d.notifications(),
+		}
+		if len(d.Senders) > 1 {
+			data.Others = len(d.Senders) - 1
+		}
+		ctx := context.WithValue(context.Background(), logPrefix, d.UserId+"/notificationDigest")
+		a.summarize(ctx, d.UserId, TemplateDigest, data, "digest", "")
+	}
+}
+
+// start sends the digests every digestInterval until ctx is done.
+func (a *NotificationAggregator) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(a.digestInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				a.flushDigests()
+			}
+		}
+	}()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type summaryCall struct {
+	userId     string
+	name       NotificationTemplateName
+	data       NotificationData
+	threadId   string
+	collapseId string
+}
+
+type summaryRecorder struct {
+	mu    sync.Mutex
+	calls []summaryCall
+}
+
+func (r *summaryRecorder) summarize(ctx context.Context, userId string, name NotificationTemplateName, data NotificationData, threadId string, collapseId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, summaryCall{userId, name, data, threadId, collapseId})
+}
+
+func (r *summaryRecorder) summaries() []summaryCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]summaryCall(nil), r.calls...)
+}
+
+// memoryDigestStore keeps digests in a map instead of DynamoDB.
+type memoryDigestStore struct {
+	mu      sync.Mutex
+	digests map[string]*NotificationDigestModel
+}
+
+func (s *memoryDigestStore) add(ctx context.Context, userId string, mid string, data NotificationData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.digests[userId]
+	if !ok {
+		d = &NotificationDigestModel{UserId: userId, First: data}
+		s.digests[userId] = d
+	}
+	d.MessageIds = addToStringSet(d.MessageIds, mid)
+	d.Senders = addToStringSet(d.Senders, data.Sender.Uid)
+	return nil
+}
+
+func addToStringSet(set []string, s string) []string {
+	for _, e := range set {
+		if e == s {
+			return set
+		}
+	}
+	return append(set, s)
+}
+
+func (s *memoryDigestStore) take(ctx context.Context) ([]NotificationDigestModel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var digests []NotificationDigestModel
+	for _, d := range s.digests {
+		digests = append(digests, *d)
+	}
+	s.digests = make(map[string]*NotificationDigestModel)
+	return digests, nil
+}
+
+func TestNotificationAggregatorCollapses(t *testing.T) {
+	r := &summaryRecorder{}
+	a := newNotificationAggregator(50*time.Millisecond, time.Hour, &memoryDigestStore{}, r.summarize)
+
+	ann := NotificationData{Sender: AddUserModel{Uid: "ann"}}
+	bob := NotificationData{Sender: AddUserModel{Uid: "bob"}}
+
+	collapseId, sendNow := a.add("u1", "t1", "m1", ann)
+	if !sendNow || collapseId != "t1.m1" {
+		t.Fatalf("first notification: %v %v", collapseId, sendNow)
+	}
+	if _, sendNow := a.add("u1", "t1", "m2", bob); sendNow {
+		t.Errorf("second notification was sent right away")
+	}
+	if _, sendNow := a.add("u1", "t1", "m3", ann); sendNow {
+		t.Errorf("third notification was sent right away")
+	}
+	// retried jobs
+	if _, sendNow := a.add("u1", "t1", "m2", bob); sendNow {
+		t.Errorf("retried notification was sent right away")
+	}
+	if _, sendNow := a.add("u1", "t1", "m1", ann); !sendNow {
+		t.Errorf("retried first notification was held")
+	}
+	if _, sendNow := a.add("u2", "t1", "m1", ann); !sendNow {
+		t.Errorf("notification to another user was held")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	calls := r.summaries()
+	if len(calls) != 1 {
+		t.Fatalf("%v summaries, want 1", len(calls))
+	}
+	c := calls[0]
+	if c.userId != "u1" || c.name != TemplateCollapsed || c.collapseId != "t1.m1" || c.data.Count != 3 || c.data.Others != 1 || c.data.Sender.Uid != "ann" {
+		t.Errorf("summary = %+v", c)
+	}
+
+	// the burst ended
+	if _, sendNow := a.add("u1", "t1", "m4", ann); !sendNow {
+		t.Errorf("notification after the burst was held")
+	}
+}
+
+func TestNotificationAggregatorDigest(t *testing.T) {
+	r := &summaryRecorder{}
+	store := &memoryDigestStore{digests: make(map[string]*NotificationDigestModel)}
+	a := newNotificationAggregator(time.Minute, time.Hour, store, r.summarize)
+
+	ctx := context.Background()
+	a.addToDigest(ctx, "u1", "m1", NotificationData{Sender: AddUserModel{Uid: "ann"}})
+	a.addToDigest(ctx, "u1", "m2", NotificationData{Sender: AddUserModel{Uid: "bob"}})
+	a.addToDigest(ctx, "u1", "m3", NotificationData{Sender: AddUserModel{Uid: "ann"}})
+	// a retried job
+	a.addToDigest(ctx, "u1", "m2", NotificationData{Sender: AddUserModel{Uid: "bob"}})
+	a.flushDigests()
+	a.flushDigests()
+
+	calls := r.summaries()
+	if len(calls) != 1 || calls[0].name != TemplateDigest || calls[0].data.Count != 3 || calls[0].data.Others != 1 || calls[0].data.Sender.Uid != "ann" {
+		t.Errorf("summaries = %+v", calls)
+	}
+}
+
+func TestCollapseIdFor(t *testing.T) {
+	if id := collapseIdFor(strings.Repeat("t", 60), "m1"); len(id) > maxCollapseIdLength {
+		t.Errorf("collapse id %q is too long", id)
+	}
+}
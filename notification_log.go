@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kjk/betterguid"
+)
+
+const (
+	defaultNotificationLogRetention = 30 * 24 * time.Hour
+	defaultNotificationLogResults   = 100
+	maxNotificationLogResults       = 500
+)
+
+type NotificationLogStatus string
+
+const (
+	NotificationLogSent   NotificationLogStatus = "sent"
+	NotificationLogFailed NotificationLogStatus = "failed"
+	// The push service rejected the token and it was deleted
+	NotificationLogInvalidToken NotificationLogStatus = "invalidToken"
+)
+
+// NotificationLogModel is one attempt to push a notification to one token.
+type NotificationLogModel struct {
+	// The recipient
+	UserId string `json:"userId" dynamodbav:"userId"`
+	// Sorts by time
+	Id string `json:"id" dynamodbav:"id"`
+	// Template of the notification, like newTask or mention
+	Event string `json:"event" dynamodbav:"event"`
+	// Key of the messageId index, which can't be empty
+	MessageId string `json:"mid" dynamodbav:"messageId,omitempty"`
+	// tokenFingerprint of the device token or Web Push endpoint
+	Token      string                `json:"token" dynamodbav:"token"`
+	Platform   PushPlatform          `json:"platform" dynamodbav:"platform"`
+	Status     NotificationLogStatus `json:"status" dynamodbav:"status"`
+	StatusCode int                   `json:"statusCode,omitempty" dynamodbav:"statusCode,omitempty"`
+	Reason     string                `json:"reason,omitempty" dynamodbav:"reason,omitempty"`
+	Error      string                `json:"error,omitempty" dynamodbav:"error,omitempty"`
+	// Time the provider took for the batch the token was sent in
+	LatencyMs int64     `json:"latencyMs" dynamodbav:"latencyMs"`
+	Timestamp time.Time `json:"timestamp" dynamodbav:"timestamp"`
+	// Unix time DynamoDB deletes the entry at
+	ExpiresAt int64 `json:"expiresAt" dynamodbav:"expiresAt"`
+}
+
+// tokenFingerprint stands in for a device token or Web Push endpoint in the
+// log, which admins read. It is the start of the token's SHA-256.
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// newNotificationLogEntry describes the result err of pushing n to t.
+func newNotificationLogEntry(n PushNotification, platform PushPlatform, t AddTokenModel, err error, latency time.Duration, now time.Time) NotificationLogModel {
+	e := NotificationLogModel{
+		UserId:    t.UserId,
+		Event:     n.Event,
+		MessageId: n.Data["mid"],
+		Token:     tokenFingerprint(t.Token),
+		Platform:  platform,
+		Status:    NotificationLogSent,
+		LatencyMs: latency.Milliseconds(),
+		Timestamp: now,
+	}
+	if err == nil {
+		return e
+	}
+
+	e.Status = NotificationLogFailed
+	if errors.Is(err, ErrPushTokenInvalid) {
+		e.Status = NotificationLogInvalidToken
+	}
+	e.Error = err.Error()
+	if t.Token != "" {
+		// transport errors quote the endpoint
+		e.Error = strings.ReplaceAll(e.Error, t.Token, e.Token)
+	}
+	var pe *PushError
+	if errors.As(err, &pe) {
+		e.StatusCode = pe.StatusCode
+		e.Reason = pe.Reason
+	}
+	return e
+}
+
+// NotificationAuditLog keeps the log entries of push attempts.
+type NotificationAuditLog interface {
+	record(ctx context.Context, entries []NotificationLogModel)
+}
+
+// DbNotificationAuditLog stores entries in the NotificationLog table, which
+// drops them after retention.
+type DbNotificationAuditLog struct {
+	retention time.Duration
+}
+
+// newDbNotificationAuditLog keeps entries for NOTIFICATION_LOG_RETENTION_DAYS,
+// 30 days by default.
+func newDbNotificationAuditLog() DbNotificationAuditLog {
+	retention := defaultNotificationLogRetention
+	if days, err := strconv.Atoi(os.Getenv("NOTIFICATION_LOG_RETENTION_DAYS")); err == nil && days > 0 {
+		retention = time.Duration(days) * 24 * time.Hour
+	}
+	return DbNotificationAuditLog{retention: retention}
+}
+
+func (l DbNotificationAuditLog) record(ctx context.Context, entries []NotificationLogModel) {
+	for _, e := range entries {
+		e.Id = betterguid.New()
+		e.ExpiresAt = e.Timestamp.Add(l.retention).Unix()
+		if err := dbService.addNotificationLog(ctx, e); err != nil {
+			log.Printf("%s : Couldn't record notification to %v. Here's why: %v\n", ctx.Value(logPrefix), e.UserId, err)
+		}
+	}
+}
+
+// NotificationProviderStats counts the push attempts of one provider.
+type NotificationProviderStats struct {
+	Attempts      int64   `json:"attempts"`
+	Sent          int64   `json:"sent"`
+	Failed        int64   `json:"failed"`
+	InvalidTokens int64   `json:"invalidTokens"`
+	SuccessRate   float64 `json:"successRate"`
+	AvgLatencyMs  float64 `json:"avgLatencyMs"`
+	latencyMs     int64
+}
+
+// NotificationStats counts push attempts by provider since the server
+// started.
+type NotificationStats struct {
+	mu        sync.Mutex
+	providers map[PushPlatform]*NotificationProviderStats
+	since     time.Time
+}
+
+var notificationStats = newNotificationStats()
+
+func newNotificationStats() *NotificationStats {
+	return &NotificationStats{providers: make(map[PushPlatform]*NotificationProviderStats), since: time.Now().UTC()}
+}
+
+func (s *NotificationStats) add(entries []NotificationLogModel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range entries {
+		p, ok := s.providers[e.Platform]
+		if !ok {
+			p = &NotificationProviderStats{}
+			s.providers[e.Platform] = p
+		}
+		p.Attempts++
+		p.latencyMs += e.LatencyMs
+		switch e.Status {
+		case NotificationLogSent:
+			p.Sent++
+		case NotificationLogInvalidToken:
+			p.InvalidTokens++
+		default:
+			p.Failed++
+		}
+	}
+}
+
+// snapshot returns a copy of the counts with the rates filled in.
+func (s *NotificationStats) snapshot() map[PushPlatform]NotificationProviderStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make(map[PushPlatform]NotificationProviderStats, len(s.providers))
+	for platform, p := range s.providers {
+		c := *p
+		if c.Attempts > 0 {
+			c.SuccessRate = float64(c.Sent) / float64(c.Attempts)
+			c.AvgLatencyMs = float64(c.latencyMs) / float64(c.Attempts)
+		}
+		stats[platform] = c
+	}
+	return stats
+}
+
+// recordNotification adds the results of pushing n to the stats and the
+// audit log.
+func (ns NotificationService) recordNotification(ctx context.Context, n PushNotification, platform PushPlatform, tokens []AddTokenModel, errs []error, latency time.Duration) {
+	now := time.Now().UTC()
+	entries := make([]NotificationLogModel, len(tokens))
+	for i, t := range tokens {
+		var err error
+		if i < len(errs) {
+			err = errs[i]
+		}
+		entries[i] = newNotificationLogEntry(n, platform, t, err, latency, now)
+	}
+
+	notificationStats.add(entries)
+	if ns.auditLog != nil {
+		ns.auditLog.record(ctx, entries)
+	}
+}
+
+func getNotificationLog(c *gin.Context) {
+	userId := c.Query("userId")
+	mid := c.Query("mid")
+	if userId == "" && mid == "" {
+		respondWithError(c, http.StatusBadRequest, "userId or mid is required")
+		return
+	}
+
+	limit := defaultNotificationLogResults
+	if s := c.Query("limit"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l < 1 || l > maxNotificationLogResults {
+			respondWithError(c, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = l
+	}
+
+	entries, err := dbService.getNotificationLog(c, userId, mid, limit)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	// newest first
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Id > entries[j].Id
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"data": entries})
+}
+
+func getNotificationStats(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, gin.H{"data": gin.H{
+		"since":     notificationStats.since,
+		"providers": notificationStats.snapshot(),
+	}})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeAuditLog struct {
+	mu      sync.Mutex
+	entries []NotificationLogModel
+}
+
+func (l *fakeAuditLog) record(ctx context.Context, entries []NotificationLogModel) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, entries...)
+}
+
+func TestSendNotificationRecordsAttempts(t *testing.T) {
+	gone := &PushError{Platform: PushPlatformFCM, StatusCode: 404, Reason: "UNREGISTERED", Err: ErrPushTokenInvalid}
+	apns := &fakePushProvider{errors: map[string]error{"busy": &PushError{Platform: PushPlatformAPNs, StatusCode: 429, Reason: "TooManyRequests"}}}
+	audit := &fakeAuditLog{}
+	ns := NotificationService{
+		providers: map[PushPlatform]PushProvider{PushPlatformAPNs: apns},
+		auditLog:  audit,
+	}
+
+	n := newAlertNotification("Ann", "", "Hi", "c1", "m1", "u1")
+	n.Event = string(TemplateChatMessage)
+	// FCM has no provider yet
+	ns.sendNotification(context.Background(), n, []AddTokenModel{
+		{UserId: "u1", Token: "ios"},
+		{UserId: "u1", Token: "busy"},
+		{UserId: "u1", Token: "android", Platform: PushPlatformFCM},
+	})
+
+	// the log has fingerprints instead of tokens
+	byToken := make(map[string]NotificationLogModel)
+	for _, e := range audit.entries {
+		byToken[e.Token] = e
+	}
+	if len(byToken) != 3 {
+		t.Fatalf("entries = %+v", audit.entries)
+	}
+	if e := byToken[tokenFingerprint("ios")]; e.Status != NotificationLogSent || e.Event != "chatMessage" || e.MessageId != "m1" || e.UserId != "u1" || e.Platform != PushPlatformAPNs {
+		t.Errorf("ios = %+v", e)
+	}
+	if e := byToken[tokenFingerprint("busy")]; e.Status != NotificationLogFailed || e.StatusCode != 429 || e.Reason != "TooManyRequests" {
+		t.Errorf("busy = %+v", e)
+	}
+	if e := byToken[tokenFingerprint("android")]; e.Status != NotificationLogFailed || e.Reason != "NoProvider" {
+		t.Errorf("android = %+v", e)
+	}
+
+	e := newNotificationLogEntry(n, PushPlatformFCM, AddTokenModel{UserId: "u1", Token: "gone"}, gone, 0, time.Now())
+	if e.Status != NotificationLogInvalidToken || e.StatusCode != 404 || e.Token != tokenFingerprint("gone") {
+		t.Errorf("gone = %+v", e)
+	}
+
+	endpoint := "https://push.example.com/send/abc"
+	e = newNotificationLogEntry(n, PushPlatformWebPush, AddTokenModel{UserId: "u1", Token: endpoint}, &PushError{Platform: PushPlatformWebPush, Reason: "Transport", Err: errors.New(`Post "` + endpoint + `": timeout`)}, 0, time.Now())
+	if strings.Contains(e.Token+e.Error, endpoint) {
+		t.Errorf("endpoint in entry %+v", e)
+	}
+}
+
+func TestNotificationStats(t *testing.T) {
+	s := newNotificationStats()
+	s.add([]NotificationLogModel{
+		{Platform: PushPlatformAPNs, Status: NotificationLogSent, LatencyMs: 10},
+		{Platform: PushPlatformAPNs, Status: NotificationLogSent, LatencyMs: 30},
+		{Platform: PushPlatformAPNs, Status: NotificationLogFailed, LatencyMs: 20},
+		{Platform: PushPlatformAPNs, Status: NotificationLogInvalidToken, LatencyMs: 20},
+		{Platform: PushPlatformWebPush, Status: NotificationLogSent, LatencyMs: 5},
+	})
+
+	stats := s.snapshot()
+	apns := stats[PushPlatformAPNs]
+	if apns.Attempts != 4 || apns.Sent != 2 || apns.Failed != 1 || apns.InvalidTokens != 1 || apns.SuccessRate != 0.5 || apns.AvgLatencyMs != 20 {
+		t.Errorf("apns = %+v", apns)
+	}
+	if web := stats[PushPlatformWebPush]; web.SuccessRate != 1 {
+		t.Errorf("webpush = %+v", web)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	// the busybox image has no zoneinfo for do not disturb time zones
+	_ "time/tzdata"
+
+	"github.com/gin-gonic/gin"
+)
+
+type NotificationEventType string
+
+const (
+	NotificationChatMessage    NotificationEventType = "chatMessage"
+	NotificationReply          NotificationEventType = "reply"
+	NotificationMention        NotificationEventType = "mention"
+	NotificationNewTask        NotificationEventType = "newTask"
+	NotificationTaskMessage    NotificationEventType = "taskMessage"
+	NotificationTaskReminder   NotificationEventType = "taskReminder"
+	NotificationTaskStatus     NotificationEventType = "taskStatus"
+	NotificationWaitingRequest NotificationEventType = "waitingRequest"
+	NotificationReaction       NotificationEventType = "reaction"
+)
+
+var notificationEventTypes = []NotificationEventType{
+	NotificationChatMessage,
+	NotificationReply,
+	NotificationMention,
+	NotificationNewTask,
+	NotificationTaskMessage,
+	NotificationTaskReminder,
+	NotificationTaskStatus,
+	NotificationWaitingRequest,
+	NotificationReaction,
+}
+
+// Replies and mentions are addressed to the user, so they come through a
+// muted chat.
+var notificationEventsIgnoringMute = []NotificationEventType{NotificationReply, NotificationMention}
+
+const dndTimeLayout = "15:04"
+
+// DoNotDisturbModel silences notifications every day from Start to End, in
+// the time zone of the user. Start after End spans midnight.
+type DoNotDisturbModel struct {
+	IsEnabled bool   `json:"isEnabled" dynamodbav:"isEnabled"`
+	Start     string `json:"start" dynamodbav:"start"`
+	End       string `json:"end" dynamodbav:"end"`
+	// IANA name like "Asia/Colombo"
+	TimeZone string `json:"timeZone" dynamodbav:"timeZone"`
+}
+
+type NotificationPreferencesModel struct {
+	UserId       string            `json:"userId" dynamodbav:"userId"`
+	DoNotDisturb DoNotDisturbModel `json:"doNotDisturb" dynamodbav:"doNotDisturb"`
+	// Chats muted until the given time, by chat id
+	MutedChats map[string]time.Time `json:"mutedChats,omitempty" dynamodbav:"mutedChats,omitempty"`
+	// Event types the user doesn't want notifications for
+	DisabledEvents []NotificationEventType `json:"disabledEvents,omitempty" dynamodbav:"disabledEvents,omitempty"`
+	// Urgent tasks notify even when muted, disabled or in do not disturb hours.
+	AllowUrgentTasks bool `json:"allowUrgentTasks" dynamodbav:"allowUrgentTasks"`
+	// Notifications other than mentions and urgent tasks are held and sent
+	// as one digest every hour.
+	Digest      bool             `json:"digest" dynamodbav:"digest"`
+	EmailDigest EmailDigestModel `json:"emailDigest" dynamodbav:"emailDigest"`
+	UpdatedAt   time.Time        `json:"updatedAt" dynamodbav:"updatedAt"`
+}
+
+type MuteChatModel struct {
+	Until time.Time `json:"until"`
+}
+
+func isValidNotificationEventType(t NotificationEventType) bool {
+	for _, v := range notificationEventTypes {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+func validateDoNotDisturb(d DoNotDisturbModel) error {
+	if !d.IsEnabled {
+		return nil
+	}
+
+	if _, err := time.Parse(dndTimeLayout, d.Start); err != nil {
+		return fmt.Errorf("invalid do not disturb start %q", d.Start)
+	}
+	if _, err := time.Parse(dndTimeLayout, d.End); err != nil {
+		return fmt.Errorf("invalid do not disturb end %q", d.End)
+	}
+	if _, err := time.LoadLocation(d.TimeZone); err != nil || d.TimeZone == "" {
+		return fmt.Errorf("invalid time zone %q", d.TimeZone)
+	}
+	return nil
+}
+
+// isActive reports whether now falls into the do not disturb hours.
+func (d DoNotDisturbModel) isActive(now time.Time) bool {
+	if !d.IsEnabled {
+		return false
+	}
+
+	loc, err := time.LoadLocation(d.TimeZone)
+	if err != nil {
+		return false
+	}
+	start, err := time.Parse(dndTimeLayout, d.Start)
+	if err != nil {
+		return false
+	}
+	end, err := time.Parse(dndTimeLayout, d.End)
+	if err != nil {
+		return false
+	}
+
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	startMinute := start.Hour()*60 + start.Minute()
+	endMinute := end.Hour()*60 + end.Minute()
+
+	if startMinute == endMinute {
+		return false
+	}
+	if startMinute < endMinute {
+		return minute >= startMinute && minute < endMinute
+	}
+	return minute >= startMinute || minute < endMinute
+}
+
+// allows decides whether the user gets a notification of type event from
+// chatId. urgent is set for notifications about urgent tasks.
+func (p NotificationPreferencesModel) allows(event NotificationEventType, chatId string, urgent bool, now time.Time) bool {
+	if urgent && p.AllowUrgentTasks {
+		return true
+	}
+
+	for _, e := range p.DisabledEvents {
+		if e == event {
+			return false
+		}
+	}
+
+	if until, ok := p.MutedChats[chatId]; ok && now.Before(until) {
+		ignoresMute := false
+		for _, e := range notificationEventsIgnoringMute {
+			if e == event {
+				ignoresMute = true
+			}
+		}
+		if !ignoresMute {
+			return false
+		}
+	}
+
+	return !p.DoNotDisturb.isActive(now)
+}
+
+// shouldNotify loads the preferences of userId and checks them. When they
+// can't be loaded the notification is sent.
+func (ns NotificationService) shouldNotify(ctx context.Context, userId string, event NotificationEventType, chatId string, urgent bool) bool {
+	p, err := dbService.getNotificationPreferences(ctx, userId)
+	if err != nil {
+		log.Printf("%s : Couldn't load notification preferences of %v, notifying anyway. Here's why: %v\n", ctx.Value(logPrefix), userId, err)
+		return true
+	}
+
+	if !p.allows(event, chatId, urgent, time.Now()) {
+		log.Printf("%s : Skipped %v notification to %v\n", ctx.Value(logPrefix), event, userId)
+		return false
+	}
+	return true
+}
+
+func getNotificationPreferences(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+
+	p, err := dbService.getNotificationPreferences(c, uid)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"data": p})
+}
+
+func updateNotificationPreferences(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+
+	var p NotificationPreferencesModel
+	if err := c.BindJSON(&p); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if err := validateDoNotDisturb(p.DoNotDisturb); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, e := range p.DisabledEvents {
+		if !isValidNotificationEventType(e) {
+			respondWithError(c, http.StatusBadRequest, fmt.Sprintf("Invalid event type %q", e))
+			return
+		}
+	}
+	if err := validateEmailDigest(&p.EmailDigest); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// only the server sends digests
+	current, err := dbService.getNotificationPreferences(c, uid)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	p.EmailDigest.LastSentAt = current.EmailDigest.LastSentAt
+
+	// expired mutes are dropped
+	now := time.Now().UTC()
+	for chatId, until := range p.MutedChats {
+		if !now.Before(until) {
+			delete(p.MutedChats, chatId)
+		}
+	}
+
+	p.UserId = uid
+	p.UpdatedAt = now
+
+	if err := dbService.putNotificationPreferences(c, p); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"data": p})
+}
+
+// setChatMute mutes a chat until the time in the body, or unmutes it for a
+// DELETE.
+func setChatMute(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+	chatId := c.Param("chatId")
+
+	var until time.Time
+	if c.Request.Method != http.MethodDelete {
+		var m MuteChatModel
+		if err := c.BindJSON(&m); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		if !time.Now().Before(m.Until) {
+			respondWithError(c, http.StatusBadRequest, "Mute must end in the future")
+			return
+		}
+		until = m.Until.UTC()
+	}
+
+	members, err := dbService.getChatGroupMembers(c, chatId)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if !isChatGroupMember(members, uid) {
+		respondWithError(c, http.StatusForbidden, "Not a member of the chat")
+		return
+	}
+
+	p, err := dbService.getNotificationPreferences(c, uid)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if until.IsZero() {
+		delete(p.MutedChats, chatId)
+	} else {
+		if p.MutedChats == nil {
+			p.MutedChats = make(map[string]time.Time)
+		}
+		p.MutedChats[chatId] = until
+	}
+	p.UpdatedAt = time.Now().UTC()
+
+	if err := dbService.putNotificationPreferences(c, p); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"data": p})
+}
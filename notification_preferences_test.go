@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDoNotDisturbIsActive(t *testing.T) {
+	d := DoNotDisturbModel{IsEnabled: true, Start: "22:00", End: "07:00", TimeZone: "Asia/Colombo"}
+
+	// Colombo is UTC+5:30
+	tests := []struct {
+		utc  string
+		want bool
+	}{
+		{"2022-10-17T16:29:00Z", false},
+		{"2022-10-17T16:30:00Z", true},
+		{"2022-10-17T20:00:00Z", true},
+		{"2022-10-18T01:29:00Z", true},
+		{"2022-10-18T01:30:00Z", false},
+	}
+	for _, tt := range tests {
+		now, _ := time.Parse(time.RFC3339, tt.utc)
+		if got := d.isActive(now); got != tt.want {
+			t.Errorf("isActive(%v) = %v, want %v", tt.utc, got, tt.want)
+		}
+	}
+
+	d = DoNotDisturbModel{IsEnabled: true, Start: "12:00", End: "13:00", TimeZone: "UTC"}
+	if !d.isActive(time.Date(2022, 10, 17, 12, 30, 0, 0, time.UTC)) || d.isActive(time.Date(2022, 10, 17, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("daytime window is wrong")
+	}
+
+	d.IsEnabled = false
+	if d.isActive(time.Date(2022, 10, 17, 12, 30, 0, 0, time.UTC)) {
+		t.Errorf("disabled schedule is active")
+	}
+}
+
+func TestNotificationPreferencesAllows(t *testing.T) {
+	now := time.Date(2022, 10, 17, 12, 0, 0, 0, time.UTC)
+	p := NotificationPreferencesModel{
+		MutedChats:     map[string]time.Time{"muted": now.Add(time.Hour), "expired": now.Add(-time.Hour)},
+		DisabledEvents: []NotificationEventType{NotificationReaction},
+	}
+
+	if !p.allows(NotificationChatMessage, "c1", false, now) {
+		t.Errorf("chat message was blocked")
+	}
+	if p.allows(NotificationReaction, "c1", false, now) {
+		t.Errorf("disabled reaction was allowed")
+	}
+	if p.allows(NotificationChatMessage, "muted", false, now) {
+		t.Errorf("muted chat was allowed")
+	}
+	if !p.allows(NotificationChatMessage, "expired", false, now) {
+		t.Errorf("expired mute still blocks")
+	}
+	if !p.allows(NotificationReply, "muted", false, now) || !p.allows(NotificationMention, "muted", false, now) {
+		t.Errorf("reply or mention was blocked by the mute")
+	}
+	if p.allows(NotificationNewTask, "muted", true, now) {
+		t.Errorf("urgent task broke through without opt in")
+	}
+
+	p.DoNotDisturb = DoNotDisturbModel{IsEnabled: true, Start: "11:00", End: "13:00", TimeZone: "UTC"}
+	if p.allows(NotificationMention, "c1", false, now) {
+		t.Errorf("mention was allowed during do not disturb")
+	}
+
+	p.AllowUrgentTasks = true
+	if !p.allows(NotificationNewTask, "muted", true, now) {
+		t.Errorf("urgent task was blocked")
+	}
+}
+
+func TestValidateDoNotDisturb(t *testing.T) {
+	if err := validateDoNotDisturb(DoNotDisturbModel{IsEnabled: true, Start: "22:00", End: "07:00", TimeZone: "Europe/Berlin"}); err != nil {
+		t.Errorf("valid schedule: %v", err)
+	}
+	if err := validateDoNotDisturb(DoNotDisturbModel{IsEnabled: true, Start: "25:00", End: "07:00", TimeZone: "UTC"}); err == nil {
+		t.Errorf("invalid start was accepted")
+	}
+	if err := validateDoNotDisturb(DoNotDisturbModel{IsEnabled: true, Start: "22:00", End: "07:00", TimeZone: "Mars/Base"}); err == nil {
+		t.Errorf("invalid time zone was accepted")
+	}
+	if err := validateDoNotDisturb(DoNotDisturbModel{}); err != nil {
+		t.Errorf("disabled schedule: %v", err)
+	}
+}
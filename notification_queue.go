@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kjk/betterguid"
+)
+
+const (
+	defaultNotificationWorkers = 8
+	// Jobs that don't fit wait in the store for the next sweep
+	notificationQueueSize = 1024
+	// Attempts of a push before it goes to the dead letters
+	maxNotificationJobAttempts = 6
+	notificationRetryBaseDelay = 5 * time.Second
+	notificationRetryMaxDelay  = 10 * time.Minute
+	// How often jobs left by the last run or dropped from a full queue are
+	// picked up
+	notificationQueueSweepInterval = 30 * time.Second
+	notificationQueueDrainTimeout  = 10 * time.Second
+)
+
+type NotificationJobKind string
+
+const (
+	NotificationJobNewTask                NotificationJobKind = "newTask"
+	NotificationJobTaskMessage            NotificationJobKind = "taskMessage"
+	NotificationJobTaskReminder           NotificationJobKind = "taskReminder"
+	NotificationJobTaskDone               NotificationJobKind = "taskDone"
+	NotificationJobTaskNotDone            NotificationJobKind = "taskNotDone"
+	NotificationJobWaitingRequest         NotificationJobKind = "waitingRequest"
+	NotificationJobWaitingRequestAccepted NotificationJobKind = "waitingRequestAccepted"
+	NotificationJobWaitingRequestDenied   NotificationJobKind = "waitingRequestDenied"
+	NotificationJobGoodJob                NotificationJobKind = "goodJob"
+	NotificationJobChatMessage            NotificationJobKind = "chatMessage"
+	NotificationJobReply                  NotificationJobKind = "reply"
+	NotificationJobMention                NotificationJobKind = "mention"
+	NotificationJobReaction               NotificationJobKind = "reaction"
+	// Another attempt at the tokens a push failed for
+	NotificationJobPush NotificationJobKind = "push"
+	// A legacy notification to the FCM tokens kept in Firebase
+	NotificationJobFirebase NotificationJobKind = "firebase"
+)
+
+// NotificationEventModel holds the arguments of the task and chat events.
+type NotificationEventModel struct {
+	SentBy       string              `json:"sentBy" dynamodbav:"sentBy"`
+	SentTo       string              `json:"sentTo,omitempty" dynamodbav:"sentTo,omitempty"`
+	ChatId       string              `json:"chatId" dynamodbav:"chatId"`
+	TaskId       string              `json:"taskId,omitempty" dynamodbav:"taskId,omitempty"`
+	TaskTitle    string              `json:"taskTitle,omitempty" dynamodbav:"taskTitle,omitempty"`
+	Message      string              `json:"message,omitempty" dynamodbav:"message,omitempty"`
+	Mid          string              `json:"mid" dynamodbav:"mid"`
+	Except       []string            `json:"except,omitempty" dynamodbav:"except,omitempty"`
+	ReactionType MessageReactionType `json:"reactionType,omitempty" dynamodbav:"reactionType,omitempty"`
+}
+
+// NotificationJobModel is an event to notify about, or a push to retry.
+// Only the fields of its kind are set.
+type NotificationJobModel struct {
+	Id           string                  `json:"id" dynamodbav:"id"`
+	Kind         NotificationJobKind     `json:"kind" dynamodbav:"kind"`
+	Event        *NotificationEventModel `json:"event,omitempty" dynamodbav:"event,omitempty"`
+	Task         *AddTaskModel           `json:"task,omitempty" dynamodbav:"task,omitempty"`
+	ChatMessage  *AddChatMessageModel    `json:"chatMessage,omitempty" dynamodbav:"chatMessage,omitempty"`
+	Parent       *AddChatMessageModel    `json:"parent,omitempty" dynamodbav:"parent,omitempty"`
+	Mention      *MentionModel           `json:"mention,omitempty" dynamodbav:"mention,omitempty"`
+	Reaction     *AddReactionModel       `json:"reaction,omitempty" dynamodbav:"reaction,omitempty"`
+	Notification *PushNotification       `json:"notification,omitempty" dynamodbav:"notification,omitempty"`
+	Tokens       []AddTokenModel         `json:"tokens,omitempty" dynamodbav:"tokens,omitempty"`
+	// Recipients of a Firebase job
+	UserIds []string `json:"userIds,omitempty" dynamodbav:"userIds,omitempty"`
+	// Log prefix of the request that queued the job
+	LogPrefix     string    `json:"logPrefix" dynamodbav:"logPrefix"`
+	Attempts      int       `json:"attempts" dynamodbav:"attempts"`
+	NextAttemptAt time.Time `json:"nextAttemptAt" dynamodbav:"nextAttemptAt"`
+	CreatedAt     time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	LastError     string    `json:"lastError,omitempty" dynamodbav:"lastError,omitempty"`
+}
+
+// taskNotificationJob is a job for the task events that all take the same
+// arguments.
+func taskNotificationJob(kind NotificationJobKind, sentBy string, sentTo string, chatId string, taskId string, taskTitle string, mid string) NotificationJobModel {
+	return NotificationJobModel{Kind: kind, Event: &NotificationEventModel{
+		SentBy:    sentBy,
+		SentTo:    sentTo,
+		ChatId:    chatId,
+		TaskId:    taskId,
+		TaskTitle: taskTitle,
+		Mid:       mid,
+	}}
+}
+
+// notificationRetryDelay is the backoff after attempts failed attempts, with
+// jitter so the retries of many pushes don't arrive together.
+func notificationRetryDelay(attempts int) time.Duration {
+	delay := notificationRetryBaseDelay
+	for i := 1; i < attempts && delay < notificationRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > notificationRetryMaxDelay {
+		delay = notificationRetryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// NotificationJobStore keeps the jobs of the queue until they are done, so
+// they survive a restart.
+type NotificationJobStore interface {
+	save(ctx context.Context, job NotificationJobModel) error
+	remove(ctx context.Context, id string) error
+	jobs(ctx context.Context) ([]NotificationJobModel, error)
+	deadLetter(ctx context.Context, job NotificationJobModel) error
+}
+
+// DbNotificationJobStore keeps jobs in the NotificationJob table and dead
+// letters in NotificationDeadLetter.
+type DbNotificationJobStore struct{}
+
+func (DbNotificationJobStore) save(ctx context.Context, job NotificationJobModel) error {
+	return dbService.addNotificationJob(ctx, job)
+}
+
+func (DbNotificationJobStore) remove(ctx context.Context, id string) error {
+	return dbService.deleteNotificationJob(ctx, id)
+}
+
+func (DbNotificationJobStore) jobs(ctx context.Context) ([]NotificationJobModel, error) {
+	return dbService.getNotificationJobs(ctx)
+}
+
+func (DbNotificationJobStore) deadLetter(ctx context.Context, job NotificationJobModel) error {
+	return dbService.addNotificationDeadLetter(ctx, job)
+}
+
+// NotificationQueue runs notification jobs on a fixed number of workers.
+// Jobs are saved before they run and removed when they are done. A failed
+// job is tried again after a backoff, until it has used up its attempts and
+// goes to the dead letters. The queue assumes it is the only one working on
+// the store.
+type NotificationQueue struct {
+	store   NotificationJobStore
+	handle  func(ctx context.Context, job *NotificationJobModel) error
+	workers int
+	queue   chan NotificationJobModel
+
+	mu sync.Mutex
+	// ids of jobs that are queued, running or waiting for their retry
+	known  map[string]bool
+	timers map[string]*time.Timer
+	closed bool
+	// ids of jobs done while a sweep loads the store, which may still list them
+	finished map[string]bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newNotificationQueue(store NotificationJobStore, workers int, handle func(ctx context.Context, job *NotificationJobModel) error) *NotificationQueue {
+	return &NotificationQueue{
+		store:   store,
+		handle:  handle,
+		workers: workers,
+		queue:   make(chan NotificationJobModel, notificationQueueSize),
+		known:   make(map[string]bool),
+		timers:  make(map[string]*time.Timer),
+		stop:    make(chan struct{}),
+	}
+}
+
+// notificationWorkers is NOTIFICATION_WORKERS, 8 by default.
+func notificationWorkers() int {
+	if n, err := strconv.Atoi(os.Getenv("NOTIFICATION_WORKERS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultNotificationWorkers
+}
+
+// start starts the workers and picks up the jobs left by the last run.
+func (q *NotificationQueue) start() {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+
+	q.sweep(time.Now())
+	go func() {
+		ticker := time.NewTicker(notificationQueueSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-q.stop:
+				return
+			case <-ticker.C:
+				q.sweep(time.Now())
+			}
+		}
+	}()
+}
+
+// add saves job and runs it after delay. Without a saved copy the job still
+// runs, but is lost if the server stops first.
+func (q *NotificationQueue) add(ctx context.Context, job NotificationJobModel, delay time.Duration) {
+	now := time.Now().UTC()
+	job.Id = betterguid.New()
+	job.CreatedAt = now
+	job.NextAttemptAt = now.Add(delay)
+	if prefix, ok := ctx.Value(logPrefix).(string); ok {
+		job.LogPrefix = prefix
+	}
+
+	if err := q.store.save(ctx, job); err != nil {
+		log.Printf("%s : Couldn't save %v notification job. Here's why: %v\n", ctx.Value(logPrefix), job.Kind, err)
+	}
+
+	if delay > 0 {
+		q.schedule(job, delay)
+	} else {
+		q.dispatch(job)
+	}
+}
+
+// dispatch hands job to the workers. A job that doesn't fit or comes after
+// the queue closed waits in the store.
+func (q *NotificationQueue) dispatch(job NotificationJobModel) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dispatchLocked(job)
+}
+
+func (q *NotificationQueue) dispatchLocked(job NotificationJobModel) {
+	if q.closed {
+		delete(q.known, job.Id)
+		return
+	}
+	select {
+	case q.queue <- job:
+		q.known[job.Id] = true
+	default:
+		delete(q.known, job.Id)
+		log.Printf("Notification queue is full, %v job %v waits for the next sweep\n", job.Kind, job.Id)
+	}
+}
+
+// schedule dispatches job once delay has passed.
+func (q *NotificationQueue) schedule(job NotificationJobModel, delay time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		delete(q.known, job.Id)
+		return
+	}
+
+	q.known[job.Id] = true
+	q.timers[job.Id] = time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		delete(q.timers, job.Id)
+		q.dispatchLocked(job)
+	})
+}
+
+func (q *NotificationQueue) forget(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.known, id)
+	if q.finished != nil {
+		q.finished[id] = true
+	}
+}
+
+// sweep dispatches the saved jobs that are due and not known to the queue.
+func (q *NotificationQueue) sweep(now time.Time) {
+	q.mu.Lock()
+	q.finished = make(map[string]bool)
+	q.mu.Unlock()
+
+	jobs, err := q.store.jobs(context.Background())
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	finished := q.finished
+	q.finished = nil
+	if err != nil {
+		log.Printf("Couldn't load notification jobs. Here's why: %v\n", err)
+		return
+	}
+
+	for _, job := range jobs {
+		if q.known[job.Id] || finished[job.Id] || job.NextAttemptAt.After(now) {
+			continue
+		}
+		q.dispatchLocked(job)
+	}
+}
+
+func (q *NotificationQueue) work() {
+	defer q.wg.Done()
+	for job := range q.queue {
+		q.run(job)
+	}
+}
+
+// run handles job and removes it, schedules its retry or moves it to the
+// dead letters. Jobs that panic are not tried again.
+func (q *NotificationQueue) run(job NotificationJobModel) {
+	// jobs outlive the connection that queued them
+	ctx := context.WithValue(context.Background(), logPrefix, job.LogPrefix)
+
+	job.Attempts++
+	err, panicked := q.safeHandle(ctx, &job)
+	if err == nil {
+		if err := q.store.remove(ctx, job.Id); err != nil {
+			log.Printf("%s : Couldn't remove notification job %v. Here's why: %v\n", ctx.Value(logPrefix), job.Id, err)
+		}
+		q.forget(job.Id)
+		return
+	}
+
+	job.LastError = err.Error()
+	if panicked || job.Attempts >= maxNotificationJobAttempts {
+		log.Printf("%s : Giving up on %v notification job %v after %v attempts. Here's why: %v\n", ctx.Value(logPrefix), job.Kind, job.Id, job.Attempts, err)
+		if err := q.store.deadLetter(ctx, job); err != nil {
+			log.Printf("%s : Couldn't add notification job %v to the dead letters. Here's why: %v\n", ctx.Value(logPrefix), job.Id, err)
+		}
+		if err := q.store.remove(ctx, job.Id); err != nil {
+			log.Printf("%s : Couldn't remove notification job %v. Here's why: %v\n", ctx.Value(logPrefix), job.Id, err)
+		}
+		q.forget(job.Id)
+		return
+	}
+
+	delay := notificationRetryDelay(job.Attempts)
+	job.NextAttemptAt = time.Now().UTC().Add(delay)
+	if err := q.store.save(ctx, job); err != nil {
+		log.Printf("%s : Couldn't save notification job %v. Here's why: %v\n", ctx.Value(logPrefix), job.Id, err)
+	}
+	log.Printf("%s : Retrying %v notification job %v in %v. Here's why: %v\n", ctx.Value(logPrefix), job.Kind, job.Id, delay, err)
+	q.schedule(job, delay)
+}
+
+func (q *NotificationQueue) safeHandle(ctx context.Context, job *NotificationJobModel) (err error, panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			panicked = true
+		}
+	}()
+	return q.handle(ctx, job), false
+}
+
+// drain stops taking jobs and waits up to timeout for the workers to finish
+// the queued ones. Jobs waiting for a retry and the ones left after timeout
+// stay in the store for the next start.
+func (q *NotificationQueue) drain(timeout time.Duration) bool {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		for id, t := range q.timers {
+			t.Stop()
+			delete(q.timers, id)
+		}
+		close(q.stop)
+		close(q.queue)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// enqueue queues job for the workers, without a queue it runs right away.
+func (ns NotificationService) enqueue(ctx context.Context, job NotificationJobModel) {
+	if ns.queue == nil {
+		if err := ns.handleJob(ctx, &job); err != nil {
+			log.Printf("%s : Failed %v notification. Here's why: %v\n", ctx.Value(logPrefix), job.Kind, err)
+		}
+		return
+	}
+	ns.queue.add(ctx, job, 0)
+}
+
+// handleJob sends the notifications of job. Failed lookups fail the job, so
+// it is tried again. Failed pushes leave the tokens to try again in job.
+func (ns NotificationService) handleJob(ctx context.Context, job *NotificationJobModel) error {
+	e := job.Event
+	if e == nil {
+		e = &NotificationEventModel{}
+	}
+
+	switch job.Kind {
+	case NotificationJobNewTask:
+		return ns.sendNewTaskNotification(ctx, *job.Task, job.Task.Id)
+	case NotificationJobTaskMessage:
+		return ns.sendTaskTextMessageNotification(ctx, e.Message, e.SentBy, e.SentTo, e.ChatId, e.TaskId, e.TaskTitle, e.Mid)
+	case NotificationJobTaskReminder:
+		return ns.sendTaskReminderNotification(ctx, e.SentBy, e.SentTo, e.ChatId, e.TaskId, e.TaskTitle, e.Mid)
+	case NotificationJobTaskDone:
+		return ns.sendTaskDoneNotification(ctx, e.SentBy, e.SentTo, e.ChatId, e.TaskId, e.TaskTitle, e.Mid)
+	case NotificationJobTaskNotDone:
+		return ns.sendTaskNotDoneNotification(ctx, e.SentBy, e.SentTo, e.ChatId, e.TaskId, e.TaskTitle, e.Mid)
+	case NotificationJobWaitingRequest:
+		return ns.sendTaskWaitingRequestNotification(ctx, e.SentBy, e.SentTo, e.ChatId, e.TaskId, e.TaskTitle, e.Mid)
+	case NotificationJobWaitingRequestAccepted:
+		return ns.sendTaskAcceptWaitingRequestNotification(ctx, e.SentBy, e.SentTo, e.ChatId, e.TaskId, e.TaskTitle, e.Mid)
+	case NotificationJobWaitingRequestDenied:
+		return ns.sendTaskDenyWaitingRequestNotification(ctx, e.SentBy, e.SentTo, e.ChatId, e.TaskId, e.TaskTitle, e.Mid)
+	case NotificationJobGoodJob:
+		return ns.sendGoodJobNotification(ctx, e.SentBy, e.SentTo, e.ChatId, e.TaskId, e.TaskTitle, e.Mid, e.ReactionType)
+	case NotificationJobChatMessage:
+		notified, err := ns.sendChatTextMessageNotification(ctx, e.Message, e.SentBy, e.ChatId, e.Mid, e.Except)
+		if err != nil && job.Event != nil {
+			// the retry skips the members notified already
+			job.Event.Except = append(job.Event.Except, notified...)
+		}
+		return err
+	case NotificationJobReply:
+		return ns.sendChatReplyNotification(ctx, *job.ChatMessage, *job.Parent)
+	case NotificationJobMention:
+		return ns.sendMentionNotification(ctx, *job.Mention)
+	case NotificationJobReaction:
+		return ns.sendReactionNotification(ctx, *job.Reaction)
+	case NotificationJobFirebase:
+		ns.sendFirebaseNotification(ctx, *job.Notification, job.UserIds)
+	case NotificationJobPush:
+		failed, err := ns.push(ctx, *job.Notification, job.Tokens)
+		if len(failed) > 0 {
+			job.Tokens = failed
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown notification job %v", job.Kind)
+	}
+	return nil
+}
+
+func getNotificationDeadLetters(c *gin.Context) {
+	jobs, err := dbService.getNotificationDeadLetters(c)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"data": jobs})
+}
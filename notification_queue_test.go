@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryJobStore keeps jobs in maps instead of DynamoDB.
+type memoryJobStore struct {
+	mu      sync.Mutex
+	saved   map[string]NotificationJobModel
+	letters []NotificationJobModel
+}
+
+func newMemoryJobStore() *memoryJobStore {
+	return &memoryJobStore{saved: make(map[string]NotificationJobModel)}
+}
+
+func (s *memoryJobStore) save(ctx context.Context, job NotificationJobModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saved[job.Id] = job
+	return nil
+}
+
+func (s *memoryJobStore) remove(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.saved, id)
+	return nil
+}
+
+func (s *memoryJobStore) jobs(ctx context.Context) ([]NotificationJobModel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []NotificationJobModel
+	for _, j := range s.saved {
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+func (s *memoryJobStore) deadLetter(ctx context.Context, job NotificationJobModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.letters = append(s.letters, job)
+	return nil
+}
+
+func TestNotificationQueueRunsAndDrains(t *testing.T) {
+	store := newMemoryJobStore()
+	// left by the last run, one due and one waiting for its retry
+	store.saved["old"] = NotificationJobModel{Id: "old", Kind: NotificationJobTaskDone, NextAttemptAt: time.Now().Add(-time.Minute)}
+	store.saved["later"] = NotificationJobModel{Id: "later", Kind: NotificationJobPush, NextAttemptAt: time.Now().Add(time.Hour)}
+
+	var mu sync.Mutex
+	var ran []string
+	q := newNotificationQueue(store, 2, func(ctx context.Context, job *NotificationJobModel) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, string(job.Kind)+"/"+ctx.Value(logPrefix).(string))
+		return nil
+	})
+	q.start()
+
+	ctx := context.WithValue(context.Background(), logPrefix, "u1/socket")
+	for i := 0; i < 5; i++ {
+		q.add(ctx, taskNotificationJob(NotificationJobTaskReminder, "u1", "u2", "c1", "t1", "Freezer", "m1"), 0)
+	}
+	if !q.drain(5 * time.Second) {
+		t.Fatal("queue didn't drain")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ran) != 6 {
+		t.Errorf("ran = %v", ran)
+	}
+	for _, r := range ran {
+		if r != "taskReminder/u1/socket" && r != "taskDone/" {
+			t.Errorf("ran %v", r)
+		}
+	}
+	if _, ok := store.saved["later"]; !ok || len(store.saved) != 1 {
+		t.Errorf("saved = %v", store.saved)
+	}
+
+	// after draining jobs only go to the store
+	q.add(ctx, NotificationJobModel{Kind: NotificationJobTaskDone}, 0)
+	if len(store.saved) != 2 || len(ran) != 6 {
+		t.Errorf("job after drain ran, saved = %v", store.saved)
+	}
+}
+
+func TestNotificationQueueRetries(t *testing.T) {
+	store := newMemoryJobStore()
+	q := newNotificationQueue(store, 1, func(ctx context.Context, job *NotificationJobModel) error {
+		if job.Kind == NotificationJobMention {
+			panic("no mention")
+		}
+		job.Tokens = job.Tokens[:1]
+		return errors.New("unavailable")
+	})
+	defer q.drain(time.Second)
+
+	job := NotificationJobModel{Id: "j1", Kind: NotificationJobPush, Tokens: []AddTokenModel{{Token: "a"}, {Token: "b"}}}
+	q.run(job)
+	saved := store.saved["j1"]
+	if saved.Attempts != 1 || len(saved.Tokens) != 1 || saved.LastError != "unavailable" || !saved.NextAttemptAt.After(time.Now()) {
+		t.Errorf("saved = %+v", saved)
+	}
+	if !q.known["j1"] || q.timers["j1"] == nil {
+		t.Errorf("retry of j1 isn't scheduled")
+	}
+
+	saved.Attempts = maxNotificationJobAttempts - 1
+	q.run(saved)
+	if _, ok := store.saved["j1"]; ok || len(store.letters) != 1 || store.letters[0].Attempts != maxNotificationJobAttempts {
+		t.Errorf("saved = %v, dead letters = %+v", store.saved, store.letters)
+	}
+
+	q.run(NotificationJobModel{Id: "j2", Kind: NotificationJobMention})
+	if len(store.letters) != 2 || store.letters[1].Attempts != 1 || store.letters[1].LastError != "panic: no mention" {
+		t.Errorf("dead letters = %+v", store.letters)
+	}
+}
+
+func TestNotificationRetryDelay(t *testing.T) {
+	for attempts, max := range map[int]time.Duration{1: 5 * time.Second, 3: 20 * time.Second, 20: notificationRetryMaxDelay} {
+		for i := 0; i < 20; i++ {
+			if d := notificationRetryDelay(attempts); d < max/2 || d > max {
+				t.Errorf("delay after %v attempts = %v", attempts, d)
+			}
+		}
+	}
+}
+
+func TestSendNotificationQueuesRetries(t *testing.T) {
+	apns := &fakePushProvider{errors: map[string]error{
+		"down":   &PushError{Platform: PushPlatformAPNs, StatusCode: 500, Reason: "InternalServerError"},
+		"broken": &PushError{Platform: PushPlatformAPNs, StatusCode: 400, Reason: "PayloadEmpty"},
+	}}
+	store := newMemoryJobStore()
+	ns := NotificationService{providers: map[PushPlatform]PushProvider{PushPlatformAPNs: apns}}
+	ns.queue = newNotificationQueue(store, 1, ns.handleJob)
+	defer ns.queue.drain(time.Second)
+
+	n := newAlertNotification("Ann", "", "Hi", "c1", "m1", "u1")
+	ns.sendNotification(context.Background(), n, []AddTokenModel{{Token: "ok"}, {Token: "down"}, {Token: "broken"}})
+
+	jobs, _ := store.jobs(context.Background())
+	if len(jobs) != 1 {
+		t.Fatalf("jobs = %+v", jobs)
+	}
+	if j := jobs[0]; j.Kind != NotificationJobPush || j.Attempts != 1 || len(j.Tokens) != 1 || j.Tokens[0].Token != "down" || j.Notification.Body != "Hi" {
+		t.Errorf("job = %+v", j)
+	}
+}
+
+func TestHandleJobFailsUnknownKinds(t *testing.T) {
+	ns := NotificationService{}
+	if err := ns.handleJob(context.Background(), &NotificationJobModel{Id: "j1", Kind: "fax"}); err == nil {
+		t.Errorf("job of unknown kind passed")
+	}
+}
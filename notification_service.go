@@ -2,213 +2,421 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-
-	"github.com/sideshow/apns2"
-	"github.com/sideshow/apns2/payload"
+	"time"
 )
 
 type NotificationService struct {
-	apnsClient *apns2.Client
+	providers        map[PushPlatform]PushProvider
+	reactionThrottle *notificationThrottle
+	templates        *NotificationTemplates
+	aggregator       *NotificationAggregator
+	// Records every push attempt, nil to only count them
+	auditLog NotificationAuditLog
+	// Runs the jobs queued with enqueue, nil to run them right away
+	queue *NotificationQueue
 }
 
-func (ns NotificationService) loadDeviceTokens(c context.Context, userIdList []string) []AddTokenModel {
-	var deviceTokens []AddTokenModel
-
-	for _, u := range userIdList {
-		tokens, err := dbService.getDeviceTokens(c, u)
-		if err != nil {
-			log.Fatalln("Could not load tokens for " + u)
-		}
-		deviceTokens = append(deviceTokens, tokens...)
+func (ns NotificationService) sendNewTaskNotification(ctx context.Context, task AddTaskModel, mid string) error {
+	if !ns.shouldNotify(ctx, task.AssginedTo, NotificationNewTask, task.GroupUid, task.IsUrgent) {
+		return nil
 	}
-
-	return deviceTokens
-}
-
-func (ns NotificationService) sendNewTaskNotification(ctx context.Context, task AddTaskModel, mid string) {
 	sender, err := dbService.getUserById(ctx, task.AssignedBy)
 
 	if err != nil {
-		log.Println("Failed to fetch sender", task.AssignedBy, err)
-		return
+		return fmt.Errorf("couldn't fetch sender %v: %w", task.AssignedBy, err)
 	}
-	alertTitle := sender.FirstName + " " + sender.LastName
-	var subtitle string
 
-	if task.IsUrgent {
-		subtitle = "(Urgent) " + task.Title
-	} else {
-		subtitle = task.Title
+	data := NotificationData{
+		Sender:      sender,
+		TaskTitle:   task.Title,
+		Description: task.Description,
+		IsUrgent:    task.IsUrgent,
 	}
-	payload := payload.NewPayload().AlertTitle(alertTitle).AlertSubtitle(subtitle).AlertBody(task.Description).ThreadID(task.Id).Badge(1).Sound("default").MutableContent().Custom("mid", mid).Custom("uid", task.AssginedTo)
-	tokens := ns.loadDeviceTokens(ctx, []string{task.AssginedTo})
-	ns.sendNotification(ctx, payload, tokens)
+	data.ChecklistDone, data.ChecklistTotal = checklistCounts(task.ChecklistItems)
+	return ns.notifyWithTemplate(ctx, task.AssginedTo, task.GroupUid, TemplateNewTask, data, task.Id, mid)
 }
 
-func (ns NotificationService) sendTaskDoneNotification(ctx context.Context, sentBy string, sentTo string, taskId string, taskTitle string, mid string) {
+func (ns NotificationService) sendTaskDoneNotification(ctx context.Context, sentBy string, sentTo string, chatId string, taskId string, taskTitle string, mid string) error {
+	if !ns.shouldNotify(ctx, sentTo, NotificationTaskStatus, chatId, false) {
+		return nil
+	}
+
 	sender, err := dbService.getUserById(ctx, sentBy)
 	if err != nil {
-		log.Println("Failed to fetch sender", sentBy, err)
-		return
+		return fmt.Errorf("couldn't fetch sender %v: %w", sentBy, err)
 	}
 
-	alertTitle := sender.FirstName + " " + sender.LastName
-	payload := payload.NewPayload().AlertTitle(alertTitle).AlertSubtitle(taskTitle).AlertBody("Done").ThreadID(taskId).Badge(1).Sound("default").MutableContent().Custom("mid", mid).Custom("uid", sentTo)
-	tokens := ns.loadDeviceTokens(ctx, []string{sentTo})
-	ns.sendNotification(ctx, payload, tokens)
-
+	data := NotificationData{Sender: sender, TaskTitle: taskTitle}
+	if task, err := dbService.getTaskById(ctx, taskId); err == nil {
+		data.ChecklistDone, data.ChecklistTotal = checklistCounts(task.ChecklistItems)
+	}
+	return ns.notifyWithTemplate(ctx, sentTo, chatId, TemplateTaskDone, data, taskId, mid)
 }
 
-func (ns NotificationService) sendTaskNotDoneNotification(ctx context.Context, sentBy string, sentTo string, taskId string, taskTitle string, mid string) {
+func (ns NotificationService) sendTaskNotDoneNotification(ctx context.Context, sentBy string, sentTo string, chatId string, taskId string, taskTitle string, mid string) error {
+	if !ns.shouldNotify(ctx, sentTo, NotificationTaskStatus, chatId, false) {
+		return nil
+	}
+
 	sender, err := dbService.getUserById(ctx, sentBy)
 	if err != nil {
-		log.Println("Failed to fetch sender", sentBy, err)
-		return
+		return fmt.Errorf("couldn't fetch sender %v: %w", sentBy, err)
 	}
 
-	alertTitle := sender.FirstName + " " + sender.LastName
-	payload := payload.NewPayload().AlertTitle(alertTitle).AlertSubtitle(taskTitle).AlertBody("Not Done").ThreadID(taskId).Badge(1).Sound("default").MutableContent().Custom("mid", mid).Custom("uid", sentTo)
-	tokens := ns.loadDeviceTokens(ctx, []string{sentTo})
-	ns.sendNotification(ctx, payload, tokens)
-
+	data := NotificationData{Sender: sender, TaskTitle: taskTitle}
+	return ns.notifyWithTemplate(ctx, sentTo, chatId, TemplateTaskNotDone, data, taskId, mid)
 }
 
-func (ns NotificationService) sendTaskTextMessageNotification(ctx context.Context, message string, sentBy string, sentTo string, taskId string, taskTitle string, mid string) {
+func (ns NotificationService) sendTaskTextMessageNotification(ctx context.Context, message string, sentBy string, sentTo string, chatId string, taskId string, taskTitle string, mid string) error {
+	if !ns.shouldNotify(ctx, sentTo, NotificationTaskMessage, chatId, false) {
+		return nil
+	}
+
 	sender, err := dbService.getUserById(ctx, sentBy)
 	if err != nil {
-		log.Println("Failed to fetch sender", sentBy, err)
-		return
+		return fmt.Errorf("couldn't fetch sender %v: %w", sentBy, err)
 	}
 
-	alertTitle := sender.FirstName + " " + sender.LastName
-	payload := payload.NewPayload().AlertTitle(alertTitle).AlertSubtitle(taskTitle).AlertBody(message).ThreadID(taskId).Badge(1).Sound("default").MutableContent().Custom("mid", mid).Custom("uid", sentTo)
-	tokens := ns.loadDeviceTokens(ctx, []string{sentTo})
-	ns.sendNotification(ctx, payload, tokens)
+	data := NotificationData{Sender: sender, TaskTitle: taskTitle, Message: message}
+	return ns.notifyWithTemplate(ctx, sentTo, chatId, TemplateTaskMessage, data, taskId, mid)
 }
 
-func (ns NotificationService) sendTaskReminderNotification(ctx context.Context, sentBy string, sentTo string, taskId string, taskTitle string, mid string) {
+func (ns NotificationService) sendTaskReminderNotification(ctx context.Context, sentBy string, sentTo string, chatId string, taskId string, taskTitle string, mid string) error {
+	// reminders of urgent tasks may break through
+	urgent := false
+	if task, err := dbService.getTaskById(ctx, taskId); err == nil {
+		urgent = task.IsUrgent
+	}
+	if !ns.shouldNotify(ctx, sentTo, NotificationTaskReminder, chatId, urgent) {
+		return nil
+	}
+
 	sender, err := dbService.getUserById(ctx, sentBy)
 	if err != nil {
-		log.Println("Failed to fetch sender", sentBy, err)
-		return
+		return fmt.Errorf("couldn't fetch sender %v: %w", sentBy, err)
 	}
 
-	alertTitle := sender.FirstName + " " + sender.LastName
-
-	payload := payload.NewPayload().AlertTitle(alertTitle).AlertSubtitle(taskTitle).AlertBody("Reminder").ThreadID(taskId).Badge(1).Sound("default").MutableContent().Custom("mid", mid).Custom("uid", sentTo)
-	tokens := ns.loadDeviceTokens(ctx, []string{sentTo})
-	ns.sendNotification(ctx, payload, tokens)
+	data := NotificationData{Sender: sender, TaskTitle: taskTitle, IsUrgent: urgent}
+	return ns.notifyWithTemplate(ctx, sentTo, chatId, TemplateTaskReminder, data, taskId, mid)
 }
 
-func (ns NotificationService) sendTaskWaitingRequestNotification(ctx context.Context, sentBy string, sentTo string, taskId string, taskTitle string, mid string) {
+func (ns NotificationService) sendTaskWaitingRequestNotification(ctx context.Context, sentBy string, sentTo string, chatId string, taskId string, taskTitle string, mid string) error {
+	if !ns.shouldNotify(ctx, sentTo, NotificationWaitingRequest, chatId, false) {
+		return nil
+	}
+
 	sender, err := dbService.getUserById(ctx, sentBy)
 	if err != nil {
-		log.Println("Failed to fetch sender", sentBy, err)
-		return
+		return fmt.Errorf("couldn't fetch sender %v: %w", sentBy, err)
 	}
 
-	alertTitle := sender.FirstName + " " + sender.LastName
-
-	payload := payload.NewPayload().AlertTitle(alertTitle).AlertSubtitle(taskTitle).AlertBody("Waiting Request").ThreadID(taskId).Badge(1).Sound("default").MutableContent().Custom("mid", mid).Custom("uid", sentTo)
-	tokens := ns.loadDeviceTokens(ctx, []string{sentTo})
-	ns.sendNotification(ctx, payload, tokens)
+	data := NotificationData{Sender: sender, TaskTitle: taskTitle}
+	return ns.notifyWithTemplate(ctx, sentTo, chatId, TemplateWaitingRequest, data, taskId, mid)
 }
 
-func (ns NotificationService) sendTaskAcceptWaitingRequestNotification(ctx context.Context, sentBy string, sentTo string, taskId string, taskTitle string, mid string) {
+func (ns NotificationService) sendTaskAcceptWaitingRequestNotification(ctx context.Context, sentBy string, sentTo string, chatId string, taskId string, taskTitle string, mid string) error {
+	if !ns.shouldNotify(ctx, sentTo, NotificationWaitingRequest, chatId, false) {
+		return nil
+	}
+
 	sender, err := dbService.getUserById(ctx, sentBy)
 	if err != nil {
-		log.Println("Failed to fetch sender", sentBy, err)
-		return
+		return fmt.Errorf("couldn't fetch sender %v: %w", sentBy, err)
 	}
 
-	alertTitle := sender.FirstName + " " + sender.LastName
-
-	payload := payload.NewPayload().AlertTitle(alertTitle).AlertSubtitle(taskTitle).AlertBody("Waiting Request Accepted").ThreadID(taskId).Badge(1).Sound("default").MutableContent().Custom("mid", mid).Custom("uid", sentTo)
-	tokens := ns.loadDeviceTokens(ctx, []string{sentTo})
-	ns.sendNotification(ctx, payload, tokens)
+	data := NotificationData{Sender: sender, TaskTitle: taskTitle}
+	return ns.notifyWithTemplate(ctx, sentTo, chatId, TemplateWaitingRequestAccepted, data, taskId, mid)
 }
 
-func (ns NotificationService) sendTaskDenyWaitingRequestNotification(ctx context.Context, sentBy string, sentTo string, taskId string, taskTitle string, mid string) {
+func (ns NotificationService) sendTaskDenyWaitingRequestNotification(ctx context.Context, sentBy string, sentTo string, chatId string, taskId string, taskTitle string, mid string) error {
+	if !ns.shouldNotify(ctx, sentTo, NotificationWaitingRequest, chatId, false) {
+		return nil
+	}
+
 	sender, err := dbService.getUserById(ctx, sentBy)
 	if err != nil {
-		log.Println("Failed to fetch sender", sentBy, err)
-		return
+		return fmt.Errorf("couldn't fetch sender %v: %w", sentBy, err)
 	}
 
-	alertTitle := sender.FirstName + " " + sender.LastName
-
-	payload := payload.NewPayload().AlertTitle(alertTitle).AlertSubtitle(taskTitle).AlertBody("Waiting Request Denied").ThreadID(taskId).Badge(1).Sound("default").MutableContent().Custom("mid", mid).Custom("uid", sentTo)
-	tokens := ns.loadDeviceTokens(ctx, []string{sentTo})
-	ns.sendNotification(ctx, payload, tokens)
+	data := NotificationData{Sender: sender, TaskTitle: taskTitle}
+	return ns.notifyWithTemplate(ctx, sentTo, chatId, TemplateWaitingRequestDenied, data, taskId, mid)
 }
 
-func (ns NotificationService) sendChatTextMessageNotification(ctx context.Context, message string, sentBy string, chatId string, mid string) {
+// sendChatTextMessageNotification notifies all members of the chat except
+// the sender and the users in except, who are notified separately. It
+// returns the members that were notified, so a retry after an error can
+// skip them.
+func (ns NotificationService) sendChatTextMessageNotification(ctx context.Context, message string, sentBy string, chatId string, mid string, except []string) ([]string, error) {
 	sender, err := dbService.getUserById(ctx, sentBy)
 	if err != nil {
-		log.Println("Failed to fetch sender", sentBy, err)
-		return
+		return nil, fmt.Errorf("couldn't fetch sender %v: %w", sentBy, err)
 	}
 
 	members, err := dbService.getChatGroupMembers(ctx, chatId)
 	if err != nil {
-		log.Println("Failed to fetch group members", sentBy, err)
-		return
+		return nil, fmt.Errorf("couldn't fetch members of %v: %w", chatId, err)
 	}
 
+	var notified []string
+	var lastErr error
 	for _, m := range members {
-		if m.MemberUserId == sentBy {
+		if m.MemberUserId == sentBy || containsString(except, m.MemberUserId) {
 			continue
 		}
+		if !ns.shouldNotify(ctx, m.MemberUserId, NotificationChatMessage, chatId, false) {
+			continue
+		}
+
+		data := NotificationData{Sender: sender, Message: message}
+		if err := ns.notifyWithTemplate(ctx, m.MemberUserId, chatId, TemplateChatMessage, data, chatId, mid); err != nil {
+			lastErr = err
+			continue
+		}
+		notified = append(notified, m.MemberUserId)
+	}
+	return notified, lastErr
+}
+
+// sendChatReplyNotification tells the author of parent about the reply m.
+// It is sent even if the author muted the chat, see notificationEventsIgnoringMute.
+func (ns NotificationService) sendChatReplyNotification(ctx context.Context, m AddChatMessageModel, parent AddChatMessageModel) error {
+	if !ns.shouldNotify(ctx, parent.SentBy, NotificationReply, m.ChatId, false) {
+		return nil
+	}
+
+	sender, err := dbService.getUserById(ctx, m.SentBy)
+	if err != nil {
+		return fmt.Errorf("couldn't fetch sender %v: %w", m.SentBy, err)
+	}
+
+	data := NotificationData{Sender: sender, Message: m.Message}
+	return ns.notifyWithTemplate(ctx, parent.SentBy, m.ChatId, TemplateReply, data, m.ChatId, m.Id)
+}
+
+// sendMentionNotification alerts a mentioned user right away, even when
+// their device is in a Focus mode.
+func (ns NotificationService) sendMentionNotification(ctx context.Context, m MentionModel) error {
+	if !ns.shouldNotify(ctx, m.UserId, NotificationMention, m.ChatId, false) {
+		return nil
+	}
+
+	sender, err := dbService.getUserById(ctx, m.SentBy)
+	if err != nil {
+		return fmt.Errorf("couldn't fetch sender %v: %w", m.SentBy, err)
+	}
 
-		alertTitle := sender.FirstName + " " + sender.LastName
-		payload := payload.NewPayload().AlertTitle(alertTitle).AlertBody(message).ThreadID(chatId).Badge(1).Sound("default").MutableContent().Custom("mid", mid).Custom("uid", m.MemberUserId)
-		tokens := ns.loadDeviceTokens(ctx, []string{m.MemberUserId})
-		ns.sendNotification(ctx, payload, tokens)
+	data := NotificationData{Sender: sender, TaskTitle: m.TaskTitle, Message: m.Message}
+	name := TemplateMention
+	threadId := m.ChatId
+	if m.TaskId != "" {
+		name = TemplateTaskMention
+		threadId = m.TaskId
 	}
 
+	n, err := ns.newNotification(ctx, m.UserId, name, data, threadId, m.MessageId)
+	if err != nil {
+		return err
+	}
+	n.Category = "MENTION"
+	n.TimeSensitive = true
+	n.HighPriority = true
+	return ns.notifyUser(ctx, m.UserId, m.ChatId, n)
 }
 
-func (ns NotificationService) sendGoodJobNotification(ctx context.Context, sentBy string, sentTo string, taskId string, taskTitle string, mid string, rtype MessageReactionType) {
+func (ns NotificationService) sendGoodJobNotification(ctx context.Context, sentBy string, sentTo string, chatId string, taskId string, taskTitle string, mid string, rtype MessageReactionType) error {
+	if !ns.shouldNotify(ctx, sentTo, NotificationReaction, chatId, false) {
+		return nil
+	}
+
 	sender, err := dbService.getUserById(ctx, sentBy)
 	if err != nil {
-		log.Println("Failed to fetch sender", sentBy, err)
+		return fmt.Errorf("couldn't fetch sender %v: %w", sentBy, err)
+	}
+
+	if !ns.reactionThrottle.allow(sentTo+"/"+taskId, time.Now()) {
+		log.Printf("%s : Throttled reaction notification to %v\n", ctx.Value(logPrefix), sentTo)
+		return nil
+	}
+
+	data := NotificationData{
+		Sender:    sender,
+		TaskTitle: taskTitle,
+		Emoji:     messageReactionEmoji[rtype],
+		Reaction:  messageReactionName[rtype],
+	}
+	return ns.notifyWithTemplate(ctx, sentTo, "", TemplateGoodJob, data, taskId, mid)
+}
+
+func (ns NotificationService) sendReactionNotification(ctx context.Context, m AddReactionModel) error {
+	if !ns.shouldNotify(ctx, m.SentTo, NotificationReaction, m.ChatId, false) {
+		return nil
+	}
+
+	sender, err := dbService.getUserById(ctx, m.SentBy)
+	if err != nil {
+		return fmt.Errorf("couldn't fetch sender %v: %w", m.SentBy, err)
+	}
+
+	// after the lookups, so a retry isn't throttled by its own attempt
+	if !ns.reactionThrottle.allow(m.SentTo+"/"+m.TargetId, time.Now()) {
+		log.Printf("%s : Throttled reaction notification to %v\n", ctx.Value(logPrefix), m.SentTo)
+		return nil
+	}
+
+	threadId := m.ChatId
+	if m.TaskId != "" {
+		threadId = m.TaskId
+	}
+
+	data := NotificationData{Sender: sender, TaskTitle: m.TaskTitle, Emoji: m.Emoji}
+	return ns.notifyWithTemplate(ctx, m.SentTo, "", TemplateReaction, data, threadId, m.Id)
+}
+
+// notifyWithTemplate renders template name for userId and sends it, see
+// notifyUser for chatId. Notifications that follow each other in a thread
+// are collapsed, and held for the digest of users in digest mode. Urgent
+// tasks and replies always come through on their own.
+func (ns NotificationService) notifyWithTemplate(ctx context.Context, userId string, chatId string, name NotificationTemplateName, data NotificationData, threadId string, mid string) error {
+	aggregate := ns.aggregator != nil && !data.IsUrgent && name != TemplateReply
+
+	// without the digest store the notification comes through on its own
+	if aggregate && ns.digestEnabled(ctx, userId) && ns.aggregator.addToDigest(ctx, userId, mid, data) == nil {
+		countUnread(ctx, userId, chatId, mid)
+		return nil
+	}
+
+	collapseId := ""
+	if aggregate {
+		var sendNow bool
+		collapseId, sendNow = ns.aggregator.add(userId, threadId, mid, data)
+		if !sendNow {
+			countUnread(ctx, userId, chatId, mid)
+			return nil
+		}
+	}
+
+	n, err := ns.newNotification(ctx, userId, name, data, threadId, mid)
+	if err != nil {
+		return err
+	}
+	n.CollapseId = collapseId
+	return ns.notifyUser(ctx, userId, chatId, n)
+}
+
+// sendSummary sends a collapsed alert or a digest made by the aggregator.
+func (ns NotificationService) sendSummary(ctx context.Context, userId string, name NotificationTemplateName, data NotificationData, threadId string, collapseId string) {
+	n, err := ns.newNotification(ctx, userId, name, data, threadId, "")
+	if err != nil {
 		return
 	}
+	n.CollapseId = collapseId
+	if name == TemplateCollapsed {
+		// the first alert of the burst made the sound already
+		n.Sound = ""
+	}
+	if err := ns.notifyUser(ctx, userId, "", n); err != nil {
+		log.Printf("%s : Couldn't send %v notification to %v. Here's why: %v\n", ctx.Value(logPrefix), name, userId, err)
+	}
+}
 
-	alertTitle := sender.FirstName + " " + sender.LastName
-	alertBody := "🎉 Good Job!"
+func (ns NotificationService) digestEnabled(ctx context.Context, userId string) bool {
+	p, err := dbService.getNotificationPreferences(ctx, userId)
+	if err != nil {
+		return false
+	}
+	return p.Digest
+}
 
-	if rtype == MessageReactionThanks {
-		alertBody = "👍 Thanks!"
-	} else if rtype == MessageReactionWellDone {
-		alertBody = "🌟 Well Done!"
+// notifyUser sends n to the devices of userId with the unread count as the
+// badge. The message counts as unread in chatId, reactions pass no chat and
+// only update the badge. Failed pushes are retried on their own, the error
+// is for loading the devices.
+func (ns NotificationService) notifyUser(ctx context.Context, userId string, chatId string, n PushNotification) error {
+	tokens, err := dbService.getDeviceTokens(ctx, userId)
+	if err != nil {
+		return fmt.Errorf("couldn't load tokens of %v: %w", userId, err)
 	}
-	payload := payload.NewPayload().AlertTitle(alertTitle).AlertSubtitle(taskTitle).AlertBody(alertBody).ThreadID(taskId).Badge(1).Sound("default").MutableContent().Custom("mid", mid).Custom("uid", sentTo)
-	tokens := ns.loadDeviceTokens(ctx, []string{sentTo})
-	ns.sendNotification(ctx, payload, tokens)
+	badge := countUnread(ctx, userId, chatId, n.Data["mid"])
+	n.Badge = &badge
+	ns.sendNotification(ctx, n, tokens)
+	return nil
+}
 
+// sendNotification pushes n to deviceTokens and queues another attempt for
+// the tokens that failed on a passing error.
+func (ns NotificationService) sendNotification(c context.Context, n PushNotification, deviceTokens []AddTokenModel) {
+	failed, err := ns.push(c, n, deviceTokens)
+	if len(failed) == 0 || ns.queue == nil {
+		return
+	}
+
+	job := NotificationJobModel{Kind: NotificationJobPush, Notification: &n, Tokens: failed, Attempts: 1, LastError: err.Error()}
+	ns.queue.add(c, job, notificationRetryDelay(1))
+}
+
+// deleteInvalidToken deletes t from where it is kept.
+func deleteInvalidToken(c context.Context, t AddTokenModel) {
+	if t.Firebase {
+		removeFailedTokens(c, []DeviceToken{{Uid: t.UserId, Token: t.Token}})
+		return
+	}
+	dbService.deleteDeviceToken(c, t.UserId, t.Token)
 }
 
-func (ns NotificationService) sendNotification(c context.Context, payload interface{}, deviceTokens []AddTokenModel) {
+// push hands n to the provider of each token's platform, records the
+// results and deletes the tokens the provider reports as invalid. It returns
+// the tokens worth another try and the last of their errors.
+func (ns NotificationService) push(c context.Context, n PushNotification, deviceTokens []AddTokenModel) ([]AddTokenModel, error) {
+	var retry []AddTokenModel
+	var retryErr error
+
+	byPlatform := make(map[PushPlatform][]AddTokenModel)
 	for _, d := range deviceTokens {
-		notification := &apns2.Notification{
-			Topic:       "com.dulithadabare.klak",
-			DeviceToken: d.Token,
-			Payload:     payload,
+		byPlatform[d.platform()] = append(byPlatform[d.platform()], d)
+	}
+
+	for platform, tokens := range byPlatform {
+		provider, ok := ns.providers[platform]
+		if !ok {
+			log.Printf("%s : No push provider for %v, dropping %v notifications\n", c.Value(logPrefix), platform, len(tokens))
+			errs := make([]error, len(tokens))
+			for i := range errs {
+				errs[i] = &PushError{Platform: platform, Reason: "NoProvider"}
+			}
+			ns.recordNotification(c, n, platform, tokens, errs, 0)
+			continue
 		}
 
-		res, err := ns.apnsClient.Push(notification)
-		if err != nil {
-			log.Println("There was an error sending notification", err)
-			return
+		start := time.Now()
+		errs := provider.Push(c, n, tokens)
+		ns.recordNotification(c, n, platform, tokens, errs, time.Since(start))
+
+		for i, err := range errs {
+			if err == nil {
+				continue
+			}
+
+			log.Printf("%s : Failed to send notification to %v. Here's why: %v\n", c.Value(logPrefix), tokens[i].UserId, err)
+			recordPushFailure(platform, err)
+			if errors.Is(err, ErrPushTokenInvalid) {
+				deleteInvalidToken(c, tokens[i])
+			} else if isRetryablePushError(err) {
+				retry = append(retry, tokens[i])
+				retryErr = err
+			}
 		}
+	}
+	return retry, retryErr
+}
 
-		if res.Sent() {
-			log.Println("Notification Sent:", res.ApnsID)
-		} else {
-			fmt.Printf("Failed to send notification: %v %v %v\n", res.StatusCode, res.ApnsID, res.Reason)
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
 		}
 	}
+	return false
 }
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Templates of all notifications. Each locale has a file named after it in
+// NOTIFICATION_TEMPLATES_DIR, or in the built in notification_templates.
+//
+//go:embed notification_templates/*.json
+var notificationTemplateFiles embed.FS
+
+// Locale of users who didn't choose one. Its file must have every template,
+// the other locales fall back to it for the ones they lack.
+const defaultNotificationLocale = "en"
+
+type NotificationTemplateName string
+
+const (
+	TemplateNewTask                NotificationTemplateName = "newTask"
+	TemplateTaskDone               NotificationTemplateName = "taskDone"
+	TemplateTaskNotDone            NotificationTemplateName = "taskNotDone"
+	TemplateTaskMessage            NotificationTemplateName = "taskMessage"
+	TemplateTaskReminder           NotificationTemplateName = "taskReminder"
+	TemplateWaitingRequest         NotificationTemplateName = "waitingRequest"
+	TemplateWaitingRequestAccepted NotificationTemplateName = "waitingRequestAccepted"
+	TemplateWaitingRequestDenied   NotificationTemplateName = "waitingRequestDenied"
+	TemplateChatMessage            NotificationTemplateName = "chatMessage"
+	TemplateReply                  NotificationTemplateName = "reply"
+	TemplateMention                NotificationTemplateName = "mention"
+	TemplateTaskMention            NotificationTemplateName = "taskMention"
+	TemplateGoodJob                NotificationTemplateName = "goodJob"
+	TemplateReaction               NotificationTemplateName = "reaction"
+	TemplateCollapsed              NotificationTemplateName = "collapsed"
+	TemplateDigest                 NotificationTemplateName = "digest"
+)
+
+var notificationTemplateNames = []NotificationTemplateName{
+	TemplateNewTask,
+	TemplateTaskDone,
+	TemplateTaskNotDone,
+	TemplateTaskMessage,
+	TemplateTaskReminder,
+	TemplateWaitingRequest,
+	TemplateWaitingRequestAccepted,
+	TemplateWaitingRequestDenied,
+	TemplateChatMessage,
+	TemplateReply,
+	TemplateMention,
+	TemplateTaskMention,
+	TemplateGoodJob,
+	TemplateReaction,
+	TemplateCollapsed,
+	TemplateDigest,
+}
+
+var localePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}([-_][a-zA-Z0-9]{2,8})*$`)
+
+// NotificationTemplate holds text/template sources rendered with
+// NotificationData. The loc keys are for users who localize notifications
+// on their device: APNs then shows the app's string for the key, formatted
+// with the loc args, instead of the text rendered here.
+type NotificationTemplate struct {
+	Title        string   `json:"title"`
+	Subtitle     string   `json:"subtitle,omitempty"`
+	Body         string   `json:"body"`
+	TitleLocKey  string   `json:"titleLocKey,omitempty"`
+	TitleLocArgs []string `json:"titleLocArgs,omitempty"`
+	LocKey       string   `json:"locKey,omitempty"`
+	LocArgs      []string `json:"locArgs,omitempty"`
+}
+
+// notificationLocaleFile is the content of one locale's file.
+type notificationLocaleFile struct {
+	// Rendered with the sender's AddUserModel
+	SenderName string                                            `json:"senderName"`
+	Templates  map[NotificationTemplateName]NotificationTemplate `json:"templates"`
+}
+
+// NotificationData is what templates can refer to. Fields that don't apply
+// to a notification are left empty.
+type NotificationData struct {
+	Sender AddUserModel
+	// Sender rendered with the senderName template of the locale
+	SenderName     string
+	TaskTitle      string
+	Description    string
+	IsUrgent       bool
+	ChecklistDone  int
+	ChecklistTotal int
+	Message        string
+	Emoji          string
+	// goodJob, thanks or wellDone for goodJob notifications
+	Reaction string
+	// Number of notifications in a collapsed alert or digest, and of their
+	// senders besides Sender
+	Count  int
+	Others int
+}
+
+// renderedNotification is a template rendered for one recipient.
+type renderedNotification struct {
+	Title        string
+	Subtitle     string
+	Body         string
+	TitleLocKey  string
+	TitleLocArgs []string
+	LocKey       string
+	LocArgs      []string
+}
+
+// notificationLocale holds the parsed templates of one locale, named
+// "<template>.<field>".
+type notificationLocale struct {
+	t     *template.Template
+	names map[NotificationTemplateName]bool
+}
+
+type NotificationTemplates struct {
+	locales map[string]notificationLocale
+}
+
+type LocaleModel struct {
+	Locale           string `json:"locale"`
+	LocalizeOnDevice bool   `json:"localizeOnDevice"`
+}
+
+// openNotificationTemplates loads the templates from NOTIFICATION_TEMPLATES_DIR,
+// or the built in ones if it isn't set.
+func openNotificationTemplates() *NotificationTemplates {
+	var fsys fs.FS
+	if dir := os.Getenv("NOTIFICATION_TEMPLATES_DIR"); dir != "" {
+		fsys = os.DirFS(dir)
+	} else {
+		sub, err := fs.Sub(notificationTemplateFiles, "notification_templates")
+		if err != nil {
+			log.Fatalf("unable to open notification templates, %v", err)
+		}
+		fsys = sub
+	}
+
+	nt, err := loadNotificationTemplates(fsys)
+	if err != nil {
+		log.Fatalf("unable to load notification templates, %v", err)
+	}
+	return nt
+}
+
+// loadNotificationTemplates parses every <locale>.json in fsys.
+func loadNotificationTemplates(fsys fs.FS) (*NotificationTemplates, error) {
+	files, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, err
+	}
+
+	nt := &NotificationTemplates{locales: make(map[string]notificationLocale)}
+	for _, f := range files {
+		data, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return nil, err
+		}
+
+		var lf notificationLocaleFile
+		if err := json.Unmarshal(data, &lf); err != nil {
+			return nil, fmt.Errorf("%v: %w", f, err)
+		}
+
+		locale := normalizeLocale(strings.TrimSuffix(path.Base(f), ".json"))
+		l, err := parseNotificationLocale(locale, lf)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", f, err)
+		}
+		nt.locales[locale] = l
+	}
+
+	def, ok := nt.locales[defaultNotificationLocale]
+	if !ok {
+		return nil, fmt.Errorf("no templates for the default locale %v", defaultNotificationLocale)
+	}
+	for _, name := range notificationTemplateNames {
+		if !def.names[name] {
+			return nil, fmt.Errorf("default locale has no %v template", name)
+		}
+	}
+	return nt, nil
+}
+
+func parseNotificationLocale(locale string, lf notificationLocaleFile) (notificationLocale, error) {
+	l := notificationLocale{
+		t:     template.New(locale),
+		names: make(map[NotificationTemplateName]bool),
+	}
+
+	parse := func(name string, text string) error {
+		if text == "" {
+			return nil
+		}
+		_, err := l.t.New(name).Parse(text)
+		return err
+	}
+
+	if err := parse("senderName", lf.SenderName); err != nil {
+		return l, err
+	}
+	for name, nt := range lf.Templates {
+		l.names[name] = true
+		prefix := string(name) + "."
+		fields := map[string]string{
+			"title":       nt.Title,
+			"subtitle":    nt.Subtitle,
+			"body":        nt.Body,
+			"titleLocKey": nt.TitleLocKey,
+			"locKey":      nt.LocKey,
+		}
+		for field, text := range fields {
+			if err := parse(prefix+field, text); err != nil {
+				return l, err
+			}
+		}
+		for i, a := range nt.TitleLocArgs {
+			if err := parse(fmt.Sprintf("%vtitleLocArgs.%d", prefix, i), a); err != nil {
+				return l, err
+			}
+		}
+		for i, a := range nt.LocArgs {
+			if err := parse(fmt.Sprintf("%vlocArgs.%d", prefix, i), a); err != nil {
+				return l, err
+			}
+		}
+	}
+	return l, nil
+}
+
+// normalizeLocale turns "si_LK" and "si-lk" into "si-LK".
+func normalizeLocale(locale string) string {
+	parts := strings.Split(strings.ReplaceAll(locale, "_", "-"), "-")
+	parts[0] = strings.ToLower(parts[0])
+	for i := 1; i < len(parts); i++ {
+		parts[i] = strings.ToUpper(parts[i])
+	}
+	return strings.Join(parts, "-")
+}
+
+// lookup finds the locale that has template name: the locale itself, its
+// language, then the default locale.
+func (nt *NotificationTemplates) lookup(locale string, name NotificationTemplateName) *template.Template {
+	var candidates []string
+	if locale != "" {
+		locale = normalizeLocale(locale)
+		candidates = append(candidates, locale)
+		if i := strings.Index(locale, "-"); i > 0 {
+			candidates = append(candidates, locale[:i])
+		}
+	}
+	candidates = append(candidates, defaultNotificationLocale)
+
+	for _, c := range candidates {
+		if l, ok := nt.locales[c]; ok && l.names[name] {
+			return l.t
+		}
+	}
+	return nil
+}
+
+// render renders template name in the recipient's locale. The loc keys are
+// only filled for recipients who localize on their device.
+func (nt *NotificationTemplates) render(recipient AddUserModel, name NotificationTemplateName, data NotificationData) (renderedNotification, error) {
+	var r renderedNotification
+
+	t := nt.lookup(recipient.Locale, name)
+	if t == nil {
+		return r, fmt.Errorf("no %v notification template", name)
+	}
+
+	var err error
+	execute := func(field string, data interface{}) string {
+		if err != nil || t.Lookup(field) == nil {
+			return ""
+		}
+		var buf bytes.Buffer
+		err = t.ExecuteTemplate(&buf, field, data)
+		return strings.TrimSpace(buf.String())
+	}
+	executeAll := func(prefix string) []string {
+		var values []string
+		for i := 0; t.Lookup(fmt.Sprintf("%v.%d", prefix, i)) != nil; i++ {
+			values = append(values, execute(fmt.Sprintf("%v.%d", prefix, i), data))
+		}
+		return values
+	}
+
+	data.SenderName = execute("senderName", data.Sender)
+	if data.SenderName == "" {
+		data.SenderName = strings.TrimSpace(data.Sender.FirstName + " " + data.Sender.LastName)
+	}
+
+	prefix := string(name) + "."
+	r.Title = execute(prefix+"title", data)
+	r.Subtitle = execute(prefix+"subtitle", data)
+	r.Body = execute(prefix+"body", data)
+	if recipient.LocalizeOnDevice {
+		r.TitleLocKey = execute(prefix+"titleLocKey", data)
+		r.TitleLocArgs = executeAll(prefix + "titleLocArgs")
+		r.LocKey = execute(prefix+"locKey", data)
+		r.LocArgs = executeAll(prefix + "locArgs")
+	}
+	return r, err
+}
+
+// newNotification renders template name for userId and builds the alert.
+// When the recipient can't be loaded the default locale is used.
+func (ns NotificationService) newNotification(ctx context.Context, userId string, name NotificationTemplateName, data NotificationData, threadId string, mid string) (PushNotification, error) {
+	recipient, err := dbService.getUserById(ctx, userId)
+	if err != nil {
+		log.Printf("%s : Couldn't load the locale of %v. Here's why: %v\n", ctx.Value(logPrefix), userId, err)
+		recipient = AddUserModel{Uid: userId}
+	}
+
+	r, err := ns.templates.render(recipient, name, data)
+	if err != nil {
+		log.Printf("%s : Couldn't render %v notification for %v. Here's why: %v\n", ctx.Value(logPrefix), name, userId, err)
+		return PushNotification{}, err
+	}
+
+	n := newAlertNotification(r.Title, r.Subtitle, r.Body, threadId, mid, userId)
+	n.Event = string(name)
+	n.TitleLocKey = r.TitleLocKey
+	n.TitleLocArgs = r.TitleLocArgs
+	n.LocKey = r.LocKey
+	n.LocArgs = r.LocArgs
+	return n, nil
+}
+
+func updateUserLocale(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+
+	var m LocaleModel
+	if err := c.BindJSON(&m); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if m.Locale != "" {
+		if !localePattern.MatchString(m.Locale) {
+			respondWithError(c, http.StatusBadRequest, fmt.Sprintf("Invalid locale %q", m.Locale))
+			return
+		}
+		m.Locale = normalizeLocale(m.Locale)
+	}
+
+	if err := dbService.updateUserLocale(c, uid, m.Locale, m.LocalizeOnDevice); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"data": m})
+}
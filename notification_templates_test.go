@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestNotificationTemplates(t *testing.T) {
+	nt := openNotificationTemplates()
+	sender := AddUserModel{FirstName: "Ann", LastName: "Perera"}
+
+	data := NotificationData{Sender: sender, TaskTitle: "Freezer", IsUrgent: true, ChecklistDone: 1, ChecklistTotal: 3}
+	r, err := nt.render(AddUserModel{}, TemplateNewTask, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Title != "Ann Perera" || r.Subtitle != "(Urgent) Freezer (1/3 done)" || r.LocKey != "" {
+		t.Errorf("new task = %+v", r)
+	}
+
+	data = NotificationData{Sender: sender, TaskTitle: "Freezer", Emoji: "👍", Reaction: "thanks"}
+	r, err = nt.render(AddUserModel{}, TemplateGoodJob, data)
+	if err != nil || r.Body != "👍 Thanks!" {
+		t.Errorf("good job = %+v, %v", r, err)
+	}
+
+	// the language of a regional locale
+	r, err = nt.render(AddUserModel{Locale: "ta_LK"}, TemplateTaskDone, NotificationData{Sender: sender})
+	if err != nil || r.Body != "முடிந்தது" {
+		t.Errorf("task done = %+v, %v", r, err)
+	}
+
+	r, err = nt.render(AddUserModel{Locale: "fr"}, TemplateTaskDone, NotificationData{Sender: sender})
+	if err != nil || r.Body != "Done" {
+		t.Errorf("task done = %+v, %v", r, err)
+	}
+
+	r, err = nt.render(AddUserModel{}, TemplateCollapsed, NotificationData{Sender: sender, Count: 3, Others: 2})
+	if err != nil || r.Body != "3 new messages from Ann Perera and 2 others" {
+		t.Errorf("collapsed = %+v, %v", r, err)
+	}
+
+	r, err = nt.render(AddUserModel{Locale: "si", LocalizeOnDevice: true}, TemplateGoodJob, data)
+	if err != nil || r.LocKey != "REACTION_THANKS" || !reflect.DeepEqual(r.LocArgs, []string{"👍"}) {
+		t.Errorf("good job = %+v, %v", r, err)
+	}
+
+	for locale, l := range nt.locales {
+		for _, name := range notificationTemplateNames {
+			if !l.names[name] {
+				t.Errorf("%v has no %v template", locale, name)
+			}
+		}
+	}
+}
+
+func TestLoadNotificationTemplates(t *testing.T) {
+	fsys := fstest.MapFS{
+		"en.json": {Data: []byte(`{"templates": {"taskDone": {"body": "Done"}}}`)},
+	}
+	if _, err := loadNotificationTemplates(fsys); err == nil {
+		t.Errorf("default locale without all templates was loaded")
+	}
+
+	fsys["en.json"] = &fstest.MapFile{Data: []byte(`{"templates": {"taskDone": {"body": "{{.Sender"}}}`)}
+	if _, err := loadNotificationTemplates(fsys); err == nil {
+		t.Errorf("broken template was loaded")
+	}
+}
+
+func TestLocalizedAPNsPayload(t *testing.T) {
+	n := newAlertNotification("Ann", "Freezer", "Done", "t1", "m1", "u1")
+	n.LocKey = "TASK_DONE"
+
+	b, err := json.Marshal(n.apnsPayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p struct {
+		Aps struct {
+			Alert map[string]interface{} `json:"alert"`
+		} `json:"aps"`
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Aps.Alert["loc-key"] != "TASK_DONE" || p.Aps.Alert["body"] != nil || p.Aps.Alert["title"] != "Ann" {
+		t.Errorf("alert = %v", p.Aps.Alert)
+	}
+}
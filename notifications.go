@@ -6,8 +6,6 @@ import (
 	"log"
 	"strconv"
 	"time"
-
-	"firebase.google.com/go/v4/messaging"
 )
 
 type DeviceToken struct {
@@ -80,24 +78,14 @@ func removeFailedTokens(c context.Context, tokens []DeviceToken) {
 
 func sendNewMessageNotification(c context.Context, msg AddMessageModel, threadId string, threadName string, recepients []AppUser) {
 	badgeCount := int(1)
-	message := &messaging.MulticastMessage{
-		Notification: &messaging.Notification{
-			Title: msg.Sender,
-			Body:  msg.Message.Content,
-		},
-		APNS: &messaging.APNSConfig{
-			Payload: &messaging.APNSPayload{
-				Aps: &messaging.Aps{
-					Alert: &messaging.ApsAlert{
-						SubTitle: threadName,
-					},
-					ThreadID:       threadId,
-					MutableContent: true,
-					Sound:          "default",
-					Badge:          &badgeCount,
-				},
-			},
-		},
+	n := PushNotification{
+		Title:          msg.Sender,
+		Subtitle:       threadName,
+		Body:           msg.Message.Content,
+		ThreadId:       threadId,
+		Badge:          &badgeCount,
+		Sound:          "default",
+		MutableContent: true,
 		Data: map[string]string{
 			"displayName":     "850",
 			"id":              msg.Id,
@@ -113,27 +101,17 @@ func sendNewMessageNotification(c context.Context, msg AddMessageModel, threadId
 		},
 	}
 
-	sendNotificationToUsers(c, message, threadId, threadName, recepients)
+	sendNotificationToUsers(c, n, threadId, threadName, recepients)
 }
 
 func sendNewThreadNotification(c context.Context, sender string, threadId string, threadName string, recepients []AppUser) {
-	message := &messaging.MulticastMessage{
-		Notification: &messaging.Notification{
-			Title: sender,
-			Body:  "Created a new thread",
-		},
-		APNS: &messaging.APNSConfig{
-			Payload: &messaging.APNSPayload{
-				Aps: &messaging.Aps{
-					Alert: &messaging.ApsAlert{
-						SubTitle: threadName,
-					},
-					ThreadID:       threadId,
-					MutableContent: true,
-					Sound:          "default",
-				},
-			},
-		},
+	n := PushNotification{
+		Title:          sender,
+		Subtitle:       threadName,
+		Body:           "Created a new thread",
+		ThreadId:       threadId,
+		Sound:          "default",
+		MutableContent: true,
 		Data: map[string]string{
 			"displayName": "850",
 			"sender":      sender,
@@ -141,139 +119,67 @@ func sendNewThreadNotification(c context.Context, sender string, threadId string
 		},
 	}
 
-	sendNotificationToUsers(c, message, threadId, threadName, recepients)
+	sendNotificationToUsers(c, n, threadId, threadName, recepients)
 }
 
 func sendNewTaskNotification(c context.Context, task AddTaskModel, recepients []AppUser) {
-	badgeCount := int(1)
-	message := &messaging.MulticastMessage{
-		Notification: &messaging.Notification{
-			Title: "New Task",
-			Body:  task.Title,
-		},
-		APNS: &messaging.APNSConfig{
-			Payload: &messaging.APNSPayload{
-				Aps: &messaging.Aps{
-					MutableContent: true,
-					Sound:          "default",
-					Badge:          &badgeCount,
-				},
-			},
-		},
-		Data: map[string]string{
-			"isLarge": "0",
-			"type":    strconv.Itoa(int(ServerPushAddTask)),
-		},
-	}
-
-	sendNotificationToUsers(c, message, "", "", recepients)
+	sendTaskLogNotification(c, "New Task", task, ServerPushAddTask, recepients)
 }
 
 func sendTaskCompletedNotification(c context.Context, task AddTaskModel, recepients []AppUser) {
-	badgeCount := int(1)
-	message := &messaging.MulticastMessage{
-		Notification: &messaging.Notification{
-			Title: "Task Completed",
-			Body:  task.Title,
-		},
-		APNS: &messaging.APNSConfig{
-			Payload: &messaging.APNSPayload{
-				Aps: &messaging.Aps{
-					MutableContent: true,
-					Sound:          "default",
-					Badge:          &badgeCount,
-				},
-			},
-		},
-		Data: map[string]string{
-			"isLarge": "0",
-			"type":    strconv.Itoa(int(ServerPushAddTaskLogItem)),
-		},
-	}
-
-	sendNotificationToUsers(c, message, "", "", recepients)
+	sendTaskLogNotification(c, "Task Completed", task, ServerPushAddTaskLogItem, recepients)
 }
 
 func sendTaskPendingNotification(c context.Context, task AddTaskModel, recepients []AppUser) {
+	sendTaskLogNotification(c, "Task Pending", task, ServerPushAddTaskLogItem, recepients)
+}
+
+func sendTaskLogNotification(c context.Context, title string, task AddTaskModel, pushType ServerPushType, recepients []AppUser) {
 	badgeCount := int(1)
-	message := &messaging.MulticastMessage{
-		Notification: &messaging.Notification{
-			Title: "Task Pending",
-			Body:  task.Title,
-		},
-		APNS: &messaging.APNSConfig{
-			Payload: &messaging.APNSPayload{
-				Aps: &messaging.Aps{
-					MutableContent: true,
-					Sound:          "default",
-					Badge:          &badgeCount,
-				},
-			},
-		},
+	n := PushNotification{
+		Title:          title,
+		Body:           task.Title,
+		Badge:          &badgeCount,
+		Sound:          "default",
+		MutableContent: true,
 		Data: map[string]string{
 			"isLarge": "0",
-			"type":    strconv.Itoa(int(ServerPushAddTaskLogItem)),
+			"type":    strconv.Itoa(int(pushType)),
 		},
 	}
 
-	sendNotificationToUsers(c, message, "", "", recepients)
+	sendNotificationToUsers(c, n, "", "", recepients)
 }
 
-func sendNotificationToUsers(c context.Context, msg *messaging.MulticastMessage, threadId string, threadName string, recepients []AppUser) {
-	tokenStart := time.Now()
-	deviceTokens := loadDeviceTokens(c, recepients)
-	tokenDuration := time.Since(tokenStart)
-
-	// Formatted string, such as "2h3m0.5s" or "4.503μs"
-	fmt.Println("Loaded device tokens", tokenDuration)
-	deviceTokenCount := len(deviceTokens)
-
-	if deviceTokenCount == 0 {
-		return
-	}
-
-	if deviceTokenCount > 500 {
-		log.Printf("%s : Device tokens (%v) larger than 500\n", c.Value(logPrefix), deviceTokenCount)
-		for i := 0; i < deviceTokenCount/500; i++ {
-			deviceTokenPart := deviceTokens[i*500 : (i+1)*500]
-			sendNotification(c, msg, threadId, threadName, deviceTokenPart)
-		}
-		remainderDeviceTokens := deviceTokens[(deviceTokenCount/500)*500:]
-		sendNotification(c, msg, threadId, threadName, remainderDeviceTokens)
-	} else {
-		sendNotification(c, msg, threadId, threadName, deviceTokens)
+// sendNotificationToUsers queues n for the FCM tokens kept in Firebase.
+func sendNotificationToUsers(c context.Context, n PushNotification, threadId string, threadName string, recepients []AppUser) {
+	userIds := make([]string, len(recepients))
+	for i, u := range recepients {
+		userIds[i] = u.Uid
 	}
+	notificationService.enqueue(c, NotificationJobModel{Kind: NotificationJobFirebase, Notification: &n, UserIds: userIds})
 
-	log.Printf("%s : Sent notification in thread (%s) to %v members\n", c.Value(logPrefix), threadId, len(recepients))
+	log.Printf("%s : Queued notification in thread (%s) to %v members\n", c.Value(logPrefix), threadId, len(recepients))
 }
 
-func sendNotification(c context.Context, message *messaging.MulticastMessage, threadId string, threadName string, deviceTokens []DeviceToken) {
-	registrationTokens := make([]string, len(deviceTokens))
-	for i, d := range deviceTokens {
-		registrationTokens[i] = d.Token
+// sendFirebaseNotification sends n to the FCM tokens of userIds kept in
+// Firebase.
+func (ns NotificationService) sendFirebaseNotification(c context.Context, n PushNotification, userIds []string) {
+	recepients := make([]AppUser, len(userIds))
+	for i, uid := range userIds {
+		recepients[i] = AppUser{Uid: uid}
 	}
 
-	message.Tokens = registrationTokens
-
-	start := time.Now()
-	br, err := cloudMessagingClient.SendMulticast(c, message)
-	tokenDuration := time.Since(start)
+	tokenStart := time.Now()
+	deviceTokens := loadDeviceTokens(c, recepients)
+	tokenDuration := time.Since(tokenStart)
 
 	// Formatted string, such as "2h3m0.5s" or "4.503μs"
-	fmt.Println("Notification call ", tokenDuration)
-	if err != nil {
-		log.Fatalln(err)
-	}
+	fmt.Println("Loaded device tokens", tokenDuration)
 
-	if br.FailureCount > 0 {
-		var failedTokens []DeviceToken
-		for idx, resp := range br.Responses {
-			if !resp.Success {
-				// The order of responses corresponds to the order of the registration tokens.
-				failedTokens = append(failedTokens, deviceTokens[idx])
-			}
-		}
-		removeFailedTokens(c, failedTokens)
-		fmt.Printf("List of tokens that caused failures: %v\n", failedTokens)
+	tokens := make([]AddTokenModel, len(deviceTokens))
+	for i, d := range deviceTokens {
+		tokens[i] = AddTokenModel{UserId: d.Uid, Token: d.Token, Timestamp: d.Timestamp, Platform: PushPlatformFCM, Firebase: true}
 	}
+	ns.sendNotification(c, n, tokens)
 }
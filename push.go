@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/payload"
+)
+
+const apnsTopic = "com.dulithadabare.klak"
+
+// FCM accepts at most this many tokens in a multicast message.
+const maxFCMMulticastTokens = 500
+
+const (
+	defaultPushAttempts   = 3
+	defaultPushRetryDelay = 500 * time.Millisecond
+)
+
+// ErrPushTokenInvalid is returned for tokens the push service won't deliver
+// to anymore. They should be deleted.
+var ErrPushTokenInvalid = errors.New("push: invalid device token")
+
+// Failed pushes by platform and reason, served with the other expvars.
+var pushFailures = expvar.NewMap("push_failures")
+
+// PushError is a failed push to one token.
+type PushError struct {
+	Platform   PushPlatform
+	StatusCode int
+	Reason     string
+	// ErrPushTokenInvalid for dead tokens, the transport error otherwise
+	Err error
+}
+
+func (e *PushError) Error() string {
+	if e.Err != nil && !errors.Is(e.Err, ErrPushTokenInvalid) {
+		return fmt.Sprintf("%v: %v", e.Platform, e.Err)
+	}
+	return fmt.Sprintf("%v: %v %v", e.Platform, e.StatusCode, e.Reason)
+}
+
+func (e *PushError) Unwrap() error {
+	return e.Err
+}
+
+// recordPushFailure counts err in pushFailures.
+func recordPushFailure(platform PushPlatform, err error) {
+	reason := "unknown"
+	var pe *PushError
+	if errors.As(err, &pe) && pe.Reason != "" {
+		reason = pe.Reason
+	}
+	pushFailures.Add(string(platform)+"."+reason, 1)
+}
+
+// isRetryablePushError reports whether err may pass, like an outage or
+// throttling of the push service.
+func isRetryablePushError(err error) bool {
+	if errors.Is(err, ErrPushTokenInvalid) {
+		return false
+	}
+	var pe *PushError
+	if !errors.As(err, &pe) {
+		return true
+	}
+	switch pe.Reason {
+	case "Transport", "QuotaExceeded", "Unavailable", "Internal":
+		return true
+	}
+	return pe.StatusCode == http.StatusTooManyRequests || pe.StatusCode >= http.StatusInternalServerError
+}
+
+// PushPlatform is the push service that issued a device token.
+type PushPlatform string
+
+const (
+	PushPlatformAPNs PushPlatform = "apns"
+	PushPlatformFCM  PushPlatform = "fcm"
+	// Browser subscriptions, added through /webpush/subscriptions
+	PushPlatformWebPush PushPlatform = "webpush"
+)
+
+// platform of the token, tokens saved before platforms were recorded are all
+// APNs tokens.
+func (t AddTokenModel) platform() PushPlatform {
+	if t.Platform == "" {
+		return PushPlatformAPNs
+	}
+	return t.Platform
+}
+
+func isValidPushPlatform(p PushPlatform) bool {
+	return p == "" || p == PushPlatformAPNs || p == PushPlatformFCM
+}
+
+// PushNotification is a notification independent of the push service. Each
+// PushProvider translates it into the payload of its platform.
+type PushNotification struct {
+	// What happened, the name of the template, for the notification log
+	Event    string
+	Title    string
+	Subtitle string
+	Body     string
+	// Notifications with the same thread id are grouped on the device
+	ThreadId string
+	// Replaces the alert with the same collapse id on the device
+	CollapseId string
+	Category   string
+	// Keys into the strings of the app, APNs shows those formatted with the
+	// args instead of Title and Body
+	TitleLocKey  string
+	TitleLocArgs []string
+	LocKey       string
+	LocArgs      []string
+	Badge        *int
+	Sound        string
+	// Lets the notification service extension change the content
+	MutableContent bool
+	// Delivered right away, even when a Focus mode is on
+	TimeSensitive bool
+	HighPriority  bool
+	Data          map[string]string
+}
+
+// newAlertNotification builds the alert all chat and task notifications use.
+// mid is the id of the message and uid the id of the recipient. The badge is
+// replaced with the unread count when the count can be loaded.
+func newAlertNotification(title string, subtitle string, body string, threadId string, mid string, uid string) PushNotification {
+	badge := 1
+	return PushNotification{
+		Title:          title,
+		Subtitle:       subtitle,
+		Body:           body,
+		ThreadId:       threadId,
+		Badge:          &badge,
+		Sound:          "default",
+		MutableContent: true,
+		Data:           map[string]string{"mid": mid, "uid": uid},
+	}
+}
+
+func (n PushNotification) apnsPayload() *payload.Payload {
+	p := payload.NewPayload()
+	if n.TitleLocKey != "" {
+		p = p.AlertTitleLocKey(n.TitleLocKey).AlertTitleLocArgs(n.TitleLocArgs)
+	} else {
+		p = p.AlertTitle(n.Title)
+	}
+	if n.LocKey != "" {
+		p = p.AlertLocKey(n.LocKey).AlertLocArgs(n.LocArgs)
+	} else {
+		p = p.AlertBody(n.Body)
+	}
+	if n.Subtitle != "" {
+		p = p.AlertSubtitle(n.Subtitle)
+	}
+	if n.ThreadId != "" {
+		p = p.ThreadID(n.ThreadId)
+	}
+	if n.Category != "" {
+		p = p.Category(n.Category)
+	}
+	if n.TimeSensitive {
+		p = p.InterruptionLevel(payload.InterruptionLevelTimeSensitive)
+	}
+	if n.Badge != nil {
+		p = p.Badge(*n.Badge)
+	}
+	if n.Sound != "" {
+		p = p.Sound(n.Sound)
+	}
+	if n.MutableContent {
+		p = p.MutableContent()
+	}
+	for k, v := range n.Data {
+		p = p.Custom(k, v)
+	}
+	return p
+}
+
+func (n PushNotification) apnsPriority() int {
+	if n.HighPriority {
+		return apns2.PriorityHigh
+	}
+	// left to APNs
+	return 0
+}
+
+// fcmMessage also carries the APNs fields, FCM delivers to iOS devices too.
+func (n PushNotification) fcmMessage(tokens []string) *messaging.MulticastMessage {
+	aps := &messaging.Aps{
+		Alert: &messaging.ApsAlert{
+			Title:        n.Title,
+			SubTitle:     n.Subtitle,
+			Body:         n.Body,
+			TitleLocKey:  n.TitleLocKey,
+			TitleLocArgs: n.TitleLocArgs,
+			LocKey:       n.LocKey,
+			LocArgs:      n.LocArgs,
+		},
+		Badge:          n.Badge,
+		Sound:          n.Sound,
+		MutableContent: n.MutableContent,
+		Category:       n.Category,
+		ThreadID:       n.ThreadId,
+	}
+	if n.TimeSensitive {
+		aps.CustomData = map[string]interface{}{"interruption-level": "time-sensitive"}
+	}
+
+	android := &messaging.AndroidConfig{
+		Priority: "normal",
+		Notification: &messaging.AndroidNotification{
+			Tag:   n.ThreadId,
+			Sound: n.Sound,
+		},
+	}
+	apnsHeaders := map[string]string{}
+	if n.CollapseId != "" {
+		android.CollapseKey = n.CollapseId
+		apnsHeaders["apns-collapse-id"] = n.CollapseId
+	}
+	if n.HighPriority {
+		android.Priority = "high"
+		apnsHeaders["apns-priority"] = "10"
+	}
+
+	return &messaging.MulticastMessage{
+		Tokens: tokens,
+		Notification: &messaging.Notification{
+			Title: n.Title,
+			Body:  n.Body,
+		},
+		Data:    n.Data,
+		Android: android,
+		APNS: &messaging.APNSConfig{
+			Headers: apnsHeaders,
+			Payload: &messaging.APNSPayload{Aps: aps},
+		},
+	}
+}
+
+type PushProvider interface {
+	// Push sends n to every token. The errors line up with tokens, nil for
+	// delivered notifications.
+	Push(ctx context.Context, n PushNotification, tokens []AddTokenModel) []error
+}
+
+// APNsProvider sends to the production or the development environment of
+// APNs, depending on the Debug flag of the token.
+type APNsProvider struct {
+	production  *apns2.Client
+	development *apns2.Client
+	// Pushes rejected with 429 or 5xx and transport errors are retried
+	// up to maxAttempts times, waiting retryDelay, then twice as long, ...
+	maxAttempts int
+	retryDelay  time.Duration
+	// Called with the corrected token when a token was delivered in the
+	// other environment than its Debug flag said
+	onEnvironmentChanged func(ctx context.Context, t AddTokenModel)
+}
+
+func NewAPNsProvider(production *apns2.Client, development *apns2.Client) *APNsProvider {
+	return &APNsProvider{
+		production:  production,
+		development: development,
+		maxAttempts: defaultPushAttempts,
+		retryDelay:  defaultPushRetryDelay,
+	}
+}
+
+func (p *APNsProvider) client(debug bool) *apns2.Client {
+	if debug {
+		return p.development
+	}
+	return p.production
+}
+
+func (p *APNsProvider) Push(ctx context.Context, n PushNotification, tokens []AddTokenModel) []error {
+	errs := make([]error, len(tokens))
+	payload := n.apnsPayload()
+	for i, t := range tokens {
+		notification := &apns2.Notification{
+			Topic:       apnsTopic,
+			DeviceToken: t.Token,
+			Payload:     payload,
+			Priority:    n.apnsPriority(),
+			CollapseID:  n.CollapseId,
+		}
+
+		// a failing token only skips itself
+		errs[i] = p.pushWithRetry(ctx, p.client(t.Debug), notification)
+
+		// tokens of one environment are bad device tokens in the other
+		var pe *PushError
+		if errors.As(errs[i], &pe) && pe.Reason == apns2.ReasonBadDeviceToken {
+			err := p.pushWithRetry(ctx, p.client(!t.Debug), notification)
+			if err != nil && !errors.Is(err, ErrPushTokenInvalid) {
+				// only a token both environments reject is invalid
+				errs[i] = err
+			} else if err == nil {
+				errs[i] = nil
+				t.Debug = !t.Debug
+				log.Printf("%s : Device token of %v belongs to the other APNs environment, debug is now %v\n", ctx.Value(logPrefix), t.UserId, t.Debug)
+				if p.onEnvironmentChanged != nil {
+					p.onEnvironmentChanged(ctx, t)
+				}
+			}
+		}
+	}
+	return errs
+}
+
+func (p *APNsProvider) pushWithRetry(ctx context.Context, client *apns2.Client, notification *apns2.Notification) error {
+	delay := p.retryDelay
+	for attempt := 1; ; attempt++ {
+		res, err := client.PushWithContext(ctx, notification)
+
+		var pushErr *PushError
+		retry := false
+		if err != nil {
+			pushErr = &PushError{Platform: PushPlatformAPNs, Reason: "Transport", Err: err}
+			retry = true
+		} else if res.Sent() {
+			log.Println("Notification Sent:", res.ApnsID)
+			return nil
+		} else {
+			pushErr = apnsError(res)
+			retry = res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError
+		}
+
+		if !retry || attempt >= p.maxAttempts {
+			return pushErr
+		}
+
+		// jitter keeps retries of many devices from arriving together
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-ctx.Done():
+			return pushErr
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+func apnsError(res *apns2.Response) *PushError {
+	e := &PushError{Platform: PushPlatformAPNs, StatusCode: res.StatusCode, Reason: res.Reason}
+	if res.StatusCode == http.StatusGone || res.Reason == apns2.ReasonBadDeviceToken || res.Reason == apns2.ReasonUnregistered {
+		e.Err = ErrPushTokenInvalid
+	}
+	return e
+}
+
+type FCMProvider struct {
+	client *messaging.Client
+}
+
+func (p FCMProvider) Push(ctx context.Context, n PushNotification, tokens []AddTokenModel) []error {
+	errs := make([]error, len(tokens))
+	for start := 0; start < len(tokens); start += maxFCMMulticastTokens {
+		end := start + maxFCMMulticastTokens
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+
+		registrationTokens := make([]string, 0, end-start)
+		for _, t := range tokens[start:end] {
+			registrationTokens = append(registrationTokens, t.Token)
+		}
+
+		br, err := p.client.SendMulticast(ctx, n.fcmMessage(registrationTokens))
+		if err != nil {
+			for i := start; i < end; i++ {
+				errs[i] = &PushError{Platform: PushPlatformFCM, Reason: "Transport", Err: err}
+			}
+			continue
+		}
+
+		// the order of responses corresponds to the order of the registration tokens
+		for i, resp := range br.Responses {
+			if !resp.Success {
+				errs[start+i] = fcmError(resp.Error)
+			}
+		}
+	}
+	return errs
+}
+
+// fcmError classifies the error FCM returned for a single token.
+func fcmError(err error) *PushError {
+	e := &PushError{Platform: PushPlatformFCM, Reason: "Unknown", Err: err}
+	switch {
+	case messaging.IsUnregistered(err):
+		e.Reason = "Unregistered"
+		e.Err = ErrPushTokenInvalid
+	case messaging.IsInvalidArgument(err):
+		// in a multicast response this means the token is malformed
+		e.Reason = "InvalidArgument"
+		e.Err = ErrPushTokenInvalid
+	case messaging.IsQuotaExceeded(err):
+		e.Reason = "QuotaExceeded"
+	case messaging.IsUnavailable(err):
+		e.Reason = "Unavailable"
+	case messaging.IsInternal(err):
+		e.Reason = "Internal"
+	}
+	return e
+}
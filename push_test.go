@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+type fakePush struct {
+	Notification PushNotification
+	Token        AddTokenModel
+}
+
+// fakePushProvider records pushes instead of sending them. Tokens in errors
+// fail with their error.
+type fakePushProvider struct {
+	mu     sync.Mutex
+	sent   []fakePush
+	errors map[string]error
+}
+
+func (p *fakePushProvider) Push(ctx context.Context, n PushNotification, tokens []AddTokenModel) []error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	errs := make([]error, len(tokens))
+	for i, t := range tokens {
+		if err := p.errors[t.Token]; err != nil {
+			errs[i] = err
+			continue
+		}
+		p.sent = append(p.sent, fakePush{Notification: n, Token: t})
+	}
+	return errs
+}
+
+func (p *fakePushProvider) pushes() []fakePush {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]fakePush(nil), p.sent...)
+}
+
+func TestSendNotificationRoutesByPlatform(t *testing.T) {
+	apns := &fakePushProvider{errors: map[string]error{"bad": errors.New("rejected")}}
+	fcm := &fakePushProvider{}
+	ns := NotificationService{providers: map[PushPlatform]PushProvider{
+		PushPlatformAPNs: apns,
+		PushPlatformFCM:  fcm,
+	}}
+
+	n := newAlertNotification("Title", "", "Body", "c1", "m1", "u1")
+	ns.sendNotification(context.Background(), n, []AddTokenModel{
+		{UserId: "u1", Token: "legacy"},
+		{UserId: "u1", Token: "ios", Platform: PushPlatformAPNs},
+		{UserId: "u1", Token: "android", Platform: PushPlatformFCM},
+		{UserId: "u1", Token: "bad", Platform: PushPlatformAPNs},
+	})
+
+	if got := apns.pushes(); len(got) != 2 || got[0].Token.Token != "legacy" || got[1].Token.Token != "ios" {
+		t.Errorf("apns pushes = %+v", got)
+	}
+	if got := fcm.pushes(); len(got) != 1 || got[0].Token.Token != "android" || got[0].Notification.Body != "Body" {
+		t.Errorf("fcm pushes = %+v", got)
+	}
+}
+
+func TestPushNotificationPayloads(t *testing.T) {
+	n := newAlertNotification("Ann", "Freezer", "Done", "t1", "m1", "u2")
+	n.Category = "MENTION"
+	n.TimeSensitive = true
+	n.HighPriority = true
+
+	b, err := json.Marshal(n.apnsPayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p struct {
+		Aps struct {
+			Alert struct {
+				Title    string `json:"title"`
+				Subtitle string `json:"subtitle"`
+				Body     string `json:"body"`
+			} `json:"alert"`
+			Badge             int    `json:"badge"`
+			ThreadId          string `json:"thread-id"`
+			Category          string `json:"category"`
+			InterruptionLevel string `json:"interruption-level"`
+			MutableContent    int    `json:"mutable-content"`
+		} `json:"aps"`
+		Mid string `json:"mid"`
+		Uid string `json:"uid"`
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Aps.Alert.Title != "Ann" || p.Aps.Alert.Subtitle != "Freezer" || p.Aps.Alert.Body != "Done" || p.Aps.Badge != 1 ||
+		p.Aps.ThreadId != "t1" || p.Aps.Category != "MENTION" || p.Aps.InterruptionLevel != "time-sensitive" || p.Aps.MutableContent != 1 {
+		t.Errorf("apns payload = %s", b)
+	}
+	if p.Mid != "m1" || p.Uid != "u2" {
+		t.Errorf("custom data missing in %s", b)
+	}
+	if n.apnsPriority() != 10 {
+		t.Errorf("priority = %v", n.apnsPriority())
+	}
+
+	m := n.fcmMessage([]string{"a", "b"})
+	if len(m.Tokens) != 2 || m.Notification.Title != "Ann" || m.Notification.Body != "Done" || m.Data["mid"] != "m1" {
+		t.Errorf("fcm message = %+v", m)
+	}
+	if m.Android.Priority != "high" || m.APNS.Headers["apns-priority"] != "10" {
+		t.Errorf("fcm priority wasn't set")
+	}
+	aps := m.APNS.Payload.Aps
+	if aps.Alert.SubTitle != "Freezer" || aps.ThreadID != "t1" || *aps.Badge != 1 || aps.CustomData["interruption-level"] != "time-sensitive" {
+		t.Errorf("fcm aps = %+v", aps)
+	}
+}
+
+func TestAPNsProviderPush(t *testing.T) {
+	attempts := make(map[string]int)
+	var mu sync.Mutex
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.URL.Path, "/3/device/")
+		mu.Lock()
+		attempts[token]++
+		n := attempts[token]
+		mu.Unlock()
+
+		switch {
+		case token == "gone":
+			w.WriteHeader(http.StatusGone)
+			fmt.Fprint(w, `{"reason":"Unregistered","timestamp":1666000000000}`)
+		case token == "bad":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"reason":"BadDeviceToken"}`)
+		case token == "busy" && n == 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"reason":"TooManyRequests"}`)
+		case token == "down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"reason":"ServiceUnavailable"}`)
+		case token == "payload":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"reason":"PayloadTooLarge"}`)
+		default:
+			w.Header().Set("apns-id", "id-"+token)
+		}
+	}))
+	defer server.Close()
+
+	client := &apns2.Client{Host: server.URL, HTTPClient: server.Client()}
+	p := NewAPNsProvider(client, client)
+	p.retryDelay = time.Millisecond
+
+	tokens := []AddTokenModel{{Token: "gone"}, {Token: "bad"}, {Token: "busy"}, {Token: "down"}, {Token: "payload"}, {Token: "ok"}}
+	errs := p.Push(context.Background(), newAlertNotification("T", "", "B", "c1", "m1", "u1"), tokens)
+
+	for i, wantInvalid := range []bool{true, true, false, false, false, false} {
+		if got := errors.Is(errs[i], ErrPushTokenInvalid); got != wantInvalid {
+			t.Errorf("%v: invalid = %v, want %v (%v)", tokens[i].Token, got, wantInvalid, errs[i])
+		}
+	}
+	if errs[2] != nil || errs[5] != nil {
+		t.Errorf("retried or good token failed: %v, %v", errs[2], errs[5])
+	}
+	if errs[3] == nil || errs[4] == nil {
+		t.Errorf("failures weren't reported")
+	}
+
+	// bad device tokens are tried in the other environment too
+	want := map[string]int{"gone": 1, "bad": 2, "busy": 2, "down": defaultPushAttempts, "payload": 1, "ok": 1}
+	if !reflect.DeepEqual(attempts, want) {
+		t.Errorf("attempts = %v, want %v", attempts, want)
+	}
+
+	// the counter is shared with other tests, so compare its value
+	var before int64
+	if v, ok := pushFailures.Get("apns.ServiceUnavailable").(*expvar.Int); ok {
+		before = v.Value()
+	}
+	recordPushFailure(PushPlatformAPNs, errs[3])
+	if after, ok := pushFailures.Get("apns.ServiceUnavailable").(*expvar.Int); !ok || after.Value() != before+1 {
+		t.Errorf("failure wasn't counted")
+	}
+}
+
+func TestAPNsProviderEnvironments(t *testing.T) {
+	// each environment knows its own tokens only
+	environment := func(known string) *httptest.Server {
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch token := strings.TrimPrefix(r.URL.Path, "/3/device/"); {
+			case token == "flaky" && known == "xcode":
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprint(w, `{"reason":"ServiceUnavailable"}`)
+			case token != known:
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"reason":"BadDeviceToken"}`)
+			}
+		}))
+	}
+	production := environment("release")
+	defer production.Close()
+	development := environment("xcode")
+	defer development.Close()
+
+	p := NewAPNsProvider(
+		&apns2.Client{Host: production.URL, HTTPClient: production.Client()},
+		&apns2.Client{Host: development.URL, HTTPClient: development.Client()},
+	)
+	p.retryDelay = time.Millisecond
+	var changed []AddTokenModel
+	p.onEnvironmentChanged = func(ctx context.Context, t AddTokenModel) {
+		changed = append(changed, t)
+	}
+
+	tokens := []AddTokenModel{
+		{Token: "release"},
+		{Token: "xcode", Debug: true},
+		// flagged wrong
+		{Token: "xcode"},
+		{Token: "release", Debug: true},
+		{Token: "unknown"},
+		// development is down
+		{Token: "flaky"},
+	}
+	errs := p.Push(context.Background(), newAlertNotification("T", "", "B", "c1", "m1", "u1"), tokens)
+
+	for i := 0; i < 4; i++ {
+		if errs[i] != nil {
+			t.Errorf("%+v: %v", tokens[i], errs[i])
+		}
+	}
+	if !errors.Is(errs[4], ErrPushTokenInvalid) {
+		t.Errorf("unknown token: %v", errs[4])
+	}
+	if errs[5] == nil || errors.Is(errs[5], ErrPushTokenInvalid) {
+		t.Errorf("token of an unavailable environment: %v", errs[5])
+	}
+
+	want := []AddTokenModel{{Token: "xcode", Debug: true}, {Token: "release"}}
+	if !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed = %+v, want %+v", changed, want)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kjk/betterguid"
+)
+
+// Maximum length of a reaction, enough for emoji ZWJ sequences.
+const maxReactionLength = 32
+
+// Reaction notifications for the same message are throttled per recipient
+// for this long, so a burst of reactions results in a single alert.
+const reactionNotificationWindow = 2 * time.Minute
+
+type ReactionTargetType int16
+
+const (
+	ReactionTargetChatMessage ReactionTargetType = iota
+	ReactionTargetTaskEvent
+	ReactionTargetTask
+)
+
+// Emoji of the reactions that used to be hard-coded for AddGoodJobMessageModel.
+var messageReactionEmoji = map[MessageReactionType]string{
+	MessageReactionGoodJob:  "🎉",
+	MessageReactionThanks:   "👍",
+	MessageReactionWellDone: "🌟",
+}
+
+// Names of the reactions in the goodJob notification template.
+var messageReactionName = map[MessageReactionType]string{
+	MessageReactionGoodJob:  "goodJob",
+	MessageReactionThanks:   "thanks",
+	MessageReactionWellDone: "wellDone",
+}
+
+type AddReactionModel struct {
+	Id         string             `json:"id" dynamodbav:"id"`
+	ChatId     string             `json:"chatId" dynamodbav:"chatId"`
+	TargetId   string             `json:"targetId" dynamodbav:"targetId"`
+	TargetType ReactionTargetType `json:"targetType" dynamodbav:"targetType"`
+	TaskId     string             `json:"taskId,omitempty" dynamodbav:"taskId,omitempty"`
+	TaskTitle  string             `json:"taskTitle,omitempty" dynamodbav:"taskTitle,omitempty"`
+	Emoji      string             `json:"emoji" dynamodbav:"emoji"`
+	SentTo     string             `json:"sentTo" dynamodbav:"sentTo"`
+	SentBy     string             `json:"sentBy" dynamodbav:"sentBy"`
+	Timestamp  time.Time          `json:"timestamp" dynamodbav:"timestamp"`
+	// Reaction counts of the target after this change. Set by the server.
+	Counts map[string]int `json:"counts" dynamodbav:"-"`
+}
+
+// ReactionModel is a single reaction of a user, stored per target.
+type ReactionModel struct {
+	TargetId  string    `json:"targetId" dynamodbav:"targetId"`
+	Id        string    `json:"id" dynamodbav:"id"`
+	ChatId    string    `json:"chatId" dynamodbav:"chatId"`
+	Emoji     string    `json:"emoji" dynamodbav:"emoji"`
+	SentBy    string    `json:"sentBy" dynamodbav:"sentBy"`
+	Timestamp time.Time `json:"timestamp" dynamodbav:"timestamp"`
+}
+
+// reactionKey makes a user's reaction unique per emoji, so adding the same
+// reaction twice is a no-op.
+func reactionKey(emoji string, userId string) string {
+	return emoji + "#" + userId
+}
+
+// Code points of emoji, including flags and skin tones.
+var emojiTable = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x00a9, Hi: 0x00a9, Stride: 1},
+		{Lo: 0x00ae, Hi: 0x00ae, Stride: 1},
+		{Lo: 0x203c, Hi: 0x203c, Stride: 1},
+		{Lo: 0x2049, Hi: 0x2049, Stride: 1},
+		{Lo: 0x2122, Hi: 0x2122, Stride: 1},
+		{Lo: 0x2139, Hi: 0x2139, Stride: 1},
+		{Lo: 0x2194, Hi: 0x21aa, Stride: 1},
+		{Lo: 0x231a, Hi: 0x23ff, Stride: 1},
+		{Lo: 0x24c2, Hi: 0x24c2, Stride: 1},
+		{Lo: 0x25aa, Hi: 0x27bf, Stride: 1},
+		{Lo: 0x2934, Hi: 0x2935, Stride: 1},
+		{Lo: 0x2b05, Hi: 0x2b55, Stride: 1},
+		{Lo: 0x3030, Hi: 0x3030, Stride: 1},
+		{Lo: 0x303d, Hi: 0x303d, Stride: 1},
+		{Lo: 0x3297, Hi: 0x3297, Stride: 1},
+		{Lo: 0x3299, Hi: 0x3299, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1f000, Hi: 0x1faff, Stride: 1},
+	},
+}
+
+// Code points that only join or modify emoji: zero width joiner, variation
+// selectors, the keycap and the tags of subdivision flags.
+var emojiComponentTable = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x200d, Hi: 0x200d, Stride: 1},
+		{Lo: 0x20e3, Hi: 0x20e3, Stride: 1},
+		{Lo: 0xfe0e, Hi: 0xfe0f, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0xe0020, Hi: 0xe007f, Stride: 1},
+	},
+}
+
+// isValidReaction reports whether emoji is a single emoji or emoji sequence.
+// Keycaps like 1️⃣ are the only ones that may start with another character.
+func isValidReaction(emoji string) bool {
+	if emoji == "" || len(emoji) > maxReactionLength || !utf8.ValidString(emoji) {
+		return false
+	}
+
+	keycap := strings.HasSuffix(emoji, "\u20e3")
+	for i, r := range emoji {
+		switch {
+		case unicode.Is(emojiTable, r):
+		case i > 0 && unicode.Is(emojiComponentTable, r):
+		case i == 0 && keycap && strings.ContainsRune("0123456789#*", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type notificationThrottle struct {
+	mu     sync.Mutex
+	window time.Duration
+	sentAt map[string]time.Time
+}
+
+func newNotificationThrottle(window time.Duration) *notificationThrottle {
+	return &notificationThrottle{
+		window: window,
+		sentAt: make(map[string]time.Time),
+	}
+}
+
+// allow reports whether a notification for key may be sent at now, and if so
+// starts a new window for it.
+func (t *notificationThrottle) allow(key string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if last, ok := t.sentAt[key]; ok && now.Sub(last) < t.window {
+		return false
+	}
+
+	// forget expired keys now and then so the map doesn't grow forever
+	if len(t.sentAt) > 1000 {
+		for k, v := range t.sentAt {
+			if now.Sub(v) >= t.window {
+				delete(t.sentAt, k)
+			}
+		}
+	}
+
+	t.sentAt[key] = now
+	return true
+}
+
+// updateReactions stores or removes a reaction and counts the change on the
+// target. Adding a reaction twice, or removing one that isn't there, leaves
+// the counts as they are.
+func updateReactions(ctx context.Context, m *AddReactionModel, remove bool) error {
+	r := ReactionModel{
+		TargetId:  m.TargetId,
+		Id:        reactionKey(m.Emoji, m.SentBy),
+		ChatId:    m.ChatId,
+		Emoji:     m.Emoji,
+		SentBy:    m.SentBy,
+		Timestamp: m.Timestamp,
+	}
+
+	var changed bool
+	var err error
+	delta := 1
+	if remove {
+		changed, err = dbService.removeReaction(ctx, r.TargetId, r.Id)
+		delta = -1
+	} else {
+		changed, err = dbService.addReaction(ctx, r)
+	}
+	if err != nil {
+		return err
+	}
+	if !changed {
+		// still read back the counts for the clients
+		delta = 0
+	}
+
+	m.Counts, err = dbService.addReactionCount(ctx, m.TargetType, m.ChatId, m.TargetId, m.Emoji, delta)
+	return err
+}
+
+func sendReactionReceipt(ctx context.Context, m AddReactionModel) {
+	mr := MessageReceiptModel{
+		Type:      Sent,
+		MessageId: m.Id,
+		Timestamp: time.Now().UTC(),
+	}
+
+	pr := ServerPush{
+		Id:     betterguid.New(),
+		UserId: m.SentBy,
+		Type:   ServerPushMessageReceipt,
+		Data:   mr,
+	}
+
+	go hub.send(ctx, m.SentBy, pr, true)
+}
+
+func handleAddReaction(ctx context.Context, m AddReactionModel) {
+	if !isValidReaction(m.Emoji) {
+		log.Printf("%s : Ignoring invalid reaction %q\n", ctx.Value(logPrefix), m.Emoji)
+		return
+	}
+
+	// send receipt
+	sendReactionReceipt(ctx, m)
+
+	if err := updateReactions(ctx, &m, false); err != nil {
+		log.Printf("%s : Couldn't save reaction to %v. Here's why: %v\n", ctx.Value(logPrefix), m.TargetId, err)
+		return
+	}
+
+	//send reaction
+	go hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushAddReaction, m, true, m.SentBy)
+
+	//send notification
+	if m.SentTo != "" && m.SentTo != m.SentBy {
+		notificationService.enqueue(ctx, NotificationJobModel{Kind: NotificationJobReaction, Reaction: &m})
+	}
+}
+
+func handleRemoveReaction(ctx context.Context, m AddReactionModel) {
+	// send receipt
+	sendReactionReceipt(ctx, m)
+
+	if err := updateReactions(ctx, &m, true); err != nil {
+		log.Printf("%s : Couldn't remove reaction from %v. Here's why: %v\n", ctx.Value(logPrefix), m.TargetId, err)
+		return
+	}
+
+	//send removal
+	go hub.sendToChat(ctx, m.ChatId, m.Id, ServerPushRemoveReaction, m, true, m.SentBy)
+}
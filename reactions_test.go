@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsValidReaction(t *testing.T) {
+	for _, emoji := range []string{"👍", "👩‍💻", "👍🏽", "❤️", "🇱🇰", "1️⃣", "🏴󠁧󠁢󠁳󠁣󠁴󠁿"} {
+		if !isValidReaction(emoji) {
+			t.Errorf("%q is not a valid reaction", emoji)
+		}
+	}
+
+	for _, emoji := range []string{"", " 👍", "👍 ", "a", "ok", "1", "<b>", "\u200d", "\ufe0f👍", "👍a"} {
+		if isValidReaction(emoji) {
+			t.Errorf("%q is a valid reaction", emoji)
+		}
+	}
+}
+
+// reactionCountDeltas returns the deltas added to the reaction counts of
+// table.
+func reactionCountDeltas(db *fakeDynamoDb, table string) []string {
+	var deltas []string
+	for _, c := range db.writes(table) {
+		if c.Op != "UpdateItem" || !strings.HasPrefix(c.Body["UpdateExpression"].(string), "ADD reactionCounts") {
+			continue
+		}
+		delta := c.Body["ExpressionAttributeValues"].(map[string]interface{})[":delta"].(map[string]interface{})
+		deltas = append(deltas, delta["N"].(string))
+	}
+	return deltas
+}
+
+func TestReactionHandlers(t *testing.T) {
+	db := useFakeDynamoDb(t)
+	useTestHub(t)
+	ctx := context.Background()
+
+	m := AddReactionModel{Id: "r1", ChatId: "g1", TargetId: "m1", TargetType: ReactionTargetChatMessage, Emoji: "👍", SentBy: "alice"}
+	pushes := 0
+	react := func(remove bool) {
+		if remove {
+			handleRemoveReaction(ctx, m)
+		} else {
+			handleAddReaction(ctx, m)
+		}
+		// the receipt and the push to the chat group
+		pushes++
+		db.waitForCalls(t, "PutItem", DDB_TABLE_USER_MESSAGES, pushes)
+		db.waitForCalls(t, "Query", DDB_TABLE_CHAT_GROUP_MEMBER, pushes)
+	}
+
+	// adding and removing twice counts each change once
+	react(false)
+	react(false)
+	react(true)
+	react(true)
+
+	expected := []string{"1", "0", "-1", "0"}
+	if deltas := reactionCountDeltas(db, DDB_TABLE_CHAT_MESSAGE); strings.Join(deltas, ",") != strings.Join(expected, ",") {
+		t.Errorf("deltas = %v, want %v", deltas, expected)
+	}
+
+	// toggling back on counts again
+	react(false)
+	expected = append(expected, "1")
+	if deltas := reactionCountDeltas(db, DDB_TABLE_CHAT_MESSAGE); strings.Join(deltas, ",") != strings.Join(expected, ",") {
+		t.Errorf("deltas = %v, want %v", deltas, expected)
+	}
+
+	m.Emoji = "ok"
+	handleAddReaction(ctx, m)
+	if deltas := reactionCountDeltas(db, DDB_TABLE_CHAT_MESSAGE); len(deltas) != len(expected) {
+		t.Errorf("invalid reaction was counted: %v", deltas)
+	}
+}
+
+func TestNotificationThrottle(t *testing.T) {
+	now := time.Date(2022, 10, 17, 8, 0, 0, 0, time.UTC)
+	throttle := newNotificationThrottle(2 * time.Minute)
+
+	if !throttle.allow("alice/m1", now) {
+		t.Errorf("first notification was throttled")
+	}
+	if throttle.allow("alice/m1", now.Add(time.Minute)) {
+		t.Errorf("second notification within the window was allowed")
+	}
+	if !throttle.allow("bob/m1", now.Add(time.Minute)) {
+		t.Errorf("notification to another user was throttled")
+	}
+	if !throttle.allow("alice/m1", now.Add(3*time.Minute)) {
+		t.Errorf("notification after the window was throttled")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/v2/analysis/lang/en"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+type SearchResultType string
+
+const (
+	SearchResultChatMessage SearchResultType = "message"
+	SearchResultTask        SearchResultType = "task"
+	SearchResultTaskMessage SearchResultType = "taskMessage"
+)
+
+var searchIndex bleve.Index
+
+// searchDocument is what the index keeps of a message or task. Only Title and
+// Text are searchable, the other fields filter and describe results.
+type searchDocument struct {
+	Id        string           `json:"id"`
+	Type      SearchResultType `json:"type"`
+	ChatId    string           `json:"chatId"`
+	TaskId    string           `json:"taskId"`
+	Title     string           `json:"title"`
+	Text      string           `json:"text"`
+	SentBy    string           `json:"sentBy"`
+	Timestamp time.Time        `json:"timestamp"`
+}
+
+type SearchResultModel struct {
+	Id        string           `json:"id"`
+	Type      SearchResultType `json:"type"`
+	ChatId    string           `json:"chatId"`
+	TaskId    string           `json:"taskId,omitempty"`
+	Title     string           `json:"title,omitempty"`
+	Text      string           `json:"text,omitempty"`
+	SentBy    string           `json:"sentBy,omitempty"`
+	Timestamp time.Time        `json:"timestamp"`
+	Score     float64          `json:"score"`
+	// Matching parts of Title and Text, with the matches in <mark> tags
+	Fragments []string `json:"fragments,omitempty"`
+}
+
+func searchIndexMapping() mapping.IndexMapping {
+	keywordField := bleve.NewTextFieldMapping()
+	keywordField.Analyzer = keyword.Name
+	keywordField.IncludeInAll = false
+
+	textField := bleve.NewTextFieldMapping()
+	textField.Analyzer = en.AnalyzerName
+
+	timeField := bleve.NewDateTimeFieldMapping()
+	timeField.IncludeInAll = false
+
+	doc := bleve.NewDocumentStaticMapping()
+	doc.AddFieldMappingsAt("id", keywordField)
+	doc.AddFieldMappingsAt("type", keywordField)
+	doc.AddFieldMappingsAt("chatId", keywordField)
+	doc.AddFieldMappingsAt("taskId", keywordField)
+	doc.AddFieldMappingsAt("sentBy", keywordField)
+	doc.AddFieldMappingsAt("title", textField)
+	doc.AddFieldMappingsAt("text", textField)
+	doc.AddFieldMappingsAt("timestamp", timeField)
+
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = doc
+	m.DefaultAnalyzer = en.AnalyzerName
+	return m
+}
+
+// openSearchIndex opens the index in the directory SEARCH_INDEX_DIR,
+// "search.bleve" by default, and creates it on the first start.
+func openSearchIndex() bleve.Index {
+	dir := os.Getenv("SEARCH_INDEX_DIR")
+	if dir == "" {
+		dir = "search.bleve"
+	}
+
+	index, err := bleve.Open(dir)
+	if errors.Is(err, bleve.ErrorIndexPathDoesNotExist) {
+		index, err = bleve.New(dir, searchIndexMapping())
+	}
+	if err != nil {
+		log.Fatalf("unable to open search index, %v", err)
+	}
+	return index
+}
+
+func searchDocumentId(t SearchResultType, id string) string {
+	return string(t) + "/" + id
+}
+
+func indexSearchDocument(ctx context.Context, d searchDocument) {
+	if err := searchIndex.Index(searchDocumentId(d.Type, d.Id), d); err != nil {
+		log.Printf("%s : Couldn't index %v %v. Here's why: %v\n", ctx.Value(logPrefix), d.Type, d.Id, err)
+	}
+}
+
+func indexChatMessage(ctx context.Context, m AddChatMessageModel) {
+	if m.IsDeleted {
+		unindexChatMessage(ctx, m.Id)
+		return
+	}
+
+	indexSearchDocument(ctx, searchDocument{
+		Id:        m.Id,
+		Type:      SearchResultChatMessage,
+		ChatId:    m.ChatId,
+		Text:      m.Message,
+		SentBy:    m.SentBy,
+		Timestamp: m.Timestamp,
+	})
+}
+
+func unindexChatMessage(ctx context.Context, messageId string) {
+	if err := searchIndex.Delete(searchDocumentId(SearchResultChatMessage, messageId)); err != nil {
+		log.Printf("%s : Couldn't remove message %v from the search index. Here's why: %v\n", ctx.Value(logPrefix), messageId, err)
+	}
+}
+
+func indexTask(ctx context.Context, t AddTaskModel) {
+	indexSearchDocument(ctx, searchDocument{
+		Id:     t.Id,
+		Type:   SearchResultTask,
+		ChatId: t.GroupUid,
+		TaskId: t.Id,
+		Title:  t.Title,
+		Text:   t.Description,
+		SentBy: t.AssignedBy,
+		// tasks don't keep their creation time
+		Timestamp: time.Now().UTC(),
+	})
+}
+
+func indexTaskMessage(ctx context.Context, m AddTaskMessageModel) {
+	indexSearchDocument(ctx, searchDocument{
+		Id:        m.Id,
+		Type:      SearchResultTaskMessage,
+		ChatId:    m.ChatId,
+		TaskId:    m.TaskId,
+		Title:     m.TaskTitle,
+		Text:      m.Message,
+		SentBy:    m.SentBy,
+		Timestamp: m.Timestamp,
+	})
+}
+
+// searchChats finds messages and tasks matching text in the given chats. An
+// empty resultType matches all types.
+func searchChats(index bleve.Index, text string, chatIds []string, resultType SearchResultType, limit int) ([]SearchResultModel, error) {
+	results := make([]SearchResultModel, 0)
+	if len(chatIds) == 0 {
+		return results, nil
+	}
+
+	match := bleve.NewMatchQuery(text)
+	match.SetOperator(query.MatchQueryOperatorAnd)
+
+	chats := make([]query.Query, 0, len(chatIds))
+	for _, id := range chatIds {
+		q := bleve.NewTermQuery(id)
+		q.SetField("chatId")
+		chats = append(chats, q)
+	}
+
+	conjuncts := []query.Query{match, bleve.NewDisjunctionQuery(chats...)}
+	if resultType != "" {
+		q := bleve.NewTermQuery(string(resultType))
+		q.SetField("type")
+		conjuncts = append(conjuncts, q)
+	}
+
+	req := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(conjuncts...), limit, 0, false)
+	req.Fields = []string{"*"}
+	req.Highlight = bleve.NewHighlightWithStyle("html")
+	req.Highlight.AddField("title")
+	req.Highlight.AddField("text")
+
+	res, err := index.Search(req)
+	if err != nil {
+		return results, err
+	}
+
+	for _, hit := range res.Hits {
+		r := SearchResultModel{Score: hit.Score}
+		r.Id, _ = hit.Fields["id"].(string)
+		t, _ := hit.Fields["type"].(string)
+		r.Type = SearchResultType(t)
+		r.ChatId, _ = hit.Fields["chatId"].(string)
+		r.TaskId, _ = hit.Fields["taskId"].(string)
+		r.Title, _ = hit.Fields["title"].(string)
+		r.Text, _ = hit.Fields["text"].(string)
+		r.SentBy, _ = hit.Fields["sentBy"].(string)
+		if ts, ok := hit.Fields["timestamp"].(string); ok {
+			r.Timestamp, _ = time.Parse(time.RFC3339, ts)
+		}
+		r.Fragments = append(hit.Fragments["title"], hit.Fragments["text"]...)
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func isValidSearchResultType(t SearchResultType) bool {
+	return t == "" || t == SearchResultChatMessage || t == SearchResultTask || t == SearchResultTaskMessage
+}
+
+func search(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+
+	text := c.Query("q")
+	if text == "" {
+		respondWithError(c, http.StatusBadRequest, "Missing query")
+		return
+	}
+
+	resultType := SearchResultType(c.Query("type"))
+	if !isValidSearchResultType(resultType) {
+		respondWithError(c, http.StatusBadRequest, "Invalid type")
+		return
+	}
+
+	limit := defaultSearchLimit
+	if v := c.Query("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 {
+			respondWithError(c, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = l
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	var chatIds []string
+	if chatId := c.Query("chatId"); chatId != "" {
+		members, err := dbService.getChatGroupMembers(c, chatId)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if !isChatGroupMember(members, uid) {
+			respondWithError(c, http.StatusForbidden, "Not a member of the chat")
+			return
+		}
+		chatIds = []string{chatId}
+	} else {
+		var err error
+		chatIds, err = dbService.getChatGroupIdsByMember(c, uid)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	results, err := searchChats(searchIndex, text, chatIds, resultType, limit)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"data": results})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+func TestSearchChats(t *testing.T) {
+	index, err := bleve.NewMemOnly(searchIndexMapping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	searchIndex = index
+	defer index.Close()
+
+	ctx := context.Background()
+	ts := time.Date(2022, 10, 17, 8, 0, 0, 0, time.UTC)
+	indexChatMessage(ctx, AddChatMessageModel{Id: "m1", ChatId: "c1", Message: "The alarm code is 1234", SentBy: "u1", Timestamp: ts})
+	indexChatMessage(ctx, AddChatMessageModel{Id: "m2", ChatId: "c2", Message: "Another alarm code", SentBy: "u2", Timestamp: ts})
+	indexTask(ctx, AddTaskModel{Id: "t1", GroupUid: "c1", Title: "Clean the freezer", Description: "Defrost it first"})
+	indexTaskMessage(ctx, AddTaskMessageModel{Id: "tm1", TaskId: "t1", ChatId: "c1", TaskTitle: "Clean the freezer", Message: "Freezers are done", Timestamp: ts})
+
+	results, err := searchChats(index, "alarm code", []string{"c1"}, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Id != "m1" || results[0].Type != SearchResultChatMessage {
+		t.Fatalf("results = %+v", results)
+	}
+	if !results[0].Timestamp.Equal(ts) || results[0].SentBy != "u1" || len(results[0].Fragments) == 0 {
+		t.Errorf("result = %+v", results[0])
+	}
+
+	// stemming matches "freezers" too
+	results, _ = searchChats(index, "freezer", []string{"c1", "c2"}, "", 10)
+	if len(results) != 2 {
+		t.Errorf("%v results for freezer, want 2", len(results))
+	}
+
+	results, _ = searchChats(index, "freezer", []string{"c1"}, SearchResultTask, 10)
+	if len(results) != 1 || results[0].TaskId != "t1" || results[0].Title != "Clean the freezer" {
+		t.Errorf("results = %+v", results)
+	}
+
+	results, _ = searchChats(index, "alarm", nil, "", 10)
+	if len(results) != 0 {
+		t.Errorf("found %v results without chats", len(results))
+	}
+
+	// edits and deletions update the index
+	indexChatMessage(ctx, AddChatMessageModel{Id: "m1", ChatId: "c1", Message: "Code changed", Timestamp: ts})
+	results, _ = searchChats(index, "alarm", []string{"c1"}, "", 10)
+	if len(results) != 0 {
+		t.Errorf("edited message still matches")
+	}
+	unindexChatMessage(ctx, "m1")
+	results, _ = searchChats(index, "code", []string{"c1"}, "", 10)
+	if len(results) != 0 {
+		t.Errorf("deleted message still matches")
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kjk/betterguid"
+)
+
+// Upper bound for the number of tasks created by a single bulk request. They
+// are written in one transaction, which DynamoDB limits to 100 items.
+const maxBulkTasks = 100
+
+type TaskTemplateItemModel struct {
+	Title       string `json:"title" dynamodbav:"title"`
+	Description string `json:"description" dynamodbav:"description"`
+	IsUrgent    bool   `json:"isUrgent" dynamodbav:"isUrgent"`
+	// Due date of the created task, relative to the start of the batch.
+	// Zero means the task has no due date.
+	DueAfterMinutes int                      `json:"dueAfterMinutes" dynamodbav:"dueAfterMinutes"`
+	ChecklistItems  []TaskChecklistItemModel `json:"checklistItems" dynamodbav:"checklistItems"`
+}
+
+type AddTaskTemplateModel struct {
+	Id        string                  `json:"id" dynamodbav:"id"`
+	ChatId    string                  `json:"chatId" dynamodbav:"chatId"`
+	Title     string                  `json:"title" dynamodbav:"title"`
+	Items     []TaskTemplateItemModel `json:"items" dynamodbav:"items"`
+	SentBy    string                  `json:"sentBy" dynamodbav:"sentBy"`
+	CreatedAt time.Time               `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+type AddBulkTasksModel struct {
+	// Template to instantiate once per assignee.
+	TemplateId string   `json:"templateId"`
+	Assignees  []string `json:"assignees"`
+	// Start of the batch. Template due dates are relative to it. Defaults to now.
+	StartAt time.Time `json:"startAt"`
+	// Tasks created as they are, in addition to the template tasks.
+	Tasks []AddTaskModel `json:"tasks"`
+}
+
+type BulkTaskErrorModel struct {
+	Index   int    `json:"index"`
+	Message string `json:"message"`
+}
+
+func isChatGroupMember(members []AddChatGroupMemberModel, userId string) bool {
+	for _, m := range members {
+		if m.MemberUserId == userId {
+			return true
+		}
+	}
+	return false
+}
+
+func instantiateTaskTemplate(t AddTaskTemplateModel, assignees []string, startAt time.Time) []AddTaskModel {
+	var tasks []AddTaskModel
+
+	for _, a := range assignees {
+		for _, item := range t.Items {
+			task := AddTaskModel{
+				Title:       item.Title,
+				Description: item.Description,
+				AssginedTo:  a,
+				IsUrgent:    item.IsUrgent,
+			}
+
+			if item.DueAfterMinutes > 0 {
+				task.DueDate = startAt.Add(time.Duration(item.DueAfterMinutes) * time.Minute).UTC()
+			}
+
+			// every task needs its own checklist
+			for _, ci := range item.ChecklistItems {
+				ci.Id = betterguid.New()
+				ci.IsDone = false
+				ci.DoneBy = ""
+				ci.DoneAt = time.Time{}
+				ci.CreatedAt = startAt.UTC()
+				task.ChecklistItems = append(task.ChecklistItems, ci)
+			}
+
+			tasks = append(tasks, task)
+		}
+	}
+
+	return tasks
+}
+
+// parseTasksCSV reads tasks from a CSV document with a header row. The
+// columns title and assignedTo are required; description, dueDate (RFC 3339)
+// and isUrgent are optional.
+func parseTasksCSV(r io.Reader) ([]AddTaskModel, []BulkTaskErrorModel, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("csv: could not read header: %w", err)
+	}
+
+	columns := make(map[string]int)
+	for i, h := range header {
+		columns[strings.TrimSpace(h)] = i
+	}
+
+	for _, required := range []string{"title", "assignedTo"} {
+		if _, ok := columns[required]; !ok {
+			return nil, nil, fmt.Errorf("csv: missing column %v", required)
+		}
+	}
+
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var tasks []AddTaskModel
+	var errs []BulkTaskErrorModel
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("csv: %w", err)
+		}
+		if len(tasks) == maxBulkTasks {
+			return nil, nil, fmt.Errorf("csv: too many tasks, the limit is %v", maxBulkTasks)
+		}
+
+		task := AddTaskModel{
+			Title:       field(record, "title"),
+			Description: field(record, "description"),
+			AssginedTo:  field(record, "assignedTo"),
+		}
+
+		if v := field(record, "dueDate"); v != "" {
+			dueDate, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				errs = append(errs, BulkTaskErrorModel{Index: len(tasks), Message: "invalid dueDate " + v})
+			}
+			task.DueDate = dueDate.UTC()
+		}
+
+		if v := field(record, "isUrgent"); v != "" {
+			isUrgent, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, BulkTaskErrorModel{Index: len(tasks), Message: "invalid isUrgent " + v})
+			}
+			task.IsUrgent = isUrgent
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	return tasks, errs, nil
+}
+
+func validateBulkTasks(tasks []AddTaskModel, members []AddChatGroupMemberModel) []BulkTaskErrorModel {
+	var errs []BulkTaskErrorModel
+
+	if len(tasks) == 0 {
+		return append(errs, BulkTaskErrorModel{Index: -1, Message: "no tasks"})
+	}
+
+	if len(tasks) > maxBulkTasks {
+		return append(errs, BulkTaskErrorModel{Index: -1, Message: fmt.Sprintf("too many tasks (%v), the limit is %v", len(tasks), maxBulkTasks)})
+	}
+
+	for i, t := range tasks {
+		if strings.TrimSpace(t.Title) == "" {
+			errs = append(errs, BulkTaskErrorModel{Index: i, Message: "title is required"})
+		}
+
+		if t.AssginedTo == "" {
+			errs = append(errs, BulkTaskErrorModel{Index: i, Message: "assignedTo is required"})
+		} else if !isChatGroupMember(members, t.AssginedTo) {
+			errs = append(errs, BulkTaskErrorModel{Index: i, Message: "assignee " + t.AssginedTo + " is not a member of the chat group"})
+		}
+	}
+
+	return errs
+}
+
+func addTaskTemplate(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+	groupId := c.Param("groupId")
+
+	var m AddTaskTemplateModel
+	if err := c.BindJSON(&m); err != nil {
+		c.AbortWithError(400, err)
+		return
+	}
+
+	members, err := dbService.getChatGroupMembers(c, groupId)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if !isChatGroupMember(members, uid) {
+		respondWithError(c, http.StatusForbidden, "Not a member of the chat group")
+		return
+	}
+
+	if strings.TrimSpace(m.Title) == "" || len(m.Items) == 0 {
+		respondWithError(c, http.StatusBadRequest, "A template needs a title and at least one task")
+		return
+	}
+
+	for _, item := range m.Items {
+		if strings.TrimSpace(item.Title) == "" {
+			respondWithError(c, http.StatusBadRequest, "Every template task needs a title")
+			return
+		}
+	}
+
+	if m.Id == "" {
+		m.Id = betterguid.New()
+	}
+	m.ChatId = groupId
+	m.SentBy = uid
+	m.CreatedAt = time.Now().UTC()
+
+	if err := dbService.addTaskTemplate(c, m); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, m)
+}
+
+func getTaskTemplates(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+	groupId := c.Param("groupId")
+
+	members, err := dbService.getChatGroupMembers(c, groupId)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if !isChatGroupMember(members, uid) {
+		respondWithError(c, http.StatusForbidden, "Not a member of the chat group")
+		return
+	}
+
+	templates, err := dbService.getTaskTemplates(c, groupId)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"data": templates})
+}
+
+func addBulkTasks(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+	groupId := c.Param("groupId")
+
+	members, err := dbService.getChatGroupMembers(c, groupId)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if !isChatGroupMember(members, uid) {
+		respondWithError(c, http.StatusForbidden, "Not a member of the chat group")
+		return
+	}
+
+	if isChatGroupArchived(c, groupId) {
+		respondWithError(c, http.StatusForbidden, "The chat group is archived")
+		return
+	}
+
+	var tasks []AddTaskModel
+
+	if c.ContentType() == "text/csv" {
+		csvTasks, errs, err := parseTasksCSV(c.Request.Body)
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(errs) > 0 {
+			respondWithError(c, http.StatusBadRequest, errs)
+			return
+		}
+		tasks = csvTasks
+	} else {
+		var m AddBulkTasksModel
+		if err := c.BindJSON(&m); err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+
+		if m.StartAt.IsZero() {
+			m.StartAt = time.Now().UTC()
+		}
+
+		if m.TemplateId != "" {
+			t, err := dbService.getTaskTemplateById(c, groupId, m.TemplateId)
+			if err != nil {
+				respondWithError(c, http.StatusNotFound, "Task template not found")
+				return
+			}
+
+			if len(m.Assignees) == 0 {
+				respondWithError(c, http.StatusBadRequest, "A template needs at least one assignee")
+				return
+			}
+
+			tasks = append(tasks, instantiateTaskTemplate(t, m.Assignees, m.StartAt)...)
+		}
+
+		tasks = append(tasks, m.Tasks...)
+	}
+
+	for i := range tasks {
+		// ids from the client could overwrite tasks of other groups
+		tasks[i].Id = betterguid.New()
+		tasks[i].AssignedBy = uid
+		tasks[i].GroupUid = groupId
+	}
+
+	// validate the whole batch before anything is written
+	if errs := validateBulkTasks(tasks, members); len(errs) > 0 {
+		respondWithError(c, http.StatusBadRequest, errs)
+		return
+	}
+
+	ctx := c.Copy()
+	//save all tasks or none, so a retry doesn't duplicate them
+	if err := dbService.addTasks(ctx, tasks); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	for _, task := range tasks {
+		indexTask(ctx, task)
+
+		recordTaskEvent(ctx, TaskEventModel{
+			ChatId:  task.GroupUid,
+			TaskId:  task.Id,
+			Type:    TaskEventCreated,
+			SentBy:  task.AssignedBy,
+			SentTo:  task.AssginedTo,
+			DueDate: task.DueDate,
+		})
+	}
+
+	for _, task := range tasks {
+		//send task
+		go hub.sendToChat(ctx, task.GroupUid, task.Id, ServerPushAddTask, task, true, task.AssignedBy)
+
+		task := task
+		notificationService.enqueue(ctx, NotificationJobModel{Kind: NotificationJobNewTask, Task: &task})
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"data": tasks})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTasksCSV(t *testing.T) {
+	doc := "title, assignedTo, dueDate, isUrgent, description\n" +
+		"Order stock, u1, 2022-10-18T18:30:00+05:30, true, \"Milk, bread\"\n" +
+		"Clean the shelves, u2, tomorrow, maybe,\n"
+
+	tasks, errs, err := parseTasksCSV(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("tasks = %+v", tasks)
+	}
+
+	if task := tasks[0]; task.Title != "Order stock" || task.AssginedTo != "u1" || !task.IsUrgent || task.Description != "Milk, bread" ||
+		!task.DueDate.Equal(time.Date(2022, 10, 18, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("tasks[0] = %+v", task)
+	}
+
+	if len(errs) != 2 || errs[0].Index != 1 || errs[0].Message != "invalid dueDate tomorrow" || errs[1].Message != "invalid isUrgent maybe" {
+		t.Errorf("errs = %+v", errs)
+	}
+
+	if _, _, err := parseTasksCSV(strings.NewReader("title, description\nOrder stock, Milk\n")); err == nil {
+		t.Error("csv without assignedTo was parsed")
+	}
+
+	long := "title, assignedTo\n" + strings.Repeat("Order stock, u1\n", maxBulkTasks+1)
+	if _, _, err := parseTasksCSV(strings.NewReader(long)); err == nil {
+		t.Error("csv with too many tasks was parsed")
+	}
+}
+
+func TestAddTasksWritesOneTransaction(t *testing.T) {
+	f := useFakeDynamoDb(t)
+
+	tasks := []AddTaskModel{{Id: "t1", Title: "Order stock"}, {Id: "t2", Title: "Clean the shelves"}}
+	if err := dbService.addTasks(context.Background(), tasks); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := f.writes(DDB_TABLE_TASK)
+	if len(writes) != 1 || writes[0].Op != "TransactWriteItems" {
+		t.Fatalf("writes = %+v", writes)
+	}
+	if items := writes[0].Body["TransactItems"].([]interface{}); len(items) != len(tasks) {
+		t.Errorf("transaction has %v items, want %v", len(items), len(tasks))
+	}
+}
+
+func TestValidateBulkTasks(t *testing.T) {
+	members := []AddChatGroupMemberModel{{MemberUserId: "u1"}, {MemberUserId: "u2"}}
+
+	errs := validateBulkTasks([]AddTaskModel{
+		{Title: "Order stock", AssginedTo: "u1"},
+		{Title: " ", AssginedTo: "u2"},
+		{Title: "Clean the shelves"},
+		{Title: "Lock the doors", AssginedTo: "u3"},
+	}, members)
+
+	expected := []BulkTaskErrorModel{
+		{Index: 1, Message: "title is required"},
+		{Index: 2, Message: "assignedTo is required"},
+		{Index: 3, Message: "assignee u3 is not a member of the chat group"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("errs = %+v", errs)
+	}
+	for i, e := range expected {
+		if errs[i] != e {
+			t.Errorf("errs[%v] = %+v, want %+v", i, errs[i], e)
+		}
+	}
+
+	if errs := validateBulkTasks(nil, members); len(errs) != 1 || errs[0].Index != -1 {
+		t.Errorf("errs of no tasks = %+v", errs)
+	}
+
+	if errs := validateBulkTasks(make([]AddTaskModel, maxBulkTasks+1), members); len(errs) != 1 || errs[0].Index != -1 {
+		t.Errorf("errs of too many tasks = %+v", errs)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// Links after the first few in a message aren't unfurled.
+	maxUnfurlLinks = 3
+	// Only the start of a page is read, the metadata is in the head.
+	maxUnfurlBytes     = 512 << 10
+	unfurlTimeout      = 5 * time.Second
+	unfurlCacheTTL     = time.Hour
+	unfurlCacheSize    = 1000
+	unfurlQueueSize    = 100
+	unfurlWorkers      = 4
+	maxUnfurlRedirects = 3
+	// Failures are retried sooner, they are often temporary.
+	unfurlFailureTTL = 5 * time.Minute
+)
+
+// ErrUnfurlBlockedAddress is returned when a link resolves to an address the server must not connect to
+var ErrUnfurlBlockedAddress = errors.New("unfurl: blocked address")
+
+var linkPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+type LinkPreviewModel struct {
+	Url         string    `json:"url" dynamodbav:"url"`
+	Title       string    `json:"title" dynamodbav:"title"`
+	Description string    `json:"description,omitempty" dynamodbav:"description,omitempty"`
+	ImageUrl    string    `json:"imageUrl,omitempty" dynamodbav:"imageUrl,omitempty"`
+	SiteName    string    `json:"siteName,omitempty" dynamodbav:"siteName,omitempty"`
+	FetchedAt   time.Time `json:"fetchedAt" dynamodbav:"fetchedAt"`
+}
+
+// LinkPreviewsModel is pushed to the chat once the links of a message are unfurled.
+type LinkPreviewsModel struct {
+	ChatId    string             `json:"chatId"`
+	MessageId string             `json:"messageId"`
+	TaskId    string             `json:"taskId,omitempty"`
+	Previews  []LinkPreviewModel `json:"previews"`
+}
+
+type unfurlJob struct {
+	ctx    context.Context
+	update LinkPreviewsModel
+	links  []string
+}
+
+type unfurlCacheEntry struct {
+	preview LinkPreviewModel
+	ok      bool
+	expires time.Time
+}
+
+type Unfurler struct {
+	client *http.Client
+	// blockedIP reports addresses that links may not resolve to
+	blockedIP func(ip net.IP) bool
+	jobs      chan unfurlJob
+
+	mu    sync.Mutex
+	cache map[string]unfurlCacheEntry
+}
+
+var linkUnfurler *Unfurler
+
+func NewUnfurler() *Unfurler {
+	u := &Unfurler{
+		blockedIP: isPrivateIP,
+		jobs:      make(chan unfurlJob, unfurlQueueSize),
+		cache:     make(map[string]unfurlCacheEntry),
+	}
+
+	// the address is checked after DNS resolution, right before connecting,
+	// so neither DNS rebinding nor redirects can reach internal services
+	dialer := &net.Dialer{
+		Timeout: unfurlTimeout,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || u.blockedIP(ip) {
+				return ErrUnfurlBlockedAddress
+			}
+			return nil
+		},
+	}
+
+	u.client = &http.Client{
+		Timeout: unfurlTimeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   unfurlTimeout,
+			ResponseHeaderTimeout: unfurlTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxUnfurlRedirects {
+				return errors.New("unfurl: too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.New("unfurl: unsupported scheme")
+			}
+			return nil
+		},
+	}
+
+	return u
+}
+
+// Special purpose networks that net.IP doesn't classify, from the IANA IPv4
+// and IPv6 special-purpose address registries.
+var reservedNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"240.0.0.0/4",
+	// IPv4-compatible addresses
+	"::/96",
+	// NAT64, which reaches IPv4 addresses through a gateway
+	"64:ff9b::/96",
+	"64:ff9b:1::/48",
+	"100::/64",
+	// Teredo
+	"2001::/32",
+	"2001:db8::/32",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = n
+	}
+	return networks
+}
+
+// isPrivateIP reports whether ip isn't a public unicast address, including
+// IPv6 addresses that embed a private IPv4 address.
+func isPrivateIP(ip net.IP) bool {
+	// IPv4-mapped IPv6 addresses are checked as IPv4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+
+	for _, n := range reservedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	// 6to4 addresses carry an IPv4 address in 2002:AABB:CCDD::/48
+	if len(ip) == net.IPv6len && ip[0] == 0x20 && ip[1] == 0x02 {
+		return isPrivateIP(net.IP(ip[2:6]))
+	}
+
+	return false
+}
+
+// extractLinks returns the distinct http(s) links in text.
+func extractLinks(text string) []string {
+	var links []string
+	seen := make(map[string]bool)
+	for _, l := range linkPattern.FindAllString(text, -1) {
+		// punctuation right after a link belongs to the sentence
+		l = strings.TrimRight(l, ".,;:!?)]}'")
+		if seen[l] {
+			continue
+		}
+		if _, err := url.ParseRequestURI(l); err != nil {
+			continue
+		}
+		seen[l] = true
+		links = append(links, l)
+		if len(links) == maxUnfurlLinks {
+			break
+		}
+	}
+	return links
+}
+
+// start runs the workers that unfurl queued links until ctx is done.
+func (u *Unfurler) start(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-u.jobs:
+					u.process(job)
+				}
+			}
+		}()
+	}
+}
+
+// enqueue schedules the links in text for unfurling. When the queue is full
+// the message just goes without previews.
+func (u *Unfurler) enqueue(ctx context.Context, update LinkPreviewsModel, text string) {
+	links := extractLinks(text)
+	if len(links) == 0 {
+		return
+	}
+
+	select {
+	case u.jobs <- unfurlJob{ctx: ctx, update: update, links: links}:
+	default:
+		log.Printf("%s : Unfurl queue is full, skipping links of %v\n", ctx.Value(logPrefix), update.MessageId)
+	}
+}
+
+func (u *Unfurler) process(job unfurlJob) {
+	update := job.update
+	for _, l := range job.links {
+		if p, ok := u.unfurl(context.Background(), l); ok {
+			update.Previews = append(update.Previews, p)
+		}
+	}
+
+	if len(update.Previews) == 0 {
+		return
+	}
+
+	if update.TaskId == "" {
+		dbService.updateChatMessageLinkPreviews(job.ctx, update.ChatId, update.MessageId, update.Previews)
+	}
+
+	// the sender wants to see the previews too
+	hub.sendToChat(job.ctx, update.ChatId, update.MessageId+"-links", ServerPushLinkPreviews, update, true, "")
+}
+
+// unfurl returns the preview of a link, from the cache if possible.
+func (u *Unfurler) unfurl(ctx context.Context, link string) (LinkPreviewModel, bool) {
+	now := time.Now()
+
+	u.mu.Lock()
+	entry, found := u.cache[link]
+	u.mu.Unlock()
+	if found && now.Before(entry.expires) {
+		return entry.preview, entry.ok
+	}
+
+	p, err := u.fetch(ctx, link)
+	if err != nil {
+		log.Printf("Couldn't unfurl %v. Here's why: %v\n", link, err)
+	}
+	entry = unfurlCacheEntry{preview: p, ok: err == nil, expires: now.Add(unfurlCacheTTL)}
+	if err != nil {
+		entry.expires = now.Add(unfurlFailureTTL)
+	}
+
+	u.mu.Lock()
+	if len(u.cache) >= unfurlCacheSize {
+		for k, v := range u.cache {
+			if !now.Before(v.expires) {
+				delete(u.cache, k)
+			}
+		}
+		// still full, drop arbitrary entries
+		for k := range u.cache {
+			if len(u.cache) < unfurlCacheSize {
+				break
+			}
+			delete(u.cache, k)
+		}
+	}
+	u.cache[link] = entry
+	u.mu.Unlock()
+
+	return entry.preview, entry.ok
+}
+
+func (u *Unfurler) fetch(ctx context.Context, link string) (LinkPreviewModel, error) {
+	p := LinkPreviewModel{Url: link}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return p, err
+	}
+	req.Header.Set("User-Agent", "HamuwemuBot/1.0 (link preview)")
+	req.Header.Set("Accept", "text/html")
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		return p, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return p, fmt.Errorf("unfurl: status %v", res.StatusCode)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return p, fmt.Errorf("unfurl: unsupported content type %q", mediaType)
+	}
+
+	meta := parseLinkMetadata(io.LimitReader(res.Body, maxUnfurlBytes))
+
+	p.Title = firstNonEmpty(meta["og:title"], meta["twitter:title"], meta["title"])
+	p.Description = firstNonEmpty(meta["og:description"], meta["twitter:description"], meta["description"])
+	p.SiteName = meta["og:site_name"]
+	if image := firstNonEmpty(meta["og:image"], meta["twitter:image"]); image != "" {
+		// relative to the final URL after redirects
+		if imageUrl, err := res.Request.URL.Parse(image); err == nil && (imageUrl.Scheme == "http" || imageUrl.Scheme == "https") {
+			p.ImageUrl = imageUrl.String()
+		}
+	}
+	p.FetchedAt = time.Now().UTC()
+
+	if p.Title == "" {
+		return p, errors.New("unfurl: page has no title")
+	}
+	return p, nil
+}
+
+// parseLinkMetadata collects the title and the OpenGraph, Twitter card and
+// description meta tags of an HTML document.
+func parseLinkMetadata(r io.Reader) map[string]string {
+	meta := make(map[string]string)
+	z := html.NewTokenizer(r)
+	inTitle := false
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return meta
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.Data {
+			case "body":
+				return meta
+			case "title":
+				inTitle = true
+			case "meta":
+				var key, content string
+				for _, a := range t.Attr {
+					switch a.Key {
+					case "property", "name":
+						key = strings.ToLower(a.Val)
+					case "content":
+						content = strings.TrimSpace(a.Val)
+					}
+				}
+				if key != "" && content != "" && meta[key] == "" {
+					meta[key] = content
+				}
+			}
+		case html.EndTagToken:
+			t := z.Token()
+			if t.Data == "head" {
+				return meta
+			}
+			inTitle = false
+		case html.TextToken:
+			if inTitle && meta["title"] == "" {
+				meta["title"] = strings.TrimSpace(string(z.Text()))
+			}
+		}
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
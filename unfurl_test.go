@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExtractLinks(t *testing.T) {
+	links := extractLinks("see https://example.com/a, and (http://example.org/b). again https://example.com/a ftp://x.y")
+	want := []string{"https://example.com/a", "http://example.org/b"}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("links = %v, want %v", links, want)
+	}
+
+	links = extractLinks("http://a.com http://b.com http://c.com http://d.com")
+	if len(links) != maxUnfurlLinks {
+		t.Errorf("%v links, want %v", len(links), maxUnfurlLinks)
+	}
+}
+
+func TestUnfurl(t *testing.T) {
+	requests := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/og", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<html><head><title>Fallback</title>
+<meta property="og:title" content="Open Graph">
+<meta name="twitter:description" content="From the card">
+<meta property="og:image" content="/img.png">
+<meta property="og:site_name" content="Example">
+</head><body><meta property="og:title" content="In the body"></body></html>`)
+	})
+	mux.HandleFunc("/title", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<title>Just a title</title><meta name="description" content="Plain">`)
+	})
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/redirect", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	u := NewUnfurler()
+	// the test server is on loopback
+	u.blockedIP = func(ip net.IP) bool { return false }
+
+	p, ok := u.unfurl(context.Background(), server.URL+"/og")
+	if !ok {
+		t.Fatal("og page wasn't unfurled")
+	}
+	if p.Title != "Open Graph" || p.Description != "From the card" || p.SiteName != "Example" {
+		t.Errorf("preview = %+v", p)
+	}
+	if p.ImageUrl != server.URL+"/img.png" {
+		t.Errorf("image = %v", p.ImageUrl)
+	}
+
+	if _, ok := u.unfurl(context.Background(), server.URL+"/og"); !ok || requests != 1 {
+		t.Errorf("cached preview wasn't used, %v requests", requests)
+	}
+
+	p, ok = u.unfurl(context.Background(), server.URL+"/title")
+	if !ok || p.Title != "Just a title" || p.Description != "Plain" {
+		t.Errorf("preview = %+v", p)
+	}
+
+	if _, ok := u.unfurl(context.Background(), server.URL+"/image"); ok {
+		t.Errorf("image was unfurled")
+	}
+	if _, ok := u.unfurl(context.Background(), server.URL+"/redirect"); ok {
+		t.Errorf("redirect loop was unfurled")
+	}
+}
+
+func TestUnfurlBlocksPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request reached the server")
+	}))
+	defer server.Close()
+
+	u := NewUnfurler()
+	_, err := u.fetch(context.Background(), server.URL)
+	if !errors.Is(err, ErrUnfurlBlockedAddress) {
+		t.Errorf("err = %v, want %v", err, ErrUnfurlBlockedAddress)
+	}
+
+	for _, ip := range []string{
+		"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "::1", "fd00::1", "0.0.0.0",
+		"100.64.0.1", "198.18.0.1", "::ffff:127.0.0.1", "::ffff:169.254.169.254", "64:ff9b::a9fe:a9fe",
+		"::127.0.0.1", "2002:a00:1::1",
+	} {
+		if !isPrivateIP(net.ParseIP(ip)) {
+			t.Errorf("%v isn't blocked", ip)
+		}
+	}
+	for _, ip := range []string{"93.184.216.34", "::ffff:93.184.216.34", "2606:2800:220:1::1", "2002:5db8:d822::1"} {
+		if isPrivateIP(net.ParseIP(ip)) {
+			t.Errorf("public address %v is blocked", ip)
+		}
+	}
+
+	// failures are cached shortly
+	u.unfurl(context.Background(), server.URL)
+	if e := u.cache[server.URL]; e.ok || e.expires.After(time.Now().Add(unfurlFailureTTL)) {
+		t.Errorf("cache entry = %+v", e)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// How long push services keep a notification for an offline browser
+	webPushTTL     = 24 * time.Hour
+	webPushTimeout = 10 * time.Second
+	// VAPID tokens may be valid for at most 24 hours
+	vapidTokenExpiry = 12 * time.Hour
+	// Size of the single record of an aes128gcm body (RFC 8188)
+	webPushRecordSize = 4096
+	// Longer bodies are cut so the payload fits into one record
+	maxWebPushBodyLength = 1000
+)
+
+var ErrWebPushPayloadTooLarge = errors.New("webpush: payload too large")
+
+// ErrVAPIDKeyMismatch is returned for subscriptions made for another VAPID
+// key. They are deleted like other dead subscriptions.
+var ErrVAPIDKeyMismatch = fmt.Errorf("webpush: subscription of another VAPID key: %w", ErrPushTokenInvalid)
+
+// WebPushKeysModel are the keys of a browser's push subscription, base64url
+// encoded.
+type WebPushKeysModel struct {
+	P256dh string `json:"p256dh" dynamodbav:"p256dh"`
+	Auth   string `json:"auth" dynamodbav:"auth"`
+}
+
+// WebPushSubscriptionModel is the PushSubscription of the browser, as
+// returned by its toJSON().
+type WebPushSubscriptionModel struct {
+	Endpoint string           `json:"endpoint"`
+	Keys     WebPushKeysModel `json:"keys"`
+}
+
+// webPushPayload is what the service worker of the dashboard receives.
+type webPushPayload struct {
+	Title    string            `json:"title"`
+	Subtitle string            `json:"subtitle,omitempty"`
+	Body     string            `json:"body"`
+	Tag      string            `json:"tag,omitempty"`
+	Badge    *int              `json:"badge,omitempty"`
+	Data     map[string]string `json:"data,omitempty"`
+}
+
+// VAPIDKeys identify this server to push services (RFC 8292).
+type VAPIDKeys struct {
+	private *ecdsa.PrivateKey
+}
+
+func generateVAPIDKeys() (*VAPIDKeys, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &VAPIDKeys{private: private}, nil
+}
+
+// parseVAPIDKeys decodes a private key in the base64url form of encode.
+func parseVAPIDKeys(s string) (*VAPIDKeys, error) {
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(s), "="))
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("webpush: invalid VAPID private key")
+	}
+
+	curve := elliptic.P256()
+	private := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	private.Curve = curve
+	private.X, private.Y = curve.ScalarBaseMult(d)
+	return &VAPIDKeys{private: private}, nil
+}
+
+// encode returns the private key as base64url, like the web-push tools do.
+func (k *VAPIDKeys) encode() string {
+	d := make([]byte, 32)
+	k.private.D.FillBytes(d)
+	return base64.RawURLEncoding.EncodeToString(d)
+}
+
+// publicKey is the applicationServerKey browsers subscribe with.
+func (k *VAPIDKeys) publicKey() string {
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), k.private.X, k.private.Y))
+}
+
+// loadVAPIDKeys takes the key from VAPID_PRIVATE_KEY. Subscriptions only
+// work with the key they were made for, so in release mode the key is
+// required. In development it is read from the file VAPID_KEY_FILE
+// ("vapid.key" by default), or generated and saved there.
+func loadVAPIDKeys(release bool) (*VAPIDKeys, error) {
+	if s := os.Getenv("VAPID_PRIVATE_KEY"); s != "" {
+		return parseVAPIDKeys(s)
+	}
+	if release {
+		return nil, errors.New("VAPID_PRIVATE_KEY is required in release mode")
+	}
+
+	file := os.Getenv("VAPID_KEY_FILE")
+	if file == "" {
+		file = "vapid.key"
+	}
+	data, err := os.ReadFile(file)
+	if err == nil {
+		return parseVAPIDKeys(string(data))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	keys, err := generateVAPIDKeys()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(file, []byte(keys.encode()+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	log.Printf("Generated VAPID keys in %v, public key %v\n", file, keys.publicKey())
+	return keys, nil
+}
+
+// token returns the signed JWT for the push service at audience.
+func (k *VAPIDKeys) token(audience string, subject string, expiry time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"exp": expiry.Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// ES256 signatures are r and s as 32 byte big-endian numbers
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func decodeWebPushKey(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// encryptWebPush encrypts plaintext for a subscription as in RFC 8291, in a
+// single aes128gcm record.
+func encryptWebPush(plaintext []byte, keys WebPushKeysModel) ([]byte, error) {
+	uaPublic, err := decodeWebPushKey(keys.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid p256dh key: %w", err)
+	}
+	authSecret, err := decodeWebPushKey(keys.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid auth secret: %w", err)
+	}
+
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, errors.New("webpush: invalid p256dh key")
+	}
+
+	// a new key pair for every message
+	asPrivate, asX, asY, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := elliptic.Marshal(curve, asX, asY)
+
+	sx, _ := curve.ScalarMult(uaX, uaY, asPrivate)
+	ecdhSecret := make([]byte, 32)
+	sx.FillBytes(ecdhSecret)
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ecdhSecret, authSecret, keyInfo), ikm); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// the padding delimiter of the last record
+	record := append(append([]byte{}, plaintext...), 0x02)
+	if len(record)+gcm.Overhead() > webPushRecordSize {
+		return nil, ErrWebPushPayloadTooLarge
+	}
+
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(webPushRecordSize))
+	body.WriteByte(byte(len(asPublic)))
+	body.Write(asPublic)
+	body.Write(gcm.Seal(nil, nonce, record, nil))
+	return body.Bytes(), nil
+}
+
+// webPushTopic turns a collapse id into a Topic header, which allows at most
+// 32 characters of the base64url alphabet.
+func webPushTopic(collapseId string) string {
+	sum := sha1.Sum([]byte(collapseId))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// isValidWebPushEndpoint accepts https URLs, push services don't use
+// anything else.
+func isValidWebPushEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+// WebPushProvider delivers notifications to browsers through their push
+// service. The token of a web push subscription is its endpoint.
+type WebPushProvider struct {
+	keys    *VAPIDKeys
+	subject string
+	client  *http.Client
+}
+
+func NewWebPushProvider(keys *VAPIDKeys, subject string) *WebPushProvider {
+	// endpoints come from clients, they must not lead to internal services
+	dialer := &net.Dialer{
+		Timeout: webPushTimeout,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return ErrUnfurlBlockedAddress
+			}
+			return nil
+		},
+	}
+
+	return &WebPushProvider{
+		keys:    keys,
+		subject: subject,
+		client: &http.Client{
+			Timeout:   webPushTimeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		},
+	}
+}
+
+func (n PushNotification) webPushPayload() ([]byte, error) {
+	body := n.Body
+	if r := []rune(body); len(r) > maxWebPushBodyLength {
+		body = string(r[:maxWebPushBodyLength]) + "…"
+	}
+	return json.Marshal(webPushPayload{
+		Title:    n.Title,
+		Subtitle: n.Subtitle,
+		Body:     body,
+		Tag:      n.ThreadId,
+		Badge:    n.Badge,
+		Data:     n.Data,
+	})
+}
+
+func (p *WebPushProvider) Push(ctx context.Context, n PushNotification, tokens []AddTokenModel) []error {
+	errs := make([]error, len(tokens))
+
+	payload, err := n.webPushPayload()
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	for i, t := range tokens {
+		errs[i] = p.send(ctx, n, payload, t)
+	}
+	return errs
+}
+
+func (p *WebPushProvider) send(ctx context.Context, n PushNotification, payload []byte, t AddTokenModel) error {
+	if t.WebPushKeys == nil {
+		return &PushError{Platform: PushPlatformWebPush, Reason: "MissingKeys", Err: ErrPushTokenInvalid}
+	}
+
+	endpoint, err := url.Parse(t.Token)
+	if err != nil {
+		return &PushError{Platform: PushPlatformWebPush, Reason: "InvalidEndpoint", Err: ErrPushTokenInvalid}
+	}
+
+	body, err := encryptWebPush(payload, *t.WebPushKeys)
+	if err != nil {
+		return &PushError{Platform: PushPlatformWebPush, Reason: "Encryption", Err: err}
+	}
+
+	jwt, err := p.keys.token(endpoint.Scheme+"://"+endpoint.Host, p.subject, time.Now().Add(vapidTokenExpiry))
+	if err != nil {
+		return &PushError{Platform: PushPlatformWebPush, Reason: "VAPID", Err: err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.Token, bytes.NewReader(body))
+	if err != nil {
+		return &PushError{Platform: PushPlatformWebPush, Reason: "InvalidEndpoint", Err: ErrPushTokenInvalid}
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(webPushTTL.Seconds())))
+	req.Header.Set("Authorization", "vapid t="+jwt+", k="+p.keys.publicKey())
+	if n.HighPriority {
+		req.Header.Set("Urgency", "high")
+	} else {
+		req.Header.Set("Urgency", "normal")
+	}
+	if n.CollapseId != "" {
+		req.Header.Set("Topic", webPushTopic(n.CollapseId))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return &PushError{Platform: PushPlatformWebPush, Reason: "Transport", Err: err}
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	if res.StatusCode == http.StatusForbidden {
+		log.Printf("%s : Push service rejected the VAPID key for %v, check VAPID_PRIVATE_KEY\n", ctx.Value(logPrefix), endpoint.Host)
+	}
+	return webPushError(res.StatusCode)
+}
+
+func webPushError(statusCode int) *PushError {
+	e := &PushError{Platform: PushPlatformWebPush, StatusCode: statusCode, Reason: strings.ReplaceAll(http.StatusText(statusCode), " ", "")}
+	switch statusCode {
+	// the subscription expired or was unsubscribed
+	case http.StatusNotFound, http.StatusGone:
+		e.Err = ErrPushTokenInvalid
+	// the subscription was made for another application server key, the
+	// browser has to subscribe again with ours
+	case http.StatusForbidden:
+		e.Reason = "VAPIDKeyMismatch"
+		e.Err = ErrVAPIDKeyMismatch
+	}
+	return e
+}
+
+func getVAPIDPublicKey(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, gin.H{"data": gin.H{"publicKey": webPushKeys.publicKey()}})
+}
+
+func addWebPushSubscription(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+
+	var s WebPushSubscriptionModel
+	if err := c.BindJSON(&s); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if !isValidWebPushEndpoint(s.Endpoint) {
+		respondWithError(c, http.StatusBadRequest, "Invalid endpoint")
+		return
+	}
+	if p256dh, err := decodeWebPushKey(s.Keys.P256dh); err != nil || len(p256dh) != 65 {
+		respondWithError(c, http.StatusBadRequest, "Invalid p256dh key")
+		return
+	}
+	if auth, err := decodeWebPushKey(s.Keys.Auth); err != nil || len(auth) != 16 {
+		respondWithError(c, http.StatusBadRequest, "Invalid auth secret")
+		return
+	}
+
+	keys := s.Keys
+	token := AddTokenModel{
+		UserId:      uid,
+		Token:       s.Endpoint,
+		Timestamp:   time.Now().UTC(),
+		Platform:    PushPlatformWebPush,
+		WebPushKeys: &keys,
+	}
+	if err := dbService.addDeviceToken(c, token); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func removeWebPushSubscription(c *gin.Context) {
+	uid := c.MustGet(uidKey).(string)
+
+	var s WebPushSubscriptionModel
+	if err := c.BindJSON(&s); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if err := dbService.deleteDeviceToken(c, uid, s.Endpoint); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"status": "ok"})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// webPushSubscriber is a browser, with the keys of its subscription.
+type webPushSubscriber struct {
+	private []byte
+	public  []byte
+	auth    []byte
+}
+
+func newWebPushSubscriber(t *testing.T) webPushSubscriber {
+	private, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	return webPushSubscriber{private: private, public: elliptic.Marshal(elliptic.P256(), x, y), auth: auth}
+}
+
+func (s webPushSubscriber) keys() *WebPushKeysModel {
+	return &WebPushKeysModel{
+		P256dh: base64.RawURLEncoding.EncodeToString(s.public),
+		Auth:   base64.RawURLEncoding.EncodeToString(s.auth),
+	}
+}
+
+// decrypt does what the browser does with an aes128gcm body.
+func (s webPushSubscriber) decrypt(body []byte) ([]byte, error) {
+	if len(body) < 21 {
+		return nil, errors.New("short body")
+	}
+	salt := body[:16]
+	keyLength := int(body[20])
+	if binary.BigEndian.Uint32(body[16:20]) != webPushRecordSize || len(body) < 21+keyLength {
+		return nil, errors.New("bad header")
+	}
+	asPublic := body[21 : 21+keyLength]
+	ciphertext := body[21+keyLength:]
+
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, asPublic)
+	if x == nil {
+		return nil, errors.New("bad key")
+	}
+	sx, _ := curve.ScalarMult(x, y, s.private)
+	secret := make([]byte, 32)
+	sx.FillBytes(secret)
+
+	info := append(append([]byte("WebPush: info\x00"), s.public...), asPublic...)
+	ikm := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, secret, s.auth, info), ikm)
+	cek := make([]byte, 16)
+	io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek)
+	nonce := make([]byte, 12)
+	io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce)
+
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) == 0 || plaintext[len(plaintext)-1] != 0x02 {
+		return nil, errors.New("no padding delimiter")
+	}
+	return plaintext[:len(plaintext)-1], nil
+}
+
+// verifyVAPID checks the Authorization header like a push service does.
+func verifyVAPID(header string, audience string) error {
+	var jwt, k string
+	for _, p := range strings.Split(strings.TrimPrefix(header, "vapid "), ",") {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, "t=") {
+			jwt = p[2:]
+		} else if strings.HasPrefix(p, "k=") {
+			k = p[2:]
+		}
+	}
+
+	public, err := base64.RawURLEncoding.DecodeString(k)
+	if err != nil {
+		return err
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), public)
+	if x == nil {
+		return errors.New("bad key")
+	}
+
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return errors.New("bad token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return errors.New("bad signature")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	if !ecdsa.Verify(key, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return errors.New("signature doesn't verify")
+	}
+
+	claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var c struct {
+		Aud string `json:"aud"`
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(claims, &c); err != nil {
+		return err
+	}
+	if c.Aud != audience || c.Sub != "mailto:test@example.com" {
+		return errors.New("bad claims " + string(claims))
+	}
+	return nil
+}
+
+func TestWebPushProvider(t *testing.T) {
+	subscriber := newWebPushSubscriber(t)
+	var received []webPushPayload
+	var topic, urgency string
+
+	push := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if r.URL.Path == "/other-key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := verifyVAPID(r.Header.Get("Authorization"), "https://"+r.Host); err != nil {
+			t.Errorf("vapid: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("TTL") == "" {
+			t.Errorf("headers = %v", r.Header)
+		}
+		topic, urgency = r.Header.Get("Topic"), r.Header.Get("Urgency")
+
+		body, _ := io.ReadAll(r.Body)
+		plaintext, err := subscriber.decrypt(body)
+		if err != nil {
+			t.Errorf("decrypt: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var p webPushPayload
+		if err := json.Unmarshal(plaintext, &p); err != nil {
+			t.Errorf("payload: %v", err)
+		}
+		received = append(received, p)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer push.Close()
+
+	keys, err := generateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewWebPushProvider(keys, "mailto:test@example.com")
+	p.client = push.Client()
+
+	n := newAlertNotification("Ann", "Freezer", "Defrost it", "t1", "m1", "u1")
+	n.HighPriority = true
+	n.CollapseId = collapseIdFor("t1", "m1")
+	tokens := []AddTokenModel{
+		{UserId: "u1", Token: push.URL + "/sub", Platform: PushPlatformWebPush, WebPushKeys: subscriber.keys()},
+		{UserId: "u1", Token: push.URL + "/gone", Platform: PushPlatformWebPush, WebPushKeys: subscriber.keys()},
+		{UserId: "u1", Token: push.URL + "/other-key", Platform: PushPlatformWebPush, WebPushKeys: subscriber.keys()},
+	}
+
+	errs := p.Push(context.Background(), n, tokens)
+	if errs[0] != nil {
+		t.Errorf("push failed: %v", errs[0])
+	}
+	if !errors.Is(errs[1], ErrPushTokenInvalid) {
+		t.Errorf("gone subscription = %v", errs[1])
+	}
+	if !errors.Is(errs[2], ErrVAPIDKeyMismatch) || !errors.Is(errs[2], ErrPushTokenInvalid) || isRetryablePushError(errs[2]) {
+		t.Errorf("subscription of another key = %v", errs[2])
+	}
+
+	if len(received) != 1 || received[0].Title != "Ann" || received[0].Body != "Defrost it" || received[0].Tag != "t1" {
+		t.Errorf("received = %+v", received)
+	}
+	if urgency != "high" || topic != webPushTopic(n.CollapseId) || len(topic) > 32 {
+		t.Errorf("urgency = %q, topic = %q", urgency, topic)
+	}
+}
+
+func TestVAPIDKeys(t *testing.T) {
+	keys, err := generateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseVAPIDKeys(keys.encode())
+	if err != nil || parsed.publicKey() != keys.publicKey() {
+		t.Errorf("parsed = %v, %v", parsed, err)
+	}
+	if _, err := parseVAPIDKeys("not a key"); err == nil {
+		t.Errorf("invalid key was parsed")
+	}
+}
+
+func TestLoadVAPIDKeys(t *testing.T) {
+	t.Setenv("VAPID_PRIVATE_KEY", "")
+	t.Setenv("VAPID_KEY_FILE", filepath.Join(t.TempDir(), "vapid.key"))
+	if _, err := loadVAPIDKeys(true); err == nil {
+		t.Errorf("release mode started without VAPID_PRIVATE_KEY")
+	}
+
+	// development keeps the generated key
+	generated, err := loadVAPIDKeys(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadVAPIDKeys(false)
+	if err != nil || loaded.publicKey() != generated.publicKey() {
+		t.Errorf("loaded = %v, %v", loaded, err)
+	}
+
+	t.Setenv("VAPID_PRIVATE_KEY", generated.encode())
+	if keys, err := loadVAPIDKeys(true); err != nil || keys.publicKey() != generated.publicKey() {
+		t.Errorf("keys = %v, %v", keys, err)
+	}
+}
+
+func TestEncryptWebPushTooLarge(t *testing.T) {
+	subscriber := newWebPushSubscriber(t)
+	if _, err := encryptWebPush(make([]byte, webPushRecordSize), *subscriber.keys()); !errors.Is(err, ErrWebPushPayloadTooLarge) {
+		t.Errorf("err = %v", err)
+	}
+}